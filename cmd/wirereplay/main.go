@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+)
+
+func main() {
+	fs := flag.NewFlagSet("", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "wirereplay records the wire messages exchanged between a driver and a server, and replays them.")
+		fmt.Fprintln(fs.Output(), "usage: wirereplay record [flags] <server host:port> <recording file>")
+		fmt.Fprintln(fs.Output(), "       wirereplay replay [flags] <recording file>")
+		fs.PrintDefaults()
+	}
+	var listen string
+	fs.StringVar(&listen, "listen", "127.0.0.1:27018", "the address to listen on.")
+	if len(os.Args) < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	mode := os.Args[1]
+	err := fs.Parse(os.Args[2:])
+	if err == flag.ErrHelp {
+		fs.Usage()
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Could not parse flags: %v", err)
+	}
+	args := fs.Args()
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %v", listen, err)
+	}
+
+	var closer interface{ Close() error }
+	switch {
+	case mode == "record" && len(args) == 2:
+		file, err := os.Create(args[1])
+		if err != nil {
+			log.Fatalf("Could not create %s: %v", args[1], err)
+		}
+		defer file.Close()
+
+		proxy := drivertest.NewProxyListener(ln, args[0], file)
+		log.Printf("Recording to %s, connect to %s", args[1], proxy.URI())
+		closer = proxy
+	case mode == "replay" && len(args) == 1:
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalf("Could not open %s: %v", args[0], err)
+		}
+		msgs, err := drivertest.ReadRecording(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Could not read %s: %v", args[0], err)
+		}
+
+		replayer, err := drivertest.NewReplayerListener(ln, msgs)
+		if err != nil {
+			log.Fatalf("Could not replay %s: %v", args[0], err)
+		}
+		defer func() {
+			for _, miss := range replayer.Misses() {
+				log.Printf("No recorded reply to %s", miss)
+			}
+		}()
+		log.Printf("Replaying %s, connect to %s", args[0], replayer.URI())
+		closer = replayer
+	default:
+		log.Println("Invalid arguments specified.")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	if err := closer.Close(); err != nil {
+		log.Printf("Could not close cleanly: %v", err)
+	}
+}
@@ -8,6 +8,7 @@ package event // import "go.mongodb.org/mongo-driver/event"
 
 import (
 	"context"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -89,3 +90,37 @@ type PoolEvent struct {
 type PoolMonitor struct {
 	Event func(*PoolEvent)
 }
+
+// strings for transaction monitoring types
+const (
+	TransactionStarted  = "TransactionStarted"
+	TransactionReloaded = "TransactionReloaded"
+	TransactionCommit   = "TransactionCommit"
+	TransactionAbort    = "TransactionAbort"
+	TransactionExpired  = "TransactionExpired"
+)
+
+// strings for transaction monitoring outcomes
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// TransactionEvent contains all information summarizing a transaction event. TxnID is the hex
+// encoded logical session id followed by the txnNumber, the same id the distributed transaction
+// package uses. Duration is the time elapsed since the transaction was started, if it is known.
+type TransactionEvent struct {
+	Type      string        `json:"type"`
+	TxnID     string        `json:"txnId"`
+	TxnNumber int64         `json:"txnNumber"`
+	Node      string        `json:"node,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Outcome   string        `json:"outcome"`
+	Failure   string        `json:"failure,omitempty"`
+}
+
+// TransactionMonitor is a function that allows the user to gain access to the lifecycle events
+// of transactions.
+type TransactionMonitor struct {
+	Event func(context.Context, *TransactionEvent)
+}
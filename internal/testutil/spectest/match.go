@@ -0,0 +1,200 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package spectest
+
+import (
+	"bytes"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// matcher compares the values a test expects with the actual ones.
+//
+// Documents match when every key of the expected document matches, the actual document may have
+// more keys unless exact is set. In command mode, the placeholder 42 matches any value, a null
+// value or false matches an absent key, and a session name such as "session0" matches the lsid of
+// that session.
+type matcher struct {
+	command bool
+	exact   bool
+	lsids   map[string][]byte
+}
+
+func (m matcher) match(path string, want, got bson.RawValue) error {
+	if m.command && isPlaceholder(want) {
+		if got.Type == 0 {
+			return fmt.Errorf("%s: expected a value, got none", path)
+		}
+		return nil
+	}
+	if wantN, ok := asFloat64(want); ok {
+		gotN, ok := asFloat64(got)
+		if !ok || wantN != gotN {
+			return fmt.Errorf("%s: expected %s, got %s", path, want, describe(got))
+		}
+		return nil
+	}
+
+	switch want.Type {
+	case bsontype.EmbeddedDocument:
+		wantDoc := want.Document()
+		gotDoc, ok := got.DocumentOK()
+		if !ok {
+			return fmt.Errorf("%s: expected a document, got %s", path, describe(got))
+		}
+		return m.matchDocument(path, wantDoc, gotDoc)
+	case bsontype.Array:
+		wantValues, _ := want.Array().Values()
+		gotArr, ok := got.ArrayOK()
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %s", path, describe(got))
+		}
+		gotValues, _ := gotArr.Values()
+		if len(wantValues) != len(gotValues) {
+			return fmt.Errorf("%s: expected %d elements, got %d", path, len(wantValues), len(gotValues))
+		}
+		for i := range wantValues {
+			if err := m.match(fmt.Sprintf("%s.%d", path, i), wantValues[i], gotValues[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if want.Type != got.Type || !bytes.Equal(want.Value, got.Value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, want, describe(got))
+	}
+	return nil
+}
+
+func (m matcher) matchDocument(path string, want, got bson.Raw) error {
+	wantElems, err := want.Elements()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	gotElems, err := got.Elements()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if m.exact && len(wantElems) != len(gotElems) {
+		return fmt.Errorf("%s: expected %s, got %s", path, want, got)
+	}
+
+	for _, e := range wantElems {
+		key, wantV := e.Key(), e.Value()
+		gotV := got.Lookup(key)
+		keyPath := path + "." + key
+
+		if m.command && key == "ordered" {
+			// The driver only sends ordered when it is set.
+			continue
+		}
+		if m.command && wantV.Type == bsontype.Null {
+			if gotV.Type != 0 {
+				return fmt.Errorf("%s: expected no value, got %s", keyPath, gotV)
+			}
+			continue
+		}
+		if b, ok := wantV.BooleanOK(); m.command && ok && !b && gotV.Type == 0 {
+			// The driver omits the boolean options left to their default, false.
+			continue
+		}
+		if m.command && key == "lsid" && wantV.Type == bsontype.String {
+			id, ok := m.lsids[wantV.StringValue()]
+			if !ok {
+				return fmt.Errorf("%s: unknown session %s", keyPath, wantV)
+			}
+			if !bytes.Equal(lsidData(gotV), id) {
+				return fmt.Errorf("%s: expected the lsid of %s, got %s", keyPath, wantV, describe(gotV))
+			}
+			continue
+		}
+		if gotV.Type == 0 {
+			return fmt.Errorf("%s: expected %s, got none", keyPath, wantV)
+		}
+		if err := m.match(keyPath, wantV, gotV); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lsidData returns the UUID of the session id lsid.
+func lsidData(lsid bson.RawValue) []byte {
+	doc, ok := lsid.DocumentOK()
+	if !ok {
+		return nil
+	}
+	_, data, ok := doc.Lookup("id").BinaryOK()
+	if !ok {
+		return nil
+	}
+	return data
+}
+
+// isPlaceholder reports whether v is the 42 placeholder of the expected commands.
+func isPlaceholder(v bson.RawValue) bool {
+	n, ok := asInt64(v)
+	return ok && n == 42
+}
+
+func describe(v bson.RawValue) string {
+	if v.Type == 0 {
+		return "none"
+	}
+	return v.String()
+}
+
+// asInt64 returns the value of an integral number.
+func asInt64(v bson.RawValue) (int64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	case bsontype.Double:
+		f := v.Double()
+		if f != float64(int64(f)) {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return 0, false
+}
+
+func asFloat64(v bson.RawValue) (float64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		return float64(v.Int64()), true
+	case bsontype.Double:
+		return v.Double(), true
+	}
+	return 0, false
+}
+
+// docValue returns doc as a value.
+func docValue(doc bson.Raw) bson.RawValue {
+	if doc == nil {
+		doc = emptyDoc
+	}
+	return bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}
+}
+
+var emptyDoc, _ = bson.Marshal(bson.D{})
+
+// toValue marshals x into a value.
+func toValue(x interface{}) bson.RawValue {
+	doc, err := bson.Marshal(bson.D{{Key: "v", Value: x}})
+	if err != nil {
+		panic(fmt.Sprintf("spectest: %v", err))
+	}
+	return bson.Raw(doc).Lookup("v")
+}
@@ -0,0 +1,686 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package spectest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+)
+
+// errorKeys are the keys of the result of an operation expected to fail.
+var errorKeys = []string{"errorContains", "errorCodeName", "errorLabelsContain", "errorLabelsOmit"}
+
+// runOperation runs op, checks its result and returns its error. The unexpected errors of the
+// operations of a withTransaction callback are returned without failing the test, the helper may
+// retry the callback after them.
+func (r *testRun) runOperation(ctx context.Context, op *Operation, inCallback bool) error {
+	var res interface{}
+	var err error
+	if name, ok := op.Arguments.Lookup("session").StringValueOK(); ok {
+		sess, ok := r.sessions[name]
+		if !ok {
+			r.fatalf("%s: unknown session %s", op.Name, name)
+		}
+		_ = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			res, err = r.execute(sc, op)
+			return nil
+		})
+	} else {
+		res, err = r.execute(ctx, op)
+	}
+
+	if r.target.fake && err != nil && strings.HasPrefix(err.Error(), "server selection error") {
+		r.t.Skip("the target has no member matching the read preference")
+	}
+	if msg := checkError(op, err); msg != "" {
+		if inCallback && err != nil {
+			return err
+		}
+		r.fatalf("%s: %s", op.Name, msg)
+	}
+	if err == nil && op.Result.Type != 0 {
+		if err := (matcher{}).match("result", op.Result, toValue(res)); err != nil {
+			r.fatalf("%s: %v", op.Name, err)
+		}
+	}
+	return err
+}
+
+// checkError returns why err is not the error op expects, or an empty string.
+func checkError(op *Operation, err error) string {
+	want, _ := op.Result.DocumentOK()
+	expected := op.Error
+	for _, key := range errorKeys {
+		if want.Lookup(key).Type != 0 {
+			expected = true
+		}
+	}
+	switch {
+	case !expected && err != nil:
+		return fmt.Sprintf("unexpected error: %v", err)
+	case !expected:
+		return ""
+	case err == nil:
+		return "expected an error"
+	}
+
+	if s, ok := want.Lookup("errorContains").StringValueOK(); ok {
+		if !strings.Contains(strings.ToLower(err.Error()), strings.ToLower(s)) {
+			return fmt.Sprintf("expected an error containing %q, got %v", s, err)
+		}
+	}
+	if s, ok := want.Lookup("errorCodeName").StringValueOK(); ok {
+		if name := errorCodeName(err); name != s {
+			return fmt.Sprintf("expected a %s error, got %v (%s)", s, err, name)
+		}
+	}
+	var labels []string
+	if cerr, ok := err.(mongo.CommandError); ok {
+		labels = cerr.Labels
+	}
+	if arr, ok := want.Lookup("errorLabelsContain").ArrayOK(); ok {
+		values, _ := arr.Values()
+		for _, v := range values {
+			if !contains(labels, v.StringValue()) {
+				return fmt.Sprintf("expected the %s label, got %v", v.StringValue(), labels)
+			}
+		}
+	}
+	if arr, ok := want.Lookup("errorLabelsOmit").ArrayOK(); ok {
+		values, _ := arr.Values()
+		for _, v := range values {
+			if contains(labels, v.StringValue()) {
+				return fmt.Sprintf("unexpected %s label", v.StringValue())
+			}
+		}
+	}
+	return ""
+}
+
+func errorCodeName(err error) string {
+	switch e := err.(type) {
+	case mongo.CommandError:
+		return e.Name
+	case mongo.WriteException:
+		if e.WriteConcernError != nil {
+			return e.WriteConcernError.Name
+		}
+	case mongo.BulkWriteException:
+		if e.WriteConcernError != nil {
+			return e.WriteConcernError.Name
+		}
+	}
+	return ""
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// execute runs op and returns its result in the shape of the expected results.
+func (r *testRun) execute(ctx context.Context, op *Operation) (interface{}, error) {
+	switch op.Object {
+	case "", "collection":
+		return r.executeCollection(ctx, op)
+	case "database":
+		return r.executeDatabase(ctx, op)
+	case "client":
+		return r.executeClient(ctx, op)
+	case "session0", "session1":
+		return r.executeSession(ctx, op)
+	case "testRunner":
+		return nil, r.executeTestRunner(op)
+	}
+	r.t.Skipf("unsupported %s operation %s", op.Object, op.Name)
+	return nil, nil
+}
+
+// args are the arguments of an operation.
+type args struct {
+	r  *testRun
+	op *Operation
+}
+
+func (a args) lookup(key string) bson.RawValue {
+	return a.op.Arguments.Lookup(key)
+}
+
+// check skips the test if the operation has arguments other than the given ones.
+func (a args) check(keys ...string) {
+	elems, _ := a.op.Arguments.Elements()
+	for _, e := range elems {
+		if e.Key() != "session" && !contains(keys, e.Key()) {
+			a.r.t.Skipf("unsupported argument %s of %s", e.Key(), a.op.Name)
+		}
+	}
+}
+
+// doc returns a document argument, or an empty document.
+func (a args) doc(key string) bson.Raw {
+	if doc, ok := a.lookup(key).DocumentOK(); ok {
+		return doc
+	}
+	return emptyDoc
+}
+
+// values returns an array argument, or nil.
+func (a args) values(key string) []bson.RawValue {
+	arr, ok := a.lookup(key).ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, _ := arr.Values()
+	return values
+}
+
+func (a args) pipeline() []bson.Raw {
+	pipeline := []bson.Raw{}
+	for _, v := range a.values("pipeline") {
+		pipeline = append(pipeline, v.Document())
+	}
+	return pipeline
+}
+
+// update returns the update argument, a document or a pipeline.
+func (a args) update() interface{} {
+	if _, ok := a.lookup("update").ArrayOK(); ok {
+		pipeline := []bson.Raw{}
+		for _, v := range a.values("update") {
+			pipeline = append(pipeline, v.Document())
+		}
+		return pipeline
+	}
+	return a.doc("update")
+}
+
+func (a args) collation() *options.Collation {
+	doc, ok := a.lookup("collation").DocumentOK()
+	if !ok {
+		return nil
+	}
+	var c options.Collation
+	if err := bson.Unmarshal(doc, &c); err != nil {
+		a.r.fatalf("invalid collation %s: %v", doc, err)
+	}
+	return &c
+}
+
+func (a args) arrayFilters() (options.ArrayFilters, bool) {
+	values := a.values("arrayFilters")
+	if values == nil {
+		return options.ArrayFilters{}, false
+	}
+	var filters []interface{}
+	for _, v := range values {
+		filters = append(filters, v.Document())
+	}
+	return options.ArrayFilters{Filters: filters}, true
+}
+
+func (a args) int64(key string) (int64, bool) {
+	return asInt64(a.lookup(key))
+}
+
+func (r *testRun) collection(op *Operation) *mongo.Collection {
+	db := r.client.Database(r.file.DatabaseName, r.databaseOptions(op.DatabaseOptions))
+	collOpts := options.Collection()
+	dbOpts := r.databaseOptions(op.CollectionOptions)
+	collOpts.ReadConcern, collOpts.WriteConcern, collOpts.ReadPreference =
+		dbOpts.ReadConcern, dbOpts.WriteConcern, dbOpts.ReadPreference
+	return db.Collection(r.file.CollectionName, collOpts)
+}
+
+// databaseOptions parses the options of a database or collection.
+func (r *testRun) databaseOptions(doc bson.Raw) *options.DatabaseOptions {
+	opts := options.Database()
+	elems, _ := doc.Elements()
+	for _, e := range elems {
+		switch e.Key() {
+		case "readConcern":
+			level, _ := e.Value().Document().Lookup("level").StringValueOK()
+			opts.SetReadConcern(readconcern.New(readconcern.Level(level)))
+		case "writeConcern":
+			opts.SetWriteConcern(writeConcern(e.Value().Document()))
+		case "readPreference":
+			opts.SetReadPreference(r.readPref(bson.Raw(e.Value().Document())))
+		default:
+			r.t.Skipf("unsupported collection option %s", e.Key())
+		}
+	}
+	return opts
+}
+
+func (r *testRun) executeCollection(ctx context.Context, op *Operation) (interface{}, error) {
+	coll := r.collection(op)
+	a := args{r: r, op: op}
+	switch op.Name {
+	case "insertOne":
+		a.check("document")
+		res, err := coll.InsertOne(ctx, a.doc("document"))
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "insertedId", Value: res.InsertedID}}, nil
+	case "insertMany":
+		a.check("documents", "options")
+		var docs []interface{}
+		for _, v := range a.values("documents") {
+			docs = append(docs, v.Document())
+		}
+		opts := options.InsertMany()
+		if ordered, ok := a.doc("options").Lookup("ordered").BooleanOK(); ok {
+			opts.SetOrdered(ordered)
+		}
+		res, err := coll.InsertMany(ctx, docs, opts)
+		if err != nil {
+			return nil, err
+		}
+		ids := bson.D{}
+		for i, id := range res.InsertedIDs {
+			ids = append(ids, bson.E{Key: strconv.Itoa(i), Value: id})
+		}
+		return bson.D{{Key: "insertedIds", Value: ids}}, nil
+	case "updateOne", "updateMany", "replaceOne":
+		var res *mongo.UpdateResult
+		var err error
+		if op.Name == "replaceOne" {
+			a.check("filter", "replacement", "upsert", "collation")
+			opts := options.Replace().SetCollation(a.collation())
+			if upsert, ok := a.lookup("upsert").BooleanOK(); ok {
+				opts.SetUpsert(upsert)
+			}
+			res, err = coll.ReplaceOne(ctx, a.doc("filter"), a.doc("replacement"), opts)
+		} else {
+			a.check("filter", "update", "upsert", "collation", "arrayFilters")
+			opts := options.Update().SetCollation(a.collation())
+			if upsert, ok := a.lookup("upsert").BooleanOK(); ok {
+				opts.SetUpsert(upsert)
+			}
+			if filters, ok := a.arrayFilters(); ok {
+				opts.SetArrayFilters(filters)
+			}
+			update := a.update()
+			if op.Name == "updateOne" {
+				res, err = coll.UpdateOne(ctx, a.doc("filter"), update, opts)
+			} else {
+				res, err = coll.UpdateMany(ctx, a.doc("filter"), update, opts)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return updateResult(res), nil
+	case "deleteOne", "deleteMany":
+		a.check("filter", "collation")
+		opts := options.Delete().SetCollation(a.collation())
+		var res *mongo.DeleteResult
+		var err error
+		if op.Name == "deleteOne" {
+			res, err = coll.DeleteOne(ctx, a.doc("filter"), opts)
+		} else {
+			res, err = coll.DeleteMany(ctx, a.doc("filter"), opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "deletedCount", Value: res.DeletedCount}}, nil
+	case "find":
+		a.check("filter", "sort", "skip", "limit", "batchSize", "collation")
+		opts := options.Find().SetCollation(a.collation())
+		if sort, ok := a.lookup("sort").DocumentOK(); ok {
+			opts.SetSort(sort)
+		}
+		if n, ok := a.int64("skip"); ok {
+			opts.SetSkip(n)
+		}
+		if n, ok := a.int64("limit"); ok {
+			opts.SetLimit(n)
+		}
+		if n, ok := a.int64("batchSize"); ok {
+			opts.SetBatchSize(int32(n))
+		}
+		cur, err := coll.Find(ctx, a.doc("filter"), opts)
+		return all(ctx, cur, err)
+	case "findOne":
+		a.check("filter")
+		return singleResult(coll.FindOne(ctx, a.doc("filter")))
+	case "findOneAndDelete":
+		a.check("filter", "sort", "projection", "collation")
+		opts := options.FindOneAndDelete().SetCollation(a.collation())
+		if sort, ok := a.lookup("sort").DocumentOK(); ok {
+			opts.SetSort(sort)
+		}
+		if projection, ok := a.lookup("projection").DocumentOK(); ok {
+			opts.SetProjection(projection)
+		}
+		return singleResult(coll.FindOneAndDelete(ctx, a.doc("filter"), opts))
+	case "findOneAndReplace":
+		a.check("filter", "replacement", "sort", "projection", "upsert", "returnDocument", "collation")
+		opts := options.FindOneAndReplace().SetCollation(a.collation())
+		if sort, ok := a.lookup("sort").DocumentOK(); ok {
+			opts.SetSort(sort)
+		}
+		if projection, ok := a.lookup("projection").DocumentOK(); ok {
+			opts.SetProjection(projection)
+		}
+		if upsert, ok := a.lookup("upsert").BooleanOK(); ok {
+			opts.SetUpsert(upsert)
+		}
+		if rd, ok := a.lookup("returnDocument").StringValueOK(); ok {
+			opts.SetReturnDocument(returnDocument(rd))
+		}
+		return singleResult(coll.FindOneAndReplace(ctx, a.doc("filter"), a.doc("replacement"), opts))
+	case "findOneAndUpdate":
+		a.check("filter", "update", "sort", "projection", "upsert", "returnDocument", "collation", "arrayFilters")
+		opts := options.FindOneAndUpdate().SetCollation(a.collation())
+		if sort, ok := a.lookup("sort").DocumentOK(); ok {
+			opts.SetSort(sort)
+		}
+		if projection, ok := a.lookup("projection").DocumentOK(); ok {
+			opts.SetProjection(projection)
+		}
+		if upsert, ok := a.lookup("upsert").BooleanOK(); ok {
+			opts.SetUpsert(upsert)
+		}
+		if rd, ok := a.lookup("returnDocument").StringValueOK(); ok {
+			opts.SetReturnDocument(returnDocument(rd))
+		}
+		if filters, ok := a.arrayFilters(); ok {
+			opts.SetArrayFilters(filters)
+		}
+		return singleResult(coll.FindOneAndUpdate(ctx, a.doc("filter"), a.update(), opts))
+	case "countDocuments":
+		a.check("filter")
+		return coll.CountDocuments(ctx, a.doc("filter"))
+	case "estimatedDocumentCount":
+		a.check()
+		return coll.EstimatedDocumentCount(ctx)
+	case "distinct":
+		a.check("fieldName", "filter", "collation")
+		field, _ := a.lookup("fieldName").StringValueOK()
+		return coll.Distinct(ctx, field, a.doc("filter"), options.Distinct().SetCollation(a.collation()))
+	case "aggregate":
+		a.check("pipeline", "batchSize", "collation", "maxTimeMS")
+		opts := options.Aggregate().SetCollation(a.collation())
+		if n, ok := a.int64("batchSize"); ok {
+			opts.SetBatchSize(int32(n))
+		}
+		if n, ok := a.int64("maxTimeMS"); ok {
+			opts.SetMaxTime(time.Duration(n) * time.Millisecond)
+		}
+		cur, err := coll.Aggregate(ctx, a.pipeline(), opts)
+		return all(ctx, cur, err)
+	case "bulkWrite":
+		a.check("requests", "options")
+		return r.bulkWrite(ctx, coll, a)
+	case "listIndexes":
+		a.check()
+		cur, err := coll.Indexes().List(ctx)
+		return all(ctx, cur, err)
+	case "listIndexNames":
+		r.t.Skip("the driver has no listIndexNames helper")
+	}
+	r.t.Skipf("unsupported collection operation %s", op.Name)
+	return nil, nil
+}
+
+func (r *testRun) bulkWrite(ctx context.Context, coll *mongo.Collection, a args) (interface{}, error) {
+	var models []mongo.WriteModel
+	insertedIDs := bson.D{}
+	for i, v := range a.values("requests") {
+		req := v.Document()
+		name, _ := req.Lookup("name").StringValueOK()
+		ra := args{r: r, op: &Operation{Name: name, Arguments: req.Lookup("arguments").Document()}}
+		switch name {
+		case "insertOne":
+			ra.check("document")
+			doc := ra.doc("document")
+			models = append(models, mongo.NewInsertOneModel().SetDocument(doc))
+			if id := doc.Lookup("_id"); id.Type != 0 {
+				insertedIDs = append(insertedIDs, bson.E{Key: strconv.Itoa(i), Value: id})
+			}
+		case "updateOne", "updateMany":
+			ra.check("filter", "update", "upsert", "collation", "arrayFilters")
+			if name == "updateOne" {
+				m := mongo.NewUpdateOneModel().SetFilter(ra.doc("filter")).SetUpdate(ra.update()).
+					SetCollation(ra.collation())
+				if upsert, ok := ra.lookup("upsert").BooleanOK(); ok {
+					m.SetUpsert(upsert)
+				}
+				if filters, ok := ra.arrayFilters(); ok {
+					m.SetArrayFilters(filters)
+				}
+				models = append(models, m)
+			} else {
+				m := mongo.NewUpdateManyModel().SetFilter(ra.doc("filter")).SetUpdate(ra.update()).
+					SetCollation(ra.collation())
+				if upsert, ok := ra.lookup("upsert").BooleanOK(); ok {
+					m.SetUpsert(upsert)
+				}
+				if filters, ok := ra.arrayFilters(); ok {
+					m.SetArrayFilters(filters)
+				}
+				models = append(models, m)
+			}
+		case "replaceOne":
+			ra.check("filter", "replacement", "upsert", "collation")
+			m := mongo.NewReplaceOneModel().SetFilter(ra.doc("filter")).SetReplacement(ra.doc("replacement")).
+				SetCollation(ra.collation())
+			if upsert, ok := ra.lookup("upsert").BooleanOK(); ok {
+				m.SetUpsert(upsert)
+			}
+			models = append(models, m)
+		case "deleteOne":
+			ra.check("filter", "collation")
+			models = append(models, mongo.NewDeleteOneModel().SetFilter(ra.doc("filter")).SetCollation(ra.collation()))
+		case "deleteMany":
+			ra.check("filter", "collation")
+			models = append(models, mongo.NewDeleteManyModel().SetFilter(ra.doc("filter")).SetCollation(ra.collation()))
+		default:
+			r.t.Skipf("unsupported bulk write request %s", name)
+		}
+	}
+
+	opts := options.BulkWrite()
+	if ordered, ok := a.doc("options").Lookup("ordered").BooleanOK(); ok {
+		opts.SetOrdered(ordered)
+	}
+	res, err := coll.BulkWrite(ctx, models, opts)
+	if err != nil {
+		return nil, err
+	}
+	upsertedIDs := bson.D{}
+	for i := range models {
+		if id, ok := res.UpsertedIDs[int64(i)]; ok {
+			upsertedIDs = append(upsertedIDs, bson.E{Key: strconv.Itoa(i), Value: id})
+		}
+	}
+	return bson.D{
+		{Key: "deletedCount", Value: res.DeletedCount},
+		{Key: "insertedCount", Value: res.InsertedCount},
+		{Key: "insertedIds", Value: insertedIDs},
+		{Key: "matchedCount", Value: res.MatchedCount},
+		{Key: "modifiedCount", Value: res.ModifiedCount},
+		{Key: "upsertedCount", Value: res.UpsertedCount},
+		{Key: "upsertedIds", Value: upsertedIDs},
+	}, nil
+}
+
+func (r *testRun) executeDatabase(ctx context.Context, op *Operation) (interface{}, error) {
+	db := r.client.Database(r.file.DatabaseName, r.databaseOptions(op.DatabaseOptions))
+	a := args{r: r, op: op}
+	switch op.Name {
+	case "runCommand":
+		a.check("command", "command_name", "readPreference")
+		opts := options.RunCmd()
+		if rp, ok := a.lookup("readPreference").DocumentOK(); ok {
+			opts.SetReadPreference(r.readPref(rp))
+		}
+		var res bson.Raw
+		err := db.RunCommand(ctx, a.doc("command"), opts).Decode(&res)
+		return res, err
+	case "aggregate":
+		a.check("pipeline", "allowDiskUse")
+		opts := options.Aggregate()
+		if b, ok := a.lookup("allowDiskUse").BooleanOK(); ok {
+			opts.SetAllowDiskUse(b)
+		}
+		cur, err := db.Aggregate(ctx, a.pipeline(), opts)
+		return all(ctx, cur, err)
+	case "listCollections", "listCollectionObjects":
+		a.check()
+		cur, err := db.ListCollections(ctx, bson.D{})
+		return all(ctx, cur, err)
+	case "listCollectionNames":
+		a.check()
+		return db.ListCollectionNames(ctx, bson.D{})
+	}
+	r.t.Skipf("unsupported database operation %s", op.Name)
+	return nil, nil
+}
+
+func (r *testRun) executeClient(ctx context.Context, op *Operation) (interface{}, error) {
+	args{r: r, op: op}.check()
+	switch op.Name {
+	case "listDatabases", "listDatabaseObjects":
+		res, err := r.client.ListDatabases(ctx, bson.D{})
+		return res.Databases, err
+	case "listDatabaseNames":
+		return r.client.ListDatabaseNames(ctx, bson.D{})
+	}
+	r.t.Skipf("unsupported client operation %s", op.Name)
+	return nil, nil
+}
+
+func (r *testRun) executeSession(ctx context.Context, op *Operation) (interface{}, error) {
+	sess := r.sessions[op.Object]
+	a := args{r: r, op: op}
+	switch op.Name {
+	case "startTransaction":
+		a.check("options")
+		return nil, sess.StartTransaction(r.transactionOptions(a.doc("options")))
+	case "commitTransaction":
+		a.check()
+		return nil, sess.CommitTransaction(ctx)
+	case "abortTransaction":
+		a.check()
+		return nil, sess.AbortTransaction(ctx)
+	case "endSession":
+		a.check()
+		sess.EndSession(ctx)
+		return nil, nil
+	case "withTransaction":
+		a.check("callback", "options")
+		var ops []*Operation
+		callback := args{r: r, op: &Operation{Arguments: a.doc("callback")}}
+		for _, v := range callback.values("operations") {
+			var nested Operation
+			if err := bson.Unmarshal(v.Document(), &nested); err != nil {
+				r.fatalf("invalid callback operation %s: %v", v, err)
+			}
+			ops = append(ops, &nested)
+		}
+		// The callback stops at the first error, which withTransaction may retry on.
+		return sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			for _, nested := range ops {
+				if err := r.runOperation(sc, nested, true); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}, r.transactionOptions(a.doc("options")))
+	}
+	r.t.Skipf("unsupported session operation %s", op.Name)
+	return nil, nil
+}
+
+// executeTestRunner runs the special operations of the transactions fixtures.
+func (r *testRun) executeTestRunner(op *Operation) error {
+	a := args{r: r, op: op}
+	name, _ := a.lookup("session").StringValueOK()
+	switch op.Name {
+	case "assertSessionPinned", "assertSessionUnpinned":
+		a.check()
+		addr, _, err := mongo.GetSessionPinning(r.sessions[name])
+		if err != nil {
+			r.fatalf("could not get the pinning of %s: %v", name, err)
+		}
+		if pinned := addr != ""; pinned != (op.Name == "assertSessionPinned") {
+			r.fatalf("%s: %s is pinned to %q", op.Name, name, addr)
+		}
+		return nil
+	case "targetedFailPoint":
+		// The setup client targets the only mongos the tests connect to, which the session is
+		// pinned to.
+		a.check("failPoint")
+		reason, err := r.fps.enable(a.doc("failPoint"))
+		if err != nil {
+			r.fatalf("could not enable the fail point: %v", err)
+		}
+		if reason != "" {
+			r.t.Skip(reason)
+		}
+		return nil
+	}
+	r.t.Skipf("unsupported test runner operation %s", op.Name)
+	return nil
+}
+
+func returnDocument(s string) options.ReturnDocument {
+	if s == "After" {
+		return options.After
+	}
+	return options.Before
+}
+
+func updateResult(res *mongo.UpdateResult) bson.D {
+	d := bson.D{
+		{Key: "matchedCount", Value: res.MatchedCount},
+		{Key: "modifiedCount", Value: res.ModifiedCount},
+		{Key: "upsertedCount", Value: res.UpsertedCount},
+	}
+	if res.UpsertedID != nil {
+		d = append(d, bson.E{Key: "upsertedId", Value: res.UpsertedID})
+	}
+	return d
+}
+
+// all returns the documents of cur, or err.
+func all(ctx context.Context, cur *mongo.Cursor, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	docs := []bson.Raw{}
+	err = cur.All(ctx, &docs)
+	return docs, err
+}
+
+// singleResult returns the document of res, or nil if there is none.
+func singleResult(res *mongo.SingleResult) (interface{}, error) {
+	var doc bson.Raw
+	switch err := res.Decode(&doc); err {
+	case nil:
+		return doc, nil
+	case mongo.ErrNoDocuments:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
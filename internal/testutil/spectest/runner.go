@@ -0,0 +1,410 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package spectest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// unimplemented are the error code names the stand-in server replies with to the commands,
+// stages and options it does not implement.
+var unimplemented = []string{"(CommandNotFound)", "(Location40324)", "(NotImplemented)"}
+
+// testRun is the state of a running test.
+type testRun struct {
+	t      *testing.T
+	target *Target
+	file   *File
+	test   *Test
+
+	setup    *mongo.Client
+	client   *mongo.Client
+	fps      *failPoints
+	sessions map[string]mongo.Session
+	lsids    map[string][]byte
+
+	mu            sync.Mutex
+	started       []*event.CommandStartedEvent
+	unimplemented string
+}
+
+func runTest(t *testing.T, tg *Target, f *File, test *Test) {
+	switch {
+	case test.SkipReason != "":
+		t.Skip(test.SkipReason)
+	case test.ChangeStreamPipeline.Type != 0:
+		t.Skip("the change streams layout is not supported")
+	case len(test.Operations) == 0:
+		t.Skip("the test has no operations")
+	case !onlyStartedEvents(test):
+		// the command monitoring fixtures expect errors through command failed events only.
+		t.Skip("only command started events can be expected")
+	}
+
+	r := &testRun{
+		t:        t,
+		target:   tg,
+		file:     f,
+		test:     test,
+		sessions: make(map[string]mongo.Session),
+		lsids:    make(map[string][]byte),
+	}
+	ctx := context.Background()
+
+	var err error
+	r.setup, err = tg.connect(options.Client().SetWriteConcern(writeconcern.New(writeconcern.WMajority())))
+	if err != nil {
+		t.Fatalf("could not connect the setup client: %v", err)
+	}
+	defer func() { _ = r.setup.Disconnect(ctx) }()
+	// Kill the sessions left by earlier tests, their transactions may hold locks.
+	_ = r.setup.Database("admin").RunCommand(ctx, bson.D{{Key: "killAllSessions", Value: bson.A{}}}).Err()
+	r.seed()
+
+	r.fps = tg.failPoints(r.setup)
+	defer r.fps.disable()
+	if test.FailPoint != nil {
+		reason, err := r.fps.enable(test.FailPoint)
+		if err != nil {
+			t.Fatalf("could not enable the fail point: %v", err)
+		}
+		if reason != "" {
+			t.Skip(reason)
+		}
+	}
+
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			r.mu.Lock()
+			r.started = append(r.started, evt)
+			r.mu.Unlock()
+		},
+		Failed: func(_ context.Context, evt *event.CommandFailedEvent) {
+			if !tg.fake {
+				return
+			}
+			for _, name := range unimplemented {
+				if strings.Contains(evt.Failure, name) {
+					r.mu.Lock()
+					if r.unimplemented == "" {
+						r.unimplemented = evt.CommandName
+					}
+					r.mu.Unlock()
+				}
+			}
+		},
+	}
+	opts := r.fps.clientOptions().SetMonitor(monitor)
+	r.clientOptions(opts)
+	r.client, err = tg.connect(opts)
+	if err != nil {
+		t.Fatalf("could not connect the client: %v", err)
+	}
+	defer func() { _ = r.client.Disconnect(ctx) }()
+
+	for _, name := range []string{"session0", "session1"} {
+		sess, err := r.client.StartSession(r.sessionOptions(name))
+		if err != nil {
+			t.Fatalf("could not start %s: %v", name, err)
+		}
+		defer sess.EndSession(ctx)
+		id, _, err := mongo.GetSessionTxnID(sess)
+		if err != nil {
+			t.Fatalf("could not get the id of %s: %v", name, err)
+		}
+		r.lsids[name], _ = base64.StdEncoding.DecodeString(id)
+		r.sessions[name] = sess
+	}
+
+	r.mu.Lock()
+	r.started = nil
+	r.mu.Unlock()
+	for _, op := range test.Operations {
+		_ = r.runOperation(ctx, op, false)
+	}
+	// Ending the sessions aborts their transactions, which the expectations may include.
+	for _, sess := range r.sessions {
+		sess.EndSession(ctx)
+	}
+
+	r.checkExpectations()
+	r.fps.disable()
+	r.checkOutcome()
+	if name := r.unimplementedCommand(); name != "" {
+		t.Skipf("the target does not implement %s", name)
+	}
+}
+
+// onlyStartedEvents reports whether the expectations of test are all command started events.
+func onlyStartedEvents(test *Test) bool {
+	for _, exp := range test.Expectations {
+		if exp.CommandStartedEvent == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// fatalf fails the test, or skips it if it ran into a command the stand-in does not implement.
+func (r *testRun) fatalf(format string, args ...interface{}) {
+	r.t.Helper()
+	if name := r.unimplementedCommand(); name != "" {
+		r.t.Skipf("the target does not implement %s", name)
+	}
+	r.t.Fatalf(format, args...)
+}
+
+func (r *testRun) unimplementedCommand() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unimplemented
+}
+
+// seed drops the collections of the test and inserts their initial data.
+func (r *testRun) seed() {
+	ctx := context.Background()
+	db := r.setup.Database(r.file.DatabaseName)
+
+	collections := map[string]bson.RawValue{r.file.CollectionName: r.file.Data}
+	if r.file.BucketName != "" {
+		// GridFS fixtures seed the files and chunks collections of the bucket.
+		collections = make(map[string]bson.RawValue)
+		elems, _ := r.file.Data.Document().Elements()
+		for _, e := range elems {
+			collections[e.Key()] = e.Value()
+		}
+	}
+	if out := r.test.Outcome; out != nil && out.Collection != nil && out.Collection.Name != "" {
+		if _, ok := collections[out.Collection.Name]; !ok {
+			collections[out.Collection.Name] = bson.RawValue{}
+		}
+	}
+
+	for name, data := range collections {
+		err := db.RunCommand(ctx, bson.D{{Key: "drop", Value: name}}).Err()
+		if err != nil && !strings.Contains(err.Error(), "ns not found") {
+			r.fatalf("could not drop %s: %v", name, err)
+		}
+		if name != r.file.CollectionName && data.Type == 0 {
+			continue
+		}
+
+		var docs []interface{}
+		if arr, ok := data.ArrayOK(); ok {
+			values, _ := arr.Values()
+			for _, v := range values {
+				docs = append(docs, v.Document())
+			}
+		}
+		if len(docs) == 0 {
+			// Transactions cannot create collections, so they must exist beforehand.
+			err = db.RunCommand(ctx, bson.D{{Key: "create", Value: name}}).Err()
+		} else {
+			_, err = db.Collection(name).InsertMany(ctx, docs)
+		}
+		if err != nil {
+			r.fatalf("could not seed %s: %v", name, err)
+		}
+	}
+}
+
+// clientOptions applies the client options of the test to opts.
+func (r *testRun) clientOptions(opts *options.ClientOptions) {
+	elems, _ := r.test.ClientOptions.Elements()
+	for _, e := range elems {
+		v := e.Value()
+		switch e.Key() {
+		case "retryWrites":
+			opts.SetRetryWrites(v.Boolean())
+		case "retryReads":
+			opts.SetRetryReads(v.Boolean())
+		case "readConcernLevel":
+			opts.SetReadConcern(readconcern.New(readconcern.Level(v.StringValue())))
+		case "w":
+			opts.SetWriteConcern(writeConcern(bson.Raw(bsonDoc("w", v))))
+		case "readPreference":
+			opts.SetReadPreference(r.readPref(bson.Raw(bsonDoc("mode", v))))
+		case "heartbeatFrequencyMS":
+			n, _ := asInt64(v)
+			opts.SetHeartbeatInterval(time.Duration(n) * time.Millisecond)
+		default:
+			r.t.Skipf("unsupported client option %s", e.Key())
+		}
+	}
+}
+
+// sessionOptions returns the options of the session with the given name.
+func (r *testRun) sessionOptions(name string) *options.SessionOptions {
+	opts := options.Session()
+	doc, ok := r.test.SessionOptions.Lookup(name).DocumentOK()
+	if !ok {
+		return opts
+	}
+	elems, _ := doc.Elements()
+	for _, e := range elems {
+		switch e.Key() {
+		case "causalConsistency":
+			opts.SetCausalConsistency(e.Value().Boolean())
+		case "defaultTransactionOptions":
+			txnOpts := r.transactionOptions(e.Value().Document())
+			if txnOpts.ReadConcern != nil {
+				opts.SetDefaultReadConcern(txnOpts.ReadConcern)
+			}
+			if txnOpts.WriteConcern != nil {
+				opts.SetDefaultWriteConcern(txnOpts.WriteConcern)
+			}
+			if txnOpts.ReadPreference != nil {
+				opts.SetDefaultReadPreference(txnOpts.ReadPreference)
+			}
+			if txnOpts.MaxCommitTime != nil {
+				opts.SetDefaultMaxCommitTime(txnOpts.MaxCommitTime)
+			}
+		default:
+			r.t.Skipf("unsupported session option %s", e.Key())
+		}
+	}
+	return opts
+}
+
+// transactionOptions parses the options of a transaction.
+func (r *testRun) transactionOptions(doc bson.Raw) *options.TransactionOptions {
+	opts := options.Transaction()
+	elems, _ := doc.Elements()
+	for _, e := range elems {
+		v := e.Value()
+		switch e.Key() {
+		case "readConcern":
+			level, _ := v.Document().Lookup("level").StringValueOK()
+			opts.SetReadConcern(readconcern.New(readconcern.Level(level)))
+		case "writeConcern":
+			opts.SetWriteConcern(writeConcern(v.Document()))
+		case "readPreference":
+			opts.SetReadPreference(r.readPref(v.Document()))
+		case "maxCommitTimeMS":
+			n, _ := asInt64(v)
+			d := time.Duration(n) * time.Millisecond
+			opts.SetMaxCommitTime(&d)
+		default:
+			r.t.Skipf("unsupported transaction option %s", e.Key())
+		}
+	}
+	return opts
+}
+
+// readPref parses a read preference such as {mode: "secondaryPreferred"}.
+func (r *testRun) readPref(doc bson.Raw) *readpref.ReadPref {
+	name, _ := doc.Lookup("mode").StringValueOK()
+	mode, err := readpref.ModeFromString(name)
+	if err != nil {
+		r.fatalf("invalid read preference %s: %v", doc, err)
+	}
+	rp, err := readpref.New(mode)
+	if err != nil {
+		r.fatalf("invalid read preference %s: %v", doc, err)
+	}
+	return rp
+}
+
+// writeConcern parses a write concern such as {w: "majority", j: true}.
+func writeConcern(doc bson.Raw) *writeconcern.WriteConcern {
+	var opts []writeconcern.Option
+	if w := doc.Lookup("w"); w.Type == bson.TypeString {
+		opts = append(opts, writeconcern.WMajority())
+	} else if n, ok := asInt64(w); ok {
+		opts = append(opts, writeconcern.W(int(n)))
+	}
+	if j, ok := doc.Lookup("j").BooleanOK(); ok {
+		opts = append(opts, writeconcern.J(j))
+	}
+	if n, ok := asInt64(doc.Lookup("wtimeout")); ok {
+		opts = append(opts, writeconcern.WTimeout(time.Duration(n)*time.Millisecond))
+	}
+	return writeconcern.New(opts...)
+}
+
+// checkExpectations checks the commands the client sent match the expectations of the test.
+func (r *testRun) checkExpectations() {
+	if r.test.Expectations == nil {
+		return
+	}
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+
+	var names []string
+	for _, evt := range started {
+		names = append(names, evt.CommandName)
+	}
+	if len(started) != len(r.test.Expectations) {
+		r.fatalf("expected %d commands, the client sent %d: %v", len(r.test.Expectations), len(started), names)
+	}
+	m := matcher{command: true, lsids: r.lsids}
+	for i, exp := range r.test.Expectations {
+		want := exp.CommandStartedEvent
+		got := started[i]
+		if want.CommandName != "" && want.CommandName != got.CommandName {
+			r.fatalf("command %d: expected %s, got %s: %v", i, want.CommandName, got.CommandName, names)
+		}
+		if want.DatabaseName != "" && want.DatabaseName != got.DatabaseName {
+			r.fatalf("command %d: expected database %s, got %s", i, want.DatabaseName, got.DatabaseName)
+		}
+		if err := m.match("command", docValue(want.Command), docValue(bson.Raw(got.Command))); err != nil {
+			r.fatalf("command %d (%s): %v\ngot %s", i, got.CommandName, err, got.Command)
+		}
+	}
+}
+
+// checkOutcome checks the data of the collection at the end of the test.
+func (r *testRun) checkOutcome() {
+	out := r.test.Outcome
+	if out == nil || out.Collection == nil || out.Collection.Data.Type == 0 {
+		return
+	}
+	name := r.file.CollectionName
+	if out.Collection.Name != "" {
+		name = out.Collection.Name
+	}
+
+	ctx := context.Background()
+	coll := r.setup.Database(r.file.DatabaseName).Collection(name,
+		options.Collection().SetReadPreference(readpref.Primary()).SetReadConcern(readconcern.Local()))
+	cur, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		r.fatalf("could not read %s: %v", name, err)
+	}
+	docs := []bson.Raw{}
+	if err := cur.All(ctx, &docs); err != nil {
+		r.fatalf("could not read %s: %v", name, err)
+	}
+
+	m := matcher{exact: true}
+	if err := m.match(name, out.Collection.Data, toValue(docs)); err != nil {
+		r.fatalf("unexpected data in %s: %v", name, err)
+	}
+}
+
+func bsonDoc(key string, v bson.RawValue) bson.Raw {
+	doc, err := bson.Marshal(bson.D{{Key: key, Value: v}})
+	if err != nil {
+		panic(fmt.Sprintf("spectest: %v", err))
+	}
+	return doc
+}
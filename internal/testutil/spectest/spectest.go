@@ -0,0 +1,249 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package spectest runs the JSON spec test fixtures under data/ against a deployment. FixtureDirs
+// finds the directories holding them.
+//
+// A fixture file seeds a collection, runs operations through a mongo.Client and checks their
+// results, the commands the client sent and the final content of the collection. The runner
+// understands the two layouts the CRUD, retryable reads and writes, transactions and convenient
+// transactions fixtures use:
+//
+//   - the v1 layout, with a single "operation" per test and its result under "outcome";
+//   - the v2 layout, with "runOn" requirements and a list of "operations" per test, each with
+//     its own result, and the expected command started events under "expectations".
+//
+// Tests written for other layouts, or using operations or fail points the runner or the target
+// do not support, are skipped with the reason.
+//
+// The target is either a real deployment, or a drivertest.Server. See Target.
+package spectest // import "go.mongodb.org/mongo-driver/internal/testutil/spectest"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// File is a fixture file.
+type File struct {
+	RunOn            []RunOn       `bson:"runOn"`
+	MinServerVersion string        `bson:"minServerVersion"`
+	MaxServerVersion string        `bson:"maxServerVersion"`
+	DatabaseName     string        `bson:"database_name"`
+	CollectionName   string        `bson:"collection_name"`
+	BucketName       string        `bson:"bucket_name"`
+	Data             bson.RawValue `bson:"data"`
+	Tests            []*Test       `bson:"tests"`
+}
+
+// RunOn is a set of requirements the deployment must meet for the tests of a file to run.
+type RunOn struct {
+	MinServerVersion string   `bson:"minServerVersion"`
+	MaxServerVersion string   `bson:"maxServerVersion"`
+	Topology         []string `bson:"topology"`
+}
+
+// Test is a test of a fixture file.
+type Test struct {
+	Description         string        `bson:"description"`
+	SkipReason          string        `bson:"skipReason"`
+	UseMultipleMongoses bool          `bson:"useMultipleMongoses"`
+	ClientOptions       bson.Raw      `bson:"clientOptions"`
+	SessionOptions      bson.Raw      `bson:"sessionOptions"`
+	FailPoint           bson.Raw      `bson:"failPoint"`
+	Operation           *Operation    `bson:"operation"`
+	Operations          []*Operation  `bson:"operations"`
+	Outcome             *Outcome      `bson:"outcome"`
+	Expectations        []Expectation `bson:"expectations"`
+
+	// ChangeStreamPipeline and Result are only set by the change streams fixtures, which use a
+	// layout of their own.
+	ChangeStreamPipeline bson.RawValue `bson:"changeStreamPipeline"`
+	Result               bson.RawValue `bson:"result"`
+}
+
+// Operation is an operation run by a test.
+type Operation struct {
+	Name              string        `bson:"name"`
+	Object            string        `bson:"object"`
+	CollectionOptions bson.Raw      `bson:"collectionOptions"`
+	DatabaseOptions   bson.Raw      `bson:"databaseOptions"`
+	Arguments         bson.Raw      `bson:"arguments"`
+	Result            bson.RawValue `bson:"result"`
+	Error             bool          `bson:"error"`
+}
+
+// Outcome is the expected outcome of a test.
+type Outcome struct {
+	// Error and Result are the outcome of the operation of a v1 test.
+	Error      bool          `bson:"error"`
+	Result     bson.RawValue `bson:"result"`
+	Collection *struct {
+		Name string        `bson:"name"`
+		Data bson.RawValue `bson:"data"`
+	} `bson:"collection"`
+}
+
+// Expectation is a command a test expects the client to send. The command monitoring fixtures
+// also expect the replies and failures of the commands.
+type Expectation struct {
+	CommandStartedEvent *struct {
+		CommandName  string   `bson:"command_name"`
+		DatabaseName string   `bson:"database_name"`
+		Command      bson.Raw `bson:"command"`
+	} `bson:"command_started_event"`
+	CommandSucceededEvent bson.Raw `bson:"command_succeeded_event"`
+	CommandFailedEvent    bson.Raw `bson:"command_failed_event"`
+}
+
+// LoadFile reads the fixture file at the given path.
+func LoadFile(filename string) (*File, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := bson.UnmarshalExtJSON(content, false, &f); err != nil {
+		return nil, err
+	}
+
+	// v1 files have a single operation per test and no database or collection names.
+	for _, test := range f.Tests {
+		if test.Operation != nil {
+			op := *test.Operation
+			if test.Outcome != nil {
+				op.Error = test.Outcome.Error
+				op.Result = test.Outcome.Result
+			}
+			test.Operations = []*Operation{&op}
+		}
+	}
+	if f.DatabaseName == "" {
+		f.DatabaseName = "spectest"
+	}
+	if f.CollectionName == "" {
+		base := filepath.Base(filename)
+		f.CollectionName = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return &f, nil
+}
+
+// FixtureDirs returns the directories under root, relative to it and sorted, holding fixture
+// files of a layout the runner understands: files with a list of tests that run an "operation" or
+// "operations". Other JSON files, such as the fixtures of the specifications the runner does not
+// cover, are ignored.
+func FixtureDirs(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(name) != ".json" {
+			return nil
+		}
+		dir, err := filepath.Rel(root, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		dir = filepath.ToSlash(dir)
+		if len(dirs) > 0 && dirs[len(dirs)-1] == dir {
+			return nil
+		}
+		ok, err := isFixture(name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// isFixture reports whether the JSON file at the given path has the layout of a fixture file.
+// Whether the runner can decode it is left to RunFile, so fixtures it fails to load are reported.
+func isFixture(filename string) (bool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	var f struct {
+		Tests []map[string]json.RawMessage `json:"tests"`
+	}
+	if err := json.Unmarshal(content, &f); err != nil {
+		return false, nil
+	}
+	for _, test := range f.Tests {
+		if test["operation"] != nil || test["operations"] != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Runner runs fixture files against a target.
+type Runner struct {
+	target *Target
+	skips  map[string]string
+}
+
+// NewRunner returns a Runner running fixtures against target.
+func NewRunner(target *Target) *Runner {
+	return &Runner{target: target, skips: make(map[string]string)}
+}
+
+// Skip skips the test with the given description for the given reason, in every file.
+func (r *Runner) Skip(description, reason string) {
+	r.skips[description] = reason
+}
+
+// RunDir runs every JSON fixture file of dir as a subtest.
+func (r *Runner) RunDir(t *testing.T, dir string) {
+	files, err := filepath.Glob(path.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("could not list the fixtures of %s: %v", dir, err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			r.RunFile(t, file)
+		})
+	}
+}
+
+// RunFile runs the tests of the fixture file at the given path, each as a subtest.
+func (r *Runner) RunFile(t *testing.T, filename string) {
+	f, err := LoadFile(filename)
+	if err != nil {
+		t.Fatalf("could not load %s: %v", filename, err)
+	}
+	if reason := r.target.unsupportedFile(t, f); reason != "" {
+		t.Skip(reason)
+	}
+	for _, test := range f.Tests {
+		test := test
+		t.Run(test.Description, func(t *testing.T) {
+			if reason, ok := r.skips[test.Description]; ok {
+				t.Skip(reason)
+			}
+			runTest(t, r.target, f, test)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package spectest
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+)
+
+const dataDir = "../../../data"
+
+// TestSpec runs the fixtures against the deployment MONGODB_URI points to, or against a
+// drivertest.Server if it is not set.
+func TestSpec(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	var target *Target
+	if uri := os.Getenv("MONGODB_URI"); uri != "" {
+		target = NewTarget(uri)
+	} else {
+		srv, err := drivertest.NewServer()
+		if err != nil {
+			t.Fatalf("could not start the server: %v", err)
+		}
+		defer srv.Close()
+		target = NewFakeTarget(srv)
+	}
+
+	dirs, err := FixtureDirs(dataDir)
+	if err != nil {
+		t.Fatalf("could not find the fixtures: %v", err)
+	}
+
+	r := NewRunner(target)
+	r.Skip("BulkWrite succeeds after PrimarySteppedDown", "retryable bulk writes are not implemented")
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(dir, func(t *testing.T) {
+			r.RunDir(t, path.Join(dataDir, dir))
+		})
+	}
+}
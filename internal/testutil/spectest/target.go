@@ -0,0 +1,309 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package spectest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+)
+
+// Target is the deployment fixtures run against.
+//
+// On a real deployment, fail points are configured with the configureFailPoint command, which
+// requires the servers to run with enableTestCommands.
+//
+// A drivertest.Server has no fail points: the failCommand fail points of the tests are emulated
+// by a driver.FaultInjector on the client running the operations. Tests using other fail points,
+// or failCommand options the emulation lacks, are skipped. So are the tests sending commands or
+// options the stand-in does not implement, and those needing a secondary.
+type Target struct {
+	uri  string
+	fake bool
+
+	once     sync.Once
+	version  []int
+	topology string
+	err      error
+}
+
+// NewTarget returns a Target for the deployment the connection string uri points to.
+func NewTarget(uri string) *Target {
+	return &Target{uri: uri}
+}
+
+// NewFakeTarget returns a Target for srv.
+func NewFakeTarget(srv *drivertest.Server) *Target {
+	return &Target{uri: srv.URI(), fake: true}
+}
+
+// connect returns a client to the target configured with opts.
+func (tg *Target) connect(opts ...*options.ClientOptions) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	base := options.Client().ApplyURI(tg.uri)
+	if tg.fake {
+		// The stand-in is always available, and never has a secondary to wait for.
+		base.SetServerSelectionTimeout(fakeSelectionTimeout)
+	}
+	opts = append([]*options.ClientOptions{base}, opts...)
+	return mongo.Connect(ctx, opts...)
+}
+
+// describe fetches the version and topology of the target.
+func (tg *Target) describe() error {
+	tg.once.Do(func() {
+		client, err := tg.connect()
+		if err != nil {
+			tg.err = err
+			return
+		}
+		defer func() { _ = client.Disconnect(context.Background()) }()
+
+		ctx := context.Background()
+		admin := client.Database("admin")
+		var info struct {
+			Version string `bson:"version"`
+		}
+		if tg.err = admin.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); tg.err != nil {
+			return
+		}
+		tg.version = parseVersion(info.Version)
+
+		var hello struct {
+			SetName string `bson:"setName"`
+			Msg     string `bson:"msg"`
+		}
+		if tg.err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); tg.err != nil {
+			return
+		}
+		switch {
+		case hello.SetName != "":
+			tg.topology = "replicaset"
+		case hello.Msg == "isdbgrid":
+			tg.topology = "sharded"
+		default:
+			tg.topology = "single"
+		}
+	})
+	return tg.err
+}
+
+// unsupportedFile returns why the tests of f cannot run on the target, or an empty string.
+func (tg *Target) unsupportedFile(t *testing.T, f *File) string {
+	if err := tg.describe(); err != nil {
+		t.Fatalf("could not describe the target: %v", err)
+	}
+	if f.MinServerVersion != "" && compareVersions(tg.version, parseVersion(f.MinServerVersion)) < 0 {
+		return fmt.Sprintf("requires server version %s or later", f.MinServerVersion)
+	}
+	if f.MaxServerVersion != "" && compareVersions(tg.version, parseVersion(f.MaxServerVersion)) > 0 {
+		return fmt.Sprintf("requires server version %s or earlier", f.MaxServerVersion)
+	}
+	if len(f.RunOn) == 0 {
+		return ""
+	}
+	for _, ro := range f.RunOn {
+		if ro.MinServerVersion != "" && compareVersions(tg.version, parseVersion(ro.MinServerVersion)) < 0 {
+			continue
+		}
+		if ro.MaxServerVersion != "" && compareVersions(tg.version, parseVersion(ro.MaxServerVersion)) > 0 {
+			continue
+		}
+		if len(ro.Topology) == 0 {
+			return ""
+		}
+		for _, topo := range ro.Topology {
+			if topo == tg.topology {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("no runOn requirement is met by a %s deployment", tg.topology)
+}
+
+// fakeSelectionTimeout is the server selection timeout of the clients of a drivertest.Server.
+const fakeSelectionTimeout = time.Second
+
+// codeNames are the names of the error codes the failCommand fail points of the fixtures use.
+var codeNames = map[int32]string{
+	6:     "HostUnreachable",
+	7:     "HostNotFound",
+	24:    "LockTimeout",
+	50:    "MaxTimeMSExpired",
+	89:    "NetworkTimeout",
+	91:    "ShutdownInProgress",
+	112:   "WriteConflict",
+	189:   "PrimarySteppedDown",
+	246:   "SnapshotUnavailable",
+	251:   "NoSuchTransaction",
+	267:   "PreparedTransactionInProgress",
+	9001:  "SocketException",
+	10107: "NotMaster",
+	11600: "InterruptedAtShutdown",
+	11601: "Interrupted",
+	11602: "InterruptedDueToReplStateChange",
+	13435: "NotMasterNoSlaveOk",
+	13436: "NotMasterOrSecondary",
+}
+
+// failPoints enables the fail points of a test.
+type failPoints struct {
+	admin  *mongo.Client
+	faults *driver.FaultInjector
+	names  []string
+}
+
+func (tg *Target) failPoints(admin *mongo.Client) *failPoints {
+	fps := &failPoints{admin: admin}
+	if tg.fake {
+		fps.faults = driver.NewFaultInjector()
+	}
+	return fps
+}
+
+// clientOptions returns the options the client running the operations of the test needs.
+func (fps *failPoints) clientOptions() *options.ClientOptions {
+	opts := options.Client()
+	if fps.faults != nil {
+		opts.SetFaultInjector(fps.faults)
+	}
+	return opts
+}
+
+// enable enables the fail point described by fp. It returns why the fail point is not
+// supported, or an empty string.
+func (fps *failPoints) enable(fp bson.Raw) (string, error) {
+	name, _ := fp.Lookup("configureFailPoint").StringValueOK()
+	if fps.faults == nil {
+		cmd := bson.D{}
+		elems, err := fp.Elements()
+		if err != nil {
+			return "", err
+		}
+		for _, e := range elems {
+			cmd = append(cmd, bson.E{Key: e.Key(), Value: e.Value()})
+		}
+		if err := fps.admin.Database("admin").RunCommand(context.Background(), cmd).Err(); err != nil {
+			return "", err
+		}
+		fps.names = append(fps.names, name)
+		return "", nil
+	}
+
+	if name != "failCommand" {
+		return fmt.Sprintf("the %s fail point cannot be emulated", name), nil
+	}
+	var spec struct {
+		Mode bson.RawValue `bson:"mode"`
+		Data struct {
+			FailCommands    []string `bson:"failCommands"`
+			CloseConnection bool     `bson:"closeConnection"`
+			ErrorCode       int32    `bson:"errorCode"`
+			ErrorLabels     []string `bson:"errorLabels"`
+			BlockConnection bool     `bson:"blockConnection"`
+			BlockTimeMS     int64    `bson:"blockTimeMS"`
+		} `bson:"data"`
+	}
+	if err := bson.Unmarshal(fp, &spec); err != nil {
+		return "", err
+	}
+	var data bson.Raw
+	if v, ok := fp.Lookup("data").DocumentOK(); ok {
+		data = v
+	}
+	elems, _ := data.Elements()
+	for _, e := range elems {
+		switch e.Key() {
+		case "failCommands", "closeConnection", "errorCode", "errorLabels", "blockConnection", "blockTimeMS":
+		default:
+			return fmt.Sprintf("the %s option of failCommand cannot be emulated", e.Key()), nil
+		}
+	}
+
+	emulated := driver.FailPoint{
+		Commands:        spec.Data.FailCommands,
+		CloseConnection: spec.Data.CloseConnection,
+		ErrorCode:       spec.Data.ErrorCode,
+		ErrorCodeName:   codeNames[spec.Data.ErrorCode],
+		ErrorLabels:     spec.Data.ErrorLabels,
+		ServerLabels:    true,
+	}
+	if spec.Data.BlockConnection {
+		emulated.BlockTime = time.Duration(spec.Data.BlockTimeMS) * time.Millisecond
+	}
+	switch {
+	case spec.Mode.Type == bson.TypeString && spec.Mode.StringValue() == "alwaysOn":
+	case spec.Mode.Type == bson.TypeString && spec.Mode.StringValue() == "off":
+		fps.faults.Disable()
+		return "", nil
+	default:
+		mode, ok := spec.Mode.DocumentOK()
+		if !ok {
+			return "invalid fail point mode", nil
+		}
+		times, ok := asInt64(mode.Lookup("times"))
+		if keys, _ := mode.Elements(); !ok || len(keys) != 1 {
+			return "only the times mode of fail points can be emulated", nil
+		}
+		emulated.Times = int(times)
+	}
+	fps.faults.Enable(emulated)
+	return "", nil
+}
+
+// disable disables the fail points enabled on a real deployment.
+func (fps *failPoints) disable() {
+	for _, name := range fps.names {
+		_ = fps.admin.Database("admin").RunCommand(context.Background(), bson.D{
+			{Key: "configureFailPoint", Value: name},
+			{Key: "mode", Value: "off"},
+		}).Err()
+	}
+	fps.names = nil
+}
+
+func parseVersion(s string) []int {
+	var version []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		version = append(version, n)
+	}
+	return version
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -50,6 +50,7 @@ type Client struct {
 	registry        *bsoncodec.Registry
 	marshaller      BSONAppender
 	monitor         *event.CommandMonitor
+	txnMonitor      *event.TransactionMonitor
 }
 
 // Connect creates a new Client and then initializes it using the Connect method.
@@ -155,6 +156,23 @@ func (c *Client) StartSession(opts ...*options.SessionOptions) (Session, error)
 		return nil, ErrClientDisconnected
 	}
 
+	sess, err := session.NewClientSession(c.topology.SessionPool, c.id, session.Explicit, c.sessionClientOptions(opts...))
+	if err != nil {
+		return nil, replaceErrors(err)
+	}
+
+	sess.RetryWrite = c.retryWrites
+	sess.RetryRead = c.retryReads
+
+	return &sessionImpl{
+		clientSession: sess,
+		client:        c,
+		topo:          c.topology,
+	}, nil
+}
+
+// sessionClientOptions merges the given session options with the defaults of the client.
+func (c *Client) sessionClientOptions(opts ...*options.SessionOptions) *session.ClientOptions {
 	sopts := options.MergeSessionOptions(opts...)
 	coreOpts := &session.ClientOptions{
 		DefaultReadConcern:    c.readConcern,
@@ -177,19 +195,7 @@ func (c *Client) StartSession(opts ...*options.SessionOptions) (Session, error)
 		coreOpts.DefaultMaxCommitTime = sopts.DefaultMaxCommitTime
 	}
 
-	sess, err := session.NewClientSession(c.topology.SessionPool, c.id, session.Explicit, coreOpts)
-	if err != nil {
-		return nil, replaceErrors(err)
-	}
-
-	sess.RetryWrite = c.retryWrites
-	sess.RetryRead = c.retryReads
-
-	return &sessionImpl{
-		clientSession: sess,
-		client:        c,
-		topo:          c.topology,
-	}, nil
+	return coreOpts
 }
 
 func (c *Client) endSessions(ctx context.Context) {
@@ -386,6 +392,16 @@ func (c *Client) configure(opts *options.ClientOptions) error {
 			func(*event.CommandMonitor) *event.CommandMonitor { return opts.Monitor },
 		))
 	}
+	// FaultInjector
+	if opts.FaultInjector != nil {
+		connOpts = append(connOpts, topology.WithFaultInjector(
+			func(*driver.FaultInjector) *driver.FaultInjector { return opts.FaultInjector },
+		))
+	}
+	// TransactionMonitor
+	if opts.TransactionMonitor != nil {
+		c.txnMonitor = opts.TransactionMonitor
+	}
 	// ReadConcern
 	c.readConcern = readconcern.New()
 	if opts.ReadConcern != nil {
@@ -0,0 +1,128 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongo
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
+)
+
+// TxnCursor describes a cursor opened inside a transaction, so that a session of the same
+// transaction on another node can continue it.
+type TxnCursor struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"coll"`
+	// the cursor id on the server, 0 if the cursor is exhausted.
+	ID        int64 `bson:"id"`
+	BatchSize int32 `bson:"batchSize,omitempty"`
+	MaxTimeMS int64 `bson:"maxTimeMS,omitempty"`
+	// the address of the server the cursor lives on, getMore must be sent to it.
+	Server string `bson:"server"`
+	// the documents the exporting node fetched but did not iterate yet.
+	Batch []bson.Raw `bson:"batch,omitempty"`
+}
+
+// TxnExportCursor returns the description of cur needed to continue it on another node. The
+// documents of the current batch that have not been iterated are part of the description, they
+// are returned first by the continued cursor. cur must not be used, and must not be closed, once
+// exported: closing it kills the cursor on the server.
+func TxnExportCursor(cur *Cursor) (*TxnCursor, error) {
+	bc, ok := cur.bc.(*driver.BatchCursor)
+	if !ok {
+		return nil, errors.New("the cursor is not backed by a *driver.BatchCursor")
+	}
+
+	batch := cur.batch
+	if batch == nil {
+		// Next has not been called yet, the first batch is unread.
+		batch = bc.Batch()
+	}
+
+	var docs []bson.Raw
+	if batch != nil {
+		rest := *batch
+		for {
+			doc, err := rest.Next()
+			if err != nil {
+				break
+			}
+			docs = append(docs, bson.Raw(append([]byte(nil), doc...)))
+		}
+	}
+
+	state := bc.State()
+	return &TxnCursor{
+		Database:   state.Database,
+		Collection: state.Collection,
+		ID:         state.ID,
+		BatchSize:  state.BatchSize,
+		MaxTimeMS:  state.MaxTimeMS,
+		Server:     state.Server.String(),
+		Batch:      docs,
+	}, nil
+}
+
+// TxnResumeCursor rebuilds the cursor described by info. The cursor sends getMore under sess,
+// which must be bound to the transaction the cursor was opened in, to the server the cursor
+// lives on. sess may be the SessionContext of the session.
+func TxnResumeCursor(ctx context.Context, sess Session, info *TxnCursor) (*Cursor, error) {
+	i, ok := exposedSession(sess)
+	if !ok {
+		return nil, errors.New("the session is not type *sessionImpl")
+	}
+	if i.client == nil || i.client.topology == nil {
+		return nil, ErrClientDisconnected
+	}
+
+	var srvr driver.Server
+	var desc description.Server
+	if info.ID != 0 {
+		selected, err := i.client.topology.SelectServerLegacy(ctx, description.Server{Addr: address.Address(info.Server)})
+		if err != nil {
+			return nil, err
+		}
+		srvr, desc = selected, selected.Description().Server
+	}
+
+	return newTxnCursor(info, srvr, desc, i.clientSession, i.client.clock, i.client.monitor, i.client.registry)
+}
+
+func newTxnCursor(info *TxnCursor, srvr driver.Server, desc description.Server, cs *session.Client,
+	clock *session.ClusterClock, monitor *event.CommandMonitor, registry *bsoncodec.Registry) (*Cursor, error) {
+	var data []byte
+	for _, doc := range info.Batch {
+		data = append(data, doc...)
+	}
+
+	cr := driver.CursorResponse{
+		Server:     srvr,
+		Desc:       desc,
+		FirstBatch: &bsoncore.DocumentSequence{Style: bsoncore.SequenceStyle, Data: data},
+		Database:   info.Database,
+		Collection: info.Collection,
+		ID:         info.ID,
+	}
+	bc, err := driver.NewBatchCursor(cr, cs, clock, driver.CursorOptions{
+		BatchSize:      info.BatchSize,
+		MaxTimeMS:      info.MaxTimeMS,
+		CommandMonitor: monitor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newCursorWithSession(bc, registry, cs)
+}
@@ -0,0 +1,157 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongo
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+// connServer is a driver.Server that always hands out the same connection.
+type connServer struct {
+	conn driver.Connection
+}
+
+func (s connServer) Connection(context.Context) (driver.Connection, error) { return s.conn, nil }
+
+func cursorTestDoc(x int32) bsoncore.Document {
+	return bsoncore.BuildDocument(nil, bsoncore.AppendInt32Element(nil, "x", x))
+}
+
+func TestTxnExportCursor(t *testing.T) {
+	docs := bsoncore.BuildArray(nil,
+		bsoncore.Value{Type: bsontype.EmbeddedDocument, Data: cursorTestDoc(1)},
+		bsoncore.Value{Type: bsontype.EmbeddedDocument, Data: cursorTestDoc(2)},
+		bsoncore.Value{Type: bsontype.EmbeddedDocument, Data: cursorTestDoc(3)},
+	)
+	bc, err := driver.NewBatchCursor(driver.CursorResponse{
+		Desc:       description.Server{Addr: address.Address("host1:27017")},
+		FirstBatch: &bsoncore.DocumentSequence{Style: bsoncore.ArrayStyle, Data: docs},
+		Database:   "db",
+		Collection: "coll",
+		ID:         42,
+	}, nil, nil, driver.CursorOptions{BatchSize: 3, MaxTimeMS: 500})
+	require.NoError(t, err)
+	cur, err := newCursor(bc, nil)
+	require.NoError(t, err)
+
+	t.Run("unread first batch", func(t *testing.T) {
+		info, err := TxnExportCursor(cur)
+		require.NoError(t, err)
+		require.Equal(t, &TxnCursor{
+			Database:   "db",
+			Collection: "coll",
+			ID:         42,
+			BatchSize:  3,
+			MaxTimeMS:  500,
+			Server:     "host1:27017",
+			Batch:      []bson.Raw{bson.Raw(cursorTestDoc(1)), bson.Raw(cursorTestDoc(2)), bson.Raw(cursorTestDoc(3))},
+		}, info)
+	})
+	t.Run("partly iterated batch", func(t *testing.T) {
+		require.True(t, cur.Next(context.Background()))
+		info, err := TxnExportCursor(cur)
+		require.NoError(t, err)
+		require.Equal(t, []bson.Raw{bson.Raw(cursorTestDoc(2)), bson.Raw(cursorTestDoc(3))}, info.Batch)
+
+		// exporting does not move the cursor.
+		require.True(t, cur.Next(context.Background()))
+		require.Equal(t, bson.Raw(cursorTestDoc(2)), cur.Current)
+	})
+}
+
+func TestTxnResumeCursor(t *testing.T) {
+	lsid, err := uuid.New()
+	require.NoError(t, err)
+	sess := newExposerTestSession(t)
+	require.NoError(t, sess.StartTransaction())
+	require.NoError(t, TnxReloadSession(sess, &TxnSession{
+		TxnNubmer: 5,
+		SessionID: base64.StdEncoding.EncodeToString(lsid[:]),
+		Started:   true,
+	}))
+
+	reply := bsoncore.BuildDocument(nil,
+		bsoncore.AppendDocumentElement(nil, "cursor", bsoncore.BuildDocument(nil,
+			bsoncore.AppendInt64Element(nil, "id", 0),
+			bsoncore.AppendStringElement(nil, "ns", "db.coll"),
+			bsoncore.BuildArrayElement(nil, "nextBatch", bsoncore.Value{Type: bsontype.EmbeddedDocument, Data: cursorTestDoc(3)}),
+		)),
+		bsoncore.AppendDoubleElement(nil, "ok", 1),
+	)
+	desc := description.Server{
+		Addr:                  address.Address("host1:27017"),
+		Kind:                  description.RSPrimary,
+		SessionTimeoutMinutes: 30,
+		WireVersion:           &description.VersionRange{Max: 8},
+	}
+	conn := &drivertest.ChannelConn{
+		Written:  make(chan []byte, 1),
+		ReadResp: make(chan []byte, 1),
+		Desc:     desc,
+	}
+	conn.ReadResp <- drivertest.MakeReply(reply)
+
+	var started []bson.Raw
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			started = append(started, evt.Command)
+		},
+	}
+
+	info := &TxnCursor{
+		Database:   "db",
+		Collection: "coll",
+		ID:         42,
+		BatchSize:  2,
+		Server:     "host1:27017",
+		Batch:      []bson.Raw{bson.Raw(cursorTestDoc(1)), bson.Raw(cursorTestDoc(2))},
+	}
+	cur, err := newTxnCursor(info, connServer{conn: conn}, desc, sess.clientSession, new(session.ClusterClock), monitor, nil)
+	require.NoError(t, err)
+
+	var got []int32
+	for cur.Next(context.Background()) {
+		got = append(got, cur.Current.Lookup("x").Int32())
+	}
+	require.NoError(t, cur.Err())
+	require.Equal(t, []int32{1, 2, 3}, got)
+	require.Equal(t, int64(0), cur.ID())
+
+	require.Len(t, started, 1)
+	cmd := started[0]
+	require.Equal(t, int64(42), cmd.Lookup("getMore").Int64())
+	require.Equal(t, "coll", cmd.Lookup("collection").StringValue())
+	require.Equal(t, int64(5), cmd.Lookup("txnNumber").Int64())
+	require.False(t, cmd.Lookup("autocommit").Boolean())
+	_, sentID := cmd.Lookup("lsid", "id").Binary()
+	require.Equal(t, lsid[:], sentID)
+	_, err = cmd.LookupErr("startTransaction")
+	require.Error(t, err, "getMore must not start the transaction again")
+}
+
+func TestTxnResumeCursorSessionContext(t *testing.T) {
+	sess := newExposerTestSession(t)
+	sessCtx := contextWithSession(context.Background(), sess)
+
+	// the session has no client, so the cursor cannot be resumed once the session is accepted.
+	_, err := TxnResumeCursor(sessCtx, sessCtx, &TxnCursor{Database: "db", Collection: "coll"})
+	require.Equal(t, ErrClientDisconnected, err)
+}
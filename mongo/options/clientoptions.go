@@ -25,6 +25,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"go.mongodb.org/mongo-driver/tag"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
 
@@ -70,6 +71,7 @@ type ClientOptions struct {
 	ConnectTimeout         *time.Duration
 	Compressors            []string
 	Dialer                 ContextDialer
+	FaultInjector          *driver.FaultInjector
 	HeartbeatInterval      *time.Duration
 	Hosts                  []string
 	LocalThreshold         *time.Duration
@@ -88,6 +90,7 @@ type ClientOptions struct {
 	Direct                 *bool
 	SocketTimeout          *time.Duration
 	TLSConfig              *tls.Config
+	TransactionMonitor     *event.TransactionMonitor
 	WriteConcern           *writeconcern.WriteConcern
 	ZlibLevel              *int
 
@@ -327,6 +330,14 @@ func (c *ClientOptions) SetDirect(b bool) *ClientOptions {
 	return c
 }
 
+// SetFaultInjector specifies a fault injector that makes the commands sent by the client fail
+// according to its fail points. It is meant for testing how an application reacts to errors
+// and network failures, and disables compression.
+func (c *ClientOptions) SetFaultInjector(fi *driver.FaultInjector) *ClientOptions {
+	c.FaultInjector = fi
+	return c
+}
+
 // SetHeartbeatInterval specifies the interval to wait between server monitoring checks.
 func (c *ClientOptions) SetHeartbeatInterval(d time.Duration) *ClientOptions {
 	c.HeartbeatInterval = &d
@@ -378,6 +389,13 @@ func (c *ClientOptions) SetMonitor(m *event.CommandMonitor) *ClientOptions {
 	return c
 }
 
+// SetTransactionMonitor specifies a monitor used to see the transactions started, committed and
+// aborted by the sessions of a client.
+func (c *ClientOptions) SetTransactionMonitor(m *event.TransactionMonitor) *ClientOptions {
+	c.TransactionMonitor = m
+	return c
+}
+
 // SetReadConcern specifies the read concern.
 func (c *ClientOptions) SetReadConcern(rc *readconcern.ReadConcern) *ClientOptions {
 	c.ReadConcern = rc
@@ -411,6 +429,13 @@ func (c *ClientOptions) SetRetryWrites(b bool) *ClientOptions {
 	return c
 }
 
+// SetRetryReads specifies whether the client has retryable reads enabled.
+func (c *ClientOptions) SetRetryReads(b bool) *ClientOptions {
+	c.RetryReads = &b
+
+	return c
+}
+
 // SetServerSelectionTimeout specifies a timeout in milliseconds to block for server selection.
 func (c *ClientOptions) SetServerSelectionTimeout(d time.Duration) *ClientOptions {
 	c.ServerSelectionTimeout = &d
@@ -473,6 +498,9 @@ func MergeClientOptions(opts ...*ClientOptions) *ClientOptions {
 		if opt.ConnectTimeout != nil {
 			c.ConnectTimeout = opt.ConnectTimeout
 		}
+		if opt.FaultInjector != nil {
+			c.FaultInjector = opt.FaultInjector
+		}
 		if opt.HeartbeatInterval != nil {
 			c.HeartbeatInterval = opt.HeartbeatInterval
 		}
@@ -497,6 +525,9 @@ func MergeClientOptions(opts ...*ClientOptions) *ClientOptions {
 		if opt.Monitor != nil {
 			c.Monitor = opt.Monitor
 		}
+		if opt.TransactionMonitor != nil {
+			c.TransactionMonitor = opt.TransactionMonitor
+		}
 		if opt.ReadConcern != nil {
 			c.ReadConcern = opt.ReadConcern
 		}
@@ -9,10 +9,12 @@ package mongo
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 	"go.mongodb.org/mongo-driver/x/mongo/driver"
@@ -67,6 +69,7 @@ type sessionImpl struct {
 	client              *Client
 	topo                *topology.Topology
 	didCommitAfterStart bool // true if commit was called after start with no other operations
+	txnStartedAt        time.Time
 }
 
 // EndSession ends the session.
@@ -167,7 +170,14 @@ func (s *sessionImpl) StartTransaction(opts ...*options.TransactionOptions) erro
 		MaxCommitTime:  topts.MaxCommitTime,
 	}
 
-	return s.clientSession.StartTransaction(coreOpts)
+	err = s.clientSession.StartTransaction(coreOpts)
+	if err != nil {
+		return err
+	}
+
+	s.txnStartedAt = time.Now()
+	s.publishTransactionEvent(context.Background(), event.TransactionStarted, nil)
+	return nil
 }
 
 // AbortTransaction aborts the session's transaction, returning any errors and error codes
@@ -179,19 +189,23 @@ func (s *sessionImpl) AbortTransaction(ctx context.Context) error {
 
 	// Do not run the abort command if the transaction is in starting state
 	if s.clientSession.TransactionStarting() || s.didCommitAfterStart {
+		s.publishTransactionEvent(ctx, event.TransactionAbort, nil)
 		return s.clientSession.AbortTransaction()
 	}
 
 	selector := makePinnedSelector(s.clientSession, description.WriteSelector())
 
 	s.clientSession.Aborting = true
-	_ = operation.NewAbortTransaction().Session(s.clientSession).ClusterClock(s.client.clock).Database("admin").
+	err = operation.NewAbortTransaction().Session(s.clientSession).ClusterClock(s.client.clock).Database("admin").
 		Deployment(s.topo).WriteConcern(s.clientSession.CurrentWc).ServerSelector(selector).
 		Retry(driver.RetryOncePerCommand).CommandMonitor(s.client.monitor).RecoveryToken(bsoncore.Document(s.clientSession.RecoveryToken)).Execute(ctx)
 
 	s.clientSession.Aborting = false
 	_ = s.clientSession.AbortTransaction()
 
+	// errors aborting are not returned, the monitor still gets to see them.
+	s.publishTransactionEvent(ctx, event.TransactionAbort, err)
+
 	return nil
 }
 
@@ -205,6 +219,7 @@ func (s *sessionImpl) CommitTransaction(ctx context.Context) error {
 	// Do not run the commit command if the transaction is in started state
 	if s.clientSession.TransactionStarting() || s.didCommitAfterStart {
 		s.didCommitAfterStart = true
+		s.publishTransactionEvent(ctx, event.TransactionCommit, nil)
 		return s.clientSession.CommitTransaction()
 	}
 
@@ -231,11 +246,43 @@ func (s *sessionImpl) CommitTransaction(ctx context.Context) error {
 	s.clientSession.UpdateCommitTransactionWriteConcern()
 
 	if err != nil {
-		return replaceErrors(err)
+		err = replaceErrors(err)
+		s.publishTransactionEvent(ctx, event.TransactionCommit, err)
+		return err
 	}
+	s.publishTransactionEvent(ctx, event.TransactionCommit, commitErr)
 	return commitErr
 }
 
+// publishTransactionEvent reports a transaction event to the transaction monitor of the client.
+// Sessions created by TxnStartSession are not reported, the transactions they join are reported
+// by the code driving them across nodes.
+func (s *sessionImpl) publishTransactionEvent(ctx context.Context, typ string, err error) {
+	if s.client == nil || s.clientSession.Detached() {
+		return
+	}
+	monitor := s.client.txnMonitor
+	if monitor == nil || monitor.Event == nil {
+		return
+	}
+
+	_, sessID := s.clientSession.Server.SessionID.Lookup("id").Binary()
+	evt := &event.TransactionEvent{
+		Type:      typ,
+		TxnID:     fmt.Sprintf("%x-%d", sessID, s.clientSession.Server.TxnNumber),
+		TxnNumber: s.clientSession.Server.TxnNumber,
+		Outcome:   event.OutcomeSucceeded,
+	}
+	if typ != event.TransactionStarted {
+		evt.Duration = time.Since(s.txnStartedAt)
+	}
+	if err != nil {
+		evt.Outcome = event.OutcomeFailed
+		evt.Failure = err.Error()
+	}
+	monitor.Event(ctx, evt)
+}
+
 func (s *sessionImpl) ClusterTime() bson.Raw {
 	return s.clientSession.ClusterTime
 }
@@ -11,19 +11,45 @@ import (
 	"encoding/base64"
 	"errors"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
 )
 
 type TxnSession struct {
+	// the txnNumber of the transaction on the logical session.
 	TxnNubmer int64
 	// must be go.mongodb.org/mongo-driver/x/mongo/driver/uuid  base64 encoding
 	SessionID string
+	// Started is true if the transaction may already be running on the server, which is the case
+	// for every session joining a transaction started by another session.
+	Started bool
+	// TransactionOptions are the options the transaction was started with. Every session of the
+	// transaction should use the same options.
+	TransactionOptions *options.TransactionOptions
+	// PinnedServer is the address of the mongos a transaction on a sharded cluster is pinned to.
+	// Sessions joining the transaction send their commands to the same mongos.
+	PinnedServer string
+	// RecoveryToken is the recovery token returned by the sharded cluster, it lets
+	// commitTransaction and abortTransaction be retried through another mongos.
+	RecoveryToken bson.Raw
+}
+
+// exposedSession returns the sessionImpl behind sess, which may be a SessionContext.
+func exposedSession(sess Session) (*sessionImpl, bool) {
+	if sc, ok := sess.(*sessionContext); ok {
+		sess = sc.Session
+	}
+	i, ok := sess.(*sessionImpl)
+	return i, ok
 }
 
 // GetSessionTxnID get the txnNumber and transaction id   from a session.
 func GetSessionTxnID(sess Session) (string, int64, error) {
-	i, ok := sess.(*sessionImpl)
+	i, ok := exposedSession(sess)
 	if !ok {
 		return "", 0, errors.New("the session is not type *sessionImpl")
 	}
@@ -32,34 +58,105 @@ func GetSessionTxnID(sess Session) (string, int64, error) {
 		i.clientSession.Server.TxnNumber, nil
 }
 
+// GetSessionPinning returns the address of the mongos the transaction of a session is pinned to
+// and the recovery token of the transaction. Both are empty unless the session runs a transaction
+// on a sharded cluster and has sent a command in it.
+func GetSessionPinning(sess Session) (string, bson.Raw, error) {
+	i, ok := exposedSession(sess)
+	if !ok {
+		return "", nil, errors.New("the session is not type *sessionImpl")
+	}
+	var addr string
+	if i.clientSession.PinnedServer != nil {
+		addr = i.clientSession.PinnedServer.Addr.String()
+	}
+	return addr, i.clientSession.RecoveryToken, nil
+}
+
+// TxnStartSession creates a session bound to the transaction described by info. The session
+// uses a dedicated server session that is not taken from the session pool of the client, so it
+// can be released with TxnReleaseSession without affecting the pool or the remote transaction.
+func TxnStartSession(c *Client, info *TxnSession, opts ...*options.SessionOptions) (Session, error) {
+	if c.topology.SessionPool == nil {
+		return nil, ErrClientDisconnected
+	}
+
+	idDoc, err := txnSessionID(info)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := session.NewDetachedClientSession(idDoc, c.id, session.Explicit, c.sessionClientOptions(opts...))
+	cs.RetryWrite = c.retryWrites
+	cs.RetryRead = c.retryReads
+	sess := &sessionImpl{
+		clientSession: cs,
+		client:        c,
+		topo:          c.topology,
+	}
+
+	// only for changing the transaction status
+	if err := sess.StartTransaction(info.TransactionOptions); err != nil {
+		return nil, err
+	}
+	cs.ResumeTransaction(info.TxnNubmer, info.Started)
+	cs.PinTransaction(address.Address(info.PinnedServer), info.RecoveryToken)
+
+	return sess, nil
+}
+
 // TnxReloadSession is used to reset a created session's session id, so that we can
 // put all the business operation
+//
+// Deprecated: use TxnStartSession, the pooled server session of sess is marked dirty here
+// and dropped when the session ends.
 func TnxReloadSession(sess Session, info *TxnSession) error {
 	i, ok := sess.(*sessionImpl)
 	if !ok {
 		panic("the session is not type *sessionImpl")
 	}
-	sessionIDBytes, err := base64.StdEncoding.DecodeString(info.SessionID)
+	idDoc, err := txnSessionID(info)
 	if err != nil {
 		return err
 	}
-	idDoc := bsonx.Doc{{Key: "id", Value: bsonx.Binary(session.UUIDSubtype, sessionIDBytes[:])}}
+	// the pool must never hand out the foreign session id again.
+	if !i.clientSession.Detached() {
+		i.clientSession.Server.MarkDirty()
+	}
 	i.clientSession.Server.SessionID = idDoc
 	i.clientSession.SessionID = idDoc
-	// i.didCommitAfterStart=false
-	if info.TxnNubmer > 1 {
-		// when the txnNumber is large than 1, it means that it's not the first transaction in
-		// this session, we do not need to create a new transaction with this txnNumber and mongodb does
-		// not allow this, so we need to change the session status from Starting to InProgressing.
-		// set state to InProgressing in a same session id, then we can use the same
-		// transaction number as a transaction in a single transaction session.
-		// otherwise a error like this will be occured as follows:
-		// (NoSuchTransaction) Given transaction number 2 does not match any in-progress transactions. The active transaction number is 1
-		i.clientSession.SetState(2)
-	}
+	// the session must carry the real txnNumber of the transaction, the server session may come
+	// from the pool and hold the txnNumber of an unrelated logical session.
+	// when the transaction has been started, the session must not send startTransaction again
+	// and needs to be InProgress. otherwise an error like this will be occured as follows:
+	// (NoSuchTransaction) Given transaction number 2 does not match any in-progress transactions. The active transaction number is 1
+	// a session joining a transaction that has not been started on the server yet gets
+	// (NoSuchTransaction) on its first command, the first command must come from the starting session.
+	i.clientSession.ResumeTransaction(info.TxnNubmer, info.Started)
+	// on a sharded cluster every command of the transaction must go through the same mongos.
+	i.clientSession.PinTransaction(address.Address(info.PinnedServer), info.RecoveryToken)
 	return nil
 }
 
+func txnSessionID(info *TxnSession) (bsonx.Doc, error) {
+	sessionIDBytes, err := base64.StdEncoding.DecodeString(info.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return bsonx.Doc{{Key: "id", Value: bsonx.Binary(session.UUIDSubtype, sessionIDBytes[:])}}, nil
+}
+
+// TxnUpdateCommitWriteConcern sets the write concern of the session's transaction to majority, as
+// the transactions spec requires when commitTransaction is retried. A session reloaded for the
+// retry does not know about the earlier attempt, so the caller has to ask for it.
+func TxnUpdateCommitWriteConcern(sess Session) {
+	i, ok := sess.(*sessionImpl)
+	if !ok {
+		panic("the session is not type *sessionImpl")
+	}
+	i.clientSession.UpdateCommitTransactionWriteConcern()
+}
+
 // TxnContextWithSession set the session into context if context includes session info
 func TxnContextWithSession(ctx context.Context, sess Session) SessionContext {
 	return contextWithSession(ctx, sess)
@@ -68,9 +165,9 @@ func TxnContextWithSession(ctx context.Context, sess Session) SessionContext {
 // TxnReleaseSession is almost same with session.EndSession(), the difference is
 // that ReleaseSession do not abrot the transaction, and just release the net connection
 // it panic if it's not a valid sessionImpl
-// Note: do not use this, because our transaction plan do not allows to reuse a session server.
-// if we do this, the session server will be reused, and the txnNumber will be increased, we
-// do not allow it happen.
+// Sessions created by TxnStartSession own a dedicated server session, releasing them neither
+// ends the logical session nor returns anything to the session pool. Pooled sessions reset by
+// TnxReloadSession are dropped from the pool.
 func TxnReleaseSession(ctx context.Context, sess Session) {
 	i, ok := sess.(*sessionImpl)
 	if !ok {
@@ -78,3 +175,15 @@ func TxnReleaseSession(ctx context.Context, sess Session) {
 	}
 	i.clientSession.EndSession()
 }
+
+// TxnContextWithoutSession returns a context that carries no session, so that operations run with
+// it are executed outside of any transaction bound to ctx.
+func TxnContextWithoutSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, nil)
+}
+
+// TxnMonitor returns the transaction monitor the client was created with, or nil if none was set.
+// Sessions created by TxnStartSession do not report to it, so the code driving them should.
+func TxnMonitor(c *Client) *event.TransactionMonitor {
+	return c.txnMonitor
+}
@@ -0,0 +1,185 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongo
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+func newExposerTestSession(t *testing.T) *sessionImpl {
+	clientID, err := uuid.New()
+	require.NoError(t, err)
+	cs, err := session.NewClientSession(session.NewPool(nil), clientID, session.Explicit)
+	require.NoError(t, err)
+	return &sessionImpl{clientSession: cs}
+}
+
+func TestTnxReloadSession(t *testing.T) {
+	lsid, err := uuid.New()
+	require.NoError(t, err)
+	sessionID := base64.StdEncoding.EncodeToString(lsid[:])
+
+	t.Run("starting session keeps the real txnNumber", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		// a pooled server session carries the txnNumber of its previous logical session.
+		sess.clientSession.Server.TxnNumber = 7
+		require.NoError(t, sess.StartTransaction())
+
+		require.NoError(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 1, SessionID: sessionID}))
+		require.Equal(t, int64(1), sess.clientSession.TxnNumber)
+		require.True(t, sess.clientSession.TransactionStarting(), "first command must send startTransaction")
+
+		id, txnNumber, err := GetSessionTxnID(sess)
+		require.NoError(t, err)
+		require.Equal(t, sessionID, id)
+		require.Equal(t, int64(1), txnNumber)
+	})
+	t.Run("joining session resumes the running transaction", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		require.NoError(t, sess.StartTransaction())
+
+		// the logical session already ran two transactions, the third one is running.
+		require.NoError(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 3, SessionID: sessionID, Started: true}))
+		require.Equal(t, int64(3), sess.clientSession.TxnNumber)
+		require.True(t, sess.clientSession.TransactionInProgress(), "joining session must not send startTransaction")
+	})
+	t.Run("joining session routes to the pinned mongos", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		require.NoError(t, sess.StartTransaction())
+
+		token := bson.Raw(bsoncore.BuildDocument(nil, bsoncore.AppendStringElement(nil, "shard", "sh1")))
+		require.NoError(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 1, SessionID: sessionID, Started: true,
+			PinnedServer: "mongos2:27017", RecoveryToken: token}))
+
+		topo := description.Topology{
+			Kind: description.Sharded,
+			Servers: []description.Server{
+				{Addr: address.Address("mongos1:27017"), Kind: description.Mongos},
+				{Addr: address.Address("mongos2:27017"), Kind: description.Mongos},
+				{Addr: address.Address("mongos3:27017"), Kind: description.Mongos},
+			},
+		}
+		selected, err := makePinnedSelector(sess.clientSession, description.WriteSelector()).SelectServer(topo, topo.Servers)
+		require.NoError(t, err)
+		require.Len(t, selected, 1)
+		require.Equal(t, address.Address("mongos2:27017"), selected[0].Addr)
+
+		addr, recoveryToken, err := GetSessionPinning(sess)
+		require.NoError(t, err)
+		require.Equal(t, "mongos2:27017", addr)
+		require.Equal(t, token, recoveryToken)
+	})
+	t.Run("unpinned session selects any mongos", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		require.NoError(t, sess.StartTransaction())
+		require.NoError(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 1, SessionID: sessionID, Started: true}))
+
+		topo := description.Topology{
+			Kind: description.Sharded,
+			Servers: []description.Server{
+				{Addr: address.Address("mongos1:27017"), Kind: description.Mongos},
+				{Addr: address.Address("mongos2:27017"), Kind: description.Mongos},
+			},
+		}
+		selected, err := makePinnedSelector(sess.clientSession, description.WriteSelector()).SelectServer(topo, topo.Servers)
+		require.NoError(t, err)
+		require.Len(t, selected, 2)
+
+		addr, recoveryToken, err := GetSessionPinning(sess)
+		require.NoError(t, err)
+		require.Empty(t, addr)
+		require.Nil(t, recoveryToken)
+	})
+	t.Run("pooled server session is never reused", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		require.NoError(t, sess.StartTransaction())
+
+		require.NoError(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 1, SessionID: sessionID}))
+		require.True(t, sess.clientSession.Server.Dirty, "pooled server session with a foreign lsid must be dropped")
+	})
+	t.Run("invalid session id", func(t *testing.T) {
+		sess := newExposerTestSession(t)
+		require.Error(t, TnxReloadSession(sess, &TxnSession{TxnNubmer: 1, SessionID: "not base64!"}))
+	})
+}
+
+func TestTxnContextWithoutSession(t *testing.T) {
+	sess := newExposerTestSession(t)
+	ctx := TxnContextWithSession(context.Background(), sess)
+	require.NotNil(t, sessionFromContext(ctx))
+	require.Nil(t, sessionFromContext(TxnContextWithoutSession(ctx)))
+}
+
+func TestTxnStartSessionDisconnected(t *testing.T) {
+	c, err := NewClient()
+	require.NoError(t, err)
+
+	_, err = TxnStartSession(c, &TxnSession{TxnNubmer: 1, SessionID: "AAAAAAAAAAAAAAAAAAAAAA=="})
+	require.Equal(t, ErrClientDisconnected, err)
+}
+
+func TestSessionTransactionEvents(t *testing.T) {
+	var events []*event.TransactionEvent
+	monitor := &event.TransactionMonitor{
+		Event: func(_ context.Context, evt *event.TransactionEvent) { events = append(events, evt) },
+	}
+
+	t.Run("pooled session", func(t *testing.T) {
+		events = nil
+		sess := newExposerTestSession(t)
+		sess.client = &Client{txnMonitor: monitor}
+
+		require.NoError(t, sess.StartTransaction())
+		require.NoError(t, sess.CommitTransaction(context.Background()))
+		require.NoError(t, sess.StartTransaction())
+		require.NoError(t, sess.AbortTransaction(context.Background()))
+
+		require.Len(t, events, 4)
+		wantTypes := []string{event.TransactionStarted, event.TransactionCommit, event.TransactionStarted, event.TransactionAbort}
+		for i, evt := range events {
+			require.Equal(t, wantTypes[i], evt.Type)
+			require.Equal(t, event.OutcomeSucceeded, evt.Outcome)
+		}
+		_, lsid := sess.clientSession.Server.SessionID.Lookup("id").Binary()
+		require.Equal(t, fmt.Sprintf("%x-1", lsid), events[1].TxnID)
+		require.Equal(t, int64(1), events[1].TxnNumber)
+		require.Equal(t, int64(2), events[3].TxnNumber)
+	})
+	t.Run("detached session", func(t *testing.T) {
+		events = nil
+		lsid, err := uuid.New()
+		require.NoError(t, err)
+		idDoc := bsonx.Doc{{Key: "id", Value: bsonx.Binary(session.UUIDSubtype, lsid[:])}}
+		sess := &sessionImpl{
+			clientSession: session.NewDetachedClientSession(idDoc, lsid, session.Explicit),
+			client:        &Client{txnMonitor: monitor},
+		}
+
+		require.NoError(t, sess.StartTransaction())
+		require.NoError(t, sess.CommitTransaction(context.Background()))
+		require.Empty(t, events)
+	})
+	t.Run("client monitor", func(t *testing.T) {
+		c, err := NewClient(options.Client().SetTransactionMonitor(monitor))
+		require.NoError(t, err)
+		require.Equal(t, monitor, TxnMonitor(c))
+	})
+}
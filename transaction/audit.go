@@ -0,0 +1,422 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrAuditBufferFull is returned by a BufferedAuditSink when a record is written while its buffer
+// is full. The record is dropped.
+var ErrAuditBufferFull = errors.New("audit buffer full, record dropped")
+
+// ErrAuditSinkClosed is returned by a BufferedAuditSink when a record is written after Close.
+var ErrAuditSinkClosed = errors.New("audit sink closed")
+
+// AuditRecord describes a command sent by this node as part of a transaction.
+type AuditRecord struct {
+	TxnID        string        `bson:"txnId" json:"txnId"`
+	TxnNumber    int64         `bson:"txnNumber" json:"txnNumber"`
+	Node         string        `bson:"node" json:"node"`
+	Command      string        `bson:"command" json:"command"`
+	Database     string        `bson:"db" json:"db"`
+	RequestID    int64         `bson:"requestId" json:"requestId"`
+	ConnectionID string        `bson:"connectionId" json:"connectionId"`
+	StartedAt    time.Time     `bson:"startedAt" json:"startedAt"`
+	Duration     time.Duration `bson:"duration" json:"duration"`
+	Failure      string        `bson:"failure,omitempty" json:"failure,omitempty"` // empty if the command succeeded
+}
+
+// AuditSink stores the audit trail written by an AuditRecorder.
+type AuditSink interface {
+	// Write appends a record to the audit trail.
+	Write(ctx context.Context, rec *AuditRecord) error
+	// Find returns the records of the transaction with the given id, oldest first.
+	Find(ctx context.Context, txnID string) ([]*AuditRecord, error)
+}
+
+// AuditRecorder records the commands sent as part of transactions to an AuditSink. It hooks the
+// command monitor of a client, so the commands of every node that installs a recorder writing to
+// a shared sink make up the trail of a distributed transaction:
+//
+//	rec := NewAuditRecorder(sink, "node-1", nil)
+//	cli, err := mongo.NewClient(options.Client().ApplyURI(uri).SetMonitor(rec.Monitor(nil)))
+//
+// Only commands carrying a txnNumber and autocommit are recorded, retryable writes and commands
+// run outside of a transaction are skipped.
+type AuditRecorder struct {
+	sink    AuditSink
+	node    string
+	onError func(error)
+
+	mu      sync.Mutex
+	pending map[int64]*AuditRecord
+}
+
+// NewAuditRecorder creates an AuditRecorder that writes to sink. node identifies this node in the
+// records and defaults to the host name. onError, if not nil, is called with the errors returned by
+// the sink; they are dropped otherwise, a failing audit trail never fails a command.
+func NewAuditRecorder(sink AuditSink, node string, onError func(error)) *AuditRecorder {
+	if node == "" {
+		node = defaultNodeID()
+	}
+	return &AuditRecorder{
+		sink:    sink,
+		node:    node,
+		onError: onError,
+		pending: make(map[int64]*AuditRecord),
+	}
+}
+
+// Monitor returns a command monitor that feeds the recorder and then forwards every event to next,
+// if it is not nil.
+func (r *AuditRecorder) Monitor(next *event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			r.started(evt)
+			if next != nil && next.Started != nil {
+				next.Started(ctx, evt)
+			}
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			r.finished(ctx, &evt.CommandFinishedEvent, "")
+			if next != nil && next.Succeeded != nil {
+				next.Succeeded(ctx, evt)
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			r.finished(ctx, &evt.CommandFinishedEvent, evt.Failure)
+			if next != nil && next.Failed != nil {
+				next.Failed(ctx, evt)
+			}
+		},
+	}
+}
+
+// Trail returns the recorded commands of the transaction with the given id, oldest first.
+func (r *AuditRecorder) Trail(ctx context.Context, txnID string) ([]*AuditRecord, error) {
+	return r.sink.Find(ctx, txnID)
+}
+
+func (r *AuditRecorder) started(evt *event.CommandStartedEvent) {
+	if _, ok := evt.Command.Lookup("autocommit").BooleanOK(); !ok {
+		return
+	}
+	txnNumber, ok := evt.Command.Lookup("txnNumber").Int64OK()
+	if !ok {
+		return
+	}
+	_, sessionID, ok := evt.Command.Lookup("lsid", "id").BinaryOK()
+	if !ok {
+		return
+	}
+
+	h := &TxnHandle{SessionID: sessionID, TxnNumber: txnNumber}
+	rec := &AuditRecord{
+		TxnID:        h.ID(),
+		TxnNumber:    txnNumber,
+		Node:         r.node,
+		Command:      evt.CommandName,
+		Database:     evt.DatabaseName,
+		RequestID:    evt.RequestID,
+		ConnectionID: evt.ConnectionID,
+		StartedAt:    timeNow(),
+	}
+
+	r.mu.Lock()
+	r.pending[evt.RequestID] = rec
+	r.mu.Unlock()
+}
+
+func (r *AuditRecorder) finished(ctx context.Context, evt *event.CommandFinishedEvent, failure string) {
+	r.mu.Lock()
+	rec, ok := r.pending[evt.RequestID]
+	delete(r.pending, evt.RequestID)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	rec.Duration = time.Duration(evt.DurationNanos)
+	rec.Failure = failure
+	if err := r.sink.Write(ctx, rec); err != nil && r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// memoryAuditSink is an AuditSink that keeps its records in memory.
+type memoryAuditSink struct {
+	mu      sync.Mutex
+	records map[string][]*AuditRecord
+}
+
+// NewMemoryAuditSink creates an AuditSink that keeps its records in memory. It only holds the
+// commands of this process and does not survive a restart.
+func NewMemoryAuditSink() AuditSink {
+	return &memoryAuditSink{records: make(map[string][]*AuditRecord)}
+}
+
+func (s *memoryAuditSink) Write(_ context.Context, rec *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *rec
+	s.records[rec.TxnID] = append(s.records[rec.TxnID], &c)
+	return nil
+}
+
+func (s *memoryAuditSink) Find(_ context.Context, txnID string) ([]*AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []*AuditRecord
+	for _, rec := range s.records[txnID] {
+		c := *rec
+		records = append(records, &c)
+	}
+	sortAuditRecords(records)
+	return records, nil
+}
+
+// fileAuditSink is an AuditSink that appends its records to a file.
+type fileAuditSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileAuditSink creates an AuditSink that appends its records to the file at path as JSON, one
+// record per line. The file is created if needed and is only opened while a record is written or
+// read, so it may be rotated at any time. Find scans the whole file.
+func NewFileAuditSink(path string) AuditSink {
+	return &fileAuditSink{path: path}
+}
+
+func (s *fileAuditSink) Write(_ context.Context, rec *AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileAuditSink) Find(_ context.Context, txnID string) ([]*AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*AuditRecord
+	dec := json.NewDecoder(f)
+	for {
+		rec := new(AuditRecord)
+		if err := dec.Decode(rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if rec.TxnID == txnID {
+			records = append(records, rec)
+		}
+	}
+	sortAuditRecords(records)
+	return records, nil
+}
+
+// collectionAuditSink is an AuditSink backed by a MongoDB collection.
+type collectionAuditSink struct {
+	coll *mongo.Collection
+}
+
+// NewCollectionAuditSink creates an AuditSink backed by coll. Records are written outside of any
+// transaction, so the trail of an aborted transaction is kept too. Commands sent to coll are not
+// part of a transaction and are never recorded themselves. coll should be indexed on txnId.
+//
+// Write inserts the record before returning. An AuditRecorder writes from the command monitor of
+// the client, so every recorded command then waits for an extra round trip, and a slow audit
+// collection slows down the transactions. Wrap the sink with NewBufferedAuditSink to insert the
+// records in the background.
+func NewCollectionAuditSink(coll *mongo.Collection) AuditSink {
+	return &collectionAuditSink{coll: coll}
+}
+
+func (s *collectionAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	_, err := s.coll.InsertOne(mongo.TxnContextWithoutSession(ctx), rec)
+	return err
+}
+
+func (s *collectionAuditSink) Find(ctx context.Context, txnID string) ([]*AuditRecord, error) {
+	ctx = mongo.TxnContextWithoutSession(ctx)
+	cursor, err := s.coll.Find(ctx, bson.M{"txnId": txnID}, options.Find().SetSort(bson.M{"startedAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var records []*AuditRecord
+	for cursor.Next(ctx) {
+		rec := new(AuditRecord)
+		if err := cursor.Decode(rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, cursor.Err()
+}
+
+// BufferedAuditSink writes records to another AuditSink from a background goroutine, so the
+// commands an AuditRecorder records do not wait for their records to be stored.
+type BufferedAuditSink struct {
+	sink    AuditSink
+	onError func(error)
+
+	records   chan *AuditRecord
+	flush     chan chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBufferedAuditSink creates a BufferedAuditSink that holds up to size records waiting to be
+// written to sink. Records written while the buffer is full are dropped with ErrAuditBufferFull.
+// onError, if not nil, is called with the errors returned by sink; they are dropped otherwise.
+// Close must be called to write the remaining records and stop the goroutine.
+func NewBufferedAuditSink(sink AuditSink, size int, onError func(error)) *BufferedAuditSink {
+	s := &BufferedAuditSink{
+		sink:    sink,
+		onError: onError,
+		records: make(chan *AuditRecord, size),
+		flush:   make(chan chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues rec to be written to the underlying sink. It never waits.
+func (s *BufferedAuditSink) Write(_ context.Context, rec *AuditRecord) error {
+	select {
+	case <-s.stop:
+		return ErrAuditSinkClosed
+	default:
+	}
+
+	select {
+	case s.records <- rec:
+		return nil
+	default:
+		return ErrAuditBufferFull
+	}
+}
+
+// Find writes the queued records and returns the records of the transaction with the given id
+// from the underlying sink.
+func (s *BufferedAuditSink) Find(ctx context.Context, txnID string) ([]*AuditRecord, error) {
+	if err := s.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return s.sink.Find(ctx, txnID)
+}
+
+// Flush waits until the records queued before the call are written to the underlying sink.
+func (s *BufferedAuditSink) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case s.flush <- ack:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close writes the queued records and stops the background goroutine.
+func (s *BufferedAuditSink) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+func (s *BufferedAuditSink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case rec := <-s.records:
+			s.write(rec)
+		case ack := <-s.flush:
+			s.drain()
+			close(ack)
+		case <-s.stop:
+			s.drain()
+			return
+		}
+	}
+}
+
+// drain writes the queued records.
+func (s *BufferedAuditSink) drain() {
+	for {
+		select {
+		case rec := <-s.records:
+			s.write(rec)
+		default:
+			return
+		}
+	}
+}
+
+func (s *BufferedAuditSink) write(rec *AuditRecord) {
+	// the command the record belongs to is over, its context may be canceled already.
+	if err := s.sink.Write(context.Background(), rec); err != nil && s.onError != nil {
+		s.onError(err)
+	}
+}
+
+func sortAuditRecords(records []*AuditRecord) {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].StartedAt.Before(records[j].StartedAt) })
+}
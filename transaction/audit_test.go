@@ -0,0 +1,184 @@
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func auditCommand(t *testing.T, doc bson.D) bson.Raw {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestAuditRecorder(t *testing.T) {
+	h := newTestHandle()
+	lsid := bson.D{{Key: "id", Value: primitive.Binary{Subtype: 0x04, Data: h.SessionID}}}
+	txnCmd := auditCommand(t, bson.D{
+		{Key: "insert", Value: "test"},
+		{Key: "lsid", Value: lsid},
+		{Key: "txnNumber", Value: h.TxnNumber},
+		{Key: "autocommit", Value: false},
+	})
+	// a retryable write carries a txnNumber but is not part of a transaction.
+	retryableCmd := auditCommand(t, bson.D{
+		{Key: "insert", Value: "test"},
+		{Key: "lsid", Value: lsid},
+		{Key: "txnNumber", Value: int64(7)},
+	})
+
+	sink := NewMemoryAuditSink()
+	var forwarded int
+	next := &event.CommandMonitor{
+		Started: func(context.Context, *event.CommandStartedEvent) { forwarded++ },
+		Failed:  func(context.Context, *event.CommandFailedEvent) { forwarded++ },
+	}
+	monitor := NewAuditRecorder(sink, "node-1", nil).Monitor(next)
+	ctx := context.Background()
+
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: txnCmd, DatabaseName: "db", CommandName: "insert", RequestID: 1})
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: retryableCmd, DatabaseName: "db", CommandName: "insert", RequestID: 2})
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: txnCmd, DatabaseName: "admin", CommandName: "commitTransaction", RequestID: 3})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 1, DurationNanos: int64(time.Millisecond)}})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 2}})
+	monitor.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 3}, Failure: "NoSuchTransaction"})
+
+	if forwarded != 4 {
+		t.Errorf("expected 4 events forwarded to the next monitor, got %d", forwarded)
+	}
+
+	records, err := sink.Find(ctx, h.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if rec := records[0]; rec.Command != "insert" || rec.Database != "db" || rec.Node != "node-1" ||
+		rec.TxnNumber != h.TxnNumber || rec.Duration != time.Millisecond || rec.Failure != "" {
+		t.Errorf("unexpected insert record %+v", rec)
+	}
+	if rec := records[1]; rec.Command != "commitTransaction" || rec.Failure != "NoSuchTransaction" {
+		t.Errorf("unexpected commit record %+v", rec)
+	}
+}
+
+type failingAuditSink struct{ AuditSink }
+
+func (failingAuditSink) Write(context.Context, *AuditRecord) error {
+	return errors.New("sink unavailable")
+}
+
+func TestAuditRecorderSinkError(t *testing.T) {
+	h := newTestHandle()
+	cmd := auditCommand(t, bson.D{
+		{Key: "find", Value: "test"},
+		{Key: "lsid", Value: bson.D{{Key: "id", Value: primitive.Binary{Subtype: 0x04, Data: h.SessionID}}}},
+		{Key: "txnNumber", Value: h.TxnNumber},
+		{Key: "autocommit", Value: false},
+	})
+
+	var errs []error
+	monitor := NewAuditRecorder(failingAuditSink{}, "", func(err error) { errs = append(errs, err) }).Monitor(nil)
+	monitor.Started(context.Background(), &event.CommandStartedEvent{Command: cmd, CommandName: "find", RequestID: 1})
+	monitor.Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 1}})
+
+	if len(errs) != 1 {
+		t.Errorf("expected the sink error to be reported, got %v", errs)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	sink := NewFileAuditSink(filepath.Join(dir, "audit.log"))
+	if records, err := sink.Find(ctx, "a-1"); err != nil || len(records) != 0 {
+		t.Fatalf("expected an empty trail before the first write, got %v, %v", records, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, rec := range []*AuditRecord{
+		{TxnID: "a-1", Command: "update", StartedAt: now.Add(time.Second)},
+		{TxnID: "b-1", Command: "insert", StartedAt: now},
+		{TxnID: "a-1", Command: "find", StartedAt: now, Duration: time.Millisecond},
+	} {
+		if err := sink.Write(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := sink.Find(ctx, "a-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Command != "find" || records[1].Command != "update" {
+		t.Fatalf("expected the find and update records in order, got %+v", records)
+	}
+	if !records[0].StartedAt.Equal(now) || records[0].Duration != time.Millisecond {
+		t.Errorf("record not read back as written: %+v", records[0])
+	}
+}
+
+// blockingAuditSink is an AuditSink whose writes wait until release is closed.
+type blockingAuditSink struct {
+	AuditSink
+	release chan struct{}
+}
+
+func (s blockingAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	<-s.release
+	return s.AuditSink.Write(ctx, rec)
+}
+
+func TestBufferedAuditSink(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	sink := NewBufferedAuditSink(blockingAuditSink{AuditSink: NewMemoryAuditSink(), release: release}, 2, nil)
+
+	// the first record is taken by the background writer, the next two fill the buffer.
+	if err := sink.Write(ctx, &AuditRecord{TxnID: "a-1", Command: "insert"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.records) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, cmd := range []string{"update", "find"} {
+		if err := sink.Write(ctx, &AuditRecord{TxnID: "a-1", Command: cmd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Write(ctx, &AuditRecord{TxnID: "a-1", Command: "delete"}); err != ErrAuditBufferFull {
+		t.Errorf("expected ErrAuditBufferFull, got %v", err)
+	}
+
+	close(release)
+	records, err := sink.Find(ctx, "a-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("expected the 3 queued records to be written, got %d", len(records))
+	}
+
+	sink.Close()
+	if err := sink.Write(ctx, &AuditRecord{TxnID: "a-1"}); err != ErrAuditSinkClosed {
+		t.Errorf("expected ErrAuditSinkClosed, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
+)
+
+// ExportToken returns a token for the same transaction as txnToken that also carries the
+// $clusterTime and operationTime observed by sess. A node should export its token once it has
+// done its part of the transaction and hand the result on, so that the nodes reloading the
+// transaction after it are causally ordered after its work. The times never move backwards:
+// the later of the times in txnToken and in sess are kept.
+//
+// On a sharded cluster the exported token also carries the mongos the transaction is pinned to
+// and its recovery token, so the transaction must be exported by the node that started it before
+// other nodes join it.
+func (m *TxnManager) ExportToken(sess mongo.Session, txnToken string) (string, error) {
+	handle, err := m.verifyToken(txnToken)
+	if err != nil {
+		return "", err
+	}
+
+	handle.ClusterTime = session.MaxClusterTime(handle.ClusterTime, sess.ClusterTime())
+	handle.OperationTime = maxTimestamp(handle.OperationTime, sess.OperationTime())
+	capturePinning(sess, handle)
+	handle.IssuedAt = timeNow()
+	handle.Nonce = nil
+
+	return encodeToken(m.keys, handle)
+}
+
+// AdvanceSession advances the cluster time and operation time of sess to the times carried by
+// txnToken. Use it on a causally consistent session that reads outside of the transaction, so
+// those reads observe the work the token was exported after.
+func (m *TxnManager) AdvanceSession(sess mongo.Session, txnToken string) error {
+	handle, err := decodeToken(m.keys, txnToken)
+	if err != nil {
+		return err
+	}
+	return advanceSession(sess, handle)
+}
+
+func advanceSession(sess mongo.Session, handle *TxnHandle) error {
+	if handle.ClusterTime != nil {
+		if err := sess.AdvanceClusterTime(handle.ClusterTime); err != nil {
+			return fmt.Errorf("advance cluster time failed, err: %v", err)
+		}
+	}
+	if handle.OperationTime != nil {
+		if err := sess.AdvanceOperationTime(handle.OperationTime); err != nil {
+			return fmt.Errorf("advance operation time failed, err: %v", err)
+		}
+	}
+	return nil
+}
+
+func maxTimestamp(t1, t2 *primitive.Timestamp) *primitive.Timestamp {
+	switch {
+	case t1 == nil:
+		return t2
+	case t2 == nil:
+		return t1
+	case t2.T > t1.T || (t2.T == t1.T && t2.I > t1.I):
+		return t2
+	default:
+		return t1
+	}
+}
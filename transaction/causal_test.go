@@ -0,0 +1,95 @@
+package Transaction
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// causalSession records the times it is advanced to.
+type causalSession struct {
+	mongo.Session
+	clusterTime   bson.Raw
+	operationTime *primitive.Timestamp
+}
+
+func (s *causalSession) ClusterTime() bson.Raw               { return s.clusterTime }
+func (s *causalSession) OperationTime() *primitive.Timestamp { return s.operationTime }
+func (s *causalSession) AdvanceClusterTime(ct bson.Raw) error {
+	s.clusterTime = ct
+	return nil
+}
+func (s *causalSession) AdvanceOperationTime(ot *primitive.Timestamp) error {
+	s.operationTime = ot
+	return nil
+}
+
+func clusterTimeDoc(t *testing.T, ts primitive.Timestamp) bson.Raw {
+	doc, err := bson.Marshal(bson.D{{Key: "$clusterTime", Value: bson.D{{Key: "clusterTime", Value: ts}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestExportTokenCarriesCausalTimes(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+
+	token, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node A exports the times it observed
+	nodeA := &causalSession{
+		clusterTime:   clusterTimeDoc(t, primitive.Timestamp{T: 100, I: 2}),
+		operationTime: &primitive.Timestamp{T: 100, I: 1},
+	}
+	exported, err := m.ExportToken(nodeA, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an older session cannot move the times backwards
+	stale := &causalSession{
+		clusterTime:   clusterTimeDoc(t, primitive.Timestamp{T: 50, I: 1}),
+		operationTime: &primitive.Timestamp{T: 50, I: 1},
+	}
+	exported, err = m.ExportToken(stale, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node B advances a session used outside of the transaction
+	nodeB := &causalSession{}
+	if err := m.AdvanceSession(nodeB, exported); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nodeB.clusterTime, nodeA.clusterTime) {
+		t.Errorf("expected cluster time %s, got %s", nodeA.clusterTime, nodeB.clusterTime)
+	}
+	if nodeB.operationTime == nil || *nodeB.operationTime != *nodeA.operationTime {
+		t.Errorf("expected operation time %v, got %v", nodeA.operationTime, nodeB.operationTime)
+	}
+
+	// the exported token still identifies the same transaction
+	h1, _ := decodeToken(ks, token)
+	h2, _ := decodeToken(ks, exported)
+	if h1.ID() != h2.ID() || !h1.ExpiresAt.Equal(h2.ExpiresAt) {
+		t.Errorf("exported token describes another transaction: %+v", h2)
+	}
+}
+
+func TestMaxTimestamp(t *testing.T) {
+	a, b := &primitive.Timestamp{T: 1, I: 5}, &primitive.Timestamp{T: 2, I: 0}
+	if maxTimestamp(a, b) != b || maxTimestamp(b, a) != b {
+		t.Error("later timestamp not chosen")
+	}
+	if maxTimestamp(nil, a) != a || maxTimestamp(a, nil) != a {
+		t.Error("nil timestamp chosen")
+	}
+}
@@ -0,0 +1,485 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+// These errors are returned by a TxnCoordinator.
+var (
+	ErrNoDecisionLog  = errors.New("transaction coordinator has no decision log configured")
+	ErrNoClusters     = errors.New("transaction coordinator needs at least one cluster")
+	ErrGlobalTxnDone  = errors.New("global transaction is already finished")
+	ErrNotPartial     = errors.New("global transaction is not partially committed")
+	ErrUnknownCluster = errors.New("cluster is not part of the transaction coordinator")
+)
+
+// GlobalCommitError is returned when a global transaction could not be committed on every
+// cluster. State tells what happened:
+//   - GlobalAborted: no branch was committed, the transaction was aborted everywhere.
+//   - GlobalCommitting: the outcome of some branches is unknown. The decision to commit stands,
+//     Recover keeps committing them.
+//   - GlobalPartial: some branches are committed while the transaction of the Failed branches
+//     is gone from their cluster. This cannot be undone by the coordinator, an operator has to
+//     repair the data and then call MarkRepaired.
+type GlobalCommitError struct {
+	ID        string
+	State     GlobalState
+	Committed []string // the clusters the transaction is committed on
+	Failed    []string // the clusters whose transaction is gone
+	InDoubt   []string // the clusters where the outcome of the commit is unknown
+	Err       error    // the first error returned by a cluster
+}
+
+// Error implements the error interface.
+func (e *GlobalCommitError) Error() string {
+	return fmt.Sprintf("global transaction %s is %s, committed: [%s], failed: [%s], in doubt: [%s], err: %v",
+		e.ID, e.State, strings.Join(e.Committed, ", "), strings.Join(e.Failed, ", "), strings.Join(e.InDoubt, ", "), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *GlobalCommitError) Unwrap() error {
+	return e.Err
+}
+
+// TxnCoordinator runs global transactions that span several clusters with a two-phase commit.
+// A global transaction has a branch, a transaction driven by a TxnManager, on every cluster. The
+// decision to commit is saved in the decision log before any branch is committed, and the branches
+// are then committed one by one.
+//
+// MongoDB cannot prepare a transaction, so a branch may still be lost after the decision: the
+// server may abort it, for instance when transactionLifetimeLimitSeconds is reached. If that
+// happens before any branch is committed the global transaction is aborted; afterwards it is
+// recorded as GlobalPartial and reported to the caller, since the committed branches cannot be
+// rolled back.
+type TxnCoordinator struct {
+	managers map[string]*TxnManager
+	clusters []string
+	log      DecisionLog
+	node     string
+
+	// commitBranch and abortBranch finish a branch on its cluster, they are replaced in tests.
+	commitBranch func(ctx context.Context, cluster string, h *TxnHandle, retrying bool) error
+	abortBranch  func(ctx context.Context, cluster string, h *TxnHandle) error
+}
+
+// NewTxnCoordinator creates a TxnCoordinator for the given clusters, keyed by a name that is
+// stored in the decision log and must not change across restarts.
+func NewTxnCoordinator(clients map[string]*mongo.Client, opts ...*CoordinatorOptions) (*TxnCoordinator, error) {
+	if len(clients) == 0 {
+		return nil, ErrNoClusters
+	}
+	o := MergeCoordinatorOptions(opts...)
+	if o.DecisionLog == nil {
+		return nil, ErrNoDecisionLog
+	}
+
+	c := &TxnCoordinator{
+		managers: make(map[string]*TxnManager, len(clients)),
+		log:      o.DecisionLog,
+		node:     defaultNodeID(),
+	}
+	if o.NodeID != nil {
+		c.node = *o.NodeID
+	}
+	for cluster, cli := range clients {
+		m, err := NewTxnManager(cli, o.ManagerOptions)
+		if err != nil {
+			return nil, fmt.Errorf("create transaction manager of cluster: %s failed, err: %v", cluster, err)
+		}
+		c.managers[cluster] = m
+		c.clusters = append(c.clusters, cluster)
+	}
+	sort.Strings(c.clusters)
+
+	c.commitBranch = func(ctx context.Context, cluster string, h *TxnHandle, retrying bool) error {
+		m := c.managers[cluster]
+		err := m.commit(ctx, h, retrying)
+		if hasErrorLabel(err, driver.UnknownTransactionCommitResult) && !isMaxTimeMSExpired(err) {
+			err = m.commit(ctx, h, true)
+		}
+		return err
+	}
+	c.abortBranch = func(ctx context.Context, cluster string, h *TxnHandle) error {
+		return c.managers[cluster].abort(ctx, h)
+	}
+	return c, nil
+}
+
+// Manager returns the TxnManager of a cluster, or nil if the cluster is unknown. Nodes joining a
+// branch reload it with the manager of its cluster and the token returned by GlobalSession.Token.
+func (c *TxnCoordinator) Manager(cluster string) *TxnManager {
+	return c.managers[cluster]
+}
+
+// Clusters returns the names of the clusters of the coordinator, sorted.
+func (c *TxnCoordinator) Clusters() []string {
+	return append([]string(nil), c.clusters...)
+}
+
+// DecisionLog returns the decision log of the coordinator.
+func (c *TxnCoordinator) DecisionLog() DecisionLog {
+	return c.log
+}
+
+// GlobalSession is a global transaction started by a TxnCoordinator, with a session bound to
+// its branch on every cluster.
+type GlobalSession struct {
+	id       string
+	sessions map[string]mongo.Session
+	tokens   map[string]string
+}
+
+// ID returns the id of the global transaction in the decision log.
+func (gs *GlobalSession) ID() string {
+	return gs.id
+}
+
+// Session returns the session bound to the branch on cluster, or nil if the cluster is unknown.
+// Use it with mongo.TxnContextWithSession to run operations in the branch.
+func (gs *GlobalSession) Session(cluster string) mongo.Session {
+	return gs.sessions[cluster]
+}
+
+// Token returns the token of the branch on cluster, so other nodes can join the branch.
+func (gs *GlobalSession) Token(cluster string) string {
+	return gs.tokens[cluster]
+}
+
+// Begin starts a global transaction with a branch on every cluster and records it in the
+// decision log. The transaction options apply to every branch.
+func (c *TxnCoordinator) Begin(ctx context.Context, opts ...*options.TransactionOptions) (*GlobalSession, error) {
+	id, err := uuid.New()
+	if err != nil {
+		return nil, fmt.Errorf("generate global transaction id failed, err: %v", err)
+	}
+
+	now := timeNow()
+	txn := &GlobalTxn{
+		ID:          hex.EncodeToString(id[:]),
+		Coordinator: c.node,
+		State:       GlobalActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	gs := &GlobalSession{
+		id:       txn.ID,
+		sessions: make(map[string]mongo.Session, len(c.clusters)),
+		tokens:   make(map[string]string, len(c.clusters)),
+	}
+
+	for _, cluster := range c.clusters {
+		m := c.managers[cluster]
+		sess, token, err := m.StartTransaction(ctx, opts...)
+		if err == nil {
+			var h *TxnHandle
+			if h, err = decodeToken(m.keys, token); err == nil {
+				gs.sessions[cluster], gs.tokens[cluster] = sess, token
+				txn.Branches = append(txn.Branches, Branch{
+					Cluster:   cluster,
+					SessionID: h.SessionID,
+					TxnNumber: h.TxnNumber,
+					Options:   h.Options,
+					State:     BranchActive,
+				})
+				continue
+			}
+			m.ReleaseSession(ctx, sess)
+		}
+
+		// nothing was recorded yet, the branches started so far are aborted right away.
+		c.release(ctx, gs)
+		for i := range txn.Branches {
+			_ = c.abortBranch(ctx, txn.Branches[i].Cluster, txn.Branches[i].handle())
+		}
+		return nil, fmt.Errorf("start branch of global transaction on cluster: %s failed, err: %v", cluster, err)
+	}
+
+	if err := c.log.Save(ctx, txn); err != nil {
+		c.release(ctx, gs)
+		for i := range txn.Branches {
+			_ = c.abortBranch(ctx, txn.Branches[i].Cluster, txn.Branches[i].handle())
+		}
+		return nil, fmt.Errorf("record global transaction: %s failed, err: %v", txn.ID, err)
+	}
+	return gs, nil
+}
+
+// Commit decides to commit the global transaction and commits its branches. The sessions of gs
+// are released first. It returns a *GlobalCommitError if the transaction could not be committed
+// on every cluster. Committing a committed transaction again is a no-op.
+func (c *TxnCoordinator) Commit(ctx context.Context, gs *GlobalSession) error {
+	c.release(ctx, gs)
+
+	txn, err := c.log.Load(ctx, gs.id)
+	if err != nil {
+		return err
+	}
+	switch txn.State {
+	case GlobalCommitted:
+		return nil
+	case GlobalActive:
+	case GlobalCommitting:
+		return c.finishCommit(ctx, txn, true)
+	default:
+		return ErrGlobalTxnDone
+	}
+
+	// the decision is durable before any branch is committed.
+	txn.State = GlobalCommitting
+	if err := c.save(ctx, txn); err != nil {
+		return err
+	}
+	return c.finishCommit(ctx, txn, false)
+}
+
+// Abort decides to abort the global transaction and aborts its branches. The sessions of gs are
+// released first.
+func (c *TxnCoordinator) Abort(ctx context.Context, gs *GlobalSession) error {
+	c.release(ctx, gs)
+
+	txn, err := c.log.Load(ctx, gs.id)
+	if err != nil {
+		return err
+	}
+	switch txn.State {
+	case GlobalAborted:
+		return nil
+	case GlobalActive, GlobalAborting:
+	default:
+		return ErrGlobalTxnDone
+	}
+
+	txn.State = GlobalAborting
+	if err := c.save(ctx, txn); err != nil {
+		return err
+	}
+	return c.finishAbort(ctx, txn, nil)
+}
+
+// RecoveredGlobalTxn describes a global transaction handled by TxnCoordinator.Recover.
+type RecoveredGlobalTxn struct {
+	Txn *GlobalTxn // the record of the transaction once recovered
+	Err error      // set if the transaction could not be finished
+}
+
+// Recover finishes the global transactions this coordinator left unfinished, typically after a
+// crash. It is meant to be called on startup, before new global transactions are begun.
+// Transactions without a decision are aborted, the others are driven to their decided outcome.
+// Transactions that end up partially committed are reported with a *GlobalCommitError.
+func (c *TxnCoordinator) Recover(ctx context.Context) ([]RecoveredGlobalTxn, error) {
+	txns, err := c.log.Find(ctx, c.node, GlobalActive, GlobalCommitting, GlobalAborting)
+	if err != nil {
+		return nil, fmt.Errorf("list unfinished global transactions failed, err: %v", err)
+	}
+
+	recovered := make([]RecoveredGlobalTxn, 0, len(txns))
+	for _, txn := range txns {
+		switch txn.State {
+		case GlobalCommitting:
+			err = c.finishCommit(ctx, txn, true)
+		case GlobalActive:
+			// presumed abort: no branch was committed without a decision.
+			txn.State = GlobalAborting
+			if err = c.save(ctx, txn); err == nil {
+				err = c.finishAbort(ctx, txn, nil)
+			}
+		default:
+			err = c.finishAbort(ctx, txn, nil)
+		}
+		recovered = append(recovered, RecoveredGlobalTxn{Txn: txn, Err: err})
+	}
+	return recovered, nil
+}
+
+// PartialTransactions returns the global transactions of this coordinator that are committed on
+// some clusters only, so an operator can repair them.
+func (c *TxnCoordinator) PartialTransactions(ctx context.Context) ([]*GlobalTxn, error) {
+	return c.log.Find(ctx, c.node, GlobalPartial)
+}
+
+// MarkRepaired records that an operator repaired the partially committed global transaction id.
+func (c *TxnCoordinator) MarkRepaired(ctx context.Context, id string) error {
+	txn, err := c.log.Load(ctx, id)
+	if err != nil {
+		return err
+	}
+	if txn.State != GlobalPartial {
+		return ErrNotPartial
+	}
+	txn.State = GlobalRepaired
+	return c.save(ctx, txn)
+}
+
+// finishCommit commits the branches of a global transaction decided to commit.
+func (c *TxnCoordinator) finishCommit(ctx context.Context, txn *GlobalTxn, retrying bool) error {
+	var firstErr error
+	for i := range txn.Branches {
+		b := &txn.Branches[i]
+		if b.State != BranchActive {
+			continue
+		}
+
+		err := c.commitBranch(ctx, b.Cluster, b.handle(), retrying)
+		switch {
+		case err == nil:
+			b.State, b.Error = BranchCommitted, ""
+		case branchLost(err) && canStillAbort(txn, b):
+			// nothing is committed yet, the decision can still be reversed.
+			b.State, b.Error = BranchFailed, err.Error()
+			txn.State = GlobalAborting
+			if serr := c.save(ctx, txn); serr != nil {
+				return serr
+			}
+			return c.finishAbort(ctx, txn, err)
+		case branchLost(err):
+			b.State, b.Error = BranchFailed, err.Error()
+		default:
+			b.Error = err.Error()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := c.save(ctx, txn); err != nil {
+			return err
+		}
+	}
+
+	cerr := newGlobalCommitError(txn, firstErr)
+	switch {
+	case len(cerr.InDoubt) != 0:
+		return cerr
+	case len(cerr.Failed) != 0:
+		txn.State = GlobalPartial
+	default:
+		txn.State = GlobalCommitted
+	}
+	if err := c.save(ctx, txn); err != nil {
+		return err
+	}
+	if txn.State == GlobalPartial {
+		cerr.State = GlobalPartial
+		return cerr
+	}
+	return nil
+}
+
+// finishAbort aborts the branches of a global transaction decided to abort. cause is the error
+// that made a commit abort, if any.
+func (c *TxnCoordinator) finishAbort(ctx context.Context, txn *GlobalTxn, cause error) error {
+	var firstErr error
+	for i := range txn.Branches {
+		b := &txn.Branches[i]
+		if b.State != BranchActive {
+			continue
+		}
+		err := c.abortBranch(ctx, b.Cluster, b.handle())
+		switch {
+		case err == nil:
+			b.State, b.Error = BranchAborted, ""
+		case err == ErrAlreadyCommitted:
+			// the branch was committed by another node, the global transaction is partial.
+			b.State, b.Error = BranchCommitted, ""
+			if cause == nil {
+				cause = err
+			}
+		default:
+			b.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr == nil {
+		txn.State = GlobalAborted
+		for i := range txn.Branches {
+			if txn.Branches[i].State == BranchCommitted {
+				txn.State = GlobalPartial
+			}
+		}
+	}
+	if err := c.save(ctx, txn); err != nil {
+		return err
+	}
+	switch {
+	case firstErr != nil:
+		return fmt.Errorf("abort global transaction: %s failed, err: %v", txn.ID, firstErr)
+	case cause != nil:
+		return newGlobalCommitError(txn, cause)
+	default:
+		return nil
+	}
+}
+
+func (c *TxnCoordinator) save(ctx context.Context, txn *GlobalTxn) error {
+	txn.UpdatedAt = timeNow()
+	if err := c.log.Save(ctx, txn); err != nil {
+		return fmt.Errorf("record global transaction: %s as %s failed, err: %v", txn.ID, txn.State, err)
+	}
+	return nil
+}
+
+func (c *TxnCoordinator) release(ctx context.Context, gs *GlobalSession) {
+	for cluster, sess := range gs.sessions {
+		c.managers[cluster].ReleaseSession(ctx, sess)
+		delete(gs.sessions, cluster)
+	}
+}
+
+// branchLost returns true if err means the transaction of a branch is gone from its cluster and
+// can never be committed.
+func branchLost(err error) bool {
+	return err == ErrLeaseExpired || err == ErrAlreadyAborted || hasErrorLabel(err, driver.TransientTransactionError) ||
+		hasErrorCode(err, errCodeNoSuchTransaction)
+}
+
+// canStillAbort returns true if no branch of txn other than lost may have been committed.
+func canStillAbort(txn *GlobalTxn, lost *Branch) bool {
+	for i := range txn.Branches {
+		b := &txn.Branches[i]
+		if b == lost || b.State == BranchFailed {
+			continue
+		}
+		if b.State != BranchActive || b.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func newGlobalCommitError(txn *GlobalTxn, err error) *GlobalCommitError {
+	cerr := &GlobalCommitError{ID: txn.ID, State: txn.State, Err: err}
+	for _, b := range txn.Branches {
+		switch b.State {
+		case BranchCommitted:
+			cerr.Committed = append(cerr.Committed, b.Cluster)
+		case BranchFailed:
+			cerr.Failed = append(cerr.Failed, b.Cluster)
+		case BranchActive:
+			cerr.InDoubt = append(cerr.InDoubt, b.Cluster)
+		}
+	}
+	return cerr
+}
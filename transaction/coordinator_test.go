@@ -0,0 +1,313 @@
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errNetwork = errors.New("connection reset")
+
+// branchResults scripts the outcome of branch commits and records the calls made.
+type branchResults struct {
+	commit  map[string][]error
+	abort   map[string]error
+	commits []string
+	retried []bool
+	aborts  []string
+}
+
+func (r *branchResults) install(c *TxnCoordinator) {
+	c.commitBranch = func(_ context.Context, cluster string, _ *TxnHandle, retrying bool) error {
+		r.commits = append(r.commits, cluster)
+		r.retried = append(r.retried, retrying)
+		errs := r.commit[cluster]
+		if len(errs) == 0 {
+			return nil
+		}
+		r.commit[cluster] = errs[1:]
+		return errs[0]
+	}
+	c.abortBranch = func(_ context.Context, cluster string, _ *TxnHandle) error {
+		r.aborts = append(r.aborts, cluster)
+		return r.abort[cluster]
+	}
+}
+
+// newTestCoordinator returns a coordinator over three clusters that are never reached, with a
+// memory decision log.
+func newTestCoordinator(t *testing.T, node string) (*TxnCoordinator, func()) {
+	clients := make(map[string]*mongo.Client)
+	for i, cluster := range []string{"a", "b", "c"} {
+		cli, err := mongo.NewClient(options.Client().SetHosts([]string{"127.0.0.1:" + string(rune('1'+i))}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		clients[cluster] = cli
+	}
+	c, err := NewTxnCoordinator(clients, Coordinator().SetDecisionLog(NewMemoryDecisionLog()).SetNodeID(node))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		for _, cli := range clients {
+			_ = cli.Disconnect(context.Background())
+		}
+	}
+}
+
+func beginTestTxn(t *testing.T, c *TxnCoordinator) *GlobalSession {
+	gs, err := c.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cluster := range c.Clusters() {
+		if gs.Session(cluster) == nil || gs.Token(cluster) == "" {
+			t.Fatalf("no branch on cluster %s", cluster)
+		}
+	}
+	return gs
+}
+
+func loadTestTxn(t *testing.T, c *TxnCoordinator, id string) *GlobalTxn {
+	txn, err := c.DecisionLog().Load(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func branchStates(txn *GlobalTxn) []BranchState {
+	var states []BranchState
+	for _, b := range txn.Branches {
+		states = append(states, b.State)
+	}
+	return states
+}
+
+func TestNewTxnCoordinatorErrors(t *testing.T) {
+	if _, err := NewTxnCoordinator(nil, Coordinator().SetDecisionLog(NewMemoryDecisionLog())); err != ErrNoClusters {
+		t.Errorf("expected ErrNoClusters, got %v", err)
+	}
+	cli, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTxnCoordinator(map[string]*mongo.Client{"a": cli}); err != ErrNoDecisionLog {
+		t.Errorf("expected ErrNoDecisionLog, got %v", err)
+	}
+}
+
+func TestCoordinatorCommit(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{}
+	results.install(c)
+	ctx := context.Background()
+
+	gs := beginTestTxn(t, c)
+	if txn := loadTestTxn(t, c, gs.ID()); txn.State != GlobalActive || len(txn.Branches) != 3 {
+		t.Fatalf("unexpected record after begin: %+v", txn)
+	}
+
+	if err := c.Commit(ctx, gs); err != nil {
+		t.Fatal(err)
+	}
+	txn := loadTestTxn(t, c, gs.ID())
+	if txn.State != GlobalCommitted {
+		t.Errorf("expected %s, got %s", GlobalCommitted, txn.State)
+	}
+	if !reflect.DeepEqual(results.commits, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected commits %v", results.commits)
+	}
+	if gs.Session("a") != nil {
+		t.Error("sessions were not released")
+	}
+
+	// committing again is a no-op, aborting is refused.
+	if err := c.Commit(ctx, gs); err != nil {
+		t.Errorf("expected no error committing again, got %v", err)
+	}
+	if err := c.Abort(ctx, gs); err != ErrGlobalTxnDone {
+		t.Errorf("expected ErrGlobalTxnDone, got %v", err)
+	}
+}
+
+func TestCoordinatorAbortsWhenFirstBranchIsLost(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{commit: map[string][]error{"a": {ErrLeaseExpired}}}
+	results.install(c)
+
+	gs := beginTestTxn(t, c)
+	err := c.Commit(context.Background(), gs)
+	cerr, ok := err.(*GlobalCommitError)
+	if !ok || cerr.State != GlobalAborted || !reflect.DeepEqual(cerr.Failed, []string{"a"}) || cerr.Err != ErrLeaseExpired {
+		t.Fatalf("expected an aborted global transaction, got %v", err)
+	}
+
+	txn := loadTestTxn(t, c, gs.ID())
+	if txn.State != GlobalAborted {
+		t.Errorf("expected %s, got %s", GlobalAborted, txn.State)
+	}
+	if !reflect.DeepEqual(branchStates(txn), []BranchState{BranchFailed, BranchAborted, BranchAborted}) {
+		t.Errorf("unexpected branch states %v", branchStates(txn))
+	}
+	if !reflect.DeepEqual(results.aborts, []string{"b", "c"}) {
+		t.Errorf("unexpected aborts %v", results.aborts)
+	}
+}
+
+func TestCoordinatorPartialCommit(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{commit: map[string][]error{"b": {ErrLeaseExpired}}}
+	results.install(c)
+	ctx := context.Background()
+
+	gs := beginTestTxn(t, c)
+	err := c.Commit(ctx, gs)
+	cerr, ok := err.(*GlobalCommitError)
+	if !ok || cerr.State != GlobalPartial || !reflect.DeepEqual(cerr.Committed, []string{"a", "c"}) ||
+		!reflect.DeepEqual(cerr.Failed, []string{"b"}) {
+		t.Fatalf("expected a partial commit, got %v", err)
+	}
+
+	partial, err := c.PartialTransactions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partial) != 1 || partial[0].ID != gs.ID() || partial[0].Branches[1].Error == "" {
+		t.Fatalf("expected the partial transaction with its error, got %+v", partial)
+	}
+
+	if err := c.MarkRepaired(ctx, gs.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MarkRepaired(ctx, gs.ID()); err != ErrNotPartial {
+		t.Errorf("expected ErrNotPartial, got %v", err)
+	}
+	if partial, _ = c.PartialTransactions(ctx); len(partial) != 0 {
+		t.Errorf("repaired transaction is still partial")
+	}
+}
+
+func TestCoordinatorRecover(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{commit: map[string][]error{"b": {errNetwork}}}
+	results.install(c)
+	ctx := context.Background()
+
+	// the outcome of b is unknown, the decision to commit stands.
+	inDoubt := beginTestTxn(t, c)
+	err := c.Commit(ctx, inDoubt)
+	cerr, ok := err.(*GlobalCommitError)
+	if !ok || cerr.State != GlobalCommitting || !reflect.DeepEqual(cerr.InDoubt, []string{"b"}) || cerr.Err != errNetwork {
+		t.Fatalf("expected b in doubt, got %v", err)
+	}
+
+	// the coordinator crashed before deciding.
+	undecided := beginTestTxn(t, c)
+
+	// another coordinator's transactions are left alone.
+	other, closeOther := newTestCoordinator(t, "node2")
+	defer closeOther()
+	other.log = c.log
+	(&branchResults{}).install(other)
+	foreign := beginTestTxn(t, other)
+
+	results.commits, results.retried = nil, nil
+	recovered, err := c.Recover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 2 {
+		t.Fatalf("expected 2 recovered transactions, got %d", len(recovered))
+	}
+	for _, r := range recovered {
+		if r.Err != nil {
+			t.Errorf("recover %s failed: %v", r.Txn.ID, r.Err)
+		}
+	}
+
+	if txn := loadTestTxn(t, c, inDoubt.ID()); txn.State != GlobalCommitted {
+		t.Errorf("expected in doubt transaction to be committed, got %s", txn.State)
+	}
+	if !reflect.DeepEqual(results.commits, []string{"b"}) || !results.retried[0] {
+		t.Errorf("expected a retried commit of b, got %v %v", results.commits, results.retried)
+	}
+	if txn := loadTestTxn(t, c, undecided.ID()); txn.State != GlobalAborted {
+		t.Errorf("expected undecided transaction to be aborted, got %s", txn.State)
+	}
+	if txn := loadTestTxn(t, c, foreign.ID()); txn.State != GlobalActive {
+		t.Errorf("expected foreign transaction to be untouched, got %s", txn.State)
+	}
+}
+
+func TestMemoryDecisionLogCopies(t *testing.T) {
+	log := NewMemoryDecisionLog()
+	ctx := context.Background()
+	txn := &GlobalTxn{ID: "1", Coordinator: "n", State: GlobalActive, Branches: []Branch{{Cluster: "a", State: BranchActive}}}
+	if err := log.Save(ctx, txn); err != nil {
+		t.Fatal(err)
+	}
+	txn.Branches[0].State = BranchCommitted
+
+	loaded, err := log.Load(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Branches[0].State != BranchActive {
+		t.Error("the log shares its record with the caller")
+	}
+	if _, err := log.Load(ctx, "2"); err != ErrGlobalTxnNotFound {
+		t.Errorf("expected ErrGlobalTxnNotFound, got %v", err)
+	}
+}
+
+func TestCoordinatorAbort(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{}
+	results.install(c)
+	ctx := context.Background()
+
+	gs := beginTestTxn(t, c)
+	if err := c.Abort(ctx, gs); err != nil {
+		t.Fatal(err)
+	}
+	if txn := loadTestTxn(t, c, gs.ID()); txn.State != GlobalAborted {
+		t.Errorf("expected %s, got %s", GlobalAborted, txn.State)
+	}
+	if len(results.commits) != 0 || !reflect.DeepEqual(results.aborts, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected calls, commits %v aborts %v", results.commits, results.aborts)
+	}
+	if err := c.Commit(ctx, gs); err != ErrGlobalTxnDone {
+		t.Errorf("expected ErrGlobalTxnDone, got %v", err)
+	}
+}
+
+func TestCoordinatorAbortAfterBranchCommitted(t *testing.T) {
+	c, closeFn := newTestCoordinator(t, "node1")
+	defer closeFn()
+	results := &branchResults{abort: map[string]error{"b": ErrAlreadyCommitted}}
+	results.install(c)
+
+	gs := beginTestTxn(t, c)
+	err := c.Abort(context.Background(), gs)
+	cerr, ok := err.(*GlobalCommitError)
+	if !ok || cerr.Err != ErrAlreadyCommitted || cerr.State != GlobalPartial || !reflect.DeepEqual(cerr.Committed, []string{"b"}) {
+		t.Fatalf("expected a partial transaction committed on b, got %v", err)
+	}
+	if txn := loadTestTxn(t, c, gs.ID()); txn.State != GlobalPartial {
+		t.Errorf("expected %s, got %s", GlobalPartial, txn.State)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ExportCursor encodes cur, a cursor opened inside a distributed transaction, so that another
+// node can continue it with ResumeCursor. The documents cur fetched but did not return yet are
+// part of the encoded cursor. cur must not be used or closed afterwards: closing it kills the
+// cursor on the server.
+//
+// The encoded cursor is not signed. The server only accepts getMore for the cursor from the
+// logical session that opened it, so it is useless without a token of the transaction.
+func ExportCursor(cur *mongo.Cursor) (string, error) {
+	info, err := mongo.TxnExportCursor(cur)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := bson.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("encode cursor failed, err: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ResumeCursor rebuilds a cursor exported by ExportCursor. sess must be a session of the
+// transaction the cursor was opened in, as returned by ReloadSession; the cursor sends getMore
+// under it.
+func ResumeCursor(ctx context.Context, sess mongo.Session, cursor string) (*mongo.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("decode cursor failed, err: %v", err)
+	}
+
+	info := new(mongo.TxnCursor)
+	if err := bson.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("decode cursor failed, err: %v", err)
+	}
+
+	return mongo.TxnResumeCursor(ctx, sess, info)
+}
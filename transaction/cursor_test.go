@@ -0,0 +1,14 @@
+package Transaction
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResumeCursorRejectsMalformed(t *testing.T) {
+	for _, cursor := range []string{"not base64!", "aGVsbG8"} {
+		if _, err := ResumeCursor(context.Background(), nil, cursor); err == nil {
+			t.Errorf("expected an error for %q", cursor)
+		}
+	}
+}
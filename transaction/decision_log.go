@@ -0,0 +1,210 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// ErrGlobalTxnNotFound is returned by a DecisionLog that holds no record for a global transaction.
+var ErrGlobalTxnNotFound = errors.New("global transaction not found in the decision log")
+
+// GlobalState is the state of a global transaction recorded in the decision log.
+type GlobalState string
+
+// These constants are the states a global transaction moves through.
+const (
+	// GlobalActive transactions have not been decided yet. They are aborted by Recover.
+	GlobalActive GlobalState = "active"
+	// GlobalCommitting transactions were decided to commit, their branches are being committed.
+	GlobalCommitting GlobalState = "committing"
+	// GlobalAborting transactions were decided to abort, their branches are being aborted.
+	GlobalAborting GlobalState = "aborting"
+	// GlobalCommitted transactions are committed on every cluster.
+	GlobalCommitted GlobalState = "committed"
+	// GlobalAborted transactions are aborted on every cluster.
+	GlobalAborted GlobalState = "aborted"
+	// GlobalPartial transactions are committed on some clusters while the transaction of at least
+	// one other cluster is gone. They need an operator to repair the data.
+	GlobalPartial GlobalState = "partial"
+	// GlobalRepaired transactions were partial and have been repaired by an operator.
+	GlobalRepaired GlobalState = "repaired"
+)
+
+// BranchState is the state of the transaction of a global transaction on one cluster.
+type BranchState string
+
+// These constants are the states a branch moves through.
+const (
+	BranchActive    BranchState = "active"
+	BranchCommitted BranchState = "committed"
+	BranchAborted   BranchState = "aborted"
+	// BranchFailed branches could not be committed because the server dropped their transaction.
+	BranchFailed BranchState = "failed"
+)
+
+// Branch is the transaction of a global transaction on one cluster.
+type Branch struct {
+	Cluster   string      `bson:"cluster"`
+	SessionID []byte      `bson:"lsid"`
+	TxnNumber int64       `bson:"txnNumber"`
+	Options   *TxnOptions `bson:"options,omitempty"`
+	State     BranchState `bson:"state"`
+	Error     string      `bson:"error,omitempty"` // the last error returned by the cluster
+}
+
+func (b *Branch) handle() *TxnHandle {
+	return &TxnHandle{SessionID: b.SessionID, TxnNumber: b.TxnNumber, Options: b.Options}
+}
+
+// GlobalTxn is the record of a global transaction in the decision log.
+type GlobalTxn struct {
+	ID          string      `bson:"_id"`
+	Coordinator string      `bson:"coordinator"`
+	State       GlobalState `bson:"state"`
+	Branches    []Branch    `bson:"branches"`
+	CreatedAt   time.Time   `bson:"createdAt"`
+	UpdatedAt   time.Time   `bson:"updatedAt"`
+}
+
+// DecisionLog durably records global transactions and the decisions taken for them. A
+// TxnCoordinator saves the decision to commit before committing any branch, so that a
+// coordinator restarting after a crash can finish the transaction.
+type DecisionLog interface {
+	// Save inserts or replaces the record of a global transaction. The record must be durable
+	// once Save returns.
+	Save(ctx context.Context, txn *GlobalTxn) error
+	// Load returns the record of a global transaction, or ErrGlobalTxnNotFound.
+	Load(ctx context.Context, id string) (*GlobalTxn, error)
+	// Find returns the records of the given coordinator that are in one of the given states.
+	Find(ctx context.Context, coordinator string, states ...GlobalState) ([]*GlobalTxn, error)
+}
+
+// collectionDecisionLog is a DecisionLog backed by a MongoDB collection.
+type collectionDecisionLog struct {
+	coll *mongo.Collection
+}
+
+// NewCollectionDecisionLog creates a DecisionLog backed by coll. Records are written with a
+// majority write concern, outside of any transaction. coll should live on a cluster that does
+// not take part in the global transactions, or at least not be written to by anything else.
+func NewCollectionDecisionLog(coll *mongo.Collection) (DecisionLog, error) {
+	majority, err := coll.Clone(options.Collection().SetWriteConcern(writeconcern.New(writeconcern.WMajority())))
+	if err != nil {
+		return nil, err
+	}
+	return &collectionDecisionLog{coll: majority}, nil
+}
+
+func (l *collectionDecisionLog) Save(ctx context.Context, txn *GlobalTxn) error {
+	_, err := l.coll.ReplaceOne(mongo.TxnContextWithoutSession(ctx), bson.M{"_id": txn.ID}, txn,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (l *collectionDecisionLog) Load(ctx context.Context, id string) (*GlobalTxn, error) {
+	txn := new(GlobalTxn)
+	err := l.coll.FindOne(mongo.TxnContextWithoutSession(ctx), bson.M{"_id": id}).Decode(txn)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrGlobalTxnNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (l *collectionDecisionLog) Find(ctx context.Context, coordinator string, states ...GlobalState) ([]*GlobalTxn, error) {
+	ctx = mongo.TxnContextWithoutSession(ctx)
+	cursor, err := l.coll.Find(ctx, bson.M{"coordinator": coordinator, "state": bson.M{"$in": states}},
+		options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var txns []*GlobalTxn
+	for cursor.Next(ctx) {
+		txn := new(GlobalTxn)
+		if err := cursor.Decode(txn); err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, cursor.Err()
+}
+
+// memoryDecisionLog is a DecisionLog that keeps its records in memory.
+type memoryDecisionLog struct {
+	mu   sync.Mutex
+	txns map[string]*GlobalTxn
+}
+
+// NewMemoryDecisionLog creates a DecisionLog that keeps its records in memory. It does not
+// survive a restart of the process, so it only suits tests and coordinators that accept losing
+// the ability to recover.
+func NewMemoryDecisionLog() DecisionLog {
+	return &memoryDecisionLog{txns: make(map[string]*GlobalTxn)}
+}
+
+func (l *memoryDecisionLog) Save(_ context.Context, txn *GlobalTxn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.txns[txn.ID] = copyGlobalTxn(txn)
+	return nil
+}
+
+func (l *memoryDecisionLog) Load(_ context.Context, id string) (*GlobalTxn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	txn, ok := l.txns[id]
+	if !ok {
+		return nil, ErrGlobalTxnNotFound
+	}
+	return copyGlobalTxn(txn), nil
+}
+
+func (l *memoryDecisionLog) Find(_ context.Context, coordinator string, states ...GlobalState) ([]*GlobalTxn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var txns []*GlobalTxn
+	for _, txn := range l.txns {
+		if txn.Coordinator != coordinator {
+			continue
+		}
+		for _, state := range states {
+			if txn.State == state {
+				txns = append(txns, copyGlobalTxn(txn))
+				break
+			}
+		}
+	}
+	sort.Slice(txns, func(i, j int) bool { return txns[i].CreatedAt.Before(txns[j].CreatedAt) })
+	return txns, nil
+}
+
+func copyGlobalTxn(txn *GlobalTxn) *GlobalTxn {
+	c := *txn
+	c.Branches = append([]Branch(nil), txn.Branches...)
+	return &c
+}
@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"net/http"
+)
+
+// Middleware returns an http.Handler that joins the transaction named by the TokenKey header of
+// each request. The request context handed to next is a mongo.SessionContext bound to the
+// reloaded session and carries the token, so it can be passed to collection methods as is and
+// is propagated by Transport. Requests without the header are passed through untouched. The
+// reloaded session is released when next returns.
+func (m *TxnManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sess, err := m.Join(r.Context(), HeaderCarrier(r.Header))
+		if err != nil {
+			http.Error(w, err.Error(), joinErrorStatus(err))
+			return
+		}
+		if sess == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer m.ReleaseSession(ctx, sess)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// joinErrorStatus maps the errors of Join to HTTP status codes.
+func joinErrorStatus(err error) int {
+	switch err {
+	case ErrInvalidToken, ErrUnknownTokenKey:
+		return http.StatusBadRequest
+	case ErrTokenExpired, ErrTokenReplayed, ErrLeaseExpired:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Transport is an http.RoundTripper that adds the transaction token carried by the request
+// context to outgoing requests as the TokenKey header.
+type Transport struct {
+	// Base is the RoundTripper used to send requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	token, ok := TokenFromContext(r.Context())
+	if !ok {
+		return base.RoundTrip(r)
+	}
+
+	// a RoundTripper must not modify the request it is given.
+	r2 := r.Clone(r.Context())
+	HeaderCarrier(r2.Header).Set(TokenKey, token)
+	return base.RoundTrip(r2)
+}
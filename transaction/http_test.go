@@ -0,0 +1,102 @@
+package Transaction
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCarriers(t *testing.T) {
+	ctx := ContextWithToken(context.Background(), "token")
+	for name, carrier := range map[string]Carrier{
+		"header": HeaderCarrier(http.Header{}),
+		"map":    MapCarrier{},
+	} {
+		if !Inject(ctx, carrier) {
+			t.Errorf("%s: token not injected", name)
+		}
+		if got := Extract(carrier); got != "token" {
+			t.Errorf("%s: expected token, got %q", name, got)
+		}
+	}
+
+	if Inject(context.Background(), MapCarrier{}) {
+		t.Error("injected a token from a context without one")
+	}
+}
+
+func TestTransportInjectsToken(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TokenKey)
+	}))
+	defer srv.Close()
+
+	cli := &http.Client{Transport: &Transport{}}
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ContextWithToken(req.Context(), "token"))
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got != "token" {
+		t.Errorf("expected token header, got %q", got)
+	}
+	if req.Header.Get(TokenKey) != "" {
+		t.Error("transport modified the original request")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+
+	called := false
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+		called bool
+	}{
+		{"no transaction", "", http.StatusOK, true},
+		{"forged token", "v1.k1.payload.signature", http.StatusBadRequest, false},
+		{"unknown key", "v1.k2.payload.signature", http.StatusBadRequest, false},
+	}
+	for _, tc := range cases {
+		called = false
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if tc.token != "" {
+			req.Header.Set(TokenKey, tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status || called != tc.called {
+			t.Errorf("%s: expected status %d and called %v, got %d and %v", tc.name, tc.status, tc.called, rec.Code, called)
+		}
+	}
+
+	h := newTestHandle()
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.revoke(h)
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(TokenKey, token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("replayed token: expected status %d, got %d", http.StatusConflict, rec.Code)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// ErrLeaseExpired is returned when a transaction is reloaded after its lease expired.
+var ErrLeaseExpired = errors.New("transaction lease expired")
+
+// ErrSweeperRunning is returned when StartSweeper is called twice on the same manager.
+var ErrSweeperRunning = errors.New("transaction sweeper already running")
+
+// ExpiredTxn describes a transaction aborted by the sweeper because its lease expired.
+type ExpiredTxn struct {
+	ID       string
+	Owner    string    // the node that started the transaction, empty if it is unknown
+	Deadline time.Time // the lease deadline that was missed
+	Err      error     // set if aborting the transaction on the server failed
+}
+
+// lease is the in-process view of a transaction lease.
+type lease struct {
+	handle   *TxnHandle
+	deadline time.Time
+}
+
+// leaseTracker keeps the leases of the transactions this process started or reloaded.
+type leaseTracker struct {
+	mu     sync.Mutex
+	leases map[string]*lease
+}
+
+func newLeaseTracker() *leaseTracker {
+	return &leaseTracker{leases: make(map[string]*lease)}
+}
+
+// renew extends the lease of a transaction to deadline, adding it to the tracker if needed. It
+// returns false if the tracker already holds a lease for the transaction that has expired.
+func (t *leaseTracker) renew(h *TxnHandle, deadline time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := timeNow()
+	if l, ok := t.leases[h.ID()]; ok {
+		if !now.Before(l.deadline) {
+			return false
+		}
+		l.deadline = deadline
+		return true
+	}
+
+	t.leases[h.ID()] = &lease{handle: h, deadline: deadline}
+	return true
+}
+
+func (t *leaseTracker) remove(h *TxnHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.leases, h.ID())
+}
+
+// expired removes and returns the leases whose deadline has passed.
+func (t *leaseTracker) expired(now time.Time) []*lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var expired []*lease
+	for id, l := range t.leases {
+		if !now.Before(l.deadline) {
+			expired = append(expired, l)
+			delete(t.leases, id)
+		}
+	}
+	return expired
+}
+
+// renewLease extends the lease of a transaction by the configured lease duration. With a
+// registry the lease is shared by all nodes; without one only this process sees renewals.
+func (m *TxnManager) renewLease(ctx context.Context, handle *TxnHandle) error {
+	deadline := timeNow().Add(*m.opts.LeaseDuration)
+	if !m.leases.renew(handle, deadline) {
+		return ErrLeaseExpired
+	}
+
+	if m.registry == nil {
+		return nil
+	}
+	ok, err := m.registry.renewLease(ctx, handle.ID(), deadline)
+	if err != nil {
+		return fmt.Errorf("renew lease of transaction: %s failed, err: %v", handle.ID(), err)
+	}
+	if !ok {
+		m.leases.remove(handle)
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// StartSweeper starts a background goroutine that aborts transactions whose lease expired every
+// interval, and reports each of them to onExpire if it is not nil. It handles the leases tracked
+// in this process and, when a registry is configured, the expired entries of every node. The
+// sweeper runs until Close is called.
+//
+// Without a registry leases are per process: a node only knows about the renewals it made itself,
+// so every node that reloads a transaction must keep it alive within the lease duration, and the
+// sweeper of a node may abort a transaction another node is still using. Configure a registry
+// when transactions span nodes. Each sweep is given interval to complete, so a sweep blocked on a
+// transaction that is in use in this process gives up instead of stalling the sweeper.
+func (m *TxnManager) StartSweeper(interval time.Duration, onExpire func(ExpiredTxn)) error {
+	m.sweepMu.Lock()
+	defer m.sweepMu.Unlock()
+
+	if m.sweepStop != nil {
+		return ErrSweeperRunning
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.sweepStop, m.sweepDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				for _, exp := range m.Sweep(ctx) {
+					if onExpire != nil {
+						onExpire(exp)
+					}
+				}
+				cancel()
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops the sweeper if it is running.
+func (m *TxnManager) Close() {
+	m.sweepMu.Lock()
+	defer m.sweepMu.Unlock()
+
+	if m.sweepStop == nil {
+		return
+	}
+	close(m.sweepStop)
+	<-m.sweepDone
+	m.sweepStop, m.sweepDone = nil, nil
+}
+
+// Sweep aborts the transactions whose lease expired and returns them. It is what the sweeper
+// runs on every tick and may be called directly instead of starting the sweeper.
+func (m *TxnManager) Sweep(ctx context.Context) []ExpiredTxn {
+	now := timeNow()
+	swept := make(map[string]bool)
+
+	var result []ExpiredTxn
+	if m.registry != nil {
+		entries, err := m.registry.expired(ctx, now)
+		if err != nil {
+			result = append(result, ExpiredTxn{Err: fmt.Errorf("list expired transactions failed, err: %v", err)})
+		}
+		for _, entry := range entries {
+			// claim the entry first, so that only one sweeper aborts it.
+			claimed, err := m.registry.claimExpired(ctx, entry.ID, now)
+			if err != nil || !claimed {
+				continue
+			}
+			swept[entry.ID] = true
+			m.leases.remove(entry.handle())
+			result = append(result, ExpiredTxn{
+				ID:       entry.ID,
+				Owner:    entry.Owner,
+				Deadline: entry.LeaseExpiresAt,
+				Err:      m.expire(ctx, entry.handle()),
+			})
+		}
+	}
+
+	for _, l := range m.leases.expired(now) {
+		if swept[l.handle.ID()] {
+			continue
+		}
+		exp := ExpiredTxn{ID: l.handle.ID(), Deadline: l.deadline}
+		if m.registry != nil {
+			// another node renewed the lease in the meantime, or already swept it.
+			claimed, err := m.registry.claimExpired(ctx, exp.ID, now)
+			if err != nil || !claimed {
+				continue
+			}
+		}
+		exp.Err = m.expire(ctx, l.handle)
+		result = append(result, exp)
+	}
+	return result
+}
+
+// expire aborts a transaction on the server and rejects its tokens from now on. Its outcome is
+// only recorded once it is known.
+func (m *TxnManager) expire(ctx context.Context, handle *TxnHandle) (err error) {
+	defer func() { m.publish(ctx, event.TransactionExpired, handle, err) }()
+
+	m.revoke(handle)
+
+	// without a registry the lease is only known to this node, another node may have finished the
+	// transaction. With one, claiming the expired entry ruled that out.
+	if m.registry == nil {
+		if state, ok := m.outcome(ctx, handle, true); ok {
+			m.finish(handle, state)
+			if state == TxnStateCommitted {
+				return ErrAlreadyCommitted
+			}
+			return nil
+		}
+	}
+
+	sess, err := m.reloadSession(ctx, handle, false)
+	if err != nil {
+		return m.resolveExpire(ctx, handle, err)
+	}
+	defer m.ReleaseSession(ctx, sess)
+
+	if err := sess.AbortTransaction(ctx); err != nil {
+		return m.resolveExpire(ctx, handle, &TxnError{Op: "abort", ID: handle.ID(), Err: err})
+	}
+
+	// the driver ignores the errors of abortTransaction, so the transaction may have been
+	// committed by another node in the meantime. If that cannot be told, its outcome stays unknown.
+	rec, err := m.sessionRecord(ctx, handle.SessionID)
+	if err != nil {
+		return &TxnError{Op: "abort", ID: handle.ID(), Err: err}
+	}
+	if recordStatus(rec, handle.TxnNumber) == TxnStatusCommitted {
+		m.finish(handle, TxnStateCommitted)
+		return ErrAlreadyCommitted
+	}
+	m.finish(handle, TxnStateAborted)
+	return nil
+}
+
+// resolveExpire returns the result of the abort of an expired transaction that failed with err.
+// With a registry the claim of the sweeper already recorded the transaction as aborted, so err is
+// returned as is.
+func (m *TxnManager) resolveExpire(ctx context.Context, handle *TxnHandle, err error) error {
+	if m.registry != nil {
+		return err
+	}
+
+	switch err = m.resolveAbort(ctx, handle, err); err {
+	case nil:
+		m.finish(handle, TxnStateAborted)
+	case ErrAlreadyCommitted:
+		m.finish(handle, TxnStateCommitted)
+	}
+	return err
+}
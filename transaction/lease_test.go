@@ -0,0 +1,120 @@
+package Transaction
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaseTracker(t *testing.T) {
+	tracker := newLeaseTracker()
+	h := newTestHandle()
+	now := timeNow()
+
+	if !tracker.renew(h, now.Add(time.Minute)) {
+		t.Fatal("new lease rejected")
+	}
+	if !tracker.renew(h, now.Add(2*time.Minute)) {
+		t.Fatal("live lease could not be renewed")
+	}
+	if expired := tracker.expired(now.Add(90 * time.Second)); len(expired) != 0 {
+		t.Errorf("renewed lease reported expired: %v", expired)
+	}
+
+	expired := tracker.expired(now.Add(3 * time.Minute))
+	if len(expired) != 1 || expired[0].handle.ID() != h.ID() {
+		t.Fatalf("expected lease of %s to expire, got %v", h.ID(), expired)
+	}
+	if len(tracker.expired(now.Add(3*time.Minute))) != 0 {
+		t.Error("expired lease returned twice")
+	}
+}
+
+func TestSweepRevokesExpiredTransactions(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks).SetLeaseDuration(time.Second))
+
+	h := newTestHandle()
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.leases.renew(h, timeNow().Add(time.Second))
+
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return time.Now().Add(5 * time.Second) }
+
+	if _, err := m.ReloadSession(context.Background(), token); err != ErrLeaseExpired {
+		t.Errorf("expected ErrLeaseExpired, got %v", err)
+	}
+
+	expired := m.Sweep(context.Background())
+	if len(expired) != 1 || expired[0].ID != h.ID() {
+		t.Fatalf("expected %s to be swept, got %+v", h.ID(), expired)
+	}
+	// the client is not connected, so the abort itself fails and is reported.
+	if expired[0].Err == nil {
+		t.Error("expected abort error to be reported")
+	}
+	if _, err := m.verifyToken(token); err != ErrTokenReplayed {
+		t.Errorf("expected swept transaction token to be rejected, got %v", err)
+	}
+	if state, ok := m.guardOutcome(h); ok {
+		t.Errorf("expected the outcome of the failed abort to stay unknown, got %s", state)
+	}
+}
+
+func TestSweepKeepsCommittedTransactions(t *testing.T) {
+	m := newOfflineManager(t)
+
+	// another node committed the transaction and told the shared guard.
+	h := newTestHandle()
+	m.guard.(OutcomeGuard).Finish(h, TxnStateCommitted)
+	m.leases.renew(h, timeNow().Add(-time.Second))
+
+	expired := m.Sweep(context.Background())
+	if len(expired) != 1 || expired[0].Err != ErrAlreadyCommitted {
+		t.Fatalf("expected %s to be reported as committed, got %+v", h.ID(), expired)
+	}
+	if state, _ := m.guardOutcome(h); state != TxnStateCommitted {
+		t.Errorf("expected the transaction to stay committed, got %s", state)
+	}
+}
+
+func TestStartSweeperTwice(t *testing.T) {
+	m := newOfflineManager(t)
+	defer m.Close()
+
+	if err := m.StartSweeper(time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.StartSweeper(time.Hour, nil); err != ErrSweeperRunning {
+		t.Errorf("expected ErrSweeperRunning, got %v", err)
+	}
+}
+
+func TestSweeperGivesUpOnBusyTransaction(t *testing.T) {
+	m := newOfflineManager(t, Manager().SetConcurrency(ConcurrencySerialize))
+	defer m.Close()
+
+	// a session of this process holds the transaction, so the sweeper cannot reload it.
+	h := newTestHandle()
+	if err := m.locker.acquire(context.Background(), h.ID(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer m.locker.release(h.ID())
+	m.leases.renew(h, timeNow().Add(-time.Second))
+
+	expired := make(chan ExpiredTxn, 1)
+	if err := m.StartSweeper(50*time.Millisecond, func(exp ExpiredTxn) { expired <- exp }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case exp := <-expired:
+		if exp.ID != h.ID() || exp.Err != context.DeadlineExceeded {
+			t.Errorf("expected the sweep of %s to time out, got %+v", h.ID(), exp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sweeper is blocked on the transaction lock")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrTransactionBusy is returned in ConcurrencyFailFast mode when another session of this
+// process is using the transaction.
+var ErrTransactionBusy = errors.New("transaction is in use by another session")
+
+// ConcurrencyMode controls how a TxnManager handles several sessions of this process using the
+// same transaction at the same time. The server rejects concurrent operations on a transaction,
+// so running them in parallel produces WriteConflict and NoSuchTransaction errors.
+type ConcurrencyMode uint8
+
+// These constants are the valid concurrency modes.
+const (
+	// ConcurrencyNone lets sessions of the same transaction run in parallel.
+	ConcurrencyNone ConcurrencyMode = iota
+	// ConcurrencySerialize makes StartTransaction, ReloadSession, CommitTransaction and
+	// AbortTransaction wait until no other session of this process holds the transaction.
+	ConcurrencySerialize
+	// ConcurrencyFailFast makes them fail with ErrTransactionBusy instead of waiting.
+	ConcurrencyFailFast
+)
+
+// txnLock is a per-transaction lock. The buffered channel holds a token while the lock is held,
+// so waiting for it can be combined with a context.
+type txnLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// txnLocker serializes the sessions of this process that use the same transaction. A session
+// holds the lock of its transaction from the moment it is created until it is released.
+type txnLocker struct {
+	mu       sync.Mutex
+	locks    map[string]*txnLock
+	sessions map[mongo.Session]string
+}
+
+func newTxnLocker() *txnLocker {
+	return &txnLocker{
+		locks:    make(map[string]*txnLock),
+		sessions: make(map[mongo.Session]string),
+	}
+}
+
+// acquire takes the lock of the transaction with the given id, waiting for it unless failFast is
+// true.
+func (l *txnLocker) acquire(ctx context.Context, id string, failFast bool) error {
+	l.mu.Lock()
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &txnLock{ch: make(chan struct{}, 1)}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	if failFast {
+		select {
+		case lock.ch <- struct{}{}:
+			return nil
+		default:
+			l.unref(id, lock)
+			return ErrTransactionBusy
+		}
+	}
+
+	select {
+	case lock.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(id, lock)
+		return ctx.Err()
+	}
+}
+
+// bind records that sess holds the lock of the transaction with the given id.
+func (l *txnLocker) bind(sess mongo.Session, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions[sess] = id
+}
+
+// releaseSession releases the lock held by sess, if any.
+func (l *txnLocker) releaseSession(sess mongo.Session) {
+	l.mu.Lock()
+	id, ok := l.sessions[sess]
+	delete(l.sessions, sess)
+	l.mu.Unlock()
+
+	if ok {
+		l.release(id)
+	}
+}
+
+func (l *txnLocker) release(id string) {
+	l.mu.Lock()
+	lock, ok := l.locks[id]
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	<-lock.ch
+	l.unref(id, lock)
+}
+
+func (l *txnLocker) unref(id string, lock *txnLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, id)
+	}
+}
@@ -0,0 +1,99 @@
+package Transaction
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestTxnLockerSerializes(t *testing.T) {
+	l := newTxnLocker()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.acquire(ctx, "txn", false); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			l.release("txn")
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("expected at most one holder at a time, got %d", maxRunning)
+	}
+	if len(l.locks) != 0 {
+		t.Errorf("expected all locks to be dropped, got %d", len(l.locks))
+	}
+}
+
+func TestTxnLockerFailFastAndCancel(t *testing.T) {
+	l := newTxnLocker()
+	ctx := context.Background()
+
+	if err := l.acquire(ctx, "txn", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(ctx, "txn", true); err != ErrTransactionBusy {
+		t.Errorf("expected ErrTransactionBusy, got %v", err)
+	}
+	if err := l.acquire(ctx, "other", true); err != nil {
+		t.Errorf("lock of another transaction is busy: %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(cctx, "txn", false); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	l.release("txn")
+	if err := l.acquire(ctx, "txn", true); err != nil {
+		t.Errorf("released lock is still busy: %v", err)
+	}
+}
+
+func TestTxnLockerReleaseSession(t *testing.T) {
+	l := newTxnLocker()
+	ctx := context.Background()
+	var sess mongo.Session = &fakeSession{}
+
+	if err := l.acquire(ctx, "txn", true); err != nil {
+		t.Fatal(err)
+	}
+	l.bind(sess, "txn")
+	l.releaseSession(sess)
+	// releasing twice is a no-op
+	l.releaseSession(sess)
+
+	if err := l.acquire(ctx, "txn", true); err != nil {
+		t.Errorf("lock still held after the session was released: %v", err)
+	}
+}
+
+// fakeSession is a distinct, comparable mongo.Session used as a map key.
+type fakeSession struct {
+	mongo.Session
+}
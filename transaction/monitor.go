@@ -0,0 +1,43 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// publish reports an event about the transaction described by handle to the monitor of the
+// manager. err is the error the operation failed with, if any.
+func (m *TxnManager) publish(ctx context.Context, typ string, handle *TxnHandle, err error) {
+	if m.monitor == nil || m.monitor.Event == nil {
+		return
+	}
+
+	evt := &event.TransactionEvent{
+		Type:      typ,
+		TxnID:     handle.ID(),
+		TxnNumber: handle.TxnNumber,
+		Node:      m.node,
+		Outcome:   event.OutcomeSucceeded,
+	}
+	if !handle.StartedAt.IsZero() {
+		evt.Duration = timeNow().Sub(handle.StartedAt)
+	}
+	if err != nil {
+		evt.Outcome = event.OutcomeFailed
+		evt.Failure = err.Error()
+	}
+	m.monitor.Event(ctx, evt)
+}
@@ -0,0 +1,90 @@
+package Transaction
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type eventRecorder struct {
+	events []*event.TransactionEvent
+}
+
+func (r *eventRecorder) monitor() *event.TransactionMonitor {
+	return &event.TransactionMonitor{
+		Event: func(_ context.Context, evt *event.TransactionEvent) { r.events = append(r.events, evt) },
+	}
+}
+
+func TestManagerMonitor(t *testing.T) {
+	clientMonitor, managerMonitor := new(eventRecorder).monitor(), new(eventRecorder).monitor()
+	cli, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017").SetTransactionMonitor(clientMonitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewTxnManager(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.monitor != clientMonitor {
+		t.Error("expected the manager to default to the monitor of the client")
+	}
+
+	m, err = NewTxnManager(cli, Manager().SetMonitor(managerMonitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.monitor != managerMonitor {
+		t.Error("expected the monitor of the manager options to be used")
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	rec := new(eventRecorder)
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks).SetLeaseDuration(time.Second).SetNodeID("node-1").SetMonitor(rec.monitor()))
+
+	h := newTestHandle()
+	h.StartedAt = timeNow()
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.leases.renew(h, timeNow().Add(time.Second))
+
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return time.Now().Add(5 * time.Second) }
+
+	if _, err := m.ReloadSession(context.Background(), token); err != ErrLeaseExpired {
+		t.Errorf("expected ErrLeaseExpired, got %v", err)
+	}
+	m.Sweep(context.Background())
+
+	if len(rec.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(rec.events))
+	}
+	for i, typ := range []string{event.TransactionReloaded, event.TransactionExpired} {
+		evt := rec.events[i]
+		if evt.Type != typ {
+			t.Errorf("event %d: expected type %s, got %s", i, typ, evt.Type)
+		}
+		if evt.TxnID != h.ID() || evt.TxnNumber != h.TxnNumber || evt.Node != "node-1" {
+			t.Errorf("event %d: unexpected transaction fields %+v", i, evt)
+		}
+		// the client is not connected, so both operations fail.
+		if evt.Outcome != event.OutcomeFailed || evt.Failure == "" {
+			t.Errorf("event %d: expected a failed outcome, got %+v", i, evt)
+		}
+		if evt.Duration < 5*time.Second {
+			t.Errorf("event %d: expected the duration to be measured from the start, got %v", i, evt.Duration)
+		}
+	}
+	if rec.events[0].Failure != ErrLeaseExpired.Error() {
+		t.Errorf("expected the reload to fail with %v, got %s", ErrLeaseExpired, rec.events[0].Failure)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultTokenTTL is the default lifetime of a transaction token. It matches the default
+// transactionLifetimeLimitSeconds of the server.
+var DefaultTokenTTL = 60 * time.Second
+
+// DefaultLeaseDuration is the default time a transaction may stay idle before the sweeper aborts it.
+var DefaultLeaseDuration = 30 * time.Second
+
+// DefaultQuorumTimeout is the default time a commit waits for the participants of a transaction.
+var DefaultQuorumTimeout = 10 * time.Second
+
+// DefaultRelayPollInterval is the default time an OutboxRelay waits between two polls of the outbox.
+var DefaultRelayPollInterval = time.Second
+
+// DefaultRelayBatchSize is the default number of events an OutboxRelay reads from the outbox at once.
+var DefaultRelayBatchSize int32 = 100
+
+// ManagerOptions represents all possible options for creating a TxnManager.
+type ManagerOptions struct {
+	SessionOptions *options.SessionOptions   // The options used for every session the manager starts or reloads.
+	KeySet         *KeySet                   // The keys used to sign and verify transaction tokens. Defaults to a random, process local key.
+	TokenTTL       *time.Duration            // The lifetime of issued transaction tokens. Defaults to DefaultTokenTTL.
+	ReplayGuard    ReplayGuard               // Records finished transactions so their tokens are rejected. Defaults to an in-memory guard.
+	Registry       *mongo.Collection         // The collection every started transaction is recorded in. Disabled by default.
+	NodeID         *string                   // Identifies this node as the owner of the transactions it starts. Defaults to the host name.
+	LeaseDuration  *time.Duration            // How long a transaction lease lasts after it is started or reloaded. Defaults to DefaultLeaseDuration.
+	Concurrency    *ConcurrencyMode          // How sessions of this process sharing a transaction are coordinated. Defaults to ConcurrencyNone.
+	QuorumTimeout  *time.Duration            // How long a commit waits for the participants of the transaction. Defaults to DefaultQuorumTimeout.
+	QuorumPolicy   *QuorumPolicy             // What a commit does when the participants are not done. Defaults to QuorumFail.
+	Monitor        *event.TransactionMonitor // Receives the lifecycle events of the transactions. Defaults to the TransactionMonitor of the client.
+}
+
+// Manager creates a new *ManagerOptions
+func Manager() *ManagerOptions {
+	return &ManagerOptions{
+		TokenTTL:      &DefaultTokenTTL,
+		LeaseDuration: &DefaultLeaseDuration,
+		QuorumTimeout: &DefaultQuorumTimeout,
+	}
+}
+
+// SetSessionOptions sets the options used for every session the manager starts or reloads.
+func (m *ManagerOptions) SetSessionOptions(opts *options.SessionOptions) *ManagerOptions {
+	m.SessionOptions = opts
+	return m
+}
+
+// SetKeySet sets the keys used to sign and verify transaction tokens. Every node that takes part
+// in the same transactions must share the key set.
+func (m *ManagerOptions) SetKeySet(ks *KeySet) *ManagerOptions {
+	m.KeySet = ks
+	return m
+}
+
+// SetTokenTTL sets the lifetime of issued transaction tokens.
+func (m *ManagerOptions) SetTokenTTL(d time.Duration) *ManagerOptions {
+	m.TokenTTL = &d
+	return m
+}
+
+// SetReplayGuard sets the guard that records finished transactions.
+func (m *ManagerOptions) SetReplayGuard(g ReplayGuard) *ManagerOptions {
+	m.ReplayGuard = g
+	return m
+}
+
+// SetRegistry sets the collection every started transaction is recorded in, which enables Recover.
+// The collection should not be written to by anything else.
+func (m *ManagerOptions) SetRegistry(coll *mongo.Collection) *ManagerOptions {
+	m.Registry = coll
+	return m
+}
+
+// SetNodeID sets the id recorded as the owner of the transactions this node starts. It must be
+// unique per node and stable across restarts.
+func (m *ManagerOptions) SetNodeID(id string) *ManagerOptions {
+	m.NodeID = &id
+	return m
+}
+
+// SetLeaseDuration sets how long a transaction lease lasts after it is started or reloaded.
+// Transactions that are not reloaded, committed or aborted within their lease are aborted by the
+// sweeper. Leases are shared by the nodes only through a registry, see StartSweeper.
+func (m *ManagerOptions) SetLeaseDuration(d time.Duration) *ManagerOptions {
+	m.LeaseDuration = &d
+	return m
+}
+
+// SetConcurrency sets how sessions of this process that use the same transaction are coordinated.
+// With ConcurrencySerialize or ConcurrencyFailFast a session holds its transaction until it is
+// released with ReleaseSession, so it must be released before the transaction is committed or
+// aborted from the same process.
+func (m *ManagerOptions) SetConcurrency(mode ConcurrencyMode) *ManagerOptions {
+	m.Concurrency = &mode
+	return m
+}
+
+// SetQuorumTimeout sets how long a commit waits for every registered participant of the
+// transaction to be done. It should be shorter than the lease duration, the lease is not renewed
+// while the commit waits.
+func (m *ManagerOptions) SetQuorumTimeout(d time.Duration) *ManagerOptions {
+	m.QuorumTimeout = &d
+	return m
+}
+
+// SetQuorumPolicy sets what a commit does when a participant failed or the participants are not
+// done within the quorum timeout.
+func (m *ManagerOptions) SetQuorumPolicy(p QuorumPolicy) *ManagerOptions {
+	m.QuorumPolicy = &p
+	return m
+}
+
+// SetMonitor sets the monitor that receives an event whenever this node starts, reloads, commits,
+// aborts or expires a transaction.
+func (m *ManagerOptions) SetMonitor(monitor *event.TransactionMonitor) *ManagerOptions {
+	m.Monitor = monitor
+	return m
+}
+
+// MergeManagerOptions combines the given *ManagerOptions into a single *ManagerOptions in a last one wins fashion.
+func MergeManagerOptions(opts ...*ManagerOptions) *ManagerOptions {
+	m := Manager()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.SessionOptions != nil {
+			m.SessionOptions = opt.SessionOptions
+		}
+		if opt.KeySet != nil {
+			m.KeySet = opt.KeySet
+		}
+		if opt.TokenTTL != nil {
+			m.TokenTTL = opt.TokenTTL
+		}
+		if opt.ReplayGuard != nil {
+			m.ReplayGuard = opt.ReplayGuard
+		}
+		if opt.Registry != nil {
+			m.Registry = opt.Registry
+		}
+		if opt.NodeID != nil {
+			m.NodeID = opt.NodeID
+		}
+		if opt.LeaseDuration != nil {
+			m.LeaseDuration = opt.LeaseDuration
+		}
+		if opt.Concurrency != nil {
+			m.Concurrency = opt.Concurrency
+		}
+		if opt.QuorumTimeout != nil {
+			m.QuorumTimeout = opt.QuorumTimeout
+		}
+		if opt.QuorumPolicy != nil {
+			m.QuorumPolicy = opt.QuorumPolicy
+		}
+		if opt.Monitor != nil {
+			m.Monitor = opt.Monitor
+		}
+	}
+
+	return m
+}
+
+// CoordinatorOptions represents all possible options for creating a TxnCoordinator.
+type CoordinatorOptions struct {
+	ManagerOptions *ManagerOptions // The options of the TxnManager created for every cluster.
+	DecisionLog    DecisionLog     // The log the decisions of global transactions are recorded in. Required.
+	NodeID         *string         // Identifies this coordinator in the decision log. Defaults to the host name.
+}
+
+// Coordinator creates a new *CoordinatorOptions
+func Coordinator() *CoordinatorOptions {
+	return &CoordinatorOptions{}
+}
+
+// SetManagerOptions sets the options of the TxnManager created for every cluster.
+func (c *CoordinatorOptions) SetManagerOptions(opts *ManagerOptions) *CoordinatorOptions {
+	c.ManagerOptions = opts
+	return c
+}
+
+// SetDecisionLog sets the log the decisions of global transactions are recorded in. It must be
+// durable for Recover to finish the global transactions of a crashed coordinator.
+func (c *CoordinatorOptions) SetDecisionLog(log DecisionLog) *CoordinatorOptions {
+	c.DecisionLog = log
+	return c
+}
+
+// SetNodeID sets the id recorded as the coordinator of the global transactions it begins. It must
+// be unique per coordinator and stable across restarts.
+func (c *CoordinatorOptions) SetNodeID(id string) *CoordinatorOptions {
+	c.NodeID = &id
+	return c
+}
+
+// MergeCoordinatorOptions combines the given *CoordinatorOptions into a single *CoordinatorOptions in a last one wins fashion.
+func MergeCoordinatorOptions(opts ...*CoordinatorOptions) *CoordinatorOptions {
+	c := Coordinator()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.ManagerOptions != nil {
+			c.ManagerOptions = opt.ManagerOptions
+		}
+		if opt.DecisionLog != nil {
+			c.DecisionLog = opt.DecisionLog
+		}
+		if opt.NodeID != nil {
+			c.NodeID = opt.NodeID
+		}
+	}
+
+	return c
+}
+
+// RelayOptions represents all possible options for creating an OutboxRelay.
+type RelayOptions struct {
+	Mode         *RelayMode     // How the relay notices new events. Defaults to RelayWatch.
+	PollInterval *time.Duration // How often the outbox is polled. Defaults to DefaultRelayPollInterval.
+	BatchSize    *int32         // How many events are read from the outbox at once. Defaults to DefaultRelayBatchSize.
+	ErrorHandler func(error)    // Called with the errors of the relay, which keeps running. Errors are dropped by default.
+}
+
+// Relay creates a new *RelayOptions
+func Relay() *RelayOptions {
+	return &RelayOptions{}
+}
+
+// SetMode sets how the relay notices new events.
+func (r *RelayOptions) SetMode(mode RelayMode) *RelayOptions {
+	r.Mode = &mode
+	return r
+}
+
+// SetPollInterval sets how often the outbox is polled. With RelayWatch the outbox is still polled
+// at this interval, to pick up the events whose delivery failed and to survive a broken change
+// stream.
+func (r *RelayOptions) SetPollInterval(d time.Duration) *RelayOptions {
+	r.PollInterval = &d
+	return r
+}
+
+// SetBatchSize sets how many events are read from the outbox at once.
+func (r *RelayOptions) SetBatchSize(n int32) *RelayOptions {
+	r.BatchSize = &n
+	return r
+}
+
+// SetErrorHandler sets the function called with the errors of the relay, such as the errors
+// returned by the publisher.
+func (r *RelayOptions) SetErrorHandler(fn func(error)) *RelayOptions {
+	r.ErrorHandler = fn
+	return r
+}
+
+// MergeRelayOptions combines the given *RelayOptions into a single *RelayOptions in a last one wins fashion.
+func MergeRelayOptions(opts ...*RelayOptions) *RelayOptions {
+	r := Relay()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Mode != nil {
+			r.Mode = opt.Mode
+		}
+		if opt.PollInterval != nil {
+			r.PollInterval = opt.PollInterval
+		}
+		if opt.BatchSize != nil {
+			r.BatchSize = opt.BatchSize
+		}
+		if opt.ErrorHandler != nil {
+			r.ErrorHandler = opt.ErrorHandler
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,270 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxEvent is an event document of an outbox collection. Events are written by the
+// transaction that produced them and delivered by an OutboxRelay once it is committed.
+type OutboxEvent struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Topic       string             `bson:"topic"`
+	Key         string             `bson:"key,omitempty"`
+	Payload     bson.Raw           `bson:"payload"`
+	TxnID       string             `bson:"txnId"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+	DeliveredAt *time.Time         `bson:"deliveredAt,omitempty"` // set once the event has been published
+}
+
+// Outbox writes events into an outbox collection as part of a transaction, so they are stored if
+// and only if the transaction commits.
+//
+// The outbox collection should be indexed on {deliveredAt: 1, _id: 1}. Delivered events are kept,
+// a TTL index on deliveredAt can be used to drop them.
+type Outbox struct {
+	coll *mongo.Collection
+}
+
+// NewOutbox creates an Outbox backed by coll.
+func NewOutbox(coll *mongo.Collection) *Outbox {
+	return &Outbox{coll: coll}
+}
+
+// Collection returns the outbox collection.
+func (o *Outbox) Collection() *mongo.Collection {
+	return o.coll
+}
+
+// Add writes an event into the outbox inside the transaction sessCtx is bound to, such as the
+// contexts handed out by WithDistributedTransaction, Join and Middleware. payload is marshalled to
+// BSON. It returns the id of the event.
+func (o *Outbox) Add(sessCtx mongo.SessionContext, topic, key string, payload interface{}) (primitive.ObjectID, error) {
+	txnID, err := sessionTxnID(sessCtx)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	doc, err := bson.Marshal(payload)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("marshal outbox event payload failed, err: %v", err)
+	}
+
+	evt := &OutboxEvent{
+		ID:        primitive.NewObjectID(),
+		Topic:     topic,
+		Key:       key,
+		Payload:   doc,
+		TxnID:     txnID,
+		CreatedAt: timeNow(),
+	}
+	if _, err := o.coll.InsertOne(sessCtx, evt); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return evt.ID, nil
+}
+
+// pending returns up to limit events that have not been delivered yet, oldest first.
+func (o *Outbox) pending(ctx context.Context, limit int32) ([]*OutboxEvent, error) {
+	ctx = mongo.TxnContextWithoutSession(ctx)
+	cursor, err := o.coll.Find(ctx, bson.M{"deliveredAt": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []*OutboxEvent
+	for cursor.Next(ctx) {
+		evt := new(OutboxEvent)
+		if err := cursor.Decode(evt); err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return events, cursor.Err()
+}
+
+// markDelivered records that an event has been published. It is the checkpoint of the relay: an
+// event that is not marked is published again.
+func (o *Outbox) markDelivered(ctx context.Context, id primitive.ObjectID) error {
+	_, err := o.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx),
+		bson.M{"_id": id, "deliveredAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deliveredAt": timeNow()}})
+	return err
+}
+
+// Publisher delivers outbox events to a message broker or any other consumer.
+type Publisher interface {
+	// Publish delivers an event. The event is delivered again later if Publish returns an error,
+	// and may be delivered more than once even if it succeeds, so consumers must be idempotent.
+	Publish(ctx context.Context, evt *OutboxEvent) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface.
+type PublisherFunc func(ctx context.Context, evt *OutboxEvent) error
+
+// Publish calls f(ctx, evt).
+func (f PublisherFunc) Publish(ctx context.Context, evt *OutboxEvent) error {
+	return f(ctx, evt)
+}
+
+// RelayMode controls how an OutboxRelay notices new events.
+type RelayMode uint8
+
+// These constants are the valid relay modes.
+const (
+	// RelayWatch watches the outbox collection with a change stream and delivers new events as
+	// soon as they are committed. It needs a replica set or a sharded cluster.
+	RelayWatch RelayMode = iota
+	// RelayPoll polls the outbox collection at the poll interval.
+	RelayPoll
+)
+
+// OutboxRelay delivers the events of an Outbox to a Publisher with at-least-once semantics. Events
+// are published in the order of their ids and marked as delivered once Publish returns, the mark
+// being the checkpoint a restarted relay resumes from. If the publisher fails the relay stops and
+// retries from the failed event at the next poll, so events are not reordered.
+//
+// Several relays may run on the same outbox, for availability, at the cost of more duplicates.
+type OutboxRelay struct {
+	outbox    *Outbox
+	publisher Publisher
+	opts      *RelayOptions
+}
+
+// NewOutboxRelay creates an OutboxRelay that delivers the events of outbox to publisher.
+func NewOutboxRelay(outbox *Outbox, publisher Publisher, opts ...*RelayOptions) *OutboxRelay {
+	r := &OutboxRelay{
+		outbox:    outbox,
+		publisher: publisher,
+		opts:      MergeRelayOptions(opts...),
+	}
+	if r.opts.Mode == nil {
+		r.opts.SetMode(RelayWatch)
+	}
+	if r.opts.PollInterval == nil {
+		r.opts.PollInterval = &DefaultRelayPollInterval
+	}
+	if r.opts.BatchSize == nil {
+		r.opts.BatchSize = &DefaultRelayBatchSize
+	}
+	return r
+}
+
+// Run delivers events until ctx is done, and returns the error of ctx. Errors met along the way
+// are passed to the error handler of the relay.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(*r.opts.PollInterval)
+	defer ticker.Stop()
+
+	watchCtx, cancel := context.WithCancel(mongo.TxnContextWithoutSession(ctx))
+	wake := make(chan struct{}, 1)
+	var watchErr chan error
+	defer func() {
+		cancel()
+		if watchErr != nil {
+			<-watchErr
+		}
+	}()
+
+	for {
+		if *r.opts.Mode == RelayWatch && watchErr == nil {
+			watchErr = make(chan error, 1)
+			go func(done chan<- error) { done <- r.watch(watchCtx, wake) }(watchErr)
+		}
+
+		if _, err := r.Deliver(ctx); err != nil && ctx.Err() == nil {
+			r.report(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-ticker.C:
+		case err := <-watchErr:
+			// the change stream is reopened on the next round, events committed in the meantime
+			// are picked up by the poll.
+			watchErr = nil
+			if ctx.Err() == nil {
+				r.report(fmt.Errorf("watch outbox failed, err: %v", err))
+			}
+		}
+	}
+}
+
+// Deliver publishes the events of the outbox that have not been delivered yet and returns how many
+// it delivered. It is what Run does on every round and may be called directly instead of running
+// the relay.
+func (r *OutboxRelay) Deliver(ctx context.Context) (int, error) {
+	delivered := 0
+	for {
+		events, err := r.outbox.pending(ctx, *r.opts.BatchSize)
+		if err != nil {
+			return delivered, fmt.Errorf("read outbox failed, err: %v", err)
+		}
+
+		for _, evt := range events {
+			if err := r.publisher.Publish(ctx, evt); err != nil {
+				return delivered, fmt.Errorf("publish outbox event: %s failed, err: %v", evt.ID.Hex(), err)
+			}
+			if err := r.outbox.markDelivered(ctx, evt.ID); err != nil {
+				return delivered, fmt.Errorf("checkpoint outbox event: %s failed, err: %v", evt.ID.Hex(), err)
+			}
+			delivered++
+		}
+
+		if int32(len(events)) < *r.opts.BatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// watch signals wake whenever an event is inserted into the outbox, until ctx is done or the
+// change stream fails.
+func (r *OutboxRelay) watch(ctx context.Context, wake chan<- struct{}) error {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	cs, err := r.outbox.coll.Watch(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+
+	// a change may have been missed while the stream was being opened.
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	for cs.Next(ctx) {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return cs.Err()
+}
+
+func (r *OutboxRelay) report(err error) {
+	if r.opts.ErrorHandler != nil {
+		r.opts.ErrorHandler(err)
+	}
+}
@@ -0,0 +1,72 @@
+package Transaction
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMergeRelayOptions(t *testing.T) {
+	relay := NewOutboxRelay(nil, nil)
+	if *relay.opts.Mode != RelayWatch || *relay.opts.PollInterval != DefaultRelayPollInterval || *relay.opts.BatchSize != DefaultRelayBatchSize {
+		t.Errorf("unexpected defaults %+v", relay.opts)
+	}
+
+	opts := MergeRelayOptions(Relay().SetMode(RelayPoll), Relay().SetPollInterval(time.Minute).SetBatchSize(10))
+	if *opts.Mode != RelayPoll || *opts.PollInterval != time.Minute || *opts.BatchSize != 10 {
+		t.Errorf("options not merged: %+v", opts)
+	}
+}
+
+type fakeSessionContext struct {
+	context.Context
+	mongo.Session
+}
+
+func TestOutboxAddOutsideTransaction(t *testing.T) {
+	m := newOfflineManager(t)
+	outbox := NewOutbox(m.Client().Database("test").Collection("outbox"))
+
+	// only sessions of the driver carry a transaction.
+	sessCtx := fakeSessionContext{Context: context.Background()}
+	if _, err := outbox.Add(sessCtx, "orders", "1", map[string]interface{}{"id": 1}); err == nil {
+		t.Error("expected an event without a transaction to be rejected")
+	}
+}
+
+func TestOutboxAddSessionContext(t *testing.T) {
+	// the client is never connected to a server, sessions only need its session pool.
+	cli, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Disconnect(context.Background())
+
+	handle := newTestHandle()
+	sess, err := mongo.TxnStartSession(cli, &mongo.TxnSession{
+		TxnNubmer: handle.TxnNumber,
+		SessionID: base64.StdEncoding.EncodeToString(handle.SessionID),
+		Started:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mongo.TxnReleaseSession(context.Background(), sess)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sessCtx := mongo.TxnContextWithSession(ctx, sess)
+	if txnID, err := sessionTxnID(sessCtx); err != nil || txnID != handle.ID() {
+		t.Fatalf("expected the transaction id %s, got %s, %v", handle.ID(), txnID, err)
+	}
+
+	// the event is bound to the transaction, then fails to be written as the context is canceled.
+	outbox := NewOutbox(cli.Database("test").Collection("outbox"))
+	if _, err := outbox.Add(sessCtx, "orders", "1", map[string]interface{}{"id": 1}); err != context.Canceled {
+		t.Errorf("expected the write to be canceled, got %v", err)
+	}
+}
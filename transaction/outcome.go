@@ -0,0 +1,122 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrAlreadyCommitted is returned when a transaction that has been committed is aborted.
+var ErrAlreadyCommitted = errors.New("transaction already committed")
+
+// ErrAlreadyAborted is returned when a transaction that has been aborted is committed.
+var ErrAlreadyAborted = errors.New("transaction already aborted")
+
+// OutcomeGuard is a ReplayGuard that also remembers how finished transactions ended. Committing a
+// committed transaction again succeeds and aborting it fails with ErrAlreadyCommitted; sharing an
+// OutcomeGuard between nodes gives every node that answer without asking the registry or the
+// server. The default guard is an OutcomeGuard.
+type OutcomeGuard interface {
+	ReplayGuard
+	// Finish marks the transaction described by the handle as finished with the given outcome,
+	// TxnStateCommitted or TxnStateAborted.
+	Finish(h *TxnHandle, outcome TxnState)
+	// Outcome returns the outcome of the transaction described by the handle, if it finished.
+	Outcome(h *TxnHandle) (TxnState, bool)
+}
+
+// finish rejects the tokens of a finished transaction from now on, records its outcome if it is
+// known and drops its lease.
+func (m *TxnManager) finish(handle *TxnHandle, outcome TxnState) {
+	if handle.ExpiresAt.IsZero() {
+		// handles rebuilt from the registry do not know their token expiry, every token of the
+		// transaction expires within TokenTTL from now though.
+		h := *handle
+		h.ExpiresAt = timeNow().Add(*m.opts.TokenTTL)
+		handle = &h
+	}
+
+	if g, ok := m.guard.(OutcomeGuard); ok && outcome != "" {
+		g.Finish(handle, outcome)
+	} else {
+		m.guard.Revoke(handle)
+	}
+	m.leases.remove(handle)
+	m.pins.remove(handle)
+}
+
+// outcome returns how the transaction described by handle ended, if it is known. The guard is
+// asked first, then the registry and, if inspect is true, the config.transactions collection of
+// the server.
+func (m *TxnManager) outcome(ctx context.Context, handle *TxnHandle, inspect bool) (TxnState, bool) {
+	if state, ok := m.guardOutcome(handle); ok {
+		return state, true
+	}
+
+	if m.registry != nil {
+		entry, err := m.registry.Get(ctx, handle.ID())
+		if err == nil && (entry.State == TxnStateCommitted || entry.State == TxnStateAborted) {
+			return entry.State, true
+		}
+	}
+
+	if inspect {
+		rec, err := m.sessionRecord(ctx, handle.SessionID)
+		if err != nil {
+			return "", false
+		}
+		switch recordStatus(rec, handle.TxnNumber) {
+		case TxnStatusCommitted:
+			return TxnStateCommitted, true
+		case TxnStatusAborted:
+			return TxnStateAborted, true
+		}
+	}
+	return "", false
+}
+
+// guardOutcome returns how the transaction described by handle ended, if the guard knows it.
+func (m *TxnManager) guardOutcome(handle *TxnHandle) (TxnState, bool) {
+	if g, ok := m.guard.(OutcomeGuard); ok {
+		return g.Outcome(handle)
+	}
+	return "", false
+}
+
+// resolveCommit returns the result of a commit that failed with err, given how the transaction
+// ended: a transaction committed by another attempt or another node is reported as committed.
+func (m *TxnManager) resolveCommit(ctx context.Context, handle *TxnHandle, err error) error {
+	state, ok := m.outcome(ctx, handle, true)
+	if !ok {
+		return err
+	}
+	if state == TxnStateAborted {
+		return ErrAlreadyAborted
+	}
+	m.finish(handle, TxnStateCommitted)
+	return nil
+}
+
+// resolveAbort returns the result of an abort that failed with err, given how the transaction
+// ended.
+func (m *TxnManager) resolveAbort(ctx context.Context, handle *TxnHandle, err error) error {
+	state, ok := m.outcome(ctx, handle, true)
+	if !ok {
+		return err
+	}
+	if state == TxnStateCommitted {
+		return ErrAlreadyCommitted
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package Transaction
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+)
+
+func TestMemoryReplayGuardOutcome(t *testing.T) {
+	g := NewMemoryReplayGuard().(OutcomeGuard)
+	committed, revoked := newTestHandle(), newTestHandle()
+	revoked.TxnNumber++
+
+	g.Finish(committed, TxnStateCommitted)
+	g.Revoke(revoked)
+
+	if !g.Revoked(committed) || !g.Revoked(revoked) {
+		t.Error("expected both transactions to be revoked")
+	}
+	if state, ok := g.Outcome(committed); !ok || state != TxnStateCommitted {
+		t.Errorf("expected %s, got %s, %v", TxnStateCommitted, state, ok)
+	}
+	if state, ok := g.Outcome(revoked); ok {
+		t.Errorf("expected no outcome for a revoked transaction, got %s", state)
+	}
+}
+
+func TestIdempotentCommitAndAbort(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+	ctx := context.Background()
+
+	committed, aborted := newTestHandle(), newTestHandle()
+	aborted.TxnNumber++
+	committedToken, err := encodeToken(ks, committed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abortedToken, err := encodeToken(ks, aborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.finish(committed, TxnStateCommitted)
+	m.finish(aborted, TxnStateAborted)
+
+	if err := m.CommitTransaction(ctx, committedToken); err != nil {
+		t.Errorf("expected a second commit to succeed, got %v", err)
+	}
+	if err := m.AbortTransaction(ctx, committedToken); err != ErrAlreadyCommitted {
+		t.Errorf("expected ErrAlreadyCommitted, got %v", err)
+	}
+	if err := m.AbortTransaction(ctx, abortedToken); err != nil {
+		t.Errorf("expected a second abort to succeed, got %v", err)
+	}
+	if err := m.CommitTransaction(ctx, abortedToken); err != ErrAlreadyAborted {
+		t.Errorf("expected ErrAlreadyAborted, got %v", err)
+	}
+
+	// handles rebuilt from the registry or the decision log get the same answers.
+	if err := m.commit(ctx, &TxnHandle{SessionID: committed.SessionID, TxnNumber: committed.TxnNumber}, true); err != nil {
+		t.Errorf("expected a retried commit to succeed, got %v", err)
+	}
+	if err := m.abort(ctx, &TxnHandle{SessionID: committed.SessionID, TxnNumber: committed.TxnNumber}); err != ErrAlreadyCommitted {
+		t.Errorf("expected ErrAlreadyCommitted, got %v", err)
+	}
+}
+
+func TestAbortWithUnknownOutcome(t *testing.T) {
+	srv, err := drivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// the config.transactions lookup telling whether another node committed the transaction
+	// fails, while the abort itself succeeds.
+	fi := driver.NewFaultInjector(driver.FailPoint{Commands: []string{"find"}, ErrorCode: 13})
+	ctx := context.Background()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(srv.URI()).SetRetryReads(false).SetFaultInjector(fi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Disconnect(ctx)
+	registry := cli.Database("test").Collection("registry")
+	m, err := NewTxnManager(cli, Manager().SetLeaseDuration(time.Second).SetRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := cli.Database("test").Collection("unknown_outcome")
+
+	start := func() (*TxnHandle, string) {
+		sess, token, err := m.StartTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.ReleaseSession(ctx, sess)
+		if _, err := coll.InsertOne(mongo.TxnContextWithSession(ctx, sess), bson.M{"x": 1}); err != nil {
+			t.Fatal(err)
+		}
+		handle, err := decodeToken(m.keys, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handle, token
+	}
+
+	handle, token := start()
+	err = m.AbortTransaction(ctx, token)
+	if txnErr, ok := err.(*TxnError); !ok || txnErr.Op != "abort" {
+		t.Errorf("expected the failed lookup to be returned, got %v", err)
+	}
+	if state, ok := m.guardOutcome(handle); ok {
+		t.Errorf("expected the outcome to stay unknown, got %s", state)
+	}
+	if state := srv.Documents("test.registry")[0].Lookup("state").StringValue(); state != string(TxnStateActive) {
+		t.Errorf("expected the registry entry to stay %s, got %s", TxnStateActive, state)
+	}
+
+	handle, _ = start()
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return time.Now().Add(5 * time.Second) }
+	// listing the expired entries of the registry fails too, and is reported without an id.
+	var swept *ExpiredTxn
+	expired := m.Sweep(ctx)
+	for i := range expired {
+		if expired[i].ID == handle.ID() {
+			swept = &expired[i]
+		}
+	}
+	if swept == nil {
+		t.Fatalf("expected %s to be swept, got %+v", handle.ID(), expired)
+	}
+	if txnErr, ok := swept.Err.(*TxnError); !ok || txnErr.Op != "abort" {
+		t.Errorf("expected the failed lookup to be reported, got %v", swept.Err)
+	}
+	if state, ok := m.guardOutcome(handle); ok {
+		t.Errorf("expected the outcome of the expired transaction to stay unknown, got %s", state)
+	}
+	if n := len(srv.Documents("test.unknown_outcome")); n != 0 {
+		t.Errorf("expected both transactions to be aborted, got %d documents", n)
+	}
+}
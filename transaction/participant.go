@@ -0,0 +1,302 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// These errors are returned by the participant operations of a TxnManager.
+var (
+	ErrInvalidParticipant = errors.New("participant name must not be empty")
+	ErrUnknownParticipant = errors.New("participant is not registered in the transaction")
+	ErrTxnNotActive       = errors.New("transaction is not active")
+	ErrQuorumTimeout      = errors.New("participants of the transaction are not done")
+	ErrParticipantFailed  = errors.New("a participant of the transaction failed")
+)
+
+// quorumPollInterval is how often a waiting commit reads the participants of its transaction.
+var quorumPollInterval = 100 * time.Millisecond
+
+// ParticipantState is the state of a participant recorded in the registry.
+type ParticipantState string
+
+// These constants are the states a participant moves through.
+const (
+	// ParticipantRegistered is the state of a participant that is working on the transaction.
+	ParticipantRegistered ParticipantState = "registered"
+	// ParticipantPrepared is the state of a participant whose writes are done but that may still
+	// use its session, for instance to read.
+	ParticipantPrepared ParticipantState = "prepared"
+	// ParticipantDone is the state of a participant that will not use the transaction anymore.
+	ParticipantDone ParticipantState = "done"
+	// ParticipantFailed is the state of a participant that could not do its part.
+	ParticipantFailed ParticipantState = "failed"
+)
+
+// Participant is a node, or a part of one, taking part in a transaction.
+type Participant struct {
+	Name      string           `bson:"name"`
+	State     ParticipantState `bson:"state"`
+	UpdatedAt time.Time        `bson:"updatedAt"`
+}
+
+// QuorumPolicy controls what a commit does when the participants of the transaction are not all
+// done.
+type QuorumPolicy uint8
+
+// These constants are the valid quorum policies.
+const (
+	// QuorumFail makes the commit fail and leaves the transaction running, so it can be committed
+	// again later or aborted.
+	QuorumFail QuorumPolicy = iota
+	// QuorumAbort makes the commit abort the transaction before failing.
+	QuorumAbort
+)
+
+// QuorumError is returned by a commit whose transaction did not reach its quorum.
+type QuorumError struct {
+	Pending []string // the participants that were not done
+	Failed  []string // the participants that failed
+	Err     error    // ErrQuorumTimeout or ErrParticipantFailed
+}
+
+// Error implements the error interface.
+func (e *QuorumError) Error() string {
+	if len(e.Failed) != 0 {
+		return fmt.Sprintf("%v: %s", e.Err, strings.Join(e.Failed, ", "))
+	}
+	return fmt.Sprintf("%v: %s", e.Err, strings.Join(e.Pending, ", "))
+}
+
+// Unwrap returns the underlying error.
+func (e *QuorumError) Unwrap() error {
+	return e.Err
+}
+
+// RegisterParticipant registers name as a participant of the transaction identified by txnToken.
+// Once a transaction has participants it is only committed when all of them are done. Registering
+// the same participant again is a no-op. It returns ErrNoRegistry if the manager has no registry.
+func (m *TxnManager) RegisterParticipant(ctx context.Context, txnToken, name string) error {
+	handle, err := m.participantHandle(txnToken, name)
+	if err != nil {
+		return err
+	}
+	return m.registry.addParticipant(ctx, handle.ID(), name)
+}
+
+// MarkPrepared records that the participant name finished its writes in the transaction
+// identified by txnToken.
+func (m *TxnManager) MarkPrepared(ctx context.Context, txnToken, name string) error {
+	return m.markParticipant(ctx, txnToken, name, ParticipantPrepared)
+}
+
+// MarkDone records that the participant name is done with the transaction identified by txnToken.
+// It should be called once the participant released its sessions of the transaction.
+func (m *TxnManager) MarkDone(ctx context.Context, txnToken, name string) error {
+	return m.markParticipant(ctx, txnToken, name, ParticipantDone)
+}
+
+// MarkFailed records that the participant name could not do its part in the transaction
+// identified by txnToken. The transaction cannot be committed anymore.
+func (m *TxnManager) MarkFailed(ctx context.Context, txnToken, name string) error {
+	return m.markParticipant(ctx, txnToken, name, ParticipantFailed)
+}
+
+func (m *TxnManager) markParticipant(ctx context.Context, txnToken, name string, state ParticipantState) error {
+	handle, err := m.participantHandle(txnToken, name)
+	if err != nil {
+		return err
+	}
+	return m.registry.setParticipant(ctx, handle.ID(), name, state)
+}
+
+func (m *TxnManager) participantHandle(txnToken, name string) (*TxnHandle, error) {
+	if m.registry == nil {
+		return nil, ErrNoRegistry
+	}
+	if name == "" {
+		return nil, ErrInvalidParticipant
+	}
+	return m.verifyToken(txnToken)
+}
+
+// awaitQuorum waits until every participant of the transaction is done and moves its registry
+// entry to committing. It returns a *QuorumError if a participant failed or the participants are
+// not done within the quorum timeout; the transaction is aborted first with QuorumAbort.
+func (m *TxnManager) awaitQuorum(ctx context.Context, handle *TxnHandle) error {
+	if m.registry == nil {
+		return nil
+	}
+
+	err := waitQuorum(ctx, *m.opts.QuorumTimeout, func(ctx context.Context) (bool, error) {
+		entry, err := m.registry.Get(ctx, handle.ID())
+		if err != nil {
+			return false, err
+		}
+		if entry.State != TxnStateActive {
+			// a retried commit already reached the quorum, other states are left to the server.
+			return true, nil
+		}
+
+		pending, failed := quorum(entry.Participants)
+		if len(failed) != 0 {
+			return false, &QuorumError{Pending: pending, Failed: failed, Err: ErrParticipantFailed}
+		}
+		if len(pending) != 0 {
+			return false, &QuorumError{Pending: pending, Err: ErrQuorumTimeout}
+		}
+		// a participant may register while the quorum is checked, the entry only moves to
+		// committing if all participants are still done.
+		return m.registry.beginCommit(ctx, handle.ID())
+	})
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*QuorumError); ok && m.opts.QuorumPolicy != nil && *m.opts.QuorumPolicy == QuorumAbort {
+		if aerr := m.abort(ctx, handle); aerr != nil {
+			return fmt.Errorf("%v, abort failed, err: %v", err, aerr)
+		}
+	}
+	return err
+}
+
+// waitQuorum calls check until it returns true, a failed participant or another error, or until
+// timeout. A *QuorumError with ErrQuorumTimeout is only returned once the timeout is reached.
+func waitQuorum(ctx context.Context, timeout time.Duration, check func(context.Context) (bool, error)) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(quorumPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := check(ctx)
+		if ok {
+			return nil
+		}
+		if qerr, isQuorum := err.(*QuorumError); err != nil && (!isQuorum || qerr.Err != ErrQuorumTimeout) {
+			return err
+		}
+
+		select {
+		case <-deadline.C:
+			if err == nil {
+				err = &QuorumError{Err: ErrQuorumTimeout}
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// quorum returns the participants that are not done and the ones that failed.
+func quorum(participants []Participant) (pending, failed []string) {
+	for _, p := range participants {
+		switch p.State {
+		case ParticipantDone:
+		case ParticipantFailed:
+			failed = append(failed, p.Name)
+		default:
+			pending = append(pending, p.Name)
+		}
+	}
+	return pending, failed
+}
+
+func (r *Registry) addParticipant(ctx context.Context, id, name string) error {
+	now := timeNow()
+	filter := bson.M{"_id": id, "state": TxnStateActive, "participants.name": bson.M{"$ne": name}}
+	update := bson.M{
+		"$push": bson.M{"participants": Participant{Name: name, State: ParticipantRegistered, UpdatedAt: now}},
+		"$set":  bson.M{"updatedAt": now},
+	}
+	res, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	_, err = r.participant(ctx, id, name)
+	return err
+}
+
+func (r *Registry) setParticipant(ctx context.Context, id, name string, state ParticipantState) error {
+	now := timeNow()
+	filter := bson.M{"_id": id, "state": TxnStateActive, "participants.name": name}
+	update := bson.M{"$set": bson.M{
+		"participants.$.state":     state,
+		"participants.$.updatedAt": now,
+		"updatedAt":                now,
+	}}
+	res, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	if _, err := r.participant(ctx, id, name); err != nil {
+		return err
+	}
+	return ErrUnknownParticipant
+}
+
+// participant returns the participant name of an active transaction. It returns ErrTxnNotActive
+// if the transaction is not active and ErrUnknownParticipant if name is not one of its participants.
+func (r *Registry) participant(ctx context.Context, id, name string) (*Participant, error) {
+	entry, err := r.Get(ctx, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrTxnNotActive
+		}
+		return nil, err
+	}
+	if entry.State != TxnStateActive {
+		return nil, ErrTxnNotActive
+	}
+	for i := range entry.Participants {
+		if entry.Participants[i].Name == name {
+			return &entry.Participants[i], nil
+		}
+	}
+	return nil, ErrUnknownParticipant
+}
+
+// beginCommit moves an active transaction whose participants are all done to committing. It
+// returns false if a participant is not done.
+func (r *Registry) beginCommit(ctx context.Context, id string) (bool, error) {
+	filter := bson.M{
+		"_id":          id,
+		"state":        TxnStateActive,
+		"participants": bson.M{"$not": bson.M{"$elemMatch": bson.M{"state": bson.M{"$ne": ParticipantDone}}}},
+	}
+	update := bson.M{"$set": bson.M{"state": TxnStateCommitting, "updatedAt": timeNow()}}
+	res, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
@@ -0,0 +1,114 @@
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuorum(t *testing.T) {
+	pending, failed := quorum([]Participant{
+		{Name: "a", State: ParticipantDone},
+		{Name: "b", State: ParticipantPrepared},
+		{Name: "c", State: ParticipantRegistered},
+		{Name: "d", State: ParticipantFailed},
+	})
+	if !reflect.DeepEqual(pending, []string{"b", "c"}) {
+		t.Errorf("unexpected pending participants %v", pending)
+	}
+	if !reflect.DeepEqual(failed, []string{"d"}) {
+		t.Errorf("unexpected failed participants %v", failed)
+	}
+
+	pending, failed = quorum(nil)
+	if pending != nil || failed != nil {
+		t.Error("a transaction without participants must reach its quorum")
+	}
+}
+
+func TestWaitQuorum(t *testing.T) {
+	defer func(d time.Duration) { quorumPollInterval = d }(quorumPollInterval)
+	quorumPollInterval = time.Millisecond
+	ctx := context.Background()
+
+	t.Run("done after polling", func(t *testing.T) {
+		calls := 0
+		err := waitQuorum(ctx, time.Second, func(context.Context) (bool, error) {
+			calls++
+			if calls < 3 {
+				return false, &QuorumError{Pending: []string{"a"}, Err: ErrQuorumTimeout}
+			}
+			return true, nil
+		})
+		if err != nil || calls != 3 {
+			t.Errorf("expected success after 3 checks, got %v after %d", err, calls)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		err := waitQuorum(ctx, 10*time.Millisecond, func(context.Context) (bool, error) {
+			return false, &QuorumError{Pending: []string{"a"}, Err: ErrQuorumTimeout}
+		})
+		qerr, ok := err.(*QuorumError)
+		if !ok || !reflect.DeepEqual(qerr.Pending, []string{"a"}) || !errors.Is(err, ErrQuorumTimeout) {
+			t.Errorf("expected a quorum timeout naming a, got %v", err)
+		}
+	})
+	t.Run("failed participant", func(t *testing.T) {
+		calls := 0
+		err := waitQuorum(ctx, time.Second, func(context.Context) (bool, error) {
+			calls++
+			return false, &QuorumError{Failed: []string{"b"}, Err: ErrParticipantFailed}
+		})
+		if !errors.Is(err, ErrParticipantFailed) || calls != 1 {
+			t.Errorf("expected an immediate ErrParticipantFailed, got %v after %d checks", err, calls)
+		}
+		if err.Error() != "a participant of the transaction failed: b" {
+			t.Errorf("unexpected message %q", err.Error())
+		}
+	})
+	t.Run("canceled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := waitQuorum(cctx, time.Second, func(context.Context) (bool, error) {
+			return false, nil
+		})
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestParticipantWithoutRegistry(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+	token, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RegisterParticipant(context.Background(), token, "node1"); err != ErrNoRegistry {
+		t.Errorf("expected ErrNoRegistry, got %v", err)
+	}
+	if err := m.MarkDone(context.Background(), token, "node1"); err != ErrNoRegistry {
+		t.Errorf("expected ErrNoRegistry, got %v", err)
+	}
+	// without a registry there are no participants to wait for.
+	if err := m.awaitQuorum(context.Background(), newTestHandle()); err != nil {
+		t.Errorf("expected no quorum without registry, got %v", err)
+	}
+}
+
+func TestQuorumOptions(t *testing.T) {
+	opts := MergeManagerOptions(Manager().SetQuorumPolicy(QuorumAbort), Manager().SetQuorumTimeout(time.Second))
+	if *opts.QuorumTimeout != time.Second {
+		t.Errorf("expected quorum timeout 1s, got %v", *opts.QuorumTimeout)
+	}
+	if opts.QuorumPolicy == nil || *opts.QuorumPolicy != QuorumAbort {
+		t.Error("expected QuorumAbort policy")
+	}
+	if *Manager().QuorumTimeout != DefaultQuorumTimeout {
+		t.Error("expected the default quorum timeout")
+	}
+}
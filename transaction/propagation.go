@@ -0,0 +1,106 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TokenKey is the key a transaction token is stored under in a Carrier, and the HTTP header
+// used by Middleware and Transport.
+const TokenKey = "X-Mongo-Txn-Token"
+
+// Carrier is the medium a transaction token travels in between nodes, such as HTTP headers or
+// RPC metadata. Implement it to propagate transactions over other RPC frameworks.
+type Carrier interface {
+	// Get returns the value stored under key, or an empty string.
+	Get(key string) string
+	// Set stores value under key.
+	Set(key, value string)
+}
+
+// HeaderCarrier adapts http.Header to the Carrier interface.
+type HeaderCarrier http.Header
+
+// Get returns the header value stored under key.
+func (c HeaderCarrier) Get(key string) string {
+	return http.Header(c).Get(key)
+}
+
+// Set sets the header value stored under key.
+func (c HeaderCarrier) Set(key, value string) {
+	http.Header(c).Set(key, value)
+}
+
+// MapCarrier adapts a map[string]string to the Carrier interface.
+type MapCarrier map[string]string
+
+// Get returns the value stored under key.
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+// Set stores value under key.
+func (c MapCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+type tokenKey struct{}
+
+// ContextWithToken returns a context carrying the given transaction token.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFromContext returns the transaction token carried by ctx, if any.
+func TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	return token, ok && token != ""
+}
+
+// Inject stores the transaction token carried by ctx in carrier. It returns false if ctx carries
+// no token.
+func Inject(ctx context.Context, carrier Carrier) bool {
+	token, ok := TokenFromContext(ctx)
+	if !ok {
+		return false
+	}
+	carrier.Set(TokenKey, token)
+	return true
+}
+
+// Extract returns the transaction token stored in carrier, or an empty string.
+func Extract(carrier Carrier) string {
+	return carrier.Get(TokenKey)
+}
+
+// Join reloads the transaction whose token is stored in carrier and returns a context bound to
+// the reloaded session that also carries the token, so it is propagated further by Inject. It
+// returns ctx unchanged and a nil session if the carrier holds no token. The caller must release
+// the returned session with ReleaseSession once it is done.
+func (m *TxnManager) Join(ctx context.Context, carrier Carrier) (context.Context, mongo.Session, error) {
+	token := Extract(carrier)
+	if token == "" {
+		return ctx, nil, nil
+	}
+
+	sess, err := m.ReloadSession(ctx, token)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	return mongo.TxnContextWithSession(ContextWithToken(ctx, token), sess), sess, nil
+}
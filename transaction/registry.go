@@ -0,0 +1,241 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TxnState is the state of a transaction recorded in the registry.
+type TxnState string
+
+// These constants are the states a registry entry moves through.
+const (
+	TxnStateActive     TxnState = "active"
+	TxnStateCommitting TxnState = "committing"
+	TxnStateCommitted  TxnState = "committed"
+	TxnStateAborted    TxnState = "aborted"
+)
+
+// errCodeNoSuchTransaction is the server error code returned for unknown transactions.
+const errCodeNoSuchTransaction = 251
+
+// RegistryEntry is the document stored in the registry collection for each transaction.
+type RegistryEntry struct {
+	ID        string    `bson:"_id"`
+	SessionID []byte    `bson:"lsid"`
+	TxnNumber int64     `bson:"txnNumber"`
+	Owner     string    `bson:"owner"`
+	State     TxnState  `bson:"state"`
+	StartedAt time.Time `bson:"startedAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+
+	LeaseExpiresAt time.Time     `bson:"leaseExpiresAt"`
+	Options        *TxnOptions   `bson:"options,omitempty"`
+	Participants   []Participant `bson:"participants,omitempty"`
+}
+
+func (e *RegistryEntry) handle() *TxnHandle {
+	return &TxnHandle{SessionID: e.SessionID, TxnNumber: e.TxnNumber, StartedAt: e.StartedAt, Options: e.Options}
+}
+
+// Registry records the transactions started by TxnManagers in a MongoDB collection. Every write
+// to the registry is performed outside of the transaction it describes, so the record survives an
+// abort and is visible to other nodes immediately.
+type Registry struct {
+	coll *mongo.Collection
+}
+
+// NewRegistry creates a Registry backed by coll.
+func NewRegistry(coll *mongo.Collection) *Registry {
+	return &Registry{coll: coll}
+}
+
+// Get returns the registry entry for the transaction with the given id.
+func (r *Registry) Get(ctx context.Context, id string) (*RegistryEntry, error) {
+	entry := new(RegistryEntry)
+	err := r.coll.FindOne(mongo.TxnContextWithoutSession(ctx), bson.M{"_id": id}).Decode(entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *Registry) insert(ctx context.Context, owner string, h *TxnHandle) error {
+	now := timeNow()
+	entry := &RegistryEntry{
+		ID:        h.ID(),
+		SessionID: h.SessionID,
+		TxnNumber: h.TxnNumber,
+		Owner:     owner,
+		State:     TxnStateActive,
+		StartedAt: now,
+		UpdatedAt: now,
+
+		LeaseExpiresAt: h.LeaseExpiresAt,
+		Options:        h.Options,
+	}
+	_, err := r.coll.InsertOne(mongo.TxnContextWithoutSession(ctx), entry)
+	return err
+}
+
+// setState moves an entry to state. A committed entry is never moved to aborted, a node that lost
+// a race with the commit must not hide it.
+func (r *Registry) setState(ctx context.Context, id string, state TxnState) error {
+	filter := bson.M{"_id": id}
+	if state == TxnStateAborted {
+		filter["state"] = bson.M{"$ne": TxnStateCommitted}
+	}
+	update := bson.M{"$set": bson.M{"state": state, "updatedAt": timeNow()}}
+	_, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	return err
+}
+
+// renewLease moves the lease deadline of an active transaction to deadline. It returns false if
+// the transaction is neither active nor committing, or its lease already expired. The lease of a
+// committing transaction is renewed so that its commit can be retried.
+func (r *Registry) renewLease(ctx context.Context, id string, deadline time.Time) (bool, error) {
+	now := timeNow()
+	filter := bson.M{"_id": id, "$or": []bson.M{
+		{"state": TxnStateActive, "leaseExpiresAt": bson.M{"$gt": now}},
+		{"state": TxnStateCommitting},
+	}}
+	update := bson.M{"$set": bson.M{"leaseExpiresAt": deadline, "updatedAt": now}}
+	res, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// expired returns the active entries whose lease expired before now.
+func (r *Registry) expired(ctx context.Context, now time.Time) ([]*RegistryEntry, error) {
+	return r.find(ctx, bson.M{"state": TxnStateActive, "leaseExpiresAt": bson.M{"$lte": now}})
+}
+
+// claimExpired marks an entry whose lease expired before now as aborted. It returns false if the
+// entry was renewed or finished in the meantime, or claimed by another node.
+func (r *Registry) claimExpired(ctx context.Context, id string, now time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "state": TxnStateActive, "leaseExpiresAt": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"state": TxnStateAborted, "updatedAt": timeNow()}}
+	res, err := r.coll.UpdateOne(mongo.TxnContextWithoutSession(ctx), filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// unfinished returns the entries owned by owner that were neither committed nor aborted.
+func (r *Registry) unfinished(ctx context.Context, owner string) ([]*RegistryEntry, error) {
+	return r.find(ctx, bson.M{
+		"owner": owner,
+		"state": bson.M{"$in": []TxnState{TxnStateActive, TxnStateCommitting}},
+	})
+}
+
+func (r *Registry) find(ctx context.Context, filter bson.M) ([]*RegistryEntry, error) {
+	ctx = mongo.TxnContextWithoutSession(ctx)
+	cursor, err := r.coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []*RegistryEntry
+	for cursor.Next(ctx) {
+		entry := new(RegistryEntry)
+		if err := cursor.Decode(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, cursor.Err()
+}
+
+// RecoveredTxn describes an orphaned transaction handled by Recover.
+type RecoveredTxn struct {
+	Entry *RegistryEntry
+	State TxnState // the state the transaction was moved to
+	Err   error    // set if the transaction could not be finalised
+}
+
+// Recover finalises the transactions this node left unfinished, typically after a crash. It is
+// meant to be called on startup, before the node starts new transactions. Active transactions are
+// aborted; transactions whose commit had been requested are committed again, and marked aborted if
+// the server no longer knows them. It returns ErrNoRegistry if the manager has no registry.
+func (m *TxnManager) Recover(ctx context.Context) ([]RecoveredTxn, error) {
+	if m.registry == nil {
+		return nil, ErrNoRegistry
+	}
+
+	entries, err := m.registry.unfinished(ctx, m.node)
+	if err != nil {
+		return nil, fmt.Errorf("list unfinished transactions failed, err: %v", err)
+	}
+
+	recovered := make([]RecoveredTxn, 0, len(entries))
+	for _, entry := range entries {
+		res := RecoveredTxn{Entry: entry}
+		res.State, res.Err = m.recoverEntry(ctx, entry)
+		recovered = append(recovered, res)
+	}
+	return recovered, nil
+}
+
+func (m *TxnManager) recoverEntry(ctx context.Context, entry *RegistryEntry) (TxnState, error) {
+	sess, err := m.reloadSession(ctx, entry.handle(), false)
+	if err != nil {
+		return entry.State, err
+	}
+	defer m.ReleaseSession(ctx, sess)
+
+	state := TxnStateAborted
+	if entry.State == TxnStateCommitting {
+		err = sess.CommitTransaction(ctx)
+		switch {
+		case err == nil:
+			state = TxnStateCommitted
+		case hasErrorCode(err, errCodeNoSuchTransaction):
+			// the server already dropped the transaction, its writes are gone.
+		default:
+			return entry.State, err
+		}
+	} else {
+		// abortTransaction errors are ignored by the driver; an unknown transaction is already gone.
+		_ = sess.AbortTransaction(ctx)
+	}
+
+	m.finish(entry.handle(), state)
+	return state, m.registry.setState(ctx, entry.ID, state)
+}
+
+func hasErrorCode(err error, code int32) bool {
+	cerr, ok := commandError(err)
+	return ok && cerr.Code == code
+}
+
+// defaultNodeID identifies the current node when no node id is configured. It must survive a
+// restart of the process, otherwise Recover cannot find the entries of the previous run.
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
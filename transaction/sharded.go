@@ -0,0 +1,121 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"encoding/base64"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// On a sharded cluster the first command of a transaction pins it to the mongos it was sent to,
+// and every later command, commitTransaction and abortTransaction included, has to go through the
+// same mongos. The mongos also returns a recovery token that lets another mongos find out the
+// outcome of the transaction when a commit is retried. Neither is known before the transaction's
+// first command, so they travel in the tokens exported by ExportToken, and the sessions released
+// by this process record them so that its own commit and abort reuse them.
+
+// pinning is the mongos a transaction is pinned to and its recovery token.
+type pinning struct {
+	server        string
+	recoveryToken bson.Raw
+}
+
+// pinTracker remembers the pinning observed by the sessions of this process.
+type pinTracker struct {
+	mu   sync.Mutex
+	pins map[string]pinning
+}
+
+func newPinTracker() *pinTracker {
+	return &pinTracker{pins: make(map[string]pinning)}
+}
+
+// record remembers the pinning of sess, if it has one.
+func (t *pinTracker) record(sess mongo.Session) {
+	server, recoveryToken, err := mongo.GetSessionPinning(sess)
+	if err != nil || (server == "" && recoveryToken == nil) {
+		return
+	}
+	id, err := sessionTxnID(sess)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pins[id] = pinning{server: server, recoveryToken: recoveryToken}
+}
+
+// apply returns h with the pinning recorded for its transaction. h is returned as is if it
+// already carries a pinning or none was recorded.
+func (t *pinTracker) apply(h *TxnHandle) *TxnHandle {
+	if h.PinnedServer != "" || h.RecoveryToken != nil {
+		return h
+	}
+
+	t.mu.Lock()
+	p, ok := t.pins[h.ID()]
+	t.mu.Unlock()
+	if !ok {
+		return h
+	}
+
+	pinned := *h
+	pinned.PinnedServer = p.server
+	pinned.RecoveryToken = p.recoveryToken
+	return &pinned
+}
+
+func (t *pinTracker) remove(h *TxnHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pins, h.ID())
+}
+
+// capturePinning copies the pinning of sess into handle. A session that is not pinned leaves
+// the pinning of handle untouched.
+func capturePinning(sess mongo.Session, handle *TxnHandle) {
+	server, recoveryToken, err := mongo.GetSessionPinning(sess)
+	if err != nil {
+		return
+	}
+	if server != "" {
+		handle.PinnedServer = server
+	}
+	if recoveryToken != nil {
+		handle.RecoveryToken = recoveryToken
+	}
+}
+
+// sessionTxnID returns the TxnHandle ID of the transaction sess is bound to.
+func sessionTxnID(sess mongo.Session) (string, error) {
+	sessionID, txnNumber, err := mongo.GetSessionTxnID(sess)
+	if err != nil {
+		return "", err
+	}
+	lsid, err := base64.StdEncoding.DecodeString(sessionID)
+	if err != nil {
+		return "", err
+	}
+	return (&TxnHandle{SessionID: lsid, TxnNumber: txnNumber}).ID(), nil
+}
+
+// unpinned returns a copy of h that is not pinned to a mongos.
+func (h *TxnHandle) unpinned() *TxnHandle {
+	u := *h
+	u.PinnedServer = ""
+	return &u
+}
@@ -0,0 +1,143 @@
+package Transaction
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newShardedManager returns a TxnManager whose client knows two mongos that are never reached:
+// sessions are only reloaded, inspected and released. The caller disconnects the client.
+func newShardedManager(t *testing.T, ks *KeySet) *TxnManager {
+	cli, err := mongo.NewClient(options.Client().SetHosts([]string{"127.0.0.1:1", "127.0.0.1:2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewTxnManager(cli, Manager().SetKeySet(ks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func recoveryToken(t *testing.T) bson.Raw {
+	doc, err := bson.Marshal(bson.D{{Key: "recoveryShardId", Value: "sh1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestReloadSessionRoutesToPinnedMongos(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newShardedManager(t, ks)
+	ctx := context.Background()
+	defer m.Client().Disconnect(ctx)
+
+	handle := newTestHandle()
+	handle.PinnedServer = "127.0.0.1:2"
+	handle.RecoveryToken = recoveryToken(t)
+	token, err := encodeToken(ks, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := m.ReloadSession(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, rt, err := mongo.GetSessionPinning(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != handle.PinnedServer || !bytes.Equal(rt, handle.RecoveryToken) {
+		t.Errorf("expected session pinned to %s with %s, got %s with %s", handle.PinnedServer, handle.RecoveryToken, server, rt)
+	}
+
+	// a node passing the transaction on keeps the pinning in the token it exports.
+	exported, err := m.ExportToken(sess, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := decodeToken(ks, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PinnedServer != handle.PinnedServer || !bytes.Equal(h.RecoveryToken, handle.RecoveryToken) {
+		t.Errorf("exported token lost the pinning: %+v", h)
+	}
+	m.ReleaseSession(ctx, sess)
+}
+
+func TestReleasedSessionPinningIsReused(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newShardedManager(t, ks)
+	ctx := context.Background()
+	defer m.Client().Disconnect(ctx)
+
+	pinned := newTestHandle()
+	pinned.PinnedServer = "127.0.0.1:1"
+	pinned.RecoveryToken = recoveryToken(t)
+	token, err := encodeToken(ks, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := m.ReloadSession(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ReleaseSession(ctx, sess)
+
+	// the token the transaction was started with does not know the mongos, the sessions this
+	// process reloads for it are pinned anyway.
+	handle := newTestHandle()
+	applied := m.pins.apply(handle)
+	if applied.PinnedServer != pinned.PinnedServer || !bytes.Equal(applied.RecoveryToken, pinned.RecoveryToken) {
+		t.Errorf("expected recorded pinning, got %+v", applied)
+	}
+	if handle.PinnedServer != "" {
+		t.Error("apply modified the handle it was given")
+	}
+
+	// a retried commit is not pinned but keeps the recovery token.
+	retry := applied.unpinned()
+	if retry.PinnedServer != "" || retry.RecoveryToken == nil {
+		t.Errorf("expected unpinned handle with recovery token, got %+v", retry)
+	}
+	if m.pins.apply(retry) != retry {
+		t.Error("unpinned handle with recovery token was pinned again")
+	}
+
+	m.revoke(handle)
+	if m.pins.apply(handle) != handle {
+		t.Error("pinning of a finished transaction was kept")
+	}
+}
+
+func TestUnpinnedSessionIsNotRecorded(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newShardedManager(t, ks)
+	ctx := context.Background()
+	defer m.Client().Disconnect(ctx)
+
+	token, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := m.ReloadSession(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ReleaseSession(ctx, sess)
+
+	if len(m.pins.pins) != 0 {
+		t.Errorf("expected no pinning to be recorded, got %v", m.pins.pins)
+	}
+}
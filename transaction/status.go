@@ -0,0 +1,159 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// ErrInvalidTxnID is returned when a transaction id is not of the form returned by TxnID.
+var ErrInvalidTxnID = errors.New("invalid transaction id")
+
+// TxnStatus is the state of a transaction as seen by the server.
+type TxnStatus string
+
+// These constants are the statuses reported by Status.
+const (
+	// TxnStatusActive means the transaction is open on the server and may still be committed.
+	TxnStatusActive TxnStatus = "active"
+	// TxnStatusCommitted means the server recorded the commit of the transaction.
+	TxnStatusCommitted TxnStatus = "committed"
+	// TxnStatusAborted means the server recorded the abort of the transaction.
+	TxnStatusAborted TxnStatus = "aborted"
+	// TxnStatusUnknown means the server knows nothing about the transaction: it never ran, it was
+	// aborted without leaving a record, or the logical session has moved on to a later transaction.
+	TxnStatusUnknown TxnStatus = "unknown"
+)
+
+// sessionTxnRecord is the part of a config.transactions document Status looks at. The state is
+// only recorded by mongodb 4.2+, older servers only write the record of committed transactions.
+type sessionTxnRecord struct {
+	TxnNumber int64  `bson:"txnNum"`
+	State     string `bson:"state"`
+}
+
+// TxnID returns the id of the transaction identified by txnToken, as used by Status, the registry
+// and the transaction events. The token only has to be signed by a known key, so the id of a
+// finished transaction can still be looked up.
+func (m *TxnManager) TxnID(txnToken string) (string, error) {
+	handle, err := decodeToken(m.keys, txnToken)
+	if err != nil {
+		return "", err
+	}
+	return handle.ID(), nil
+}
+
+// Status reports whether the transaction with the given id is still open on the server. Open
+// transactions are looked up with currentOp, including idle sessions; the outcome of finished ones
+// is read from the config.transactions collection. Both need the inprog and find privileges on the
+// cluster. On a sharded cluster config.transactions lives on the shards, so through mongos finished
+// transactions are reported as TxnStatusUnknown.
+func (m *TxnManager) Status(ctx context.Context, txnID string) (TxnStatus, error) {
+	sessionID, txnNumber, err := parseTxnID(txnID)
+	if err != nil {
+		return "", err
+	}
+
+	// the inspection must not run inside a transaction bound to ctx.
+	ctx = mongo.TxnContextWithoutSession(ctx)
+	lsid := primitive.Binary{Subtype: 0x04, Data: sessionID}
+
+	cmd := bson.D{
+		{Key: "currentOp", Value: 1},
+		{Key: "$all", Value: true},
+		{Key: "lsid.id", Value: lsid},
+		{Key: "transaction.parameters.txnNumber", Value: txnNumber},
+	}
+	var ops struct {
+		InProg []bson.Raw `bson:"inprog"`
+	}
+	err = m.client.Database("admin").RunCommand(ctx, cmd, options.RunCmd().SetReadPreference(readpref.Primary())).Decode(&ops)
+	if err != nil {
+		return "", fmt.Errorf("inspect transaction: %s failed, err: %v", txnID, err)
+	}
+	if len(ops.InProg) != 0 {
+		return TxnStatusActive, nil
+	}
+
+	// the transaction is not running, it may have finished in the meantime.
+	rec, err := m.sessionRecord(ctx, sessionID)
+	if err != nil {
+		return "", fmt.Errorf("inspect transaction: %s failed, err: %v", txnID, err)
+	}
+	return recordStatus(rec, txnNumber), nil
+}
+
+// sessionRecord returns the config.transactions record of the logical session with the given id,
+// or nil if it has none.
+func (m *TxnManager) sessionRecord(ctx context.Context, sessionID []byte) (*sessionTxnRecord, error) {
+	coll := m.client.Database("config").Collection("transactions", options.Collection().SetReadPreference(readpref.Primary()))
+	rec := new(sessionTxnRecord)
+	lsid := primitive.Binary{Subtype: 0x04, Data: sessionID}
+	err := coll.FindOne(mongo.TxnContextWithoutSession(ctx), bson.M{"_id.id": lsid}).Decode(rec)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// recordStatus returns the status of transaction txnNumber described by the config.transactions
+// record of its logical session. rec is nil if the logical session has no record.
+func recordStatus(rec *sessionTxnRecord, txnNumber int64) TxnStatus {
+	if rec == nil || rec.TxnNumber != txnNumber {
+		return TxnStatusUnknown
+	}
+
+	switch rec.State {
+	case "", "committed":
+		// servers older than 4.2 only record committed transactions, without a state.
+		return TxnStatusCommitted
+	case "aborted":
+		return TxnStatusAborted
+	case "inProgress", "prepared":
+		return TxnStatusActive
+	default:
+		return TxnStatusUnknown
+	}
+}
+
+// parseTxnID splits a transaction id into the logical session id and the txnNumber.
+func parseTxnID(txnID string) ([]byte, int64, error) {
+	i := strings.LastIndexByte(txnID, '-')
+	if i < 0 {
+		return nil, 0, ErrInvalidTxnID
+	}
+
+	sessionID, err := hex.DecodeString(txnID[:i])
+	if err != nil || len(sessionID) != 16 {
+		return nil, 0, ErrInvalidTxnID
+	}
+	txnNumber, err := strconv.ParseInt(txnID[i+1:], 10, 64)
+	if err != nil || txnNumber <= 0 {
+		return nil, 0, ErrInvalidTxnID
+	}
+	return sessionID, txnNumber, nil
+}
@@ -0,0 +1,75 @@
+package Transaction
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestParseTxnID(t *testing.T) {
+	h := newTestHandle()
+	sessionID, txnNumber, err := parseTxnID(h.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sessionID, h.SessionID) || txnNumber != h.TxnNumber {
+		t.Errorf("expected %x and %d, got %x and %d", h.SessionID, h.TxnNumber, sessionID, txnNumber)
+	}
+
+	for _, id := range []string{"", "3", "zz-3", "0123-3", "30313233343536373839616263646566-", "30313233343536373839616263646566-0", "30313233343536373839616263646566-x"} {
+		if _, _, err := parseTxnID(id); err != ErrInvalidTxnID {
+			t.Errorf("%q: expected ErrInvalidTxnID, got %v", id, err)
+		}
+	}
+}
+
+func TestRecordStatus(t *testing.T) {
+	testCases := []struct {
+		name string
+		rec  *sessionTxnRecord
+		want TxnStatus
+	}{
+		{"no record", nil, TxnStatusUnknown},
+		{"earlier transaction", &sessionTxnRecord{TxnNumber: 2, State: "committed"}, TxnStatusUnknown},
+		{"later transaction", &sessionTxnRecord{TxnNumber: 4, State: "committed"}, TxnStatusUnknown},
+		{"committed", &sessionTxnRecord{TxnNumber: 3, State: "committed"}, TxnStatusCommitted},
+		{"committed without state", &sessionTxnRecord{TxnNumber: 3}, TxnStatusCommitted},
+		{"aborted", &sessionTxnRecord{TxnNumber: 3, State: "aborted"}, TxnStatusAborted},
+		{"prepared", &sessionTxnRecord{TxnNumber: 3, State: "prepared"}, TxnStatusActive},
+		{"in progress", &sessionTxnRecord{TxnNumber: 3, State: "inProgress"}, TxnStatusActive},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := recordStatus(tc.rec, 3); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTxnID(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+
+	h := newTestHandle()
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// finished transactions can still be looked up.
+	m.revoke(h)
+
+	id, err := m.TxnID(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != h.ID() {
+		t.Errorf("expected %s, got %s", h.ID(), id)
+	}
+	if _, err := m.TxnID("garbage"); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	if _, err := m.Status(context.Background(), "garbage"); err != ErrInvalidTxnID {
+		t.Errorf("expected ErrInvalidTxnID, got %v", err)
+	}
+}
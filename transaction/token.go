@@ -0,0 +1,276 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tokenVersion is the prefix of every token produced by this package. It is bumped whenever the
+// layout of the signed payload changes in an incompatible way.
+const tokenVersion = "v1"
+
+// nonceLen is the number of random bytes mixed into each token.
+const nonceLen = 8
+
+// ErrInvalidToken is returned when a token is malformed or its signature does not match.
+var ErrInvalidToken = errors.New("invalid transaction token")
+
+// ErrUnknownTokenKey is returned when a token was signed with a key that is not in the key set.
+var ErrUnknownTokenKey = errors.New("transaction token signed with unknown key")
+
+// ErrTokenExpired is returned when a token is used after its expiry time.
+var ErrTokenExpired = errors.New("transaction token expired")
+
+// ErrTokenReplayed is returned when a token refers to a transaction that has already been
+// committed or aborted.
+var ErrTokenReplayed = errors.New("transaction token refers to a finished transaction")
+
+// timeNow is the clock used by the package, replaced in tests.
+var timeNow = time.Now
+
+// TxnHandle is the payload carried by a transaction token. It identifies a transaction on the
+// server. The token signs the handle but does not encrypt it, so its fields can be read by anyone
+// holding the token.
+type TxnHandle struct {
+	SessionID      []byte      `bson:"lsid"`
+	TxnNumber      int64       `bson:"txnNumber"`
+	IssuedAt       time.Time   `bson:"iat"`
+	ExpiresAt      time.Time   `bson:"exp"`
+	LeaseExpiresAt time.Time   `bson:"lease"`        // the lease deadline when the token was issued
+	StartedAt      time.Time   `bson:"st,omitempty"` // when the transaction was started
+	Options        *TxnOptions `bson:"opts,omitempty"`
+	Nonce          []byte      `bson:"nonce"`
+
+	// the causal consistency times observed by the last node that exported the token.
+	ClusterTime   bson.Raw             `bson:"ct,omitempty"`
+	OperationTime *primitive.Timestamp `bson:"ot,omitempty"`
+
+	// the mongos the transaction is pinned to and the recovery token of the transaction on a
+	// sharded cluster, as observed by the last node that exported the token.
+	PinnedServer  string   `bson:"mongos,omitempty"`
+	RecoveryToken bson.Raw `bson:"rt,omitempty"`
+}
+
+// ID returns a stable identifier for the transaction described by the handle. Tokens issued
+// for the same transaction share the same ID.
+func (h *TxnHandle) ID() string {
+	return fmt.Sprintf("%x-%d", h.SessionID, h.TxnNumber)
+}
+
+// KeySet holds the HMAC keys used to sign and verify transaction tokens. New tokens are signed
+// with the current key; tokens signed with any key still in the set are accepted, so keys can be
+// rotated without invalidating transactions that are in flight.
+type KeySet struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeySet creates a KeySet whose current signing key is secret, identified by id.
+func NewKeySet(id string, secret []byte) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string][]byte)}
+	if err := ks.Rotate(id, secret); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewRandomKeySet creates a KeySet with a single random key. Tokens signed by it can only be
+// verified in the same process, so it is only suitable for tests and single node deployments.
+func NewRandomKeySet() (*KeySet, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewKeySet("random", secret)
+}
+
+// Rotate adds a key to the set and makes it the current signing key.
+func (k *KeySet) Rotate(id string, secret []byte) error {
+	if id == "" || strings.Contains(id, ".") {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	if len(secret) < 16 {
+		return errors.New("token key must be at least 16 bytes")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), secret...)
+	k.current = id
+	return nil
+}
+
+// Retire removes a key from the set. Tokens signed with it are rejected afterwards. The
+// current key cannot be retired.
+func (k *KeySet) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.current {
+		return fmt.Errorf("cannot retire current key %q", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+func (k *KeySet) currentKey() (string, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *KeySet) key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secret, ok := k.keys[id]
+	return secret, ok
+}
+
+// encodeToken signs the handle with the current key of the key set. The token layout is
+// version.keyID.payload.signature, where payload is the BSON encoded handle and both payload
+// and signature are base64url encoded.
+func encodeToken(keys *KeySet, h *TxnHandle) (string, error) {
+	if len(h.Nonce) == 0 {
+		h.Nonce = make([]byte, nonceLen)
+		if _, err := rand.Read(h.Nonce); err != nil {
+			return "", err
+		}
+	}
+
+	payload, err := bson.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+
+	kid, secret := keys.currentKey()
+	signed := tokenVersion + "." + kid + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(secret, signed)), nil
+}
+
+// decodeToken verifies the signature of a token and returns its handle. It does not check
+// expiry; that is left to the caller so that expired tokens can still be inspected.
+func decodeToken(keys *KeySet, token string) (*TxnHandle, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != tokenVersion {
+		return nil, ErrInvalidToken
+	}
+
+	secret, ok := keys.key(parts[1])
+	if !ok {
+		return nil, ErrUnknownTokenKey
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := token[:len(token)-len(parts[3])-1]
+	if !hmac.Equal(mac, sign(secret, signed)) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	h := new(TxnHandle)
+	if err := bson.Unmarshal(payload, h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if len(h.SessionID) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	return h, nil
+}
+
+func sign(secret []byte, signed string) []byte {
+	m := hmac.New(sha256.New, secret)
+	_, _ = m.Write([]byte(signed))
+	return m.Sum(nil)
+}
+
+// ReplayGuard records finished transactions so that tokens referring to them are rejected.
+type ReplayGuard interface {
+	// Revoke marks the transaction described by the handle as finished.
+	Revoke(h *TxnHandle)
+	// Revoked reports whether the transaction described by the handle has finished.
+	Revoked(h *TxnHandle) bool
+}
+
+// memoryReplayGuard is the default ReplayGuard. It remembers finished transactions, and how they
+// ended, until the tokens issued for them expire.
+type memoryReplayGuard struct {
+	mu       sync.Mutex
+	revoked  map[string]time.Time
+	outcomes map[string]TxnState
+}
+
+// NewMemoryReplayGuard creates a ReplayGuard that keeps its state in process memory. It is an
+// OutcomeGuard.
+func NewMemoryReplayGuard() ReplayGuard {
+	return &memoryReplayGuard{
+		revoked:  make(map[string]time.Time),
+		outcomes: make(map[string]TxnState),
+	}
+}
+
+func (g *memoryReplayGuard) Revoke(h *TxnHandle) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.revoke(h)
+}
+
+func (g *memoryReplayGuard) revoke(h *TxnHandle) {
+	now := timeNow()
+	for id, exp := range g.revoked {
+		if now.After(exp) {
+			delete(g.revoked, id)
+			delete(g.outcomes, id)
+		}
+	}
+	g.revoked[h.ID()] = h.ExpiresAt
+}
+
+func (g *memoryReplayGuard) Finish(h *TxnHandle, outcome TxnState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.revoke(h)
+	g.outcomes[h.ID()] = outcome
+}
+
+func (g *memoryReplayGuard) Outcome(h *TxnHandle) (TxnState, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, ok := g.outcomes[h.ID()]
+	return state, ok
+}
+
+func (g *memoryReplayGuard) Revoked(h *TxnHandle) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.revoked[h.ID()]
+	return ok
+}
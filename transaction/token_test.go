@@ -0,0 +1,149 @@
+package Transaction
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func newTestKeySet(t *testing.T, id string) *KeySet {
+	ks, err := NewKeySet(id, []byte("0123456789abcdef-"+id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func newOfflineManager(t *testing.T, opts ...*ManagerOptions) *TxnManager {
+	cli, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewTxnManager(cli, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func newTestHandle() *TxnHandle {
+	now := timeNow()
+	return &TxnHandle{
+		SessionID: []byte("0123456789abcdef"),
+		TxnNumber: 3,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	h := newTestHandle()
+
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "MDEyMzQ1Njc4OWFiY2RlZg") {
+		t.Errorf("token leaks the base64 session id: %s", token)
+	}
+
+	got, err := decodeToken(ks, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID() != h.ID() || got.TxnNumber != 3 || !got.ExpiresAt.Equal(h.ExpiresAt.Truncate(time.Millisecond)) {
+		t.Errorf("decoded handle %+v does not match %+v", got, h)
+	}
+}
+
+func TestTokenRejectsTampering(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	token, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, err := encodeToken(newTestKeySet(t, "k1"), &TxnHandle{SessionID: []byte("fedcba9876543210"), ExpiresAt: timeNow().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedParts := strings.Split(forged, ".")
+
+	cases := map[string]struct {
+		token string
+		err   error
+	}{
+		"swapped payload": {strings.Join([]string{parts[0], parts[1], forgedParts[2], parts[3]}, "."), ErrInvalidToken},
+		"wrong version":   {"v0" + token[2:], ErrInvalidToken},
+		"unknown key":     {strings.Join([]string{parts[0], "k2", parts[2], parts[3]}, "."), ErrUnknownTokenKey},
+		"truncated":       {parts[0] + "." + parts[1], ErrInvalidToken},
+		"raw session id":  {"MDEyMzQ1Njc4OWFiY2RlZg==", ErrInvalidToken},
+	}
+	for name, tc := range cases {
+		if _, err := decodeToken(ks, tc.token); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	old, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ks.Rotate("k2", []byte("fedcba9876543210fedcba")); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := encodeToken(ks, newTestHandle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fresh, tokenVersion+".k2.") {
+		t.Errorf("expected new token to be signed with k2, got %s", fresh)
+	}
+	if _, err := decodeToken(ks, old); err != nil {
+		t.Errorf("token signed with previous key rejected: %v", err)
+	}
+
+	if err := ks.Retire("k2"); err == nil {
+		t.Error("expected retiring the current key to fail")
+	}
+	if err := ks.Retire("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeToken(ks, old); err != ErrUnknownTokenKey {
+		t.Errorf("expected ErrUnknownTokenKey after retiring k1, got %v", err)
+	}
+}
+
+func TestVerifyTokenExpiredAndReplayed(t *testing.T) {
+	ks := newTestKeySet(t, "k1")
+	m := newOfflineManager(t, Manager().SetKeySet(ks))
+
+	h := newTestHandle()
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.verifyToken(token); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	m.guard.Revoke(h)
+	if _, err := m.verifyToken(token); err != ErrTokenReplayed {
+		t.Errorf("expected ErrTokenReplayed, got %v", err)
+	}
+
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := m.verifyToken(token); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
@@ -15,94 +15,445 @@ package Transaction
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync"
 
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
 )
 
-var (
-	client *mongo.Client
-)
+// ErrNilClient is returned when a TxnManager is created without a client.
+var ErrNilClient = errors.New("transaction manager requires a non-nil client")
+
+// TxnError is returned when the server fails to commit or abort a transaction. Err is the error
+// returned by the driver, such as a mongo.CommandError carrying error labels.
+type TxnError struct {
+	Op  string // "commit" or "abort"
+	ID  string // the id of the transaction
+	Err error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("%s transaction: %s failed, err: %v", e.Op, e.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the driver.
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoRegistry is returned when an operation needs the transaction registry but the manager was
+// created without one.
+var ErrNoRegistry = errors.New("transaction manager has no registry configured")
+
+// TxnManager drives distributed transactions against a single cluster. A process may hold
+// several managers, one for each *mongo.Client it talks to.
+//
+// Transactions are identified by signed tokens rather than by the raw logical session id, so a
+// token can be passed between service nodes without letting them forge or extend transactions.
+type TxnManager struct {
+	client   *mongo.Client
+	opts     *ManagerOptions
+	keys     *KeySet
+	guard    ReplayGuard
+	registry *Registry
+	node     string
+	leases   *leaseTracker
+	locker   *txnLocker
+	pins     *pinTracker
+	monitor  *event.TransactionMonitor
+
+	sweepMu   sync.Mutex
+	sweepStop chan struct{}
+	sweepDone chan struct{}
+}
+
+// NewTxnManager creates a TxnManager that uses the given client for every transaction it starts,
+// reloads, commits or aborts.
+func NewTxnManager(cli *mongo.Client, opts ...*ManagerOptions) (*TxnManager, error) {
+	if cli == nil {
+		return nil, ErrNilClient
+	}
+
+	m := &TxnManager{
+		client: cli,
+		opts:   MergeManagerOptions(opts...),
+		leases: newLeaseTracker(),
+		locker: newTxnLocker(),
+		pins:   newPinTracker(),
+	}
+
+	m.keys = m.opts.KeySet
+	if m.keys == nil {
+		keys, err := NewRandomKeySet()
+		if err != nil {
+			return nil, fmt.Errorf("generate token key failed, err: %v", err)
+		}
+		m.keys = keys
+	}
+
+	m.guard = m.opts.ReplayGuard
+	if m.guard == nil {
+		m.guard = NewMemoryReplayGuard()
+	}
+
+	if m.opts.Registry != nil {
+		m.registry = NewRegistry(m.opts.Registry)
+	}
+
+	m.node = defaultNodeID()
+	if m.opts.NodeID != nil {
+		m.node = *m.opts.NodeID
+	}
+
+	m.monitor = m.opts.Monitor
+	if m.monitor == nil {
+		m.monitor = mongo.TxnMonitor(cli)
+	}
+
+	return m, nil
+}
+
+// Client returns the client used by the manager.
+func (m *TxnManager) Client() *mongo.Client {
+	return m.client
+}
+
+// Registry returns the registry of the manager, or nil if none is configured.
+func (m *TxnManager) Registry() *Registry {
+	return m.registry
+}
+
+// NodeID returns the id this manager records as the owner of the transactions it starts.
+func (m *TxnManager) NodeID() string {
+	return m.node
+}
+
+// record updates the registry entry of a transaction if a registry is configured.
+func (m *TxnManager) record(ctx context.Context, handle *TxnHandle, state TxnState) error {
+	if m.registry == nil {
+		return nil
+	}
+	if err := m.registry.setState(ctx, handle.ID(), state); err != nil {
+		return fmt.Errorf("record transaction: %s as %s failed, err: %v", handle.ID(), state, err)
+	}
+	return nil
+}
+
+// revoke rejects the tokens of a transaction whose outcome is unknown from now on and drops its
+// lease.
+func (m *TxnManager) revoke(handle *TxnHandle) {
+	m.finish(handle, "")
+}
 
 // CommitTransaction 提交事务
-func CommitTransaction(ctx context.Context, txnUUID string) error {
+//
+// Committing a transaction that has already been committed, by this node or another one, succeeds;
+// committing an aborted transaction fails with ErrAlreadyAborted.
+func (m *TxnManager) CommitTransaction(ctx context.Context, txnToken string) error {
+	handle, err := m.verifyToken(txnToken)
+	if err == ErrTokenReplayed {
+		return m.resolveCommit(ctx, handle, err)
+	}
+	if err != nil {
+		return err
+	}
 
-	reloadSession, _, err := reloadSession(ctx, client, txnUUID)
+	return m.commit(ctx, handle, false)
+}
+
+// commit commits the transaction described by handle. retrying is true if an earlier commit
+// attempt of the transaction may have reached the server, in which case the commit is sent with
+// a majority write concern as the transactions spec requires. A retried commit of a transaction
+// with a recovery token is not pinned, so it can go through another mongos if the pinned one is
+// unavailable.
+func (m *TxnManager) commit(ctx context.Context, handle *TxnHandle, retrying bool) (err error) {
+	defer func() { m.publish(ctx, event.TransactionCommit, handle, err) }()
+
+	if state, ok := m.guardOutcome(handle); ok {
+		if state == TxnStateAborted {
+			return ErrAlreadyAborted
+		}
+		return nil
+	}
+	// another attempt or another node may have finished the transaction while this one failed.
+	defer func() {
+		if _, quorum := err.(*QuorumError); err != nil && !quorum {
+			err = m.resolveCommit(ctx, handle, err)
+		}
+	}()
+
+	// renewing the lease keeps the sweeper away while the commit is in flight.
+	if err := m.renewLease(ctx, handle); err != nil {
+		return err
+	}
+
+	// the transaction is only committed once all its participants are done.
+	if err := m.awaitQuorum(ctx, handle); err != nil {
+		return err
+	}
+
+	target := m.pins.apply(handle)
+	if retrying && target.RecoveryToken != nil {
+		target = target.unpinned()
+	}
+
+	reloadSession, err := m.reloadSession(ctx, target, false)
 	if err != nil {
 		return err
 	}
+	defer m.ReleaseSession(ctx, reloadSession)
+
+	if err := m.record(ctx, handle, TxnStateCommitting); err != nil {
+		return err
+	}
+
+	if retrying {
+		mongo.TxnUpdateCommitWriteConcern(reloadSession)
+	}
 
 	// we commit the transaction with the session id
 	err = reloadSession.CommitTransaction(ctx)
 	if err != nil {
-		return fmt.Errorf("commit transaction: %s failed, err: %v", txnUUID, err)
+		return &TxnError{Op: "commit", ID: handle.ID(), Err: err}
 	}
+	m.finish(handle, TxnStateCommitted)
 
-	return nil
+	return m.record(ctx, handle, TxnStateCommitted)
 }
 
 // AbortTransaction 取消事务
-func AbortTransaction(ctx context.Context, txnUUID string) error {
-	reloadSession, _, err := reloadSession(ctx, client, txnUUID)
+//
+// Aborting a transaction that has already been aborted succeeds; aborting a committed transaction
+// fails with ErrAlreadyCommitted.
+func (m *TxnManager) AbortTransaction(ctx context.Context, txnToken string) error {
+	handle, err := m.verifyToken(txnToken)
+	if err == ErrTokenReplayed {
+		return m.resolveAbort(ctx, handle, err)
+	}
 	if err != nil {
 		return err
 	}
 
+	return m.abort(ctx, handle)
+}
+
+func (m *TxnManager) abort(ctx context.Context, handle *TxnHandle) (err error) {
+	defer func() { m.publish(ctx, event.TransactionAbort, handle, err) }()
+
+	if state, ok := m.outcome(ctx, handle, false); ok {
+		if state == TxnStateCommitted {
+			return ErrAlreadyCommitted
+		}
+		return nil
+	}
+
+	reloadSession, err := m.reloadSession(ctx, handle, false)
+	if err != nil {
+		return m.resolveAbort(ctx, handle, err)
+	}
+	defer m.ReleaseSession(ctx, reloadSession)
+
 	// we abort the transaction with the session id
 	err = reloadSession.AbortTransaction(ctx)
 	if err != nil {
-		return fmt.Errorf("abort transaction: %s failed, err: %v", txnUUID, err)
+		return m.resolveAbort(ctx, handle, &TxnError{Op: "abort", ID: handle.ID(), Err: err})
 	}
 
-	return nil
+	// the driver ignores the errors of abortTransaction, so the transaction may have been
+	// committed by another node in the meantime. If that cannot be told, its outcome stays unknown
+	// and a later abort resolves it.
+	rec, err := m.sessionRecord(ctx, handle.SessionID)
+	if err != nil {
+		m.revoke(handle)
+		return &TxnError{Op: "abort", ID: handle.ID(), Err: err}
+	}
+	if recordStatus(rec, handle.TxnNumber) == TxnStatusCommitted {
+		m.finish(handle, TxnStateCommitted)
+		return ErrAlreadyCommitted
+	}
+	m.finish(handle, TxnStateAborted)
+
+	return m.record(ctx, handle, TxnStateAborted)
 }
 
-func StartTransaction(ctx context.Context, cli *mongo.Client) (mongo.Session, string, error) {
-	return reloadSession(ctx, cli, "")
+// StartTransaction starts a new transaction and returns the session bound to it together with
+// the signed token that other nodes use to join it. The transaction options are carried by the
+// token and applied by every node that reloads the transaction.
+func (m *TxnManager) StartTransaction(ctx context.Context, opts ...*options.TransactionOptions) (mongo.Session, string, error) {
+	to, err := newTxnOptions(opts...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mUUID, err := uuid.New()
+	if err != nil {
+		return nil, "", fmt.Errorf("generate txn number failed, err: %v", err)
+	}
+
+	sess, token, _, err := m.startTransaction(ctx, mUUID[:], 1, to)
+	return sess, token, err
 }
 
-func ReloadSession(ctx context.Context, cli *mongo.Client, txnUUID string) (mongo.Session, error) {
-	sess, _, err := reloadSession(ctx, cli, txnUUID)
-	return sess, err
+// StartNextTransaction starts a new transaction on the logical session of the transaction
+// identified by txnToken, using the next txnNumber. The previous transaction should have been
+// committed or aborted; if it is still running the server aborts it, and its tokens are rejected
+// from now on either way. Without options the new transaction uses the options of the previous one.
+func (m *TxnManager) StartNextTransaction(ctx context.Context, txnToken string, opts ...*options.TransactionOptions) (mongo.Session, string, error) {
+	prev, err := decodeToken(m.keys, txnToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if !timeNow().Before(prev.ExpiresAt) {
+		return nil, "", ErrTokenExpired
+	}
+
+	to := prev.Options
+	if len(opts) != 0 {
+		if to, err = newTxnOptions(opts...); err != nil {
+			return nil, "", err
+		}
+	}
+
+	m.revoke(prev)
+	sess, token, _, err := m.startTransaction(ctx, prev.SessionID, prev.TxnNumber+1, to)
+	return sess, token, err
+}
+
+func (m *TxnManager) startTransaction(ctx context.Context, sessionID []byte, txnNumber int64, to *TxnOptions) (mongo.Session, string, *TxnHandle, error) {
+	now := timeNow()
+	handle := &TxnHandle{
+		SessionID:      sessionID,
+		TxnNumber:      txnNumber,
+		IssuedAt:       now,
+		ExpiresAt:      now.Add(*m.opts.TokenTTL),
+		LeaseExpiresAt: now.Add(*m.opts.LeaseDuration),
+		StartedAt:      now,
+		Options:        to,
+	}
+
+	token, err := encodeToken(m.keys, handle)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("issue transaction token failed, err: %v", err)
+	}
+
+	if m.registry != nil {
+		if err := m.registry.insert(ctx, m.node, handle); err != nil {
+			return nil, "", nil, fmt.Errorf("register transaction: %s failed, err: %v", handle.ID(), err)
+		}
+	}
+	m.leases.renew(handle, handle.LeaseExpiresAt)
+
+	sess, err := m.reloadSession(ctx, handle, true)
+	m.publish(ctx, event.TransactionStarted, handle, err)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return sess, token, handle, nil
 }
 
-func reloadSession(ctx context.Context, cli *mongo.Client, txnUUID string) (mongo.Session, string, error) {
-	// create a session client.
-	sess, err := cli.StartSession()
+// ReloadSession creates a session that joins the transaction identified by txnToken and renews
+// the lease of the transaction. Forged, expired and replayed tokens are rejected, and so are
+// transactions whose lease expired.
+func (m *TxnManager) ReloadSession(ctx context.Context, txnToken string) (mongo.Session, error) {
+	handle, err := m.verifyToken(txnToken)
 	if err != nil {
-		return nil, txnUUID, fmt.Errorf("start session failed, err: %v", err)
+		return nil, err
+	}
+
+	if err := m.renewLease(ctx, handle); err != nil {
+		m.publish(ctx, event.TransactionReloaded, handle, err)
+		return nil, err
 	}
 
-	// only for changing the transaction status
-	err = sess.StartTransaction()
+	sess, err := m.reloadSession(ctx, handle, false)
+	m.publish(ctx, event.TransactionReloaded, handle, err)
+	return sess, err
+}
+
+// verifyToken checks the signature, expiry and replay state of a token and returns its handle. The
+// handle is returned along with ErrTokenReplayed, so the outcome of the transaction can be looked up.
+func (m *TxnManager) verifyToken(txnToken string) (*TxnHandle, error) {
+	handle, err := decodeToken(m.keys, txnToken)
 	if err != nil {
-		return nil, txnUUID, fmt.Errorf("start transaction %s failed: %v", txnUUID, err)
+		return nil, err
 	}
 
-	var txnNumber int64
-	if txnUUID == "" {
-		mUUID, err := uuid.New()
-		if err != nil {
-			return nil, txnUUID, fmt.Errorf("generate txn number failed, err: %v", err)
+	if !timeNow().Before(handle.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	if m.guard.Revoked(handle) {
+		return handle, ErrTokenReplayed
+	}
+
+	return handle, nil
+}
+
+func (m *TxnManager) reloadSession(ctx context.Context, handle *TxnHandle, starting bool) (mongo.Session, error) {
+	// route the session to the mongos the transaction is pinned to, if this process knows it.
+	handle = m.pins.apply(handle)
+
+	mode := ConcurrencyNone
+	if m.opts.Concurrency != nil {
+		mode = *m.opts.Concurrency
+	}
+	if mode != ConcurrencyNone {
+		if err := m.locker.acquire(ctx, handle.ID(), mode == ConcurrencyFailFast); err != nil {
+			return nil, err
 		}
-		txnUUID = base64.StdEncoding.EncodeToString(mUUID[:])
-		txnNumber = 1
-	} else {
-		txnNumber = 2
+	}
 
+	topts, err := handle.Options.transactionOptions()
+	if err != nil {
+		if mode != ConcurrencyNone {
+			m.locker.release(handle.ID())
+		}
+		return nil, fmt.Errorf("reload transaction: %s failed, err: %v", handle.ID(), err)
 	}
 
-	// reset the session info with the session id.
+	// reset the session info with the session id. only the starting session sends
+	// startTransaction, every other session joins the running transaction.
 	info := &mongo.TxnSession{
-		TxnNubmer: txnNumber,
-		SessionID: txnUUID,
+		TxnNubmer:          handle.TxnNumber,
+		SessionID:          base64.StdEncoding.EncodeToString(handle.SessionID),
+		Started:            !starting,
+		TransactionOptions: topts,
+		PinnedServer:       handle.PinnedServer,
+		RecoveryToken:      handle.RecoveryToken,
 	}
 
-	err = mongo.TnxReloadSession(sess, info)
+	// the session owns a dedicated server session, it is never taken from or returned to the
+	// session pool of the client.
+	sess, err := mongo.TxnStartSession(m.client, info, m.opts.SessionOptions)
 	if err != nil {
-		return nil, txnUUID, fmt.Errorf("reload transaction: %s failed, err: %v", txnUUID, err)
+		if mode != ConcurrencyNone {
+			m.locker.release(handle.ID())
+		}
+		return nil, fmt.Errorf("reload transaction: %s failed, err: %v", handle.ID(), err)
+	}
+	if mode != ConcurrencyNone {
+		m.locker.bind(sess, handle.ID())
 	}
 
-	return sess, txnUUID, nil
+	// order the session after the work of the node that exported the token.
+	if err := advanceSession(sess, handle); err != nil {
+		m.ReleaseSession(ctx, sess)
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// ReleaseSession releases a session returned by StartTransaction or ReloadSession once the node
+// is done with it. The transaction keeps running on the server and the session pool of the client
+// is left untouched. Other sessions of this process waiting for the transaction may proceed.
+func (m *TxnManager) ReleaseSession(ctx context.Context, sess mongo.Session) {
+	m.pins.record(sess)
+	mongo.TxnReleaseSession(ctx, sess)
+	m.locker.releaseSession(sess)
 }
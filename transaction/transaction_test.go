@@ -3,14 +3,24 @@ package Transaction
 import (
 	"context"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
 )
 
-var dbName string
+var (
+	dbName string
+	client *mongo.Client
+	mgr    *TxnManager
+
+	fakeOnce   sync.Once
+	fakeServer *drivertest.Server
+	fakeErr    error
+)
 
 func initMongoClient(t *testing.T) {
 	disableWriteRetry := false
@@ -21,10 +31,23 @@ func initMongoClient(t *testing.T) {
 		export mongodb_connect_uri=mongodb://user:password@ip:port/dbname?authMechanism=SCRAM-SHA-1
 		export mongodb_rsname=replica set name
 		export mongodb_dbname=dbname
+
+		without mongodb_connect_uri, the tests run against an in-process drivertest.Server.
 	*/
 	rsName := os.Getenv("mongodb_rsname")
 	cnnectURI := os.Getenv("mongodb_connect_uri")
 	dbName = os.Getenv("mongodb_dbname")
+	if cnnectURI == "" {
+		fakeOnce.Do(func() { fakeServer, fakeErr = drivertest.NewServer() })
+		if fakeErr != nil {
+			t.Error(fakeErr.Error())
+			return
+		}
+		cnnectURI, rsName = fakeServer.URI(), drivertest.ReplicaSetName
+		if dbName == "" {
+			dbName = "txn_test"
+		}
+	}
 	conOpt := options.ClientOptions{
 		MaxPoolSize:    &maxPoolSize,
 		MinPoolSize:    &minPoolSize,
@@ -46,6 +69,12 @@ func initMongoClient(t *testing.T) {
 		return
 	}
 
+	mgr, err = NewTxnManager(client)
+	if nil != err {
+		t.Error(err.Error())
+		return
+	}
+
 }
 
 func TestTransaction(t *testing.T) {
@@ -57,14 +86,14 @@ func TestTransaction(t *testing.T) {
 	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
 
 	table := db.Collection(tableName)
-	txnSess, txnUUID, err := StartTransaction(ctx, client)
+	txnSess, txnUUID, err := mgr.StartTransaction(ctx)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	txnCtx1 := mongo.TxnContextWithSession(ctx, txnSess)
 
-	txnSess2, txnUUID2, err := StartTransaction(ctx, client)
+	txnSess2, txnUUID2, err := mgr.StartTransaction(ctx)
 	if err != nil {
 		t.Error(err)
 		return
@@ -143,12 +172,12 @@ func TestTransaction(t *testing.T) {
 
 	// 提交事务
 	// commit transaction
-	if err := CommitTransaction(txnCtx1, txnUUID); err != nil {
+	if err := mgr.CommitTransaction(txnCtx1, txnUUID); err != nil {
 		t.Error(err)
 		return
 	}
 
-	if err := AbortTransaction(txnCtx2, txnUUID2); err != nil {
+	if err := mgr.AbortTransaction(txnCtx2, txnUUID2); err != nil {
 		t.Error(err)
 		return
 	}
@@ -188,14 +217,14 @@ func TestDistributeTransaction(t *testing.T) {
 	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
 
 	table := db.Collection(tableName)
-	txnSessNode1, txnUUID, err := StartTransaction(ctx, client)
+	txnSessNode1, txnUUID, err := mgr.StartTransaction(ctx)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	txnCtxNode1 := mongo.TxnContextWithSession(ctx, txnSessNode1)
 
-	txnSessNode2, err := ReloadSession(ctx, client, txnUUID)
+	txnSessNode2, err := mgr.ReloadSession(ctx, txnUUID)
 	if err != nil {
 		t.Error(err)
 		return
@@ -228,7 +257,7 @@ func TestDistributeTransaction(t *testing.T) {
 	}
 
 	// node1  commit transaction
-	if err := CommitTransaction(txnCtxNode1, txnUUID); err != nil {
+	if err := mgr.CommitTransaction(txnCtxNode1, txnUUID); err != nil {
 		t.Error(err)
 		return
 	}
@@ -245,3 +274,595 @@ func TestDistributeTransaction(t *testing.T) {
 	}
 
 }
+
+func TestNewTxnManagerNilClient(t *testing.T) {
+	if _, err := NewTxnManager(nil); err != ErrNilClient {
+		t.Errorf("expected ErrNilClient, got %v", err)
+	}
+}
+
+func TestRegistryRecover(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName, registryName := "test", "test_txn_registry"
+	db.Collection(tableName).Drop(ctx)
+	db.Collection(registryName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	db.RunCommand(ctx, map[string]interface{}{"create": registryName})
+
+	opts := Manager().SetRegistry(db.Collection(registryName)).SetNodeID("node1")
+	crashed, err := NewTxnManager(client, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// node1 starts a transaction and dies before committing it
+	txnSess, _, err := crashed.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	table := db.Collection(tableName)
+	if _, err := table.InsertOne(mongo.TxnContextWithSession(ctx, txnSess), map[string]interface{}{"txn": "orphan"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// node1 restarts and recovers its orphaned transactions
+	restarted, err := NewTxnManager(client, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	recovered, err := restarted.Recover(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(recovered) != 1 || recovered[0].Err != nil || recovered[0].State != TxnStateAborted {
+		t.Errorf("unexpected recover result: %+v", recovered)
+		return
+	}
+
+	entry, err := restarted.Registry().Get(ctx, recovered[0].Entry.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if entry.State != TxnStateAborted {
+		t.Errorf("expected registry state %s, got %s", TxnStateAborted, entry.State)
+		return
+	}
+
+	cnt, err := table.CountDocuments(ctx, map[string]interface{}{"txn": "orphan"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 0 {
+		t.Error("orphaned transaction was not aborted")
+		return
+	}
+}
+
+func TestSuccessiveTransactions(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName := "test"
+	db.Collection(tableName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	table := db.Collection(tableName)
+
+	txnSess1, txnToken1, err := mgr.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := table.InsertOne(mongo.TxnContextWithSession(ctx, txnSess1), map[string]interface{}{"txn": 1}); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := mgr.CommitTransaction(ctx, txnToken1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the second transaction runs on the same lsid with txnNumber 2
+	txnSess2, txnToken2, err := mgr.StartNextTransaction(ctx, txnToken1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsid1, txnNumber1, _ := mongo.GetSessionTxnID(txnSess1)
+	lsid2, txnNumber2, _ := mongo.GetSessionTxnID(txnSess2)
+	if lsid1 != lsid2 || txnNumber1 != 1 || txnNumber2 != 2 {
+		t.Errorf("unexpected session ids: %s/%d and %s/%d", lsid1, txnNumber1, lsid2, txnNumber2)
+		return
+	}
+	if _, err := table.InsertOne(mongo.TxnContextWithSession(ctx, txnSess2), map[string]interface{}{"txn": 2}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// another node joins the second transaction with its exact txnNumber
+	txnSessNode2, err := mgr.ReloadSession(ctx, txnToken2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cnt, err := table.CountDocuments(mongo.TxnContextWithSession(ctx, txnSessNode2), map[string]interface{}{"txn": 2})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 1 {
+		t.Error("joined session does not see the data of the second transaction")
+		return
+	}
+
+	if err := mgr.CommitTransaction(ctx, txnToken2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the first token refers to a finished transaction
+	if _, err := mgr.ReloadSession(ctx, txnToken1); err != ErrTokenReplayed {
+		t.Errorf("expected ErrTokenReplayed, got %v", err)
+		return
+	}
+}
+
+func TestReloadBeforeStartNoSuchTransaction(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName := "test"
+	db.Collection(tableName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	table := db.Collection(tableName)
+
+	_, txnToken, err := mgr.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	txnSessNode2, err := mgr.ReloadSession(ctx, txnToken)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the starting session has not sent any command yet, so the server does not know the
+	// transaction and a joining session cannot run the first command.
+	_, err = table.InsertOne(mongo.TxnContextWithSession(ctx, txnSessNode2), map[string]interface{}{"txn": "node2"})
+	cerr, ok := err.(mongo.CommandError)
+	if !ok || cerr.Code != errCodeNoSuchTransaction {
+		t.Errorf("expected NoSuchTransaction, got %v", err)
+		return
+	}
+}
+
+func TestWithDistributedTransaction(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName := "test"
+	db.Collection(tableName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	table := db.Collection(tableName)
+
+	_, err := WithDistributedTransaction(ctx, mgr, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if _, err := table.InsertOne(sessCtx, map[string]interface{}{"txn": "node1"}); err != nil {
+			return nil, err
+		}
+
+		// node2 joins through the token carried by the context
+		carrier := MapCarrier{}
+		if !Inject(sessCtx, carrier) {
+			t.Error("no token in the transaction context")
+		}
+		node2Ctx, node2Sess, err := mgr.Join(ctx, carrier)
+		if err != nil {
+			return nil, err
+		}
+		defer mgr.ReleaseSession(node2Ctx, node2Sess)
+
+		return WithDistributedTransaction(node2Ctx, mgr, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return table.InsertOne(sessCtx, map[string]interface{}{"txn": "node2"})
+		})
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cnt, err := table.CountDocuments(ctx, map[string]interface{}{"txn": map[string]interface{}{"$in": []string{"node1", "node2"}}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 2 {
+		t.Errorf("expected 2 committed documents, got %d", cnt)
+		return
+	}
+}
+
+func TestCursorContinuation(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName := "test"
+	db.Collection(tableName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	table := db.Collection(tableName)
+
+	sess, token, err := mgr.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sessCtx := mongo.TxnContextWithSession(ctx, sess)
+	for i := 0; i < 5; i++ {
+		if _, err := table.InsertOne(sessCtx, map[string]interface{}{"txn": "cursor", "i": i}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// node1 reads the first document and hands the cursor on
+	cur, err := table.Find(sessCtx, map[string]interface{}{"txn": "cursor"}, options.Find().SetBatchSize(2).SetSort(map[string]interface{}{"i": 1}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !cur.Next(sessCtx) {
+		t.Errorf("expected a document, err: %v", cur.Err())
+		return
+	}
+	exported, err := ExportCursor(cur)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	mgr.ReleaseSession(ctx, sess)
+
+	// node2 continues the cursor under its own session of the transaction
+	node2Sess, err := mgr.ReloadSession(ctx, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	node2Ctx := mongo.TxnContextWithSession(ctx, node2Sess)
+	resumed, err := ResumeCursor(node2Ctx, node2Sess, exported)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var rest []map[string]interface{}
+	if err := resumed.All(node2Ctx, &rest); err != nil {
+		t.Error(err)
+		return
+	}
+	mgr.ReleaseSession(ctx, node2Sess)
+	if len(rest) != 4 {
+		t.Errorf("expected the 4 remaining documents, got %d", len(rest))
+		return
+	}
+
+	if err := mgr.CommitTransaction(ctx, token); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestParticipantQuorum(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName, registryName := "test", "test_txn_registry"
+	db.Collection(tableName).Drop(ctx)
+	db.Collection(registryName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	db.RunCommand(ctx, map[string]interface{}{"create": registryName})
+
+	m, err := NewTxnManager(client, Manager().SetRegistry(db.Collection(registryName)).SetQuorumTimeout(300*time.Millisecond))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sess, token, err := m.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	table := db.Collection(tableName)
+	if _, err := table.InsertOne(mongo.TxnContextWithSession(ctx, sess), map[string]interface{}{"txn": "quorum"}); err != nil {
+		t.Error(err)
+		return
+	}
+	m.ReleaseSession(ctx, sess)
+
+	if err := m.RegisterParticipant(ctx, token, "node2"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := m.MarkPrepared(ctx, token, "node2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// node2 is still working, the commit times out and leaves the transaction running
+	err = m.CommitTransaction(ctx, token)
+	if qerr, ok := err.(*QuorumError); !ok || qerr.Err != ErrQuorumTimeout || len(qerr.Pending) != 1 {
+		t.Errorf("expected quorum timeout for node2, got %v", err)
+		return
+	}
+
+	if err := m.MarkDone(ctx, token, "node2"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := m.CommitTransaction(ctx, token); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := m.MarkDone(ctx, token, "node2"); err != ErrTokenReplayed {
+		t.Errorf("expected ErrTokenReplayed after commit, got %v", err)
+	}
+	cnt, err := table.CountDocuments(ctx, map[string]interface{}{"txn": "quorum"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 1 {
+		t.Errorf("expected the committed document, got %d", cnt)
+	}
+}
+
+func TestCoordinatorTwoClusters(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName, logName := "test", "test_txn_decisions"
+	db.Collection(tableName).Drop(ctx)
+	db.Collection(logName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	db.RunCommand(ctx, map[string]interface{}{"create": logName})
+
+	decisions, err := NewCollectionDecisionLog(db.Collection(logName))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the same deployment stands in for both clusters, each branch is a transaction of its own.
+	coord, err := NewTxnCoordinator(map[string]*mongo.Client{"east": client, "west": client},
+		Coordinator().SetDecisionLog(decisions))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	gs, err := coord.Begin(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	table := db.Collection(tableName)
+	for _, cluster := range coord.Clusters() {
+		if _, err := table.InsertOne(mongo.TxnContextWithSession(ctx, gs.Session(cluster)), map[string]interface{}{"txn": cluster}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err := coord.Commit(ctx, gs); err != nil {
+		t.Error(err)
+		return
+	}
+
+	txn, err := decisions.Load(ctx, gs.ID())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if txn.State != GlobalCommitted {
+		t.Errorf("expected %s, got %s", GlobalCommitted, txn.State)
+	}
+	cnt, err := table.CountDocuments(ctx, map[string]interface{}{"txn": map[string]interface{}{"$in": []string{"east", "west"}}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 2 {
+		t.Errorf("expected 2 committed documents, got %d", cnt)
+	}
+}
+
+func TestTxnStatus(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName := "test"
+	db.Collection(tableName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+
+	sess, token, err := mgr.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	id, err := mgr.TxnID(token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := db.Collection(tableName).InsertOne(mongo.TxnContextWithSession(ctx, sess), map[string]interface{}{"txn": "status"}); err != nil {
+		t.Error(err)
+		return
+	}
+	mgr.ReleaseSession(ctx, sess)
+
+	if status, err := mgr.Status(ctx, id); err != nil || status != TxnStatusActive {
+		t.Errorf("expected the running transaction to be active, got %s, %v", status, err)
+		return
+	}
+
+	if err := mgr.CommitTransaction(ctx, token); err != nil {
+		t.Error(err)
+		return
+	}
+	if status, err := mgr.Status(ctx, id); err != nil || status != TxnStatusCommitted {
+		t.Errorf("expected the transaction to be committed, got %s, %v", status, err)
+	}
+}
+
+func TestCollectionAuditSink(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	auditName := "test_txn_audit"
+	db.Collection(auditName).Drop(ctx)
+
+	sink := NewCollectionAuditSink(db.Collection(auditName))
+	now := time.Now()
+	for _, rec := range []*AuditRecord{
+		{TxnID: "a-1", Command: "update", StartedAt: now.Add(time.Second)},
+		{TxnID: "a-1", Command: "find", StartedAt: now},
+		{TxnID: "b-1", Command: "insert", StartedAt: now},
+	} {
+		if err := sink.Write(ctx, rec); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	records, err := sink.Find(ctx, "a-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(records) != 2 || records[0].Command != "find" || records[1].Command != "update" {
+		t.Errorf("expected the find and update records in order, got %+v", records)
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	outboxName := "test_txn_outbox"
+	db.Collection(outboxName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": outboxName})
+	outbox := NewOutbox(db.Collection(outboxName))
+
+	_, err := WithDistributedTransaction(ctx, mgr, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return outbox.Add(sessCtx, "orders", "committed", map[string]interface{}{"id": 1})
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sess, token, err := mgr.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := outbox.Add(mongo.TxnContextWithSession(ctx, sess), "orders", "aborted", map[string]interface{}{"id": 2}); err != nil {
+		t.Error(err)
+		return
+	}
+	mgr.ReleaseSession(ctx, sess)
+	if err := mgr.AbortTransaction(ctx, token); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var published []*OutboxEvent
+	relay := NewOutboxRelay(outbox, PublisherFunc(func(_ context.Context, evt *OutboxEvent) error {
+		published = append(published, evt)
+		return nil
+	}), Relay().SetMode(RelayPoll))
+
+	n, err := relay.Deliver(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if n != 1 || len(published) != 1 || published[0].Key != "committed" || published[0].TxnID == "" {
+		t.Errorf("expected only the committed event to be published, got %d: %+v", n, published)
+		return
+	}
+
+	// delivered events are checkpointed and not published again.
+	if n, err := relay.Deliver(ctx); err != nil || n != 0 {
+		t.Errorf("expected nothing left to deliver, got %d, %v", n, err)
+	}
+}
+
+func TestIdempotentCommitAcrossNodes(t *testing.T) {
+	initMongoClient(t)
+	ctx := context.TODO()
+	db := client.Database(dbName)
+	tableName, registryName := "test", "test_txn_registry"
+	db.Collection(tableName).Drop(ctx)
+	db.Collection(registryName).Drop(ctx)
+	db.RunCommand(ctx, map[string]interface{}{"create": tableName})
+	db.RunCommand(ctx, map[string]interface{}{"create": registryName})
+
+	// two nodes share the token keys and the registry, but not their replay guards.
+	ks, err := NewRandomKeySet()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opts := Manager().SetKeySet(ks).SetRegistry(db.Collection(registryName))
+	node1, err := NewTxnManager(client, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	node2, err := NewTxnManager(client, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sess, token, err := node1.StartTransaction(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := db.Collection(tableName).InsertOne(mongo.TxnContextWithSession(ctx, sess), map[string]interface{}{"txn": "idempotent"}); err != nil {
+		t.Error(err)
+		return
+	}
+	node1.ReleaseSession(ctx, sess)
+
+	if err := node1.CommitTransaction(ctx, token); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := node1.CommitTransaction(ctx, token); err != nil {
+		t.Errorf("expected a second commit on the same node to succeed, got %v", err)
+	}
+	if err := node2.CommitTransaction(ctx, token); err != nil {
+		t.Errorf("expected a commit on another node to succeed, got %v", err)
+	}
+	if err := node2.AbortTransaction(ctx, token); err != ErrAlreadyCommitted {
+		t.Errorf("expected ErrAlreadyCommitted, got %v", err)
+	}
+
+	cnt, err := db.Collection(tableName).CountDocuments(ctx, map[string]interface{}{"txn": "idempotent"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 1 {
+		t.Errorf("expected the committed document, got %d", cnt)
+	}
+}
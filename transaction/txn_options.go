@@ -0,0 +1,150 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+// TxnOptions is the serialized form of the options.TransactionOptions chosen by the node that
+// started a transaction. Every node reloading the transaction applies them, so all participants
+// use the same read concern, write concern, read preference and max commit time.
+type TxnOptions struct {
+	ReadConcern     string    `bson:"rc,omitempty"`
+	WriteConcern    bson.Raw  `bson:"wc,omitempty"`
+	ReadPreference  int32     `bson:"rp,omitempty"`
+	MaxStalenessMS  int64     `bson:"rpMaxStaleness,omitempty"`
+	TagSets         []tag.Set `bson:"rpTagSets,omitempty"`
+	MaxCommitTimeMS int64     `bson:"mct,omitempty"`
+}
+
+// newTxnOptions serializes the given transaction options. It returns nil if no option is set.
+func newTxnOptions(opts ...*options.TransactionOptions) (*TxnOptions, error) {
+	topts := options.MergeTransactionOptions(opts...)
+	if topts.ReadConcern == nil && topts.WriteConcern == nil && topts.ReadPreference == nil && topts.MaxCommitTime == nil {
+		return nil, nil
+	}
+
+	to := new(TxnOptions)
+	if topts.ReadConcern != nil {
+		_, data, err := topts.ReadConcern.MarshalBSONValue()
+		if err != nil {
+			return nil, fmt.Errorf("invalid read concern: %v", err)
+		}
+		if level, ok := bson.Raw(data).Lookup("level").StringValueOK(); ok {
+			to.ReadConcern = level
+		}
+	}
+
+	if topts.WriteConcern != nil {
+		_, data, err := topts.WriteConcern.MarshalBSONValue()
+		switch err {
+		case nil:
+			to.WriteConcern = data
+		case writeconcern.ErrEmptyWriteConcern:
+			// the driver accepts a write concern without fields and does not send it.
+		default:
+			return nil, fmt.Errorf("invalid write concern: %v", err)
+		}
+	}
+
+	if rp := topts.ReadPreference; rp != nil {
+		to.ReadPreference = int32(rp.Mode())
+		if ms, ok := rp.MaxStaleness(); ok {
+			to.MaxStalenessMS = int64(ms / time.Millisecond)
+		}
+		to.TagSets = rp.TagSets()
+	}
+
+	if topts.MaxCommitTime != nil {
+		to.MaxCommitTimeMS = int64(*topts.MaxCommitTime / time.Millisecond)
+	}
+
+	return to, nil
+}
+
+// transactionOptions rebuilds the options.TransactionOptions described by to.
+func (to *TxnOptions) transactionOptions() (*options.TransactionOptions, error) {
+	topts := options.Transaction()
+	if to == nil {
+		return topts, nil
+	}
+
+	if to.ReadConcern != "" {
+		topts.SetReadConcern(readconcern.New(readconcern.Level(to.ReadConcern)))
+	}
+
+	if len(to.WriteConcern) != 0 {
+		wc, err := decodeWriteConcern(to.WriteConcern)
+		if err != nil {
+			return nil, err
+		}
+		topts.SetWriteConcern(wc)
+	}
+
+	if to.ReadPreference != 0 {
+		var rpOpts []readpref.Option
+		if to.MaxStalenessMS != 0 {
+			rpOpts = append(rpOpts, readpref.WithMaxStaleness(time.Duration(to.MaxStalenessMS)*time.Millisecond))
+		}
+		if len(to.TagSets) != 0 {
+			rpOpts = append(rpOpts, readpref.WithTagSets(to.TagSets...))
+		}
+		rp, err := readpref.New(readpref.Mode(to.ReadPreference), rpOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read preference: %v", err)
+		}
+		topts.SetReadPreference(rp)
+	}
+
+	if to.MaxCommitTimeMS != 0 {
+		mct := time.Duration(to.MaxCommitTimeMS) * time.Millisecond
+		topts.SetMaxCommitTime(&mct)
+	}
+
+	return topts, nil
+}
+
+func decodeWriteConcern(doc bson.Raw) (*writeconcern.WriteConcern, error) {
+	var wcOpts []writeconcern.Option
+	if w, err := doc.LookupErr("w"); err == nil {
+		switch w.Type {
+		case bsontype.Int32:
+			wcOpts = append(wcOpts, writeconcern.W(int(w.Int32())))
+		case bsontype.String:
+			if w.StringValue() == "majority" {
+				wcOpts = append(wcOpts, writeconcern.WMajority())
+			} else {
+				wcOpts = append(wcOpts, writeconcern.WTagSet(w.StringValue()))
+			}
+		default:
+			return nil, fmt.Errorf("invalid write concern w: %s", w)
+		}
+	}
+	if j, ok := doc.Lookup("j").BooleanOK(); ok {
+		wcOpts = append(wcOpts, writeconcern.J(j))
+	}
+	if wtimeout, ok := doc.Lookup("wtimeout").Int64OK(); ok {
+		wcOpts = append(wcOpts, writeconcern.WTimeout(time.Duration(wtimeout)*time.Millisecond))
+	}
+	return writeconcern.New(wcOpts...), nil
+}
@@ -0,0 +1,102 @@
+package Transaction
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+func TestTxnOptionsRoundTrip(t *testing.T) {
+	mct := 3 * time.Second
+	rp, err := readpref.New(readpref.NearestMode,
+		readpref.WithMaxStaleness(90*time.Second),
+		readpref.WithTagSets(tag.Set{{Name: "dc", Value: "sz"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority(), writeconcern.J(true), writeconcern.WTimeout(5*time.Second))).
+		SetReadPreference(rp).
+		SetMaxCommitTime(&mct)
+
+	to, err := newTxnOptions(topts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the options travel inside the signed token
+	ks := newTestKeySet(t, "k1")
+	h := newTestHandle()
+	h.Options = to
+	token, err := encodeToken(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeToken(ks, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decoded.Options.transactionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, wantRc, _ := topts.ReadConcern.MarshalBSONValue()
+	_, gotRc, _ := got.ReadConcern.MarshalBSONValue()
+	if !bytes.Equal(wantRc, gotRc) {
+		t.Errorf("read concern mismatch")
+	}
+	wc := got.WriteConcern
+	if wc.GetW() != "majority" || !wc.GetJ() || wc.GetWTimeout() != 5*time.Second {
+		t.Errorf("write concern mismatch: %v %v %v", wc.GetW(), wc.GetJ(), wc.GetWTimeout())
+	}
+	staleness, _ := got.ReadPreference.MaxStaleness()
+	if got.ReadPreference.Mode() != readpref.NearestMode || staleness != 90*time.Second ||
+		len(got.ReadPreference.TagSets()) != 1 || !got.ReadPreference.TagSets()[0].Contains("dc", "sz") {
+		t.Errorf("read preference mismatch: %+v", got.ReadPreference)
+	}
+	if got.MaxCommitTime == nil || *got.MaxCommitTime != mct {
+		t.Errorf("max commit time mismatch: %v", got.MaxCommitTime)
+	}
+}
+
+func TestTxnOptionsEmpty(t *testing.T) {
+	to, err := newTxnOptions()
+	if err != nil || to != nil {
+		t.Fatalf("expected no options, got %+v, %v", to, err)
+	}
+
+	topts, err := to.transactionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topts.ReadConcern != nil || topts.WriteConcern != nil || topts.ReadPreference != nil || topts.MaxCommitTime != nil {
+		t.Errorf("expected empty transaction options, got %+v", topts)
+	}
+}
+
+func TestTxnOptionsEmptyWriteConcern(t *testing.T) {
+	to, err := newTxnOptions(options.Transaction().SetWriteConcern(writeconcern.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != nil && len(to.WriteConcern) != 0 {
+		t.Errorf("expected no write concern, got %s", to.WriteConcern)
+	}
+
+	topts, err := to.transactionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topts.WriteConcern != nil {
+		t.Errorf("expected no write concern, got %+v", topts.WriteConcern)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Transaction
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+// withTransactionTimeout bounds the retries of WithDistributedTransaction, like the driver does
+// for Session.WithTransaction.
+var withTransactionTimeout = 120 * time.Second
+
+// WithDistributedTransaction runs fn inside a distributed transaction.
+//
+// If ctx carries a transaction token, as the contexts built by Middleware and Join do, fn joins
+// that transaction and its result is returned as is: the node that started the transaction is
+// the one that commits it and retries it. Otherwise a new transaction is started, fn is run and
+// the transaction is committed, retrying for TransientTransactionError and
+// UnknownTransactionCommitResult errors the same way Session.WithTransaction does. Retried commits
+// are sent with a majority write concern even though each attempt uses a reloaded session.
+//
+// The transaction options only apply to new transactions; a joined transaction keeps the
+// options it was started with. The context handed to fn carries the transaction token, so calls
+// made with it through Transport or Inject join the same transaction. fn may be run multiple
+// times due to retry attempts. Non-retryable and timed out errors are returned from this
+// function.
+func WithDistributedTransaction(ctx context.Context, mgr *TxnManager, fn func(sessCtx mongo.SessionContext) (interface{}, error),
+	opts ...*options.TransactionOptions) (interface{}, error) {
+	if token, ok := TokenFromContext(ctx); ok {
+		sess, err := mgr.ReloadSession(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		defer mgr.ReleaseSession(ctx, sess)
+
+		return fn(mongo.TxnContextWithSession(ctx, sess))
+	}
+
+	to, err := newTxnOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(withTransactionTimeout)
+	defer timeout.Stop()
+	for {
+		mUUID, err := uuid.New()
+		if err != nil {
+			return nil, err
+		}
+		sess, token, handle, err := mgr.startTransaction(ctx, mUUID[:], 1, to)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := fn(mongo.TxnContextWithSession(ContextWithToken(ctx, token), sess))
+		mgr.ReleaseSession(ctx, sess)
+		if err != nil {
+			_ = mgr.abort(ctx, handle)
+
+			select {
+			case <-timeout.C:
+				return nil, err
+			default:
+			}
+
+			if hasErrorLabel(err, driver.TransientTransactionError) {
+				continue
+			}
+			return res, err
+		}
+
+		retrying := false
+	CommitLoop:
+		for {
+			err = mgr.commit(ctx, handle, retrying)
+			if err == nil {
+				return res, nil
+			}
+
+			select {
+			case <-timeout.C:
+				return res, err
+			default:
+			}
+
+			if hasErrorLabel(err, driver.UnknownTransactionCommitResult) && !isMaxTimeMSExpired(err) {
+				retrying = true
+				continue
+			}
+			if hasErrorLabel(err, driver.TransientTransactionError) {
+				// the transaction is gone on the server, its tokens must not be used anymore.
+				mgr.finish(handle, TxnStateAborted)
+				_ = mgr.record(ctx, handle, TxnStateAborted)
+				break CommitLoop
+			}
+			return res, err
+		}
+	}
+}
+
+// commandError returns the mongo.CommandError behind err, if any.
+func commandError(err error) (mongo.CommandError, bool) {
+	if terr, ok := err.(*TxnError); ok {
+		err = terr.Err
+	}
+	cerr, ok := err.(mongo.CommandError)
+	return cerr, ok
+}
+
+func hasErrorLabel(err error, label string) bool {
+	cerr, ok := commandError(err)
+	return ok && cerr.HasErrorLabel(label)
+}
+
+func isMaxTimeMSExpired(err error) bool {
+	cerr, ok := commandError(err)
+	return ok && cerr.IsMaxTimeMSExpiredError()
+}
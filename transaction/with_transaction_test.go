@@ -0,0 +1,103 @@
+package Transaction
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/drivertest"
+)
+
+func TestErrorLabelsThroughTxnError(t *testing.T) {
+	transient := &TxnError{Op: "commit", ID: "id", Err: mongo.CommandError{
+		Code:   251,
+		Labels: []string{driver.TransientTransactionError},
+	}}
+	unknown := mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired", Labels: []string{driver.UnknownTransactionCommitResult}}
+
+	if !hasErrorLabel(transient, driver.TransientTransactionError) {
+		t.Error("label of wrapped command error not found")
+	}
+	if !hasErrorCode(transient, errCodeNoSuchTransaction) {
+		t.Error("code of wrapped command error not found")
+	}
+	if !hasErrorLabel(unknown, driver.UnknownTransactionCommitResult) || !isMaxTimeMSExpired(unknown) {
+		t.Error("labels of bare command error not found")
+	}
+	if hasErrorLabel(errors.New("plain"), driver.TransientTransactionError) {
+		t.Error("plain error reported a label")
+	}
+}
+
+func TestWithDistributedTransactionRetriesCommit(t *testing.T) {
+	srv, err := drivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var commits []bson.Raw
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			if evt.CommandName == "commitTransaction" {
+				mu.Lock()
+				commits = append(commits, evt.Command)
+				mu.Unlock()
+			}
+		},
+	}
+	// the first commit fails with ShutdownInProgress before reaching the server, so its result is
+	// unknown to the driver.
+	fi := driver.NewFaultInjector(driver.FailPoint{
+		Commands:  []string{"commitTransaction"},
+		Times:     1,
+		ErrorCode: 91,
+	})
+	ctx := context.Background()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(srv.URI()).SetRetryWrites(false).
+		SetMonitor(monitor).SetFaultInjector(fi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Disconnect(ctx)
+	m, err := NewTxnManager(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coll := cli.Database("test").Collection("commit_retry")
+	_, err = WithDistributedTransaction(ctx, m, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return coll.InsertOne(sessCtx, bson.M{"_id": 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Triggered() != 1 {
+		t.Errorf("expected the fault to be injected once, got %d", fi.Triggered())
+	}
+	if n := len(srv.Documents("test.commit_retry")); n != 1 {
+		t.Errorf("expected the transaction to be committed, got %d documents", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(commits) != 2 {
+		t.Fatalf("expected commitTransaction to be sent twice, got %d", len(commits))
+	}
+	if w, ok := commits[0].Lookup("writeConcern", "w").StringValueOK(); ok && w == "majority" {
+		t.Error("expected the first commit to use the write concern of the transaction")
+	}
+	if w, _ := commits[1].Lookup("writeConcern", "w").StringValueOK(); w != "majority" {
+		t.Errorf("expected the retried commit to use a majority write concern, got %s", commits[1])
+	}
+	if wtimeout, ok := commits[1].Lookup("writeConcern", "wtimeout").Int64OK(); !ok || wtimeout != 10000 {
+		t.Errorf("expected the retried commit to use a wtimeout of 10000, got %s", commits[1])
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
 )
@@ -23,6 +24,7 @@ type BatchCursor struct {
 	id                   int64
 	err                  error
 	server               Server
+	addr                 address.Address
 	batchSize            int32
 	maxTimeMS            int64
 	currentBatch         *bsoncore.DocumentSequence
@@ -113,6 +115,7 @@ func NewBatchCursor(cr CursorResponse, clientSession *session.Client, clock *ses
 		collection:           cr.Collection,
 		id:                   cr.ID,
 		server:               cr.Server,
+		addr:                 cr.Desc.Addr,
 		batchSize:            opts.BatchSize,
 		maxTimeMS:            opts.MaxTimeMS,
 		cmdMonitor:           opts.CommandMonitor,
@@ -0,0 +1,35 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package driver
+
+import (
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+)
+
+// CursorState is the server side state of a BatchCursor. It is enough to build a BatchCursor in
+// another process that continues the cursor with getMore, provided that process uses the same
+// logical session, since the server only accepts getMore from the session that opened the cursor.
+type CursorState struct {
+	Database   string
+	Collection string
+	ID         int64
+	BatchSize  int32
+	MaxTimeMS  int64
+	Server     address.Address
+}
+
+// State returns the server side state of this batch cursor.
+func (bc *BatchCursor) State() CursorState {
+	return CursorState{
+		Database:   bc.database,
+		Collection: bc.collection,
+		ID:         bc.id,
+		BatchSize:  bc.batchSize,
+		MaxTimeMS:  bc.maxTimeMS,
+		Server:     bc.addr,
+	}
+}
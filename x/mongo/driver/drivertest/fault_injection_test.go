@@ -0,0 +1,158 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+)
+
+// codeShutdownInProgress is a retryable error code the fake server never returns by itself.
+const codeShutdownInProgress = 91
+
+// newFaultClient connects a client configured with fi to a fresh Server and returns the names of
+// the commands the client starts.
+func newFaultClient(t *testing.T, fi *driver.FaultInjector, opts *options.ClientOptions) (*mongo.Client, func() []string) {
+	t.Helper()
+	srv, err := NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	started := make(chan string, 100)
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) { started <- evt.CommandName },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli, err := mongo.Connect(ctx, options.MergeClientOptions(
+		options.Client().ApplyURI(srv.URI()).SetMonitor(monitor).SetFaultInjector(fi), opts))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cli.Disconnect(context.Background()) })
+
+	return cli, func() []string {
+		var names []string
+		for {
+			select {
+			case name := <-started:
+				names = append(names, name)
+			default:
+				return names
+			}
+		}
+	}
+}
+
+func TestFaultInjectionRetryWrites(t *testing.T) {
+	ctx := context.Background()
+
+	fi := driver.NewFaultInjector(driver.FailPoint{
+		Commands: []string{"insert"}, Times: 1, ErrorCode: codeShutdownInProgress,
+	})
+	cli, started := newFaultClient(t, fi, options.Client().SetRetryWrites(true))
+	coll := cli.Database("test").Collection("faults")
+	_, err := coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"insert", "insert"}, started())
+	require.Equal(t, 1, fi.Triggered())
+
+	fi.Enable(driver.FailPoint{Commands: []string{"insert"}, Times: 1, CloseConnection: true})
+	_, err = coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 2}})
+	require.NoError(t, err, "a network error is retried too")
+	require.Equal(t, []string{"insert", "insert"}, started())
+
+	fi = driver.NewFaultInjector(driver.FailPoint{
+		Commands: []string{"insert"}, Times: 1, ErrorCode: codeShutdownInProgress,
+	})
+	cli, started = newFaultClient(t, fi, options.Client().SetRetryWrites(false))
+	_, err = cli.Database("test").Collection("faults").InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	cerr, ok := err.(mongo.CommandError)
+	require.True(t, ok, "expected a command error, got %v", err)
+	require.Equal(t, int32(codeShutdownInProgress), cerr.Code)
+	require.Equal(t, []string{"insert"}, started())
+}
+
+func TestFaultInjectionRetryReads(t *testing.T) {
+	ctx := context.Background()
+
+	fi := driver.NewFaultInjector()
+	cli, started := newFaultClient(t, fi, options.Client().SetRetryReads(true))
+	coll := cli.Database("test").Collection("faults")
+	_, err := coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	require.NoError(t, err)
+	started()
+
+	fi.Enable(driver.FailPoint{Commands: []string{"count"}, Times: 1, CloseConnection: true})
+	n, err := coll.CountDocuments(ctx, bson.D{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, []string{"aggregate"}, started(), "CountDocuments runs an aggregate, not a count")
+
+	fi.Enable(driver.FailPoint{Commands: []string{"find"}, Times: 2, ErrorCode: codeShutdownInProgress})
+	err = coll.FindOne(ctx, bson.D{}).Err()
+	cerr, ok := err.(mongo.CommandError)
+	require.True(t, ok, "reads are retried only once, got %v", err)
+	require.Equal(t, int32(codeShutdownInProgress), cerr.Code)
+	require.Equal(t, []string{"find", "find"}, started())
+	require.Equal(t, 2, fi.Triggered())
+}
+
+func TestFaultInjectionWithTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	fi := driver.NewFaultInjector()
+	cli, started := newFaultClient(t, fi, nil)
+	coll := cli.Database("test").Collection("faults")
+	_, err := coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: 0}})
+	require.NoError(t, err)
+	started()
+
+	fi.Enable(driver.FailPoint{
+		Commands: []string{"update"}, Times: 1,
+		ErrorCode: codeWriteConflict, ErrorLabels: []string{driver.TransientTransactionError},
+	})
+	fi.Enable(driver.FailPoint{
+		Commands: []string{"commitTransaction"}, Times: 1,
+		ErrorCode: codeShutdownInProgress, ErrorLabels: []string{driver.UnknownTransactionCommitResult},
+	})
+
+	sess, err := cli.StartSession()
+	require.NoError(t, err)
+	defer sess.EndSession(ctx)
+
+	var attempts int
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		attempts++
+		return coll.UpdateOne(sc, bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: 1}}}})
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts, "a transient transaction error restarts the callback")
+	require.Equal(t, []string{"update", "abortTransaction", "update", "commitTransaction", "commitTransaction"}, started())
+
+	var doc struct{ N int32 }
+	require.NoError(t, coll.FindOne(ctx, bson.D{{Key: "_id", Value: 1}}).Decode(&doc))
+	require.Equal(t, int32(1), doc.N, "the transaction must be committed exactly once")
+}
+
+func TestFaultInjectionBlockTime(t *testing.T) {
+	fi := driver.NewFaultInjector(driver.FailPoint{Commands: []string{"ping"}, BlockTime: time.Second})
+	cli, _ := newFaultClient(t, fi, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := cli.Database("admin").RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Err()
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Second, "a blocked command must honor the context deadline")
+}
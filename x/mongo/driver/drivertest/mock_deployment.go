@@ -0,0 +1,443 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// ErrMockNetwork is the error returned by the connections of a MockDeployment when an
+// expectation simulates a network failure.
+var ErrMockNetwork = errors.New("drivertest: simulated network error")
+
+// MockDeployment is a driver.Deployment that answers the commands sent to it from a script of
+// expectations, so operations can be unit tested without building wire messages by hand.
+//
+// Each command is matched against the expectations in the order they were declared; the first
+// one that matches and has calls left answers it. Commands matching no expectation get a
+// CommandNotFound error and are reported by Verify. A MockDeployment is safe for concurrent use.
+//
+//	md := drivertest.NewMockDeployment()
+//	md.Expect("insert").WithField("insert", "coll").Reply(bson.D{{"n", 1}})
+//	md.Expect("commitTransaction").ReplyError(251, "no such transaction", "TransientTransactionError")
+//	... run operations with md as their deployment ...
+//	err := md.Verify()
+type MockDeployment struct {
+	mu           sync.Mutex
+	desc         description.Server
+	kind         description.TopologyKind
+	retryWrites  bool
+	inOrder      bool
+	expectations []*Expectation
+	received     []bson.Raw
+	failures     []string
+	conns        int
+}
+
+var _ driver.Deployment = (*MockDeployment)(nil)
+var _ driver.Server = (*MockDeployment)(nil)
+
+// NewMockDeployment returns a MockDeployment that describes itself as the primary of a replica set
+// running MongoDB 4.2.
+func NewMockDeployment() *MockDeployment {
+	addr := address.Address("mock.drivertest:27017")
+	return &MockDeployment{
+		desc: description.Server{
+			Addr:                  addr,
+			CanonicalAddr:         addr,
+			Kind:                  description.RSPrimary,
+			WireVersion:           &description.VersionRange{Min: 0, Max: 8},
+			SessionTimeoutMinutes: 30,
+			MaxBatchCount:         100000,
+			MaxDocumentSize:       16 * 1024 * 1024,
+			MaxMessageSize:        maxMessageSize,
+		},
+		kind:        description.ReplicaSetWithPrimary,
+		retryWrites: true,
+	}
+}
+
+// SetDescription sets the server description reported by the connections of the deployment.
+func (md *MockDeployment) SetDescription(desc description.Server) *MockDeployment {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.desc = desc
+	return md
+}
+
+// SetKind sets the topology kind of the deployment. Defaults to description.ReplicaSetWithPrimary.
+func (md *MockDeployment) SetKind(kind description.TopologyKind) *MockDeployment {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.kind = kind
+	return md
+}
+
+// SetRetryWrites sets whether the deployment supports retryable writes. Defaults to true.
+func (md *MockDeployment) SetRetryWrites(retryWrites bool) *MockDeployment {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.retryWrites = retryWrites
+	return md
+}
+
+// InOrder makes the deployment require the expectations to be met in the order they were
+// declared: a command may only match an expectation once all the expectations declared before
+// it got their calls.
+func (md *MockDeployment) InOrder() *MockDeployment {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.inOrder = true
+	return md
+}
+
+// Expect declares that the command with the given name will be sent, once by default. The
+// returned Expectation narrows the commands it matches and sets the reply.
+func (md *MockDeployment) Expect(name string) *Expectation {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	e := &Expectation{
+		md:    md,
+		name:  name,
+		times: 1,
+		reply: bson.D{},
+	}
+	md.expectations = append(md.expectations, e)
+	return e
+}
+
+// Commands returns the commands received so far, in order.
+func (md *MockDeployment) Commands() []bson.Raw {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return append([]bson.Raw(nil), md.received...)
+}
+
+// Verify returns an error describing the expectations that did not get all their calls and the
+// commands that matched no expectation, or nil if the script was followed.
+func (md *MockDeployment) Verify() error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	problems := append([]string(nil), md.failures...)
+	for _, e := range md.expectations {
+		if e.times >= 0 && e.calls < e.times {
+			problems = append(problems, fmt.Sprintf("%s: expected %d call(s), got %d", e, e.times, e.calls))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("drivertest: " + strings.Join(problems, "; "))
+}
+
+// SelectServer implements the driver.Deployment interface. It returns the deployment itself.
+func (md *MockDeployment) SelectServer(context.Context, description.ServerSelector) (driver.Server, error) {
+	return md, nil
+}
+
+// SupportsRetryWrites implements the driver.Deployment interface.
+func (md *MockDeployment) SupportsRetryWrites() bool {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.retryWrites
+}
+
+// Kind implements the driver.Deployment interface.
+func (md *MockDeployment) Kind() description.TopologyKind {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.kind
+}
+
+// Connection implements the driver.Server interface. Every call returns a new connection.
+func (md *MockDeployment) Connection(context.Context) (driver.Connection, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.conns++
+	return &mockConn{md: md, id: fmt.Sprintf("mock-%d", md.conns), desc: md.desc}, nil
+}
+
+// respond finds the expectation matching the command of r and returns it.
+func (md *MockDeployment) respond(r *request) (*Expectation, error) {
+	raw, err := bson.Marshal(r.cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.received = append(md.received, raw)
+
+	for _, e := range md.expectations {
+		exhausted := e.times >= 0 && e.calls >= e.times
+		if !exhausted && e.matches(r, raw) {
+			e.calls++
+			return e, nil
+		}
+		if md.inOrder && !exhausted && e.calls < e.times {
+			break
+		}
+	}
+
+	md.failures = append(md.failures, fmt.Sprintf("unexpected command %s", raw))
+	return nil, nil
+}
+
+// Expectation is a command a MockDeployment expects and the way it answers it.
+type Expectation struct {
+	md       *MockDeployment
+	name     string
+	db       string
+	fields   bson.D
+	absent   []string
+	match    func(bson.Raw) bool
+	times    int
+	calls    int
+	reply    bson.D
+	netError bool
+}
+
+func (e *Expectation) String() string {
+	s := fmt.Sprintf("%q", e.name)
+	for _, f := range e.fields {
+		s += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+	}
+	return s
+}
+
+// InDatabase restricts the expectation to commands sent to the given database.
+func (e *Expectation) InDatabase(db string) *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.db = db
+	return e
+}
+
+// WithField restricts the expectation to commands whose field at the dotted path key equals
+// value. Numbers of different types compare equal when their values are equal.
+func (e *Expectation) WithField(key string, value interface{}) *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.fields = append(e.fields, bson.E{Key: key, Value: normalize(value)})
+	return e
+}
+
+// WithoutField restricts the expectation to commands that have no field at the dotted path key.
+func (e *Expectation) WithoutField(key string) *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.absent = append(e.absent, key)
+	return e
+}
+
+// Matching restricts the expectation to commands for which fn returns true.
+func (e *Expectation) Matching(fn func(cmd bson.Raw) bool) *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.match = fn
+	return e
+}
+
+// Times sets the number of commands the expectation answers. Defaults to 1.
+func (e *Expectation) Times(n int) *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.times = n
+	return e
+}
+
+// AnyTimes lets the expectation answer any number of commands, including none.
+func (e *Expectation) AnyTimes() *Expectation {
+	return e.Times(-1)
+}
+
+// Reply sets the document the expectation answers with. The ok field is added if doc does not
+// have one. The default reply is {ok: 1}.
+func (e *Expectation) Reply(doc interface{}) *Expectation {
+	d, ok := normalize(doc).(bson.D)
+	if !ok {
+		panic(fmt.Sprintf("drivertest: cannot use %T as a reply", doc))
+	}
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.reply = d
+	return e
+}
+
+// ReplyError makes the expectation answer with a command error with the given code, message
+// and error labels.
+func (e *Expectation) ReplyError(code int32, msg string, labels ...string) *Expectation {
+	reply := bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: msg},
+		{Key: "code", Value: code},
+	}
+	if name, ok := codeNames[code]; ok {
+		reply = append(reply, bson.E{Key: "codeName", Value: name})
+	}
+	if len(labels) != 0 {
+		arr := make(bson.A, len(labels))
+		for i, l := range labels {
+			arr[i] = l
+		}
+		reply = append(reply, bson.E{Key: "errorLabels", Value: arr})
+	}
+	return e.Reply(reply)
+}
+
+// NetworkError makes the expectation fail the connection instead of answering: reading the reply
+// returns ErrMockNetwork.
+func (e *Expectation) NetworkError() *Expectation {
+	e.md.mu.Lock()
+	defer e.md.mu.Unlock()
+	e.netError = true
+	return e
+}
+
+func (e *Expectation) matches(r *request, raw bson.Raw) bool {
+	if r.name() != e.name || (e.db != "" && r.db != e.db) {
+		return false
+	}
+	for _, f := range e.fields {
+		if !matchValues(valuesAt(r.cmd, strings.Split(f.Key, ".")), f.Value) {
+			return false
+		}
+	}
+	for _, key := range e.absent {
+		if len(valuesAt(r.cmd, strings.Split(key, "."))) != 0 {
+			return false
+		}
+	}
+	return e.match == nil || e.match(raw)
+}
+
+// normalize returns v as it reads once encoded to BSON and decoded as a bson.D field.
+func normalize(v interface{}) interface{} {
+	data, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		panic(fmt.Sprintf("drivertest: cannot encode %T: %v", v, err))
+	}
+	var d bson.D
+	_ = bson.Unmarshal(data, &d)
+	return d[0].Value
+}
+
+// mockConn is a connection of a MockDeployment. Each written command queues its reply, which the
+// following read returns.
+type mockConn struct {
+	md      *MockDeployment
+	id      string
+	desc    description.Server
+	pending [][]byte
+	closed  bool
+}
+
+// WriteWireMessage implements the driver.Connection interface.
+func (c *mockConn) WriteWireMessage(_ context.Context, wm []byte) error {
+	if c.closed {
+		return ErrMockNetwork
+	}
+	_, reqID, _, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return errors.New("drivertest: malformed message header")
+	}
+
+	var req *request
+	var moreToCome bool
+	var err error
+	switch opcode {
+	case wiremessage.OpMsg:
+		req, moreToCome, err = parseMsg(rem)
+	case wiremessage.OpQuery:
+		req, err = parseQuery(rem)
+	default:
+		err = fmt.Errorf("drivertest: unsupported opcode %s", opcode)
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := c.md.respond(req)
+	if err != nil {
+		return err
+	}
+	if moreToCome {
+		return nil
+	}
+
+	var reply bson.D
+	switch {
+	case e == nil:
+		reply = bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "errmsg", Value: fmt.Sprintf("drivertest: no expectation matches command %q", req.name())},
+			{Key: "code", Value: codeCommandNotFound},
+			{Key: "codeName", Value: codeNames[codeCommandNotFound]},
+		}
+	case e.netError:
+		c.pending = append(c.pending, nil)
+		return nil
+	default:
+		c.md.mu.Lock()
+		reply = append(bson.D(nil), e.reply...)
+		c.md.mu.Unlock()
+		if _, ok := lookup(reply, "ok"); !ok {
+			reply = append(reply, bson.E{Key: "ok", Value: 1.0})
+		}
+	}
+
+	doc, err := bson.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if opcode == wiremessage.OpQuery {
+		c.pending = append(c.pending, queryReply(reqID, doc))
+	} else {
+		c.pending = append(c.pending, msgReply(reqID, doc))
+	}
+	return nil
+}
+
+// ReadWireMessage implements the driver.Connection interface.
+func (c *mockConn) ReadWireMessage(_ context.Context, dst []byte) ([]byte, error) {
+	if c.closed || len(c.pending) == 0 {
+		return nil, errors.New("drivertest: no reply to read")
+	}
+	wm := c.pending[0]
+	c.pending = c.pending[1:]
+	if wm == nil {
+		c.closed = true
+		return nil, ErrMockNetwork
+	}
+	return append(dst, wm...), nil
+}
+
+// Description implements the driver.Connection interface.
+func (c *mockConn) Description() description.Server { return c.desc }
+
+// Close implements the driver.Connection interface.
+func (c *mockConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// ID implements the driver.Connection interface.
+func (c *mockConn) ID() string { return c.id }
+
+// Address implements the driver.Connection interface.
+func (c *mockConn) Address() address.Address { return c.desc.Addr }
@@ -0,0 +1,123 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/operation"
+	driversession "go.mongodb.org/mongo-driver/x/mongo/driver/session"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+func mustDoc(t *testing.T, v interface{}) bsoncore.Document {
+	t.Helper()
+	data, err := bson.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
+
+func TestMockDeploymentReply(t *testing.T) {
+	md := NewMockDeployment()
+	md.Expect("ping").InDatabase("admin").Reply(bson.D{{Key: "pong", Value: true}})
+	md.Expect("insert").WithField("insert", "coll").WithField("documents.x", 1).Reply(bson.D{{Key: "n", Value: 1}})
+
+	cmd := operation.NewCommand(mustDoc(t, bson.D{{Key: "ping", Value: 1}})).Database("admin").Deployment(md)
+	require.NoError(t, cmd.Execute(context.Background()))
+	pong, ok := cmd.Result().Lookup("pong").BooleanOK()
+	require.True(t, ok && pong)
+
+	ins := operation.NewInsert(mustDoc(t, bson.D{{Key: "_id", Value: 1}, {Key: "x", Value: 1}})).
+		Database("db").Collection("coll").Deployment(md)
+	require.NoError(t, ins.Execute(context.Background()))
+	require.Equal(t, int32(1), ins.Result().N)
+
+	require.NoError(t, md.Verify())
+	require.Len(t, md.Commands(), 2)
+}
+
+func TestMockDeploymentErrors(t *testing.T) {
+	md := NewMockDeployment()
+	md.Expect("commitTransaction").ReplyError(codeNoSuchTransaction, "no such transaction", driver.TransientTransactionError)
+	md.Expect("find").NetworkError()
+
+	cmd := operation.NewCommand(mustDoc(t, bson.D{{Key: "commitTransaction", Value: 1}})).Database("admin").Deployment(md)
+	err := cmd.Execute(context.Background())
+	derr, ok := err.(driver.Error)
+	require.True(t, ok, "expected a driver.Error, got %v", err)
+	require.Equal(t, codeNoSuchTransaction, derr.Code)
+	require.True(t, derr.HasErrorLabel(driver.TransientTransactionError))
+
+	find := operation.NewFind(mustDoc(t, bson.D{})).Database("db").Collection("coll").Deployment(md)
+	err = find.Execute(context.Background())
+	derr, ok = err.(driver.Error)
+	require.True(t, ok, "expected a driver.Error, got %v", err)
+	require.True(t, derr.NetworkError())
+
+	require.NoError(t, md.Verify())
+}
+
+func TestMockDeploymentRetryableWrite(t *testing.T) {
+	md := NewMockDeployment()
+	md.Expect("insert").NetworkError()
+	md.Expect("insert").Reply(bson.D{{Key: "n", Value: 1}})
+
+	id, err := uuid.New()
+	require.NoError(t, err)
+	sess, err := driversession.NewClientSession(&driversession.Pool{}, id, driversession.Explicit)
+	require.NoError(t, err)
+
+	ins := operation.NewInsert(mustDoc(t, bson.D{{Key: "_id", Value: 1}})).
+		Database("db").Collection("coll").Session(sess).ClusterClock(&driversession.ClusterClock{}).Retry(driver.RetryOncePerCommand).Deployment(md)
+	require.NoError(t, ins.Execute(context.Background()))
+	require.NoError(t, md.Verify())
+
+	cmds := md.Commands()
+	require.Len(t, cmds, 2)
+	_, ok := cmds[0].Lookup("txnNumber").Int64OK()
+	require.True(t, ok, "a retryable write carries a txnNumber")
+	require.Equal(t, cmds[0].Lookup("txnNumber"), cmds[1].Lookup("txnNumber"), "a retry must reuse the txnNumber")
+}
+
+func TestMockDeploymentVerify(t *testing.T) {
+	md := NewMockDeployment()
+	md.Expect("ping").Times(2)
+	md.Expect("buildInfo").AnyTimes()
+
+	cmd := operation.NewCommand(mustDoc(t, bson.D{{Key: "ping", Value: 1}})).Database("admin").Deployment(md)
+	require.NoError(t, cmd.Execute(context.Background()))
+	require.Error(t, md.Verify(), "ping was expected twice")
+
+	require.NoError(t, cmd.Execute(context.Background()))
+	require.NoError(t, md.Verify())
+
+	err := cmd.Execute(context.Background())
+	require.Error(t, err, "a third ping matches no expectation")
+	require.Error(t, md.Verify())
+}
+
+func TestMockDeploymentInOrder(t *testing.T) {
+	md := NewMockDeployment().InOrder()
+	md.Expect("ping")
+	md.Expect("buildInfo")
+
+	buildInfo := operation.NewCommand(mustDoc(t, bson.D{{Key: "buildInfo", Value: 1}})).Database("admin").Deployment(md)
+	require.Error(t, buildInfo.Execute(context.Background()), "buildInfo must wait for ping")
+
+	md = NewMockDeployment().InOrder()
+	md.Expect("ping")
+	md.Expect("buildInfo")
+	ping := operation.NewCommand(mustDoc(t, bson.D{{Key: "ping", Value: 1}})).Database("admin").Deployment(md)
+	require.NoError(t, ping.Execute(context.Background()))
+	require.NoError(t, buildInfo.Deployment(md).Execute(context.Background()))
+	require.NoError(t, md.Verify())
+}
@@ -0,0 +1,213 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// Proxy forwards the connections it accepts to a server and records every wire message exchanged
+// on them. The recording can be replayed to a client later with a Replayer.
+//
+// Clients must connect to a Proxy directly, as the URI method does: the servers a replica set
+// member reports are not rewritten, so a client discovering the replica set would bypass the
+// proxy. The compressors the server supports are removed from its isMaster replies, so clients
+// never compress their messages and the recording can be decoded and replayed.
+type Proxy struct {
+	ln     net.Listener
+	target string
+	rec    *recorder
+
+	mu       sync.Mutex
+	nextConn int64
+	conns    map[net.Conn]struct{}
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+// NewProxy starts a Proxy listening on a random port of the loopback interface, forwarding its
+// connections to the server at the host:port address target and writing the recording to w.
+func NewProxy(target string, w io.Writer) (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return NewProxyListener(ln, target, w), nil
+}
+
+// NewProxyListener starts a Proxy accepting connections on ln. The Proxy closes ln when it is
+// closed.
+func NewProxyListener(ln net.Listener, target string, w io.Writer) *Proxy {
+	p := &Proxy{
+		ln:     ln,
+		target: target,
+		rec:    newRecorder(w),
+		conns:  make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go p.accept()
+	return p
+}
+
+// Addr returns the host:port address the proxy listens on.
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// URI returns a connection string connecting directly to the proxy.
+func (p *Proxy) URI() string {
+	return fmt.Sprintf("mongodb://%s/?connect=direct", p.Addr())
+}
+
+// Close stops the proxy and closes its connections. It returns the first error writing the
+// recording, if any.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return p.rec.error()
+	}
+	p.closed = true
+	err := p.ln.Close()
+	for c := range p.conns {
+		_ = c.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	if rerr := p.rec.error(); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (p *Proxy) accept() {
+	defer p.wg.Done()
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		p.conns[c] = struct{}{}
+		p.nextConn++
+		id := p.nextConn
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go p.serve(id, c)
+	}
+}
+
+// serve forwards the messages of the client connection c to a new connection to the target and
+// the replies back, until either side closes its connection.
+func (p *Proxy) serve(id int64, c net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, c)
+		p.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	sc, err := net.DialTimeout("tcp", p.target, 10*time.Second)
+	if err != nil {
+		return
+	}
+	defer func() { _ = sc.Close() }()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn, fromClient bool) {
+		defer func() { done <- struct{}{} }()
+		for {
+			wm, err := readMessage(src)
+			if err != nil {
+				return
+			}
+			if !fromClient {
+				wm = withoutCompression(wm)
+			}
+			p.rec.record(id, fromClient, wm)
+			if _, err = dst.Write(wm); err != nil {
+				return
+			}
+		}
+	}
+	go pipe(sc, c, true)
+	go pipe(c, sc, false)
+
+	// Closing both connections when one side is done stops the other pipe.
+	<-done
+	_ = c.Close()
+	_ = sc.Close()
+	<-done
+}
+
+// withoutCompression returns the server reply wm without the compression field of isMaster
+// replies. Replies without the field and replies it cannot rewrite are returned as is.
+func withoutCompression(wm []byte) []byte {
+	_, _, _, opcode, _, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return wm
+	}
+
+	// the offset of the reply document, right after the header and the fields of the opcode.
+	var off int
+	switch opcode {
+	case wiremessage.OpReply:
+		off = 16 + 20
+	case wiremessage.OpMsg:
+		// messages with a checksum would need it computed again.
+		flags, _, ok := wiremessage.ReadMsgFlags(wm[16:])
+		if !ok || flags&wiremessage.ChecksumPresent != 0 || len(wm) <= 20 || wm[20] != byte(wiremessage.SingleDocument) {
+			return wm
+		}
+		off = 16 + 5
+	default:
+		return wm
+	}
+	if len(wm) < off {
+		return wm
+	}
+	doc, _, ok := bsoncore.ReadDocument(wm[off:])
+	if !ok {
+		return wm
+	}
+	if _, err := doc.LookupErr("compression"); err != nil {
+		return wm
+	}
+
+	elems, err := doc.Elements()
+	if err != nil {
+		return wm
+	}
+	kept := make([][]byte, 0, len(elems))
+	for _, e := range elems {
+		if e.Key() != "compression" {
+			kept = append(kept, e)
+		}
+	}
+
+	dst := append([]byte(nil), wm[:off]...)
+	dst = bsoncore.BuildDocumentFromElements(dst, kept...)
+	dst = append(dst, wm[off+len(doc):]...)
+	return bsoncore.UpdateLength(dst, 0, int32(len(dst)))
+}
@@ -0,0 +1,132 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func connect(t *testing.T, uri string) *mongo.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+	return cli
+}
+
+// replayWorkload runs CRUD operations and a transaction and returns the documents it reads.
+func replayWorkload(t *testing.T, cli *mongo.Client) []bson.M {
+	t.Helper()
+	ctx := context.Background()
+	coll := cli.Database("test").Collection("replay")
+
+	_, err := coll.InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: 1}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "n", Value: 2}},
+	})
+	require.NoError(t, err)
+
+	sess, err := cli.StartSession()
+	require.NoError(t, err)
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if _, err := coll.UpdateOne(sc, bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: 10}}}}); err != nil {
+			return nil, err
+		}
+		return coll.DeleteOne(sc, bson.D{{Key: "_id", Value: 2}})
+	})
+	require.NoError(t, err)
+
+	cur, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	require.NoError(t, err)
+	var docs []bson.M
+	require.NoError(t, cur.All(ctx, &docs))
+	return docs
+}
+
+func TestProxyRecordReplay(t *testing.T) {
+	srv, err := NewServer()
+	require.NoError(t, err)
+	defer func() { _ = srv.Close() }()
+
+	var recording bytes.Buffer
+	proxy, err := NewProxy(srv.Addr(), &recording)
+	require.NoError(t, err)
+	cli := connect(t, proxy.URI())
+	want := replayWorkload(t, cli)
+	require.NoError(t, cli.Disconnect(context.Background()))
+	require.NoError(t, proxy.Close())
+	require.Len(t, want, 1)
+	require.EqualValues(t, 11, want[0]["n"])
+
+	msgs, err := ReadRecording(&recording)
+	require.NoError(t, err)
+	var commands []string
+	for _, msg := range msgs {
+		if msg.FromClient && msg.Command != "isMaster" {
+			commands = append(commands, msg.Command)
+		}
+	}
+	require.Subset(t, commands, []string{"insert", "update", "delete", "commitTransaction", "find"})
+
+	replayer, err := NewReplayer(msgs)
+	require.NoError(t, err)
+	defer func() { _ = replayer.Close() }()
+	require.NoError(t, srv.Close(), "the replay must not need the server")
+
+	cli = connect(t, replayer.URI())
+	got := replayWorkload(t, cli)
+	require.NoError(t, cli.Disconnect(context.Background()))
+	require.Equal(t, want, got)
+	require.Empty(t, replayer.Misses())
+}
+
+func TestReplayerMiss(t *testing.T) {
+	replayer, err := NewReplayer(nil)
+	require.NoError(t, err)
+	defer func() { _ = replayer.Close() }()
+
+	cli := connect(t, replayer.URI())
+	defer func() { _ = cli.Disconnect(context.Background()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = cli.Database("admin").RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Err()
+	require.Error(t, err, "nothing was recorded")
+}
+
+func TestProxyHidesCompression(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{Key: "ismaster", Value: true},
+		{Key: "compression", Value: bson.A{"zlib", "snappy"}},
+		{Key: "ok", Value: 1.0},
+	})
+	require.NoError(t, err)
+
+	for _, wm := range [][]byte{queryReply(7, doc), msgReply(7, doc)} {
+		msg, err := DecodeMessage(withoutCompression(wm))
+		require.NoError(t, err)
+		require.Equal(t, int32(7), msg.ResponseTo)
+		require.Contains(t, string(msg.Document), `"ismaster":true`)
+		require.NotContains(t, string(msg.Document), "compression", "%s", msg.OpCode)
+	}
+
+	// replies without compressors are forwarded untouched.
+	doc, err = bson.Marshal(bson.D{{Key: "ok", Value: 1.0}})
+	require.NoError(t, err)
+	wm := msgReply(7, doc)
+	require.Equal(t, wm, withoutCompression(wm))
+}
@@ -0,0 +1,163 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// Message is a wire message recorded by a Proxy. A recording is a file with one Message per line
+// encoded as JSON, in the order the proxy saw them.
+type Message struct {
+	// Conn identifies the client connection the message was sent on.
+	Conn int64 `json:"conn"`
+	// Time is when the proxy read the message.
+	Time time.Time `json:"time"`
+	// FromClient is true for the messages sent by the client and false for the replies of the
+	// server.
+	FromClient bool   `json:"fromClient"`
+	OpCode     string `json:"opCode"`
+	RequestID  int32  `json:"requestID"`
+	ResponseTo int32  `json:"responseTo"`
+	// Database and Command are the database and name of the command a client message carries.
+	Database string `json:"db,omitempty"`
+	Command  string `json:"command,omitempty"`
+	// Document is the body of the message as relaxed extended JSON, for people reading the
+	// recording. It is empty for messages that could not be decoded, such as compressed ones.
+	Document json.RawMessage `json:"document,omitempty"`
+	// Wire is the wire message as sent.
+	Wire []byte `json:"wire"`
+}
+
+// DecodeMessage decodes the wire message wm. The fields that depend on the connection, the time
+// and the direction of the message are left for the caller to set.
+func DecodeMessage(wm []byte) (Message, error) {
+	_, reqID, respTo, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return Message{}, errors.New("malformed message header")
+	}
+	msg := Message{
+		OpCode:     opcode.String(),
+		RequestID:  reqID,
+		ResponseTo: respTo,
+		Wire:       wm,
+	}
+
+	req, err := decodeBody(opcode, rem)
+	if err != nil || req == nil {
+		return msg, err
+	}
+	msg.Database = req.db
+	msg.Command = req.name()
+	msg.Document, err = bson.MarshalExtJSON(req.cmd, false, false)
+	return msg, err
+}
+
+// decodeBody decodes the body of an OP_MSG, OP_QUERY or OP_REPLY message. It returns nil for the
+// other opcodes.
+func decodeBody(opcode wiremessage.OpCode, rem []byte) (*request, error) {
+	switch opcode {
+	case wiremessage.OpMsg:
+		req, _, err := parseMsg(rem)
+		return req, err
+	case wiremessage.OpQuery:
+		return parseQuery(rem)
+	case wiremessage.OpReply:
+		return parseReply(rem)
+	default:
+		return nil, nil
+	}
+}
+
+func parseReply(src []byte) (*request, error) {
+	_, rem, ok := wiremessage.ReadReplyFlags(src)
+	if ok {
+		_, rem, ok = wiremessage.ReadReplyCursorID(rem)
+	}
+	if ok {
+		_, rem, ok = wiremessage.ReadReplyStartingFrom(rem)
+	}
+	if ok {
+		_, rem, ok = wiremessage.ReadReplyNumberReturned(rem)
+	}
+	if !ok {
+		return nil, errors.New("malformed OP_REPLY header")
+	}
+	doc, _, ok := wiremessage.ReadReplyDocument(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_REPLY document")
+	}
+
+	req := &request{}
+	if err := bson.Unmarshal(doc, &req.cmd); err != nil {
+		return nil, err
+	}
+	if len(req.cmd) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	return req, nil
+}
+
+// ReadRecording reads the messages of a recording written by a Proxy.
+func ReadRecording(r io.Reader) ([]Message, error) {
+	dec := json.NewDecoder(r)
+	var msgs []Message
+	for {
+		var msg Message
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// recorder writes the messages of a recording. It keeps the first error it gets.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func newRecorder(w io.Writer) *recorder {
+	return &recorder{enc: json.NewEncoder(w)}
+}
+
+func (r *recorder) record(conn int64, fromClient bool, wm []byte) {
+	// A message that cannot be decoded is still recorded as is, for people reading the recording.
+	// A Replayer rejects the recordings with client messages it cannot decode.
+	msg, _ := DecodeMessage(wm)
+	msg.Wire = wm
+	msg.Conn = conn
+	msg.Time = time.Now()
+	msg.FromClient = fromClient
+	if !fromClient {
+		msg.Database, msg.Command = "", ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(&msg)
+	}
+}
+
+func (r *recorder) error() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
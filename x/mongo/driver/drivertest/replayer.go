@@ -0,0 +1,280 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// volatileFields are the command fields that differ from one run of a client to the next. They
+// are ignored when matching commands to a recording.
+var volatileFields = map[string]bool{
+	"lsid":         true,
+	"$clusterTime": true,
+	"client":       true,
+}
+
+// repeatableCommands are sent at times that depend on timers rather than on the operations run
+// by a client. They are matched by name only and, once their recorded replies run out, get the
+// last one again.
+var repeatableCommands = map[string]bool{
+	"isMaster":    true,
+	"ismaster":    true,
+	"buildInfo":   true,
+	"ping":        true,
+	"endSessions": true,
+}
+
+// Replayer is a fake server that replies to commands with the replies recorded for them by a
+// Proxy, so a client can run again offline the operations it ran against a real deployment.
+//
+// A command gets the reply to the first recorded command that is equal to it, ignoring the
+// session ids and cluster times, and that was not replayed yet. The operations of the client must
+// therefore send the same commands in the same order as when they were recorded: for instance the
+// documents it inserts must have an _id, as the ones generated by the driver differ on each run.
+// Commands that have no recorded reply fail with CommandNotFound and are reported by Misses.
+//
+// Authentication cannot be replayed: the SCRAM conversation carries random nonces and the server
+// proves it knows the password from them. A recording made by an authenticated client must be
+// replayed by a client without credentials; the recorded conversation is then never asked for.
+type Replayer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	replies map[string][][]byte
+	last    map[string][]byte
+	misses  []string
+	conns   map[net.Conn]struct{}
+	closed  bool
+
+	wg sync.WaitGroup
+}
+
+// NewReplayer starts a Replayer of msgs listening on a random port of the loopback interface.
+func NewReplayer(msgs []Message) (*Replayer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReplayerListener(ln, msgs)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewReplayerListener starts a Replayer of msgs accepting connections on ln. The Replayer closes
+// ln when it is closed.
+func NewReplayerListener(ln net.Listener, msgs []Message) (*Replayer, error) {
+	r := &Replayer{
+		ln:      ln,
+		replies: make(map[string][][]byte),
+		last:    make(map[string][]byte),
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	type requestKey struct {
+		conn int64
+		id   int32
+	}
+	keys := make(map[requestKey]string)
+	for i, msg := range msgs {
+		if msg.FromClient {
+			key, _, err := replayKey(msg.Wire)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %v", i, err)
+			}
+			keys[requestKey{msg.Conn, msg.RequestID}] = key
+			continue
+		}
+		key, ok := keys[requestKey{msg.Conn, msg.ResponseTo}]
+		if !ok {
+			return nil, fmt.Errorf("message %d: reply to unknown request %d", i, msg.ResponseTo)
+		}
+		r.replies[key] = append(r.replies[key], msg.Wire)
+	}
+
+	r.wg.Add(1)
+	go r.accept()
+	return r, nil
+}
+
+// Addr returns the host:port address the replayer listens on.
+func (r *Replayer) Addr() string {
+	return r.ln.Addr().String()
+}
+
+// URI returns a connection string connecting directly to the replayer.
+func (r *Replayer) URI() string {
+	return fmt.Sprintf("mongodb://%s/?connect=direct", r.Addr())
+}
+
+// Misses returns the commands that had no recorded reply, as relaxed extended JSON.
+func (r *Replayer) Misses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.misses...)
+}
+
+// Close stops the replayer and closes its connections.
+func (r *Replayer) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	err := r.ln.Close()
+	for c := range r.conns {
+		_ = c.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return err
+}
+
+func (r *Replayer) accept() {
+	defer r.wg.Done()
+	for {
+		c, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		r.conns[c] = struct{}{}
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		go r.serve(c)
+	}
+}
+
+func (r *Replayer) serve(c net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		r.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	for {
+		wm, err := readMessage(c)
+		if err != nil {
+			return
+		}
+
+		reply, err := r.handle(wm)
+		if err != nil {
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err = c.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the recorded reply to the command carried by wm, or nil if the client does not
+// expect one.
+func (r *Replayer) handle(wm []byte) ([]byte, error) {
+	key, req, err := replayKey(wm)
+	if err != nil {
+		return nil, err
+	}
+	if wiremessage.IsMsgMoreToCome(wm) {
+		return nil, nil
+	}
+	_, reqID, _, opcode, _, _ := wiremessage.ReadHeader(wm)
+
+	r.mu.Lock()
+	recorded := r.replies[key]
+	var reply []byte
+	switch {
+	case len(recorded) > 0:
+		reply = recorded[0]
+		r.replies[key] = recorded[1:]
+		r.last[key] = reply
+	case repeatableCommands[req.name()]:
+		reply = r.last[key]
+	}
+	if reply == nil {
+		doc, _ := bson.MarshalExtJSON(req.cmd, false, false)
+		r.misses = append(r.misses, string(doc))
+	}
+	r.mu.Unlock()
+
+	if reply == nil {
+		doc, err := bson.Marshal(bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "errmsg", Value: fmt.Sprintf("drivertest: no recorded reply to command %q", req.name())},
+			{Key: "code", Value: codeCommandNotFound},
+			{Key: "codeName", Value: codeNames[codeCommandNotFound]},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if opcode == wiremessage.OpQuery {
+			return queryReply(reqID, doc), nil
+		}
+		return msgReply(reqID, doc), nil
+	}
+
+	reply = append([]byte(nil), reply...)
+	binary.LittleEndian.PutUint32(reply[4:], uint32(wiremessage.NextRequestID()))
+	binary.LittleEndian.PutUint32(reply[8:], uint32(reqID))
+	return reply, nil
+}
+
+// replayKey returns the key recorded replies to the command carried by wm are stored under,
+// along with the command.
+func replayKey(wm []byte) (string, *request, error) {
+	_, _, _, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return "", nil, errors.New("malformed message header")
+	}
+	req, err := decodeBody(opcode, rem)
+	if err != nil {
+		return "", nil, err
+	}
+	if req == nil || opcode == wiremessage.OpReply {
+		return "", nil, fmt.Errorf("unsupported opcode %s", opcode)
+	}
+
+	prefix := opcode.String() + " " + req.db + " "
+	if repeatableCommands[req.name()] {
+		return prefix + req.name(), req, nil
+	}
+	cmd := make(bson.D, 0, len(req.cmd))
+	for _, e := range req.cmd {
+		if !volatileFields[e.Key] && e.Key != "$db" {
+			cmd = append(cmd, e)
+		}
+	}
+	doc, err := bson.MarshalExtJSON(cmd, true, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix + string(doc), req, nil
+}
@@ -0,0 +1,422 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// ReplicaSetName is the name of the replica set a Server reports to be the primary of.
+const ReplicaSetName = "rs0"
+
+// maxMessageSize bounds the wire messages a Server accepts.
+const maxMessageSize = 48000000
+
+// Server is an in-process fake mongod for tests. It listens on a local TCP port, speaks the
+// OP_MSG and OP_QUERY wire protocols and reports itself as the primary of a single member
+// replica set, so a client connects to it like to a real deployment.
+//
+// Server keeps its data in memory and implements the commands drivers send for CRUD operations:
+// insert, find, getMore, killCursors, update, delete, findAndModify, count, distinct and a subset
+// of aggregate, along with the usual administrative commands. Multi-document transactions are
+// supported: a transaction works on a snapshot of the data taken when it starts, is identified by
+// the lsid and txnNumber of its commands, and fails with a WriteConflict error labeled
+// TransientTransactionError if it writes a document written concurrently by another client.
+// Writes outside a transaction that touch a document written by an open transaction fail with
+// WriteConflict too, instead of waiting for the transaction to end. Ending or killing a session
+// aborts its transaction.
+//
+// Commands are run one at a time. Unknown commands fail with CommandNotFound, and commands using
+// collations, array filters or update pipelines fail with NotImplemented. Write concerns
+// requiring more than one member are reported as unsatisfiable.
+type Server struct {
+	ln         net.Listener
+	addr       string
+	electionID primitive.ObjectID
+
+	mu         sync.Mutex
+	st         *store
+	cursors    map[int64]*cursor
+	nextCursor int64
+	conns      map[net.Conn]struct{}
+	closed     bool
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a Server listening on a random port of the loopback interface.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:         ln,
+		addr:       ln.Addr().String(),
+		electionID: primitive.NewObjectID(),
+		st:         newStore(),
+		cursors:    make(map[int64]*cursor),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the host:port address the server listens on.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// URI returns a connection string for the server.
+func (s *Server) URI() string {
+	return fmt.Sprintf("mongodb://%s/?replicaSet=%s", s.addr, ReplicaSetName)
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.ln.Close()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Documents returns the committed documents of the namespace ns, in the form "db.collection",
+// in insertion order.
+func (s *Server) Documents(ns string) []bson.Raw {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.st.data[ns]
+	if c == nil {
+		return nil
+	}
+	docs := make([]bson.Raw, len(c.records))
+	for i, r := range c.records {
+		docs[i] = r.doc
+	}
+	return docs
+}
+
+// Collections returns the namespaces of the server, sorted.
+func (s *Server) Collections() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces := make([]string, 0, len(s.st.data))
+	for ns := range s.st.data {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serve(c)
+	}
+}
+
+// serve reads the wire messages sent on c and writes the replies to them.
+func (s *Server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	for {
+		wm, err := readMessage(c)
+		if err != nil {
+			return
+		}
+
+		reply, err := s.handle(wm)
+		if err != nil {
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err = c.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(size[:]))
+	if length < 16 || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	wm := make([]byte, length)
+	copy(wm, size[:])
+	if _, err := io.ReadFull(r, wm[4:]); err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// handle runs the command carried by the wire message wm and returns the reply to send, or nil if
+// the client does not expect one.
+func (s *Server) handle(wm []byte) ([]byte, error) {
+	_, reqID, _, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return nil, errors.New("malformed message header")
+	}
+
+	switch opcode {
+	case wiremessage.OpMsg:
+		req, moreToCome, err := parseMsg(rem)
+		if err != nil {
+			return nil, err
+		}
+		reply := s.run(req)
+		if moreToCome {
+			return nil, nil
+		}
+		return msgReply(reqID, reply), nil
+	case wiremessage.OpQuery:
+		req, err := parseQuery(rem)
+		if err != nil {
+			return nil, err
+		}
+		return queryReply(reqID, s.run(req)), nil
+	default:
+		return nil, fmt.Errorf("unsupported opcode %s", opcode)
+	}
+}
+
+// request is a command sent to the server.
+type request struct {
+	db  string
+	cmd bson.D
+}
+
+func (r *request) name() string {
+	return r.cmd[0].Key
+}
+
+func (r *request) arg() interface{} {
+	return r.cmd[0].Value
+}
+
+// field returns the value of the given field of the command.
+func (r *request) field(key string) (interface{}, bool) {
+	return lookup(r.cmd, key)
+}
+
+// doc returns the document stored in the given field of the command, or nil.
+func (r *request) doc(key string) bson.D {
+	v, _ := lookup(r.cmd, key)
+	d, _ := v.(bson.D)
+	return d
+}
+
+// int returns the integer stored in the given field of the command, or 0.
+func (r *request) int(key string) int64 {
+	v, _ := lookup(r.cmd, key)
+	n, _ := asInt64(v)
+	return n
+}
+
+// collection returns the collection the command applies to, named by its first field.
+func (r *request) collection() (string, *commandError) {
+	coll, ok := r.arg().(string)
+	if !ok || coll == "" {
+		return "", errorf(codeBadValue, "collection name has invalid type %T", r.arg())
+	}
+	return coll, nil
+}
+
+// ns returns the namespace the command applies to.
+func (r *request) ns() (string, *commandError) {
+	coll, err := r.collection()
+	if err != nil {
+		return "", err
+	}
+	return r.db + "." + coll, nil
+}
+
+func parseMsg(src []byte) (*request, bool, error) {
+	flags, rem, ok := wiremessage.ReadMsgFlags(src)
+	if !ok {
+		return nil, false, errors.New("malformed OP_MSG flags")
+	}
+	if flags&wiremessage.ChecksumPresent != 0 {
+		if len(rem) < 4 {
+			return nil, false, errors.New("malformed OP_MSG checksum")
+		}
+		rem = rem[:len(rem)-4]
+	}
+
+	var body bsoncore.Document
+	type sequence struct {
+		id   string
+		docs []bsoncore.Document
+	}
+	var seqs []sequence
+	for len(rem) > 0 {
+		var stype wiremessage.SectionType
+		stype, rem, ok = wiremessage.ReadMsgSectionType(rem)
+		if !ok {
+			return nil, false, errors.New("malformed OP_MSG section")
+		}
+		switch stype {
+		case wiremessage.SingleDocument:
+			body, rem, ok = wiremessage.ReadMsgSectionSingleDocument(rem)
+		case wiremessage.DocumentSequence:
+			var seq sequence
+			seq.id, seq.docs, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem)
+			seqs = append(seqs, seq)
+		default:
+			return nil, false, fmt.Errorf("unknown OP_MSG section type %d", stype)
+		}
+		if !ok {
+			return nil, false, errors.New("malformed OP_MSG section")
+		}
+	}
+	if body == nil {
+		return nil, false, errors.New("OP_MSG has no body")
+	}
+
+	req := &request{}
+	if err := bson.Unmarshal(body, &req.cmd); err != nil {
+		return nil, false, err
+	}
+	for _, seq := range seqs {
+		docs := make(bson.A, 0, len(seq.docs))
+		for _, raw := range seq.docs {
+			var d bson.D
+			if err := bson.Unmarshal(raw, &d); err != nil {
+				return nil, false, err
+			}
+			docs = append(docs, d)
+		}
+		req.cmd = append(req.cmd, bson.E{Key: seq.id, Value: docs})
+	}
+	if len(req.cmd) == 0 {
+		return nil, false, errors.New("empty command")
+	}
+	req.db, _ = lookupString(req.cmd, "$db")
+
+	return req, flags&wiremessage.MoreToCome != 0, nil
+}
+
+func parseQuery(src []byte) (*request, error) {
+	_, rem, ok := wiremessage.ReadQueryFlags(src)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY flags")
+	}
+	ns, rem, ok := wiremessage.ReadQueryFullCollectionName(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY namespace")
+	}
+	_, rem, ok = wiremessage.ReadQueryNumberToSkip(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY numberToSkip")
+	}
+	_, rem, ok = wiremessage.ReadQueryNumberToReturn(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY numberToReturn")
+	}
+	query, _, ok := wiremessage.ReadQueryQuery(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY query")
+	}
+
+	dot := strings.IndexByte(ns, '.')
+	if dot < 0 || ns[dot+1:] != "$cmd" {
+		return nil, fmt.Errorf("OP_QUERY is only supported for commands, got namespace %q", ns)
+	}
+
+	req := &request{db: ns[:dot]}
+	if err := bson.Unmarshal(query, &req.cmd); err != nil {
+		return nil, err
+	}
+	if inner, ok := lookup(req.cmd, "$query"); ok {
+		d, ok := inner.(bson.D)
+		if !ok {
+			return nil, errors.New("$query must be a document")
+		}
+		req.cmd = d
+	}
+	if len(req.cmd) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return req, nil
+}
+
+func lookupString(doc bson.D, key string) (string, bool) {
+	v, _ := lookup(doc, key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+func msgReply(responseTo int32, doc []byte) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), responseTo, wiremessage.OpMsg)
+	dst = wiremessage.AppendMsgFlags(dst, 0)
+	dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+func queryReply(responseTo int32, doc []byte) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), responseTo, wiremessage.OpReply)
+	dst = wiremessage.AppendReplyFlags(dst, 0)
+	dst = wiremessage.AppendReplyCursorID(dst, 0)
+	dst = wiremessage.AppendReplyStartingFrom(dst, 0)
+	dst = wiremessage.AppendReplyNumberReturned(dst, 1)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
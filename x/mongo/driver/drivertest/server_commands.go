@@ -0,0 +1,1259 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultBatchSize is the number of documents in the first batch of a cursor when the command
+// does not set a batch size.
+const defaultBatchSize = 101
+
+// transactionsNS is the namespace holding the session records of committed transactions.
+const transactionsNS = "config.transactions"
+
+type commandFunc func(s *Server, v *view, r *request) (bson.D, *commandError)
+
+var commands = map[string]commandFunc{
+	"isMaster":          (*Server).isMaster,
+	"ismaster":          (*Server).isMaster,
+	"ping":              (*Server).ping,
+	"buildInfo":         (*Server).buildInfo,
+	"buildinfo":         (*Server).buildInfo,
+	"endSessions":       (*Server).endSessions,
+	"killSessions":      (*Server).endSessions,
+	"killAllSessions":   (*Server).killAllSessions,
+	"getLastError":      (*Server).ping,
+	"create":            (*Server).create,
+	"drop":              (*Server).drop,
+	"dropDatabase":      (*Server).dropDatabase,
+	"createIndexes":     (*Server).createIndexes,
+	"listCollections":   (*Server).listCollections,
+	"listDatabases":     (*Server).listDatabases,
+	"insert":            (*Server).insert,
+	"update":            (*Server).update,
+	"delete":            (*Server).delete,
+	"findAndModify":     (*Server).findAndModify,
+	"find":              (*Server).find,
+	"getMore":           (*Server).getMore,
+	"killCursors":       (*Server).killCursors,
+	"count":             (*Server).count,
+	"distinct":          (*Server).distinct,
+	"aggregate":         (*Server).aggregate,
+	"commitTransaction": (*Server).commitTransaction,
+	"abortTransaction":  (*Server).abortTransaction,
+	"currentOp":         (*Server).currentOp,
+}
+
+// notInTransaction lists the commands that cannot run in a transaction.
+var notInTransaction = map[string]bool{
+	"create":          true,
+	"drop":            true,
+	"dropDatabase":    true,
+	"createIndexes":   true,
+	"listCollections": true,
+	"listDatabases":   true,
+	"count":           true,
+	"currentOp":       true,
+}
+
+// run runs the command of r and returns the reply document.
+func (s *Server) run(r *request) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply, err := s.dispatch(r)
+	if err != nil {
+		reply = bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "errmsg", Value: err.msg},
+			{Key: "code", Value: err.code},
+			{Key: "codeName", Value: codeNames[err.code]},
+		}
+		if len(err.labels) != 0 {
+			labels := make(bson.A, len(err.labels))
+			for i, l := range err.labels {
+				labels[i] = l
+			}
+			reply = append(reply, bson.E{Key: "errorLabels", Value: labels})
+		}
+	} else {
+		reply = append(reply, bson.E{Key: "ok", Value: 1.0})
+	}
+
+	if name := r.name(); name != "isMaster" && name != "ismaster" {
+		clusterTime := s.st.clock
+		reply = append(reply,
+			bson.E{Key: "$clusterTime", Value: bson.D{
+				{Key: "clusterTime", Value: clusterTime},
+				{Key: "signature", Value: bson.D{
+					{Key: "hash", Value: primitive.Binary{Data: make([]byte, 20)}},
+					{Key: "keyId", Value: int64(0)},
+				}},
+			}},
+			bson.E{Key: "operationTime", Value: clusterTime},
+		)
+	}
+
+	doc, merr := bson.Marshal(reply)
+	if merr != nil {
+		doc, _ = bson.Marshal(bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "errmsg", Value: merr.Error()},
+			{Key: "code", Value: codeBadValue},
+		})
+	}
+	return doc
+}
+
+func (s *Server) dispatch(r *request) (bson.D, *commandError) {
+	h, ok := commands[r.name()]
+	if !ok {
+		return nil, errorf(codeCommandNotFound, "no such command: '%s'", r.name())
+	}
+	if err := checkImplemented(r); err != nil {
+		return nil, err
+	}
+	v, err := s.bind(r)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := h(s, v, r)
+
+	// Like on a server, a failed command aborts the transaction it is part of.
+	if v.txn != nil && r.name() != "commitTransaction" && r.name() != "abortTransaction" {
+		if _, failed := lookup(reply, "writeErrors"); failed || err != nil {
+			s.st.abort(v.sess)
+		}
+	}
+	if err == nil {
+		reply = append(reply, checkWriteConcern(r)...)
+	}
+	return reply, err
+}
+
+// checkImplemented returns a NotImplemented error if the command of r uses options the server
+// does not implement, rather than ignoring them.
+func checkImplemented(r *request) *commandError {
+	if _, ok := r.field("collation"); ok {
+		return errorf(codeNotImplemented, "collations are not implemented")
+	}
+	if r.name() == "aggregate" {
+		if _, ok := r.arg().(string); !ok {
+			return errorf(codeNotImplemented, "database aggregations are not implemented")
+		}
+	}
+	if u, ok := r.field("update"); ok && r.name() == "findAndModify" {
+		if _, ok := u.(bson.A); ok {
+			return errorf(codeNotImplemented, "update pipelines are not implemented")
+		}
+	}
+	if _, ok := r.field("arrayFilters"); ok {
+		return errorf(codeNotImplemented, "array filters are not implemented")
+	}
+
+	for _, key := range []string{"updates", "deletes"} {
+		list, _ := r.field(key)
+		stmts, _ := list.(bson.A)
+		for _, stmt := range stmts {
+			d, _ := stmt.(bson.D)
+			if _, ok := lookup(d, "collation"); ok {
+				return errorf(codeNotImplemented, "collations are not implemented")
+			}
+			if _, ok := lookup(d, "arrayFilters"); ok {
+				return errorf(codeNotImplemented, "array filters are not implemented")
+			}
+			if u, _ := lookup(d, "u"); u != nil {
+				if _, ok := u.(bson.A); ok {
+					return errorf(codeNotImplemented, "update pipelines are not implemented")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkWriteConcern returns the writeConcernError field of the reply to a command whose write
+// concern requires more members than the replica set has.
+func checkWriteConcern(r *request) bson.D {
+	w, _ := lookup(r.doc("writeConcern"), "w")
+	if n, ok := asInt64(w); !ok || n <= 1 {
+		return nil
+	}
+	return bson.D{{Key: "writeConcernError", Value: bson.D{
+		{Key: "code", Value: codeUnsatisfiableWriteConcern},
+		{Key: "codeName", Value: codeNames[codeUnsatisfiableWriteConcern]},
+		{Key: "errmsg", Value: "Not enough data-bearing nodes"},
+	}}}
+}
+
+// bind returns the view the command of r runs against: the data of its transaction if it is
+// part of one, and the shared data otherwise. It starts the transaction of commands with
+// startTransaction set.
+func (s *Server) bind(r *request) (*view, *commandError) {
+	v := &view{s: s.st}
+	lsid := r.doc("lsid")
+	if lsid == nil {
+		return v, nil
+	}
+	id, ok := lookup(lsid, "id")
+	bin, isBin := id.(primitive.Binary)
+	if !ok || !isBin {
+		return nil, errorf(codeBadValue, "lsid.id must be a UUID")
+	}
+	v.sess = s.st.session(bin.Data)
+
+	txnNumber, hasTxnNumber := r.field("txnNumber")
+	n, _ := asInt64(txnNumber)
+	if _, ok := r.field("autocommit"); !ok {
+		// a retryable write, which moves the session past its current transaction.
+		if hasTxnNumber && n > v.sess.txnNumber {
+			s.st.abort(v.sess)
+			v.sess.txnNumber = n
+			v.sess.txn = nil
+		}
+		return v, nil
+	}
+
+	if !hasTxnNumber {
+		return nil, errorf(codeBadValue, "'autocommit' field requires a transaction number to also be specified")
+	}
+	if notInTransaction[r.name()] {
+		return nil, errorf(codeOperationNotSupportedInTxn, "Cannot run '%s' in a multi-document transaction.", r.name())
+	}
+
+	if start, _ := r.field("startTransaction"); truthy(start) {
+		if err := s.st.begin(v.sess, n); err != nil {
+			return nil, err
+		}
+		v.txn = v.sess.txn
+		return v, nil
+	}
+
+	txn, err := s.st.transaction(v.sess, n, r.name() == "commitTransaction")
+	if err != nil {
+		return nil, err
+	}
+	v.txn = txn
+	return v, nil
+}
+
+func (s *Server) isMaster(v *view, r *request) (bson.D, *commandError) {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	return bson.D{
+		{Key: "ismaster", Value: true},
+		{Key: "secondary", Value: false},
+		{Key: "setName", Value: ReplicaSetName},
+		{Key: "setVersion", Value: int32(1)},
+		{Key: "hosts", Value: bson.A{s.addr}},
+		{Key: "primary", Value: s.addr},
+		{Key: "me", Value: s.addr},
+		{Key: "electionId", Value: s.electionID},
+		{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+		{Key: "maxMessageSizeBytes", Value: int32(maxMessageSize)},
+		{Key: "maxWriteBatchSize", Value: int32(100000)},
+		{Key: "localTime", Value: now},
+		{Key: "logicalSessionTimeoutMinutes", Value: int32(30)},
+		{Key: "minWireVersion", Value: int32(0)},
+		{Key: "maxWireVersion", Value: int32(8)},
+		{Key: "readOnly", Value: false},
+	}, nil
+}
+
+func (s *Server) ping(v *view, r *request) (bson.D, *commandError) {
+	return bson.D{}, nil
+}
+
+// endSessions aborts the transactions of the sessions listed by the command.
+func (s *Server) endSessions(v *view, r *request) (bson.D, *commandError) {
+	ids, _ := r.arg().(bson.A)
+	for _, id := range ids {
+		d, _ := id.(bson.D)
+		uuid, _ := lookup(d, "id")
+		if bin, ok := uuid.(primitive.Binary); ok {
+			s.st.abort(s.st.session(bin.Data))
+		}
+	}
+	return bson.D{}, nil
+}
+
+// killAllSessions aborts the transactions of all sessions.
+func (s *Server) killAllSessions(v *view, r *request) (bson.D, *commandError) {
+	for _, sess := range s.st.sessions {
+		s.st.abort(sess)
+	}
+	return bson.D{}, nil
+}
+
+func (s *Server) buildInfo(v *view, r *request) (bson.D, *commandError) {
+	return bson.D{
+		{Key: "version", Value: "4.2.0"},
+		{Key: "versionArray", Value: bson.A{int32(4), int32(2), int32(0), int32(0)}},
+		{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+	}, nil
+}
+
+func (s *Server) create(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	if v.exists(ns) {
+		return nil, errorf(codeNamespaceExists, "Collection already exists. NS: %s", ns)
+	}
+	v.create(ns)
+	return bson.D{}, nil
+}
+
+func (s *Server) drop(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	if !v.exists(ns) {
+		return nil, errorf(codeNamespaceNotFound, "ns not found")
+	}
+	v.drop(ns)
+	return bson.D{{Key: "ns", Value: ns}, {Key: "nIndexesWas", Value: int32(1)}}, nil
+}
+
+func (s *Server) dropDatabase(v *view, r *request) (bson.D, *commandError) {
+	for ns := range v.data() {
+		if strings.HasPrefix(ns, r.db+".") {
+			v.drop(ns)
+		}
+	}
+	return bson.D{{Key: "dropped", Value: r.db}}, nil
+}
+
+// createIndexes creates the collection but ignores the indexes: the server scans collections
+// for every query and does not enforce unique indexes.
+func (s *Server) createIndexes(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	indexes, _ := r.field("indexes")
+	list, _ := indexes.(bson.A)
+	existed := v.exists(ns)
+	v.create(ns)
+	return bson.D{
+		{Key: "createdCollectionAutomatically", Value: !existed},
+		{Key: "numIndexesBefore", Value: int32(1)},
+		{Key: "numIndexesAfter", Value: int32(1 + len(list))},
+	}, nil
+}
+
+func (s *Server) listCollections(v *view, r *request) (bson.D, *commandError) {
+	filter := r.doc("filter")
+	var docs []bson.D
+	for ns := range v.data() {
+		if !strings.HasPrefix(ns, r.db+".") {
+			continue
+		}
+		doc := bson.D{
+			{Key: "name", Value: strings.TrimPrefix(ns, r.db+".")},
+			{Key: "type", Value: "collection"},
+			{Key: "options", Value: bson.D{}},
+			{Key: "info", Value: bson.D{{Key: "readOnly", Value: false}}},
+		}
+		m, err := matchDoc(doc, filter)
+		if err != nil {
+			return nil, errorf(codeBadValue, "%v", err)
+		}
+		if m {
+			docs = append(docs, doc)
+		}
+	}
+	sortDocs(docs, bson.D{{Key: "name", Value: int32(1)}})
+	return s.cursorReply(r.db+".$cmd.listCollections", docs, 0, false), nil
+}
+
+func (s *Server) listDatabases(v *view, r *request) (bson.D, *commandError) {
+	seen := map[string]bool{}
+	var names []string
+	for ns := range v.data() {
+		db := strings.SplitN(ns, ".", 2)[0]
+		if !seen[db] {
+			seen[db] = true
+			names = append(names, db)
+		}
+	}
+	sort.Strings(names)
+
+	dbs := make(bson.A, len(names))
+	for i, name := range names {
+		dbs[i] = bson.D{
+			{Key: "name", Value: name},
+			{Key: "sizeOnDisk", Value: int64(0)},
+			{Key: "empty", Value: false},
+		}
+	}
+	return bson.D{{Key: "databases", Value: dbs}, {Key: "totalSize", Value: int64(0)}}, nil
+}
+
+// writeError builds an entry of the writeErrors array of a write command reply.
+func writeError(index int, err error) bson.D {
+	code := codeBadValue
+	if cerr, ok := err.(*commandError); ok {
+		code = cerr.code
+		err = fmt.Errorf("%s", cerr.msg)
+	}
+	return bson.D{
+		{Key: "index", Value: int32(index)},
+		{Key: "code", Value: code},
+		{Key: "errmsg", Value: err.Error()},
+	}
+}
+
+func writeReply(reply bson.D, writeErrors bson.A) bson.D {
+	if len(writeErrors) != 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+func duplicateKey(ns string, doc bson.D) *commandError {
+	id, _ := lookup(doc, "_id")
+	return errorf(codeDuplicateKey, "E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", ns, id)
+}
+
+// ensureID returns doc with an _id field, generating an ObjectID if it has none.
+func ensureID(doc bson.D) bson.D {
+	if _, ok := lookup(doc, "_id"); ok {
+		return doc
+	}
+	return append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+}
+
+func (s *Server) insert(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	docs, _ := r.field("documents")
+	list, ok := docs.(bson.A)
+	if !ok {
+		return nil, errorf(codeFailedToParse, "documents must be an array")
+	}
+	ordered := true
+	if o, ok := r.field("ordered"); ok {
+		ordered = truthy(o)
+	}
+
+	n := 0
+	var writeErrors bson.A
+	for i, d := range list {
+		doc, ok := d.(bson.D)
+		if !ok {
+			return nil, errorf(codeFailedToParse, "documents must be documents")
+		}
+		doc = ensureID(doc)
+		rec, rerr := newRecord(doc)
+		if rerr == nil && v.data().get(ns, rec.key) != nil {
+			rerr = duplicateKey(ns, doc)
+		}
+		if rerr != nil {
+			writeErrors = append(writeErrors, writeError(i, rerr))
+			if ordered {
+				break
+			}
+			continue
+		}
+		if err := v.put(ns, rec); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	v.create(ns)
+	return writeReply(bson.D{{Key: "n", Value: int32(n)}}, writeErrors), nil
+}
+
+// match returns the documents of ns matching filter, in insertion order.
+func (s *Server) match(v *view, ns string, filter bson.D) ([]bson.D, []*record, *commandError) {
+	var docs []bson.D
+	var recs []*record
+	for _, rec := range v.docs(ns) {
+		doc := rec.decode()
+		m, err := matchDoc(doc, filter)
+		if err != nil {
+			return nil, nil, errorf(codeBadValue, "%v", err)
+		}
+		if m {
+			docs = append(docs, doc)
+			recs = append(recs, rec)
+		}
+	}
+	return docs, recs, nil
+}
+
+// upsert inserts the document built from filter and update when an upsert matches nothing.
+func (s *Server) upsert(v *view, ns string, filter bson.D, update interface{}) (bson.D, error) {
+	doc, err := applyUpdate(equalityFields(filter), update, filter, true)
+	if err != nil {
+		return nil, errorf(codeFailedToParse, "%v", err)
+	}
+	doc = ensureID(doc)
+	rec, err := newRecord(doc)
+	if err != nil {
+		return nil, err
+	}
+	if v.data().get(ns, rec.key) != nil {
+		return nil, duplicateKey(ns, doc)
+	}
+	if err := v.put(ns, rec); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// replace stores the updated version of the document of old and reports whether it changed.
+func (s *Server) replace(v *view, ns string, old *record, doc bson.D) (bool, error) {
+	rec, err := newRecord(doc)
+	if err != nil {
+		return false, err
+	}
+	if rec.key != old.key {
+		return false, errorf(codeBadValue, "the _id field cannot be changed")
+	}
+	if bytes.Equal(rec.doc, old.doc) {
+		return false, nil
+	}
+	if err := v.put(ns, rec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Server) update(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	updates, _ := r.field("updates")
+	list, ok := updates.(bson.A)
+	if !ok {
+		return nil, errorf(codeFailedToParse, "updates must be an array")
+	}
+	ordered := true
+	if o, ok := r.field("ordered"); ok {
+		ordered = truthy(o)
+	}
+
+	var n, modified int
+	var upserted, writeErrors bson.A
+	for i, u := range list {
+		spec, _ := u.(bson.D)
+		filter, _ := lookup(spec, "q")
+		q, _ := filter.(bson.D)
+		upd, _ := lookup(spec, "u")
+		multi, _ := lookup(spec, "multi")
+		ups, _ := lookup(spec, "upsert")
+
+		docs, recs, cerr := s.match(v, ns, q)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if !truthy(multi) && len(docs) > 1 {
+			docs, recs = docs[:1], recs[:1]
+		}
+
+		var werr error
+		for j, doc := range docs {
+			doc, err := applyUpdate(doc, upd, q, false)
+			if err != nil {
+				werr = errorf(codeFailedToParse, "%v", err)
+				break
+			}
+			changed, err := s.replace(v, ns, recs[j], doc)
+			if cerr, ok := err.(*commandError); ok && cerr.code == codeWriteConflict {
+				return nil, cerr
+			}
+			if err != nil {
+				werr = err
+				break
+			}
+			n++
+			if changed {
+				modified++
+			}
+		}
+
+		if werr == nil && len(docs) == 0 && truthy(ups) {
+			doc, err := s.upsert(v, ns, q, upd)
+			if cerr, ok := err.(*commandError); ok && cerr.code == codeWriteConflict {
+				return nil, cerr
+			}
+			if err != nil {
+				werr = err
+			} else {
+				n++
+				id, _ := lookup(doc, "_id")
+				upserted = append(upserted, bson.D{{Key: "index", Value: int32(i)}, {Key: "_id", Value: id}})
+			}
+		}
+
+		if werr != nil {
+			writeErrors = append(writeErrors, writeError(i, werr))
+			if ordered {
+				break
+			}
+		}
+	}
+
+	reply := bson.D{{Key: "n", Value: int32(n)}, {Key: "nModified", Value: int32(modified)}}
+	if len(upserted) != 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	return writeReply(reply, writeErrors), nil
+}
+
+func (s *Server) delete(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	deletes, _ := r.field("deletes")
+	list, ok := deletes.(bson.A)
+	if !ok {
+		return nil, errorf(codeFailedToParse, "deletes must be an array")
+	}
+
+	n := 0
+	for _, d := range list {
+		spec, _ := d.(bson.D)
+		filter, _ := lookup(spec, "q")
+		q, _ := filter.(bson.D)
+		limit, _ := lookup(spec, "limit")
+
+		_, recs, cerr := s.match(v, ns, q)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if l, _ := asInt64(limit); l == 1 && len(recs) > 1 {
+			recs = recs[:1]
+		}
+		for _, rec := range recs {
+			if err := v.remove(ns, rec.key); err != nil {
+				return nil, err
+			}
+			n++
+		}
+	}
+	return bson.D{{Key: "n", Value: int32(n)}}, nil
+}
+
+func (s *Server) findAndModify(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	q := r.doc("query")
+	upd, hasUpdate := r.field("update")
+	remove, _ := r.field("remove")
+	returnNew, _ := r.field("new")
+	ups, _ := r.field("upsert")
+	if truthy(remove) == hasUpdate {
+		return nil, errorf(codeFailedToParse, "either an update or remove=true must be specified")
+	}
+
+	docs, recs, cerr := s.match(v, ns, q)
+	if cerr != nil {
+		return nil, cerr
+	}
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+	if spec := r.doc("sort"); len(spec) != 0 {
+		sort.SliceStable(order, func(i, j int) bool { return lessDocs(docs[order[i]], docs[order[j]], spec) })
+	}
+
+	var value interface{}
+	lastError := bson.D{}
+	switch {
+	case len(docs) != 0 && truthy(remove):
+		i := order[0]
+		if err := v.remove(ns, recs[i].key); err != nil {
+			return nil, err
+		}
+		value = docs[i]
+		lastError = bson.D{{Key: "n", Value: int32(1)}}
+	case len(docs) != 0:
+		i := order[0]
+		old := recs[i].decode()
+		doc, err := applyUpdate(docs[i], upd, q, false)
+		if err != nil {
+			return nil, errorf(codeFailedToParse, "%v", err)
+		}
+		if _, err := s.replace(v, ns, recs[i], doc); err != nil {
+			return nil, err.(*commandError)
+		}
+		value = old
+		if truthy(returnNew) {
+			value = doc
+		}
+		lastError = bson.D{{Key: "n", Value: int32(1)}, {Key: "updatedExisting", Value: true}}
+	case hasUpdate && truthy(ups):
+		doc, err := s.upsert(v, ns, q, upd)
+		if err != nil {
+			return nil, err.(*commandError)
+		}
+		id, _ := lookup(doc, "_id")
+		if truthy(returnNew) {
+			value = doc
+		}
+		lastError = bson.D{{Key: "n", Value: int32(1)}, {Key: "updatedExisting", Value: false}, {Key: "upserted", Value: id}}
+	default:
+		lastError = bson.D{{Key: "n", Value: int32(0)}}
+	}
+
+	if d, ok := value.(bson.D); ok {
+		projected, err := project(d, r.doc("fields"))
+		if err != nil {
+			return nil, errorf(codeBadValue, "%v", err)
+		}
+		value = projected
+	}
+	return bson.D{{Key: "lastErrorObject", Value: lastError}, {Key: "value", Value: value}}, nil
+}
+
+// read returns the documents of ns matching filter. The config.transactions namespace is
+// synthesized from the committed transactions of the sessions.
+func (s *Server) read(v *view, ns string, filter bson.D) ([]bson.D, *commandError) {
+	if ns != transactionsNS {
+		docs, _, err := s.match(v, ns, filter)
+		return docs, err
+	}
+
+	var docs []bson.D
+	for _, sess := range s.sessionsSorted() {
+		if sess.committed == 0 {
+			continue
+		}
+		doc := bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "id", Value: primitive.Binary{Subtype: 4, Data: sess.id}},
+				{Key: "uid", Value: primitive.Binary{Data: make([]byte, 32)}},
+			}},
+			{Key: "txnNum", Value: sess.committed},
+			{Key: "lastWriteDate", Value: primitive.NewDateTimeFromTime(sess.committedAt)},
+			{Key: "state", Value: string(txnCommitted)},
+		}
+		m, err := matchDoc(doc, filter)
+		if err != nil {
+			return nil, errorf(codeBadValue, "%v", err)
+		}
+		if m {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (s *Server) sessionsSorted() []*session {
+	out := make([]*session, 0, len(s.st.sessions))
+	for _, sess := range s.st.sessions {
+		out = append(out, sess)
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i].id) < string(out[j].id) })
+	return out
+}
+
+func (s *Server) find(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	docs, err := s.read(v, ns, r.doc("filter"))
+	if err != nil {
+		return nil, err
+	}
+	sortDocs(docs, r.doc("sort"))
+
+	if skip := int(r.int("skip")); skip > 0 {
+		if skip > len(docs) {
+			skip = len(docs)
+		}
+		docs = docs[skip:]
+	}
+	limit := r.int("limit")
+	single, _ := r.field("singleBatch")
+	if limit < 0 {
+		limit = -limit
+		single = true
+	}
+	if limit > 0 && int(limit) < len(docs) {
+		docs = docs[:limit]
+	}
+
+	proj := r.doc("projection")
+	for i, d := range docs {
+		if docs[i], err = projectDoc(d, proj); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := int(defaultBatchSize)
+	if _, ok := r.field("batchSize"); ok {
+		batch = int(r.int("batchSize"))
+	}
+	return s.cursorReply(ns, docs, batch, truthy(single)), nil
+}
+
+func projectDoc(doc bson.D, proj bson.D) (bson.D, *commandError) {
+	out, err := project(doc, proj)
+	if err != nil {
+		return nil, errorf(codeBadValue, "%v", err)
+	}
+	return out, nil
+}
+
+// cursor holds the documents of a query left to return.
+type cursor struct {
+	ns   string
+	docs []bson.D
+}
+
+// cursorReply returns the first batch of docs and registers a cursor for the others. A batch size
+// of 0 returns all of them.
+func (s *Server) cursorReply(ns string, docs []bson.D, batchSize int, single bool) bson.D {
+	n := len(docs)
+	if batchSize > 0 && batchSize < n {
+		n = batchSize
+	}
+
+	var id int64
+	if n < len(docs) && !single {
+		s.nextCursor++
+		id = s.nextCursor
+		s.cursors[id] = &cursor{ns: ns, docs: docs[n:]}
+	}
+
+	return bson.D{{Key: "cursor", Value: bson.D{
+		{Key: "firstBatch", Value: batchArray(docs[:n])},
+		{Key: "id", Value: id},
+		{Key: "ns", Value: ns},
+	}}}
+}
+
+func batchArray(docs []bson.D) bson.A {
+	batch := make(bson.A, len(docs))
+	for i, d := range docs {
+		batch[i] = d
+	}
+	return batch
+}
+
+func (s *Server) getMore(v *view, r *request) (bson.D, *commandError) {
+	id := r.int("getMore")
+	c, ok := s.cursors[id]
+	if !ok {
+		return nil, errorf(codeCursorNotFound, "cursor id %d not found", id)
+	}
+
+	n := len(c.docs)
+	if size := int(r.int("batchSize")); size > 0 && size < n {
+		n = size
+	}
+	batch := c.docs[:n]
+	c.docs = c.docs[n:]
+	if len(c.docs) == 0 {
+		delete(s.cursors, id)
+		id = 0
+	}
+
+	return bson.D{{Key: "cursor", Value: bson.D{
+		{Key: "nextBatch", Value: batchArray(batch)},
+		{Key: "id", Value: id},
+		{Key: "ns", Value: c.ns},
+	}}}, nil
+}
+
+func (s *Server) killCursors(v *view, r *request) (bson.D, *commandError) {
+	ids, _ := r.field("cursors")
+	list, _ := ids.(bson.A)
+
+	killed, notFound := bson.A{}, bson.A{}
+	for _, raw := range list {
+		id, _ := asInt64(raw)
+		if _, ok := s.cursors[id]; ok {
+			delete(s.cursors, id)
+			killed = append(killed, id)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+	return bson.D{
+		{Key: "cursorsKilled", Value: killed},
+		{Key: "cursorsNotFound", Value: notFound},
+		{Key: "cursorsAlive", Value: bson.A{}},
+		{Key: "cursorsUnknown", Value: bson.A{}},
+	}, nil
+}
+
+func (s *Server) count(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	docs, err := s.read(v, ns, r.doc("query"))
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(docs))
+	if skip := r.int("skip"); skip > 0 {
+		n -= skip
+		if n < 0 {
+			n = 0
+		}
+	}
+	if limit := r.int("limit"); limit != 0 {
+		if limit < 0 {
+			limit = -limit
+		}
+		if limit < n {
+			n = limit
+		}
+	}
+	return bson.D{{Key: "n", Value: int32(n)}}, nil
+}
+
+func (s *Server) distinct(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := lookupString(r.cmd, "key")
+	if !ok {
+		return nil, errorf(codeFailedToParse, "key must be a string")
+	}
+	docs, err := s.read(v, ns, r.doc("query"))
+	if err != nil {
+		return nil, err
+	}
+
+	values := bson.A{}
+	for _, d := range docs {
+		for _, val := range expand(valuesAt(d, strings.Split(key, "."))) {
+			if _, ok := val.(bson.A); ok {
+				continue
+			}
+			dup := false
+			for _, seen := range values {
+				if compareValues(seen, val) == 0 {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				values = append(values, val)
+			}
+		}
+	}
+	return bson.D{{Key: "values", Value: values}}, nil
+}
+
+func (s *Server) aggregate(v *view, r *request) (bson.D, *commandError) {
+	ns, err := r.ns()
+	if err != nil {
+		return nil, err
+	}
+	pipeline, _ := r.field("pipeline")
+	stages, ok := pipeline.(bson.A)
+	if !ok {
+		return nil, errorf(codeFailedToParse, "'pipeline' option must be specified as an array")
+	}
+
+	var docs []bson.D
+	for i, st := range stages {
+		stage, ok := st.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, errorf(codeFailedToParse, "a pipeline stage specification object must contain exactly one field")
+		}
+		if i == 0 {
+			filter := bson.D{}
+			if stage[0].Key == "$match" {
+				filter, _ = stage[0].Value.(bson.D)
+			}
+			if docs, err = s.read(v, ns, filter); err != nil {
+				return nil, err
+			}
+			if stage[0].Key == "$match" {
+				continue
+			}
+		}
+		if docs, err = runStage(docs, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(stages) == 0 {
+		if docs, err = s.read(v, ns, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := 0
+	if c := r.doc("cursor"); c != nil {
+		if size, ok := lookup(c, "batchSize"); ok {
+			n, _ := asInt64(size)
+			batch = int(n)
+		}
+	}
+	return s.cursorReply(ns, docs, batch, false), nil
+}
+
+// runStage applies an aggregation stage other than a leading $match to docs.
+func runStage(docs []bson.D, stage bson.E) ([]bson.D, *commandError) {
+	switch stage.Key {
+	case "$match":
+		filter, _ := stage.Value.(bson.D)
+		var out []bson.D
+		for _, d := range docs {
+			m, err := matchDoc(d, filter)
+			if err != nil {
+				return nil, errorf(codeBadValue, "%v", err)
+			}
+			if m {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+	case "$sort":
+		spec, _ := stage.Value.(bson.D)
+		sortDocs(docs, spec)
+		return docs, nil
+	case "$skip":
+		n, _ := asInt64(stage.Value)
+		if int(n) > len(docs) {
+			n = int64(len(docs))
+		}
+		return docs[n:], nil
+	case "$limit":
+		n, _ := asInt64(stage.Value)
+		if n <= 0 {
+			return nil, errorf(codeBadValue, "the limit must be positive")
+		}
+		if int(n) < len(docs) {
+			docs = docs[:n]
+		}
+		return docs, nil
+	case "$project":
+		spec, _ := stage.Value.(bson.D)
+		for i, d := range docs {
+			var err *commandError
+			if docs[i], err = projectDoc(d, spec); err != nil {
+				return nil, err
+			}
+		}
+		return docs, nil
+	case "$count":
+		name, _ := stage.Value.(string)
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return []bson.D{{{Key: name, Value: int32(len(docs))}}}, nil
+	case "$group":
+		spec, _ := stage.Value.(bson.D)
+		return group(docs, spec)
+	default:
+		return nil, errorf(codeUnrecognizedPipelineStage, "Unrecognized pipeline stage name: '%s'", stage.Key)
+	}
+}
+
+// evaluate evaluates an aggregation expression: a "$field" path or a constant.
+func evaluate(doc bson.D, expr interface{}) interface{} {
+	if path, ok := expr.(string); ok && strings.HasPrefix(path, "$") {
+		vals := valuesAt(doc, strings.Split(path[1:], "."))
+		if len(vals) == 0 {
+			return nil
+		}
+		return vals[0]
+	}
+	return expr
+}
+
+// group implements the $group stage with the $sum, $min, $max, $first, $last, $push and
+// $addToSet accumulators.
+func group(docs []bson.D, spec bson.D) ([]bson.D, *commandError) {
+	idExpr, ok := lookup(spec, "_id")
+	if !ok {
+		return nil, errorf(codeFailedToParse, "a group specification must include an _id")
+	}
+
+	type bucket struct {
+		id   interface{}
+		docs []bson.D
+	}
+	var buckets []*bucket
+	for _, d := range docs {
+		id := evaluate(d, idExpr)
+		var b *bucket
+		for _, cand := range buckets {
+			if compareValues(cand.id, id) == 0 {
+				b = cand
+				break
+			}
+		}
+		if b == nil {
+			b = &bucket{id: id}
+			buckets = append(buckets, b)
+		}
+		b.docs = append(b.docs, d)
+	}
+
+	out := make([]bson.D, 0, len(buckets))
+	for _, b := range buckets {
+		res := bson.D{{Key: "_id", Value: b.id}}
+		for _, field := range spec {
+			if field.Key == "_id" {
+				continue
+			}
+			acc, ok := field.Value.(bson.D)
+			if !ok || len(acc) != 1 {
+				return nil, errorf(codeFailedToParse, "the field '%s' must be an accumulator object", field.Key)
+			}
+			val, err := accumulate(b.docs, acc[0])
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, bson.E{Key: field.Key, Value: val})
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+func accumulate(docs []bson.D, acc bson.E) (interface{}, *commandError) {
+	switch acc.Key {
+	case "$sum":
+		var sum interface{} = int32(0)
+		for _, d := range docs {
+			v := evaluate(d, acc.Value)
+			if _, ok := asFloat64(v); !ok {
+				continue
+			}
+			sum, _ = addNumbers(sum, v)
+		}
+		return sum, nil
+	case "$min", "$max":
+		var res interface{}
+		for _, d := range docs {
+			v := evaluate(d, acc.Value)
+			if v == nil {
+				continue
+			}
+			c := 0
+			if res != nil {
+				c = compareValues(v, res)
+			}
+			if res == nil || (acc.Key == "$min" && c < 0) || (acc.Key == "$max" && c > 0) {
+				res = v
+			}
+		}
+		return res, nil
+	case "$first":
+		return evaluate(docs[0], acc.Value), nil
+	case "$last":
+		return evaluate(docs[len(docs)-1], acc.Value), nil
+	case "$push", "$addToSet":
+		list := bson.A{}
+		for _, d := range docs {
+			v := evaluate(d, acc.Value)
+			dup := false
+			if acc.Key == "$addToSet" {
+				for _, seen := range list {
+					if compareValues(seen, v) == 0 {
+						dup = true
+						break
+					}
+				}
+			}
+			if !dup {
+				list = append(list, v)
+			}
+		}
+		return list, nil
+	default:
+		return nil, errorf(codeFailedToParse, "unknown group operator '%s'", acc.Key)
+	}
+}
+
+func (s *Server) commitTransaction(v *view, r *request) (bson.D, *commandError) {
+	if v.txn == nil {
+		return nil, errorf(codeNoSuchTransaction, "commitTransaction must be run within a transaction")
+	}
+	if v.txn.state == txnInProgress {
+		s.st.commit(v.sess)
+		s.st.tick()
+	}
+	return bson.D{}, nil
+}
+
+func (s *Server) abortTransaction(v *view, r *request) (bson.D, *commandError) {
+	if v.txn == nil {
+		return nil, errorf(codeNoSuchTransaction, "abortTransaction must be run within a transaction")
+	}
+	s.st.abort(v.sess)
+	return bson.D{}, nil
+}
+
+// currentOp reports the open transactions as idle sessions, the way the server reports
+// transactions between two of their commands. The fields of the command other than the options
+// filter the operations.
+func (s *Server) currentOp(v *view, r *request) (bson.D, *commandError) {
+	filter := bson.D{}
+	for _, e := range r.cmd[1:] {
+		switch {
+		case strings.HasPrefix(e.Key, "$"), e.Key == "lsid", e.Key == "txnNumber", e.Key == "comment",
+			e.Key == "readConcern", e.Key == "writeConcern":
+		default:
+			filter = append(filter, e)
+		}
+	}
+
+	now := time.Now()
+	inprog := bson.A{}
+	for _, sess := range s.sessionsSorted() {
+		if sess.txn == nil || sess.txn.state != txnInProgress {
+			continue
+		}
+		op := bson.D{
+			{Key: "type", Value: "idleSession"},
+			{Key: "active", Value: false},
+			{Key: "desc", Value: "inactive transaction"},
+			{Key: "lsid", Value: bson.D{
+				{Key: "id", Value: primitive.Binary{Subtype: 4, Data: sess.id}},
+				{Key: "uid", Value: primitive.Binary{Data: make([]byte, 32)}},
+			}},
+			{Key: "transaction", Value: bson.D{
+				{Key: "parameters", Value: bson.D{
+					{Key: "txnNumber", Value: sess.txn.number},
+					{Key: "autocommit", Value: false},
+				}},
+				{Key: "startWallClockTime", Value: sess.txn.startedAt.Format(time.RFC3339Nano)},
+				{Key: "timeOpenMicros", Value: int64(now.Sub(sess.txn.startedAt) / time.Microsecond)},
+			}},
+		}
+		m, err := matchDoc(op, filter)
+		if err != nil {
+			return nil, errorf(codeBadValue, "%v", err)
+		}
+		if m {
+			inprog = append(inprog, op)
+		}
+	}
+	return bson.D{{Key: "inprog", Value: inprog}}, nil
+}
@@ -0,0 +1,932 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// This file implements the subset of the MongoDB query language understood by Server: query
+// filters, update documents, sorts and projections. Documents are handled as bson.D values, so
+// embedded documents are bson.D and arrays are bson.A.
+
+// lookup returns the value of the given top-level field of doc.
+func lookup(doc bson.D, key string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// isOperatorDoc reports whether v is a document whose first field is a $-prefixed operator.
+func isOperatorDoc(v interface{}) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// valuesAt returns the values found at the dotted path in v. Arrays met along the path are
+// traversed, so a path may resolve to several values. A missing field resolves to no value.
+func valuesAt(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	switch t := v.(type) {
+	case bson.D:
+		child, ok := lookup(t, path[0])
+		if !ok {
+			return nil
+		}
+		return valuesAt(child, path[1:])
+	case bson.A:
+		var vals []interface{}
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(t) {
+				vals = append(vals, valuesAt(t[i], path[1:])...)
+			}
+			return vals
+		}
+		for _, elem := range t {
+			if _, ok := elem.(bson.D); ok {
+				vals = append(vals, valuesAt(elem, path)...)
+			}
+		}
+		return vals
+	default:
+		return nil
+	}
+}
+
+// expand returns vals followed by the elements of the arrays among them, the set of values a
+// query condition is matched against.
+func expand(vals []interface{}) []interface{} {
+	out := append([]interface{}(nil), vals...)
+	for _, v := range vals {
+		if arr, ok := v.(bson.A); ok {
+			out = append(out, arr...)
+		}
+	}
+	return out
+}
+
+// matchDoc reports whether doc matches the query filter.
+func matchDoc(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			clauses, ok := e.Value.(bson.A)
+			if !ok || len(clauses) == 0 {
+				return false, fmt.Errorf("%s must be a nonempty array", e.Key)
+			}
+			matched := 0
+			for _, c := range clauses {
+				sub, ok := c.(bson.D)
+				if !ok {
+					return false, fmt.Errorf("%s entries must be documents", e.Key)
+				}
+				m, err := matchDoc(doc, sub)
+				if err != nil {
+					return false, err
+				}
+				if m {
+					matched++
+				}
+			}
+			switch {
+			case e.Key == "$and" && matched != len(clauses),
+				e.Key == "$or" && matched == 0,
+				e.Key == "$nor" && matched != 0:
+				return false, nil
+			}
+		case "$comment":
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return false, fmt.Errorf("unknown top level operator: %s", e.Key)
+			}
+			m, err := matchField(doc, e.Key, e.Value)
+			if err != nil || !m {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchField reports whether the values at path in doc satisfy cond, which is either an operator
+// document or a value to compare with.
+func matchField(doc bson.D, path string, cond interface{}) (bool, error) {
+	raw := valuesAt(doc, strings.Split(path, "."))
+	if !isOperatorDoc(cond) {
+		return matchValues(raw, cond), nil
+	}
+
+	return matchOperators(raw, cond.(bson.D))
+}
+
+// matchOperators reports whether raw satisfies every operator of ops.
+func matchOperators(raw []interface{}, ops bson.D) (bool, error) {
+	for _, op := range ops {
+		m, err := matchOperator(raw, op.Key, op.Value, ops)
+		if err != nil || !m {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchValues reports whether any of vals, or of their array elements, equals want. A null want
+// also matches a missing field, and a regular expression matches strings.
+func matchValues(raw []interface{}, want interface{}) bool {
+	if re, ok := want.(primitive.Regex); ok {
+		return matchRegex(expand(raw), re.Pattern, re.Options)
+	}
+	if want == nil && len(raw) == 0 {
+		return true
+	}
+	for _, v := range expand(raw) {
+		if compareValues(v, want) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperator(raw []interface{}, op string, arg interface{}, ops bson.D) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchValues(raw, arg), nil
+	case "$ne":
+		return !matchValues(raw, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(raw) {
+			if typeOrder(v) != typeOrder(arg) {
+				continue
+			}
+			c := compareValues(v, arg)
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := arg.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		found := false
+		for _, want := range list {
+			if matchValues(raw, want) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		return truthy(arg) == (len(raw) > 0), nil
+	case "$not":
+		if re, ok := arg.(primitive.Regex); ok {
+			return !matchRegex(expand(raw), re.Pattern, re.Options), nil
+		}
+		if !isOperatorDoc(arg) {
+			return false, fmt.Errorf("$not needs a regex or a document")
+		}
+		m, err := matchOperators(raw, arg.(bson.D))
+		return !m, err
+	case "$size":
+		n, ok := asInt64(arg)
+		if !ok {
+			return false, fmt.Errorf("$size needs a number")
+		}
+		for _, v := range raw {
+			if arr, ok := v.(bson.A); ok && int64(len(arr)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		sub, ok := arg.(bson.D)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch needs an object")
+		}
+		for _, v := range raw {
+			arr, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, elem := range arr {
+				m, err := matchElement(elem, sub)
+				if err != nil {
+					return false, err
+				}
+				if m {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$regex":
+		var opts string
+		if s, ok := lookup(ops, "$options"); ok {
+			opts, _ = s.(string)
+		}
+		pattern, ok := arg.(string)
+		if !ok {
+			return false, fmt.Errorf("$regex has to be a string")
+		}
+		return matchRegex(expand(raw), pattern, opts), nil
+	case "$options":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+// matchElement matches an array element for $elemMatch: documents are matched as a query filter
+// and other values against the operators of cond.
+func matchElement(elem interface{}, cond bson.D) (bool, error) {
+	if isOperatorDoc(cond) {
+		return matchOperators([]interface{}{elem}, cond)
+	}
+	d, ok := elem.(bson.D)
+	if !ok {
+		return false, nil
+	}
+	return matchDoc(d, cond)
+}
+
+func matchRegex(vals []interface{}, pattern, opts string) bool {
+	flags := ""
+	for _, o := range opts {
+		if o == 'i' || o == 'm' || o == 's' {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	for _, v := range vals {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOrder returns the position of the type of v in the BSON comparison order.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Undefined, primitive.Null:
+		return 1
+	case int32, int64, float64, int, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 13
+	default:
+		return 12
+	}
+}
+
+// compareValues orders two values the way the server does: first by type, then by value.
+func compareValues(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return ta - tb
+	}
+
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case bv:
+			return -1
+		default:
+			return 1
+		}
+	case primitive.ObjectID:
+		bv := b.(primitive.ObjectID)
+		return bytes.Compare(av[:], bv[:])
+	case primitive.Binary:
+		bv := b.(primitive.Binary)
+		if len(av.Data) != len(bv.Data) {
+			return len(av.Data) - len(bv.Data)
+		}
+		if av.Subtype != bv.Subtype {
+			return int(av.Subtype) - int(bv.Subtype)
+		}
+		return bytes.Compare(av.Data, bv.Data)
+	case primitive.Timestamp:
+		bv := b.(primitive.Timestamp)
+		switch {
+		case av.T != bv.T:
+			return cmpUint(av.T, bv.T)
+		default:
+			return cmpUint(av.I, bv.I)
+		}
+	case bson.D:
+		bv := b.(bson.D)
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			if c := strings.Compare(av[i].Key, bv[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(av[i].Value, bv[i].Value); c != 0 {
+				return c
+			}
+		}
+		return len(av) - len(bv)
+	case bson.A:
+		bv := b.(bson.A)
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			if c := compareValues(av[i], bv[i]); c != 0 {
+				return c
+			}
+		}
+		return len(av) - len(bv)
+	}
+
+	switch ta {
+	case 2:
+		fa, _ := asFloat64(a)
+		fb, _ := asFloat64(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 9:
+		return cmpInt64(asMillis(a), asMillis(b))
+	case 0, 1, 13:
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func cmpUint(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func asMillis(v interface{}) int64 {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return int64(t)
+	case time.Time:
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	return 0
+}
+
+func asFloat64(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case float64:
+		return t, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(t.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func asInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case int:
+		return int64(t), true
+	case float64:
+		if t == math.Trunc(t) {
+			return int64(t), true
+		}
+	}
+	return 0, false
+}
+
+// truthy interprets v the way the server interprets boolean options.
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case nil:
+		return false
+	}
+	if f, ok := asFloat64(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// sortDocs sorts docs in place following the sort specification spec.
+func sortDocs(docs []bson.D, spec bson.D) {
+	if len(spec) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return lessDocs(docs[i], docs[j], spec) })
+}
+
+// lessDocs reports whether a sorts before b following the sort specification spec.
+func lessDocs(a, b bson.D, spec bson.D) bool {
+	for _, e := range spec {
+		dir := 1
+		if n, ok := asInt64(e.Value); ok && n < 0 {
+			dir = -1
+		}
+		c := compareValues(sortKey(a, e.Key, dir), sortKey(b, e.Key, dir))
+		if c != 0 {
+			return c*dir < 0
+		}
+	}
+	return false
+}
+
+// sortKey returns the value docs are sorted by for the given path: the smallest value for an
+// ascending sort and the largest one for a descending sort.
+func sortKey(doc bson.D, path string, dir int) interface{} {
+	vals := valuesAt(doc, strings.Split(path, "."))
+	if len(vals) == 0 {
+		return nil
+	}
+	var key interface{}
+	for i, v := range expand(vals) {
+		if _, ok := v.(bson.A); ok {
+			continue
+		}
+		if i == 0 || key == nil || compareValues(v, key)*dir < 0 {
+			key = v
+		}
+	}
+	if key == nil {
+		return vals[0]
+	}
+	return key
+}
+
+// project applies an inclusion or exclusion projection to the top-level fields of doc.
+func project(doc bson.D, proj bson.D) (bson.D, error) {
+	if len(proj) == 0 {
+		return doc, nil
+	}
+
+	include := map[string]bool{}
+	mode := 0
+	keepID := true
+	for _, e := range proj {
+		field := strings.SplitN(e.Key, ".", 2)[0]
+		on := truthy(e.Value)
+		if field == "_id" {
+			keepID = on
+			continue
+		}
+		m := -1
+		if on {
+			m = 1
+		}
+		if mode != 0 && mode != m {
+			return nil, fmt.Errorf("cannot mix inclusion and exclusion in a projection")
+		}
+		mode = m
+		include[field] = true
+	}
+
+	out := bson.D{}
+	for _, e := range doc {
+		switch {
+		case e.Key == "_id":
+			if keepID {
+				out = append(out, e)
+			}
+		case mode >= 0 && include[e.Key], mode < 0 && !include[e.Key]:
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// equalityFields returns the fields of filter that have a fixed value, which seed the document
+// inserted by an upsert.
+func equalityFields(filter bson.D) bson.D {
+	doc := bson.D{}
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and":
+			clauses, _ := e.Value.(bson.A)
+			for _, c := range clauses {
+				if sub, ok := c.(bson.D); ok {
+					for _, se := range equalityFields(sub) {
+						doc, _ = setPath(doc, strings.Split(se.Key, "."), se.Value)
+					}
+				}
+			}
+		case strings.HasPrefix(e.Key, "$"):
+		case isOperatorDoc(e.Value):
+			if v, ok := lookup(e.Value.(bson.D), "$eq"); ok {
+				doc, _ = setPath(doc, strings.Split(e.Key, "."), v)
+			}
+		default:
+			doc, _ = setPath(doc, strings.Split(e.Key, "."), e.Value)
+		}
+	}
+	return doc
+}
+
+// applyUpdate returns doc modified by update, which is either a replacement document or a
+// document of update operators. filter resolves the positional $ operator and inserting tells
+// whether the update is creating a document for an upsert.
+func applyUpdate(doc bson.D, update interface{}, filter bson.D, inserting bool) (bson.D, error) {
+	upd, ok := update.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("update must be a document, got %T", update)
+	}
+
+	if !isOperatorDoc(upd) {
+		out := bson.D{}
+		if id, ok := lookup(doc, "_id"); ok {
+			out = append(out, bson.E{Key: "_id", Value: id})
+		}
+		for _, e := range upd {
+			if strings.HasPrefix(e.Key, "$") {
+				return nil, fmt.Errorf("replacement document cannot contain operator %s", e.Key)
+			}
+			if e.Key == "_id" {
+				if id, ok := lookup(doc, "_id"); ok && compareValues(id, e.Value) != 0 {
+					return nil, fmt.Errorf("the _id field cannot be changed")
+				}
+				if len(out) == 0 {
+					out = append(out, e)
+				}
+				continue
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	}
+
+	var err error
+	for _, op := range upd {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("modifiers of %s must be a document", op.Key)
+		}
+		for _, f := range fields {
+			path, perr := resolvePositional(doc, f.Key, filter)
+			if perr != nil {
+				return nil, perr
+			}
+			if path[0] == "_id" && op.Key != "$setOnInsert" && !(inserting && op.Key == "$set") {
+				if cur, ok := lookup(doc, "_id"); !ok || compareValues(cur, f.Value) != 0 || op.Key != "$set" {
+					return nil, fmt.Errorf("performing an update on the path '_id' would modify the immutable field '_id'")
+				}
+			}
+
+			switch op.Key {
+			case "$set":
+				doc, err = setPath(doc, path, f.Value)
+			case "$setOnInsert":
+				if inserting {
+					doc, err = setPath(doc, path, f.Value)
+				}
+			case "$unset":
+				doc = unsetPath(doc, path)
+			case "$inc":
+				doc, err = incPath(doc, path, f.Value)
+			case "$push", "$addToSet":
+				doc, err = pushPath(doc, path, f.Value, op.Key == "$addToSet")
+			case "$pull":
+				doc, err = pullPath(doc, path, f.Value)
+			case "$min", "$max":
+				cur := valuesAt(doc, path)
+				c := 0
+				if len(cur) > 0 {
+					c = compareValues(f.Value, cur[0])
+				}
+				if len(cur) == 0 || (op.Key == "$min" && c < 0) || (op.Key == "$max" && c > 0) {
+					doc, err = setPath(doc, path, f.Value)
+				}
+			case "$currentDate":
+				doc, err = setPath(doc, path, primitive.NewDateTimeFromTime(time.Now()))
+			default:
+				return nil, fmt.Errorf("unknown modifier: %s", op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// resolvePositional splits key into a path, replacing a positional $ with the index of the first
+// array element matched by filter.
+func resolvePositional(doc bson.D, key string, filter bson.D) ([]string, error) {
+	path := strings.Split(key, ".")
+	for i, p := range path {
+		if p != "$" {
+			continue
+		}
+		prefix := strings.Join(path[:i], ".")
+		vals := valuesAt(doc, path[:i])
+		if len(vals) != 1 {
+			return nil, fmt.Errorf("the positional operator did not find the match needed from the query")
+		}
+		arr, ok := vals[0].(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("the positional operator did not find the match needed from the query")
+		}
+
+		idx := -1
+		for j, elem := range arr {
+			m, err := matchArrayConditions(prefix, elem, filter)
+			if err != nil {
+				return nil, err
+			}
+			if m {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("the positional operator did not find the match needed from the query")
+		}
+		path[i] = strconv.Itoa(idx)
+	}
+	return path, nil
+}
+
+// matchArrayConditions reports whether elem, an element of the array at prefix, satisfies the
+// conditions filter puts on that array.
+func matchArrayConditions(prefix string, elem interface{}, filter bson.D) (bool, error) {
+	conds := bson.D{}
+	for _, e := range filter {
+		if e.Key == prefix || strings.HasPrefix(e.Key, prefix+".") {
+			conds = append(conds, e)
+		}
+	}
+	if len(conds) == 0 {
+		return false, nil
+	}
+	return matchDoc(bson.D{{Key: prefix, Value: bson.A{elem}}}, conds)
+}
+
+// setPath sets the value at path in doc, creating the embedded documents it needs.
+func setPath(doc bson.D, path []string, v interface{}) (bson.D, error) {
+	out, err := setIn(doc, path, v)
+	if err != nil {
+		return nil, err
+	}
+	return out.(bson.D), nil
+}
+
+func setIn(container interface{}, path []string, v interface{}) (interface{}, error) {
+	switch t := container.(type) {
+	case bson.D:
+		for i, e := range t {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				t[i].Value = v
+				return t, nil
+			}
+			child, err := setIn(e.Value, path[1:], v)
+			if err != nil {
+				return nil, err
+			}
+			t[i].Value = child
+			return t, nil
+		}
+		if len(path) == 1 {
+			return append(t, bson.E{Key: path[0], Value: v}), nil
+		}
+		child, err := setIn(bson.D{}, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		return append(t, bson.E{Key: path[0], Value: child}), nil
+	case bson.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("cannot create field '%s' in an array", path[0])
+		}
+		for len(t) <= i {
+			t = append(t, nil)
+		}
+		if len(path) == 1 {
+			t[i] = v
+			return t, nil
+		}
+		child := t[i]
+		if child == nil {
+			child = bson.D{}
+		}
+		child, err = setIn(child, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = child
+		return t, nil
+	default:
+		return nil, fmt.Errorf("cannot create field '%s' in element of type %T", path[0], container)
+	}
+}
+
+// unsetPath removes the value at path from doc.
+func unsetPath(doc bson.D, path []string) bson.D {
+	out, _ := unsetIn(doc, path).(bson.D)
+	return out
+}
+
+func unsetIn(container interface{}, path []string) interface{} {
+	switch t := container.(type) {
+	case bson.D:
+		for i, e := range t {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				return append(t[:i:i], t[i+1:]...)
+			}
+			t[i].Value = unsetIn(e.Value, path[1:])
+			return t
+		}
+	case bson.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(t) {
+			return t
+		}
+		if len(path) == 1 {
+			t[i] = nil
+			return t
+		}
+		t[i] = unsetIn(t[i], path[1:])
+	}
+	return container
+}
+
+func incPath(doc bson.D, path []string, delta interface{}) (bson.D, error) {
+	if _, ok := asFloat64(delta); !ok {
+		return nil, fmt.Errorf("cannot increment with non-numeric argument")
+	}
+	cur := valuesAt(doc, path)
+	if len(cur) == 0 {
+		return setPath(doc, path, delta)
+	}
+	sum, err := addNumbers(cur[0], delta)
+	if err != nil {
+		return nil, err
+	}
+	return setPath(doc, path, sum)
+}
+
+// addNumbers adds two numbers, widening the result to the largest of their types.
+func addNumbers(a, b interface{}) (interface{}, error) {
+	fa, ok := asFloat64(a)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply $inc to a value of non-numeric type %T", a)
+	}
+	fb, _ := asFloat64(b)
+	_, af := a.(float64)
+	_, bf := b.(float64)
+	if af || bf {
+		return fa + fb, nil
+	}
+	ia, _ := asInt64(a)
+	ib, _ := asInt64(b)
+	_, a64 := a.(int64)
+	_, b64 := b.(int64)
+	sum := ia + ib
+	if a64 || b64 || sum > math.MaxInt32 || sum < math.MinInt32 {
+		return sum, nil
+	}
+	return int32(sum), nil
+}
+
+func pushPath(doc bson.D, path []string, v interface{}, unique bool) (bson.D, error) {
+	items := bson.A{v}
+	if d, ok := v.(bson.D); ok {
+		if each, ok := lookup(d, "$each"); ok {
+			if items, ok = each.(bson.A); !ok {
+				return nil, fmt.Errorf("the argument to $each must be an array")
+			}
+		}
+	}
+
+	var arr bson.A
+	if cur := valuesAt(doc, path); len(cur) != 0 {
+		var ok bool
+		if arr, ok = cur[0].(bson.A); !ok {
+			return nil, fmt.Errorf("the field '%s' must be an array", strings.Join(path, "."))
+		}
+	}
+	arr = append(bson.A(nil), arr...)
+
+	for _, item := range items {
+		if unique {
+			present := false
+			for _, elem := range arr {
+				if compareValues(elem, item) == 0 {
+					present = true
+					break
+				}
+			}
+			if present {
+				continue
+			}
+		}
+		arr = append(arr, item)
+	}
+	return setPath(doc, path, arr)
+}
+
+func pullPath(doc bson.D, path []string, cond interface{}) (bson.D, error) {
+	cur := valuesAt(doc, path)
+	if len(cur) == 0 {
+		return doc, nil
+	}
+	arr, ok := cur[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply $pull to a non-array value")
+	}
+
+	kept := bson.A{}
+	for _, elem := range arr {
+		var m bool
+		var err error
+		if d, ok := cond.(bson.D); ok {
+			m, err = matchElement(elem, d)
+		} else {
+			m = compareValues(elem, cond) == 0
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !m {
+			kept = append(kept, elem)
+		}
+	}
+	return setPath(doc, path, kept)
+}
@@ -0,0 +1,453 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Server error codes, with the names the server reports them under.
+const (
+	codeBadValue                     int32 = 2
+	codeFailedToParse                int32 = 9
+	codeNamespaceNotFound            int32 = 26
+	codeCursorNotFound               int32 = 43
+	codeNamespaceExists              int32 = 48
+	codeCommandNotFound              int32 = 59
+	codeUnsatisfiableWriteConcern    int32 = 100
+	codeWriteConflict                int32 = 112
+	codeConflictingOperationProgress int32 = 117
+	codeOperationNotSupportedInTxn   int32 = 263
+	codeTransactionTooOld            int32 = 225
+	codeNotImplemented               int32 = 238
+	codeNoSuchTransaction            int32 = 251
+	codeTransactionCommitted         int32 = 256
+	codeDuplicateKey                 int32 = 11000
+	codeUnrecognizedPipelineStage    int32 = 40324
+)
+
+var codeNames = map[int32]string{
+	codeBadValue:                     "BadValue",
+	codeFailedToParse:                "FailedToParse",
+	codeNamespaceNotFound:            "NamespaceNotFound",
+	codeCursorNotFound:               "CursorNotFound",
+	codeNamespaceExists:              "NamespaceExists",
+	codeCommandNotFound:              "CommandNotFound",
+	codeUnsatisfiableWriteConcern:    "UnsatisfiableWriteConcern",
+	codeWriteConflict:                "WriteConflict",
+	codeConflictingOperationProgress: "ConflictingOperationInProgress",
+	codeOperationNotSupportedInTxn:   "OperationNotSupportedInTransaction",
+	codeTransactionTooOld:            "TransactionTooOld",
+	codeNotImplemented:               "NotImplemented",
+	codeNoSuchTransaction:            "NoSuchTransaction",
+	codeTransactionCommitted:         "TransactionCommitted",
+	codeDuplicateKey:                 "DuplicateKey",
+	codeUnrecognizedPipelineStage:    "Location40324",
+}
+
+const transientTransactionError = "TransientTransactionError"
+
+// commandError is a command failure reported to the client as an ok: 0 reply.
+type commandError struct {
+	code   int32
+	msg    string
+	labels []string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("(%s) %s", codeNames[e.code], e.msg)
+}
+
+func errorf(code int32, format string, args ...interface{}) *commandError {
+	return &commandError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// record is a stored document. Records are never modified: a write replaces the record, so a
+// transaction detects conflicting writes by comparing record pointers.
+type record struct {
+	key string
+	doc bson.Raw
+}
+
+// newRecord builds the record of doc, which must have an _id.
+func newRecord(doc bson.D) (*record, error) {
+	id, ok := lookup(doc, "_id")
+	if !ok {
+		return nil, errorf(codeBadValue, "document has no _id")
+	}
+	key, err := idKey(id)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, errorf(codeBadValue, "%v", err)
+	}
+	return &record{key: key, doc: raw}, nil
+}
+
+// idKey returns a string identifying the _id value id.
+func idKey(id interface{}) (string, error) {
+	if _, ok := id.(bson.A); ok {
+		return "", errorf(codeBadValue, "can't use an array for _id")
+	}
+	data, err := bson.Marshal(bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return "", errorf(codeBadValue, "invalid _id: %v", err)
+	}
+	return string(data), nil
+}
+
+func (r *record) decode() bson.D {
+	var doc bson.D
+	_ = bson.Unmarshal(r.doc, &doc)
+	return doc
+}
+
+// collection holds the records of a namespace in insertion order.
+type collection struct {
+	records []*record
+}
+
+func (c *collection) find(key string) (int, *record) {
+	for i, r := range c.records {
+		if r.key == key {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+// dataset maps namespaces to collections. Collections are copied on write, so a shallow copy of
+// a dataset is a snapshot.
+type dataset map[string]*collection
+
+func (d dataset) clone() dataset {
+	out := make(dataset, len(d))
+	for ns, c := range d {
+		out[ns] = c
+	}
+	return out
+}
+
+func (d dataset) get(ns, key string) *record {
+	c, ok := d[ns]
+	if !ok {
+		return nil
+	}
+	_, r := c.find(key)
+	return r
+}
+
+// put stores rec in ns, replacing the record with the same _id if any.
+func (d dataset) put(ns string, rec *record) {
+	c := d[ns]
+	if c == nil {
+		c = &collection{}
+	}
+	records := append([]*record(nil), c.records...)
+	if i, _ := c.find(rec.key); i >= 0 {
+		records[i] = rec
+	} else {
+		records = append(records, rec)
+	}
+	d[ns] = &collection{records: records}
+}
+
+// remove deletes the record with the given key from ns.
+func (d dataset) remove(ns, key string) {
+	c := d[ns]
+	if c == nil {
+		return
+	}
+	i, _ := c.find(key)
+	if i < 0 {
+		return
+	}
+	records := make([]*record, 0, len(c.records)-1)
+	records = append(records, c.records[:i]...)
+	records = append(records, c.records[i+1:]...)
+	d[ns] = &collection{records: records}
+}
+
+// txnState is the state of a transaction of a server session.
+type txnState string
+
+const (
+	txnInProgress txnState = "inProgress"
+	txnCommitted  txnState = "committed"
+	txnAborted    txnState = "aborted"
+)
+
+// transaction is a multi-document transaction. It reads and writes a private copy of the data
+// taken when it started, and applies its writes to the shared data when it commits.
+type transaction struct {
+	number    int64
+	state     txnState
+	startedAt time.Time
+	base      dataset
+	view      dataset
+	writes    map[string]map[string]bool
+	created   map[string]bool
+}
+
+func (t *transaction) wrote(ns, key string) bool {
+	return t.writes[ns][key]
+}
+
+// session is the server side of a logical session.
+type session struct {
+	id        []byte
+	txnNumber int64
+	txn       *transaction
+	// committed is the number of the last committed transaction, which is reported in the
+	// config.transactions collection.
+	committed   int64
+	committedAt time.Time
+}
+
+// store holds the data of a Server and the state of its sessions.
+type store struct {
+	data     dataset
+	sessions map[string]*session
+	clock    primitive.Timestamp
+}
+
+func newStore() *store {
+	return &store{
+		data:     make(dataset),
+		sessions: make(map[string]*session),
+	}
+}
+
+// tick advances the cluster time and returns it.
+func (s *store) tick() primitive.Timestamp {
+	now := uint32(time.Now().Unix())
+	if now > s.clock.T {
+		s.clock = primitive.Timestamp{T: now, I: 1}
+	} else {
+		s.clock.I++
+	}
+	return s.clock
+}
+
+func (s *store) session(id []byte) *session {
+	key := string(id)
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &session{id: append([]byte(nil), id...)}
+		s.sessions[key] = sess
+	}
+	return sess
+}
+
+// activeTxns returns the in progress transactions of all sessions but the one with the given
+// id, in session order.
+func (s *store) activeTxns(except []byte) []*session {
+	var out []*session
+	for key, sess := range s.sessions {
+		if key != string(except) && sess.txn != nil && sess.txn.state == txnInProgress {
+			out = append(out, sess)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i].id) < string(out[j].id) })
+	return out
+}
+
+// begin starts transaction number n on sess, aborting any older transaction.
+func (s *store) begin(sess *session, n int64) *commandError {
+	if n < sess.txnNumber {
+		return errorf(codeTransactionTooOld, "txnNumber %d is less than last txnNumber %d seen in session %x",
+			n, sess.txnNumber, sess.id)
+	}
+	if n == sess.txnNumber && sess.txn != nil {
+		return errorf(codeConflictingOperationProgress,
+			"cannot start transaction %d on session %x because a transaction with the same number is in progress", n, sess.id)
+	}
+	if sess.txn != nil && sess.txn.state == txnInProgress {
+		sess.txn.state = txnAborted
+	}
+	sess.txnNumber = n
+	sess.txn = &transaction{
+		number:    n,
+		state:     txnInProgress,
+		startedAt: time.Now(),
+		base:      s.data.clone(),
+		view:      s.data.clone(),
+		writes:    make(map[string]map[string]bool),
+		created:   make(map[string]bool),
+	}
+	return nil
+}
+
+// transaction returns the transaction number n of sess, which a command running in it continues.
+// commit tells whether the command is commitTransaction, which may be retried once the
+// transaction committed.
+func (s *store) transaction(sess *session, n int64, commit bool) (*transaction, *commandError) {
+	if n < sess.txnNumber {
+		return nil, errorf(codeTransactionTooOld, "txnNumber %d is less than last txnNumber %d seen in session %x",
+			n, sess.txnNumber, sess.id)
+	}
+	txn := sess.txn
+	if txn == nil || txn.number != n || txn.state == txnAborted {
+		err := errorf(codeNoSuchTransaction, "Transaction %d has been aborted.", n)
+		if txn == nil || txn.number != n {
+			err.msg = fmt.Sprintf("Given transaction number %d does not match any in-progress transactions.", n)
+		}
+		err.labels = []string{transientTransactionError}
+		return nil, err
+	}
+	if txn.state == txnCommitted && !commit {
+		return nil, errorf(codeTransactionCommitted, "Transaction %d has been committed.", n)
+	}
+	return txn, nil
+}
+
+// commit applies the writes of the transaction of sess to the shared data.
+func (s *store) commit(sess *session) {
+	txn := sess.txn
+	if txn.state != txnInProgress {
+		return
+	}
+	data := s.data.clone()
+	for ns := range txn.created {
+		if _, ok := data[ns]; !ok {
+			data[ns] = &collection{}
+		}
+	}
+	for ns, keys := range txn.writes {
+		for key := range keys {
+			if rec := txn.view.get(ns, key); rec != nil {
+				data.put(ns, rec)
+			} else {
+				data.remove(ns, key)
+			}
+		}
+	}
+	s.data = data
+	txn.state = txnCommitted
+	sess.committed = txn.number
+	sess.committedAt = time.Now()
+}
+
+// abort discards the transaction of sess.
+func (s *store) abort(sess *session) {
+	if sess.txn != nil && sess.txn.state == txnInProgress {
+		sess.txn.state = txnAborted
+	}
+}
+
+// view is the data a command reads and writes: the shared data, or the private copy of the
+// transaction the command runs in.
+type view struct {
+	s    *store
+	sess *session
+	txn  *transaction
+}
+
+func (v *view) data() dataset {
+	if v.txn != nil {
+		return v.txn.view
+	}
+	return v.s.data
+}
+
+// docs returns the documents of ns.
+func (v *view) docs(ns string) []*record {
+	c := v.data()[ns]
+	if c == nil {
+		return nil
+	}
+	return c.records
+}
+
+func (v *view) exists(ns string) bool {
+	_, ok := v.data()[ns]
+	return ok
+}
+
+// create creates the collection ns if it does not exist yet.
+func (v *view) create(ns string) {
+	if v.exists(ns) {
+		return
+	}
+	if v.txn != nil {
+		v.txn.view[ns] = &collection{}
+		v.txn.created[ns] = true
+		return
+	}
+	v.s.data[ns] = &collection{}
+}
+
+// checkWrite returns a WriteConflict error if the document with the given key of ns cannot be
+// written by this command.
+func (v *view) checkWrite(ns, key string) *commandError {
+	var self []byte
+	if v.sess != nil {
+		self = v.sess.id
+	}
+	for _, other := range v.s.activeTxns(self) {
+		if other.txn.wrote(ns, key) {
+			return v.conflict()
+		}
+	}
+	if v.txn != nil && v.s.data.get(ns, key) != v.txn.base.get(ns, key) {
+		return v.conflict()
+	}
+	return nil
+}
+
+func (v *view) conflict() *commandError {
+	err := errorf(codeWriteConflict, "WriteConflict error: this operation conflicted with another operation. Please retry your operation or multi-document transaction.")
+	if v.txn != nil {
+		v.txn.state = txnAborted
+		err.labels = []string{transientTransactionError}
+	}
+	return err
+}
+
+// put stores rec in ns.
+func (v *view) put(ns string, rec *record) *commandError {
+	if err := v.checkWrite(ns, rec.key); err != nil {
+		return err
+	}
+	v.create(ns)
+	v.data().put(ns, rec)
+	v.track(ns, rec.key)
+	return nil
+}
+
+// remove deletes the document with the given key from ns.
+func (v *view) remove(ns, key string) *commandError {
+	if err := v.checkWrite(ns, key); err != nil {
+		return err
+	}
+	v.data().remove(ns, key)
+	v.track(ns, key)
+	return nil
+}
+
+func (v *view) track(ns, key string) {
+	if v.txn == nil {
+		v.s.tick()
+		return
+	}
+	if v.txn.writes[ns] == nil {
+		v.txn.writes[ns] = make(map[string]bool)
+	}
+	v.txn.writes[ns][key] = true
+}
+
+// drop removes the collection ns.
+func (v *view) drop(ns string) {
+	delete(v.data(), ns)
+}
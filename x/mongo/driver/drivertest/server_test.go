@@ -0,0 +1,237 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package drivertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+func newServerClient(t *testing.T) (*Server, *mongo.Client) {
+	t.Helper()
+	srv, err := NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(srv.URI()).SetRetryWrites(false))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cli.Disconnect(context.Background()) })
+	return srv, cli
+}
+
+func TestServerCRUD(t *testing.T) {
+	srv, cli := newServerClient(t)
+	ctx := context.Background()
+	coll := cli.Database("test").Collection("crud")
+
+	_, err := coll.InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: 10}, {Key: "tags", Value: bson.A{"a", "b"}}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "n", Value: 20}, {Key: "tags", Value: bson.A{"b"}}},
+		bson.D{{Key: "_id", Value: 3}, {Key: "n", Value: 30}},
+	})
+	require.NoError(t, err)
+
+	_, err = coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	require.True(t, isDuplicateKey(err), "expected a duplicate key error, got %v", err)
+
+	n, err := coll.CountDocuments(ctx, bson.D{{Key: "n", Value: bson.D{{Key: "$gte", Value: 20}}}})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	n, err = coll.CountDocuments(ctx, bson.D{{Key: "tags", Value: "b"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	res, err := coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: 2}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: 5}}}, {Key: "$push", Value: bson.D{{Key: "tags", Value: "c"}}}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.MatchedCount)
+	require.Equal(t, int64(1), res.ModifiedCount)
+
+	res, err = coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: 4}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "n", Value: 40}}}}, options.Update().SetUpsert(true))
+	require.NoError(t, err)
+	require.Equal(t, int32(4), res.UpsertedID)
+
+	cur, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "n", Value: -1}}).SetBatchSize(2))
+	require.NoError(t, err)
+	var docs []struct {
+		ID int32 `bson:"_id"`
+		N  int32 `bson:"n"`
+	}
+	require.NoError(t, cur.All(ctx, &docs))
+	require.Len(t, docs, 4)
+	require.Equal(t, int32(4), docs[0].ID)
+	require.Equal(t, int32(25), docs[2].N)
+
+	del, err := coll.DeleteMany(ctx, bson.D{{Key: "n", Value: bson.D{{Key: "$lt", Value: 30}}}})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), del.DeletedCount)
+	require.Len(t, srv.Documents("test.crud"), 2)
+
+	var doc bson.M
+	err = coll.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: 3}}, bson.D{{Key: "$set", Value: bson.D{{Key: "done", Value: true}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	require.NoError(t, err)
+	require.Equal(t, true, doc["done"])
+}
+
+func TestServerTransactions(t *testing.T) {
+	_, cli := newServerClient(t)
+	ctx := context.Background()
+	coll := cli.Database("test").Collection("txn")
+	_, err := coll.InsertOne(ctx, bson.D{{Key: "_id", Value: "shared"}, {Key: "v", Value: 0}})
+	require.NoError(t, err)
+
+	t.Run("isolation and commit", func(t *testing.T) {
+		sess, err := cli.StartSession()
+		require.NoError(t, err)
+		defer sess.EndSession(ctx)
+
+		require.NoError(t, sess.StartTransaction())
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			_, err := coll.InsertOne(sc, bson.D{{Key: "_id", Value: "committed"}})
+			return err
+		})
+		require.NoError(t, err)
+
+		n, err := coll.CountDocuments(ctx, bson.D{{Key: "_id", Value: "committed"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n, "uncommitted writes must not be visible outside the transaction")
+
+		require.NoError(t, sess.CommitTransaction(ctx))
+		n, err = coll.CountDocuments(ctx, bson.D{{Key: "_id", Value: "committed"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		sess, err := cli.StartSession()
+		require.NoError(t, err)
+		defer sess.EndSession(ctx)
+
+		require.NoError(t, sess.StartTransaction())
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			_, err := coll.InsertOne(sc, bson.D{{Key: "_id", Value: "aborted"}})
+			return err
+		})
+		require.NoError(t, err)
+		require.NoError(t, sess.AbortTransaction(ctx))
+
+		n, err := coll.CountDocuments(ctx, bson.D{{Key: "_id", Value: "aborted"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n)
+	})
+
+	t.Run("write conflict", func(t *testing.T) {
+		s1, err := cli.StartSession()
+		require.NoError(t, err)
+		defer s1.EndSession(ctx)
+		s2, err := cli.StartSession()
+		require.NoError(t, err)
+		defer s2.EndSession(ctx)
+
+		inc := bson.D{{Key: "$inc", Value: bson.D{{Key: "v", Value: 1}}}}
+		require.NoError(t, s1.StartTransaction())
+		require.NoError(t, s2.StartTransaction())
+		err = mongo.WithSession(ctx, s1, func(sc mongo.SessionContext) error {
+			_, err := coll.UpdateOne(sc, bson.D{{Key: "_id", Value: "shared"}}, inc)
+			return err
+		})
+		require.NoError(t, err)
+
+		err = mongo.WithSession(ctx, s2, func(sc mongo.SessionContext) error {
+			_, err := coll.UpdateOne(sc, bson.D{{Key: "_id", Value: "shared"}}, inc)
+			return err
+		})
+		cerr, ok := err.(mongo.CommandError)
+		require.True(t, ok, "expected a command error, got %v", err)
+		require.Equal(t, int32(codeWriteConflict), cerr.Code)
+		require.True(t, cerr.HasErrorLabel(transientTransactionError))
+
+		require.NoError(t, s1.CommitTransaction(ctx))
+		var doc struct{ V int32 }
+		require.NoError(t, coll.FindOne(ctx, bson.D{{Key: "_id", Value: "shared"}}).Decode(&doc))
+		require.Equal(t, int32(1), doc.V)
+	})
+
+	t.Run("with transaction", func(t *testing.T) {
+		sess, err := cli.StartSession()
+		require.NoError(t, err)
+		defer sess.EndSession(ctx)
+
+		_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return coll.UpdateOne(sc, bson.D{{Key: "_id", Value: "shared"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "v", Value: 7}}}})
+		})
+		require.NoError(t, err)
+
+		var doc struct{ V int32 }
+		require.NoError(t, coll.FindOne(ctx, bson.D{{Key: "_id", Value: "shared"}}).Decode(&doc))
+		require.Equal(t, int32(7), doc.V)
+	})
+
+	t.Run("kill all sessions", func(t *testing.T) {
+		sess, err := cli.StartSession()
+		require.NoError(t, err)
+		defer sess.EndSession(ctx)
+
+		require.NoError(t, sess.StartTransaction())
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			_, err := coll.InsertOne(sc, bson.D{{Key: "_id", Value: "killed"}})
+			return err
+		})
+		require.NoError(t, err)
+
+		err = cli.Database("admin").RunCommand(ctx, bson.D{{Key: "killAllSessions", Value: bson.A{}}}).Err()
+		require.NoError(t, err)
+		_, err = coll.InsertOne(ctx, bson.D{{Key: "_id", Value: "killed"}})
+		require.NoError(t, err)
+	})
+}
+
+func TestServerUnknownCommand(t *testing.T) {
+	_, cli := newServerClient(t)
+	err := cli.Database("admin").RunCommand(context.Background(), bson.D{{Key: "frobnicate", Value: 1}}).Err()
+	cerr, ok := err.(mongo.CommandError)
+	require.True(t, ok, "expected a command error, got %v", err)
+	require.Equal(t, int32(codeCommandNotFound), cerr.Code)
+}
+
+func TestServerUnimplementedOptions(t *testing.T) {
+	_, cli := newServerClient(t)
+	ctx := context.Background()
+	coll := cli.Database("test").Collection("options")
+
+	_, err := coll.Find(ctx, bson.D{}, options.Find().SetCollation(&options.Collation{Locale: "en_US"}))
+	cerr, ok := err.(mongo.CommandError)
+	require.True(t, ok, "expected a command error, got %v", err)
+	require.Equal(t, int32(codeNotImplemented), cerr.Code)
+
+	_, err = coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	require.NoError(t, err)
+	wc := writeconcern.New(writeconcern.W(2))
+	_, err = cli.Database("test").Collection("options", options.Collection().SetWriteConcern(wc)).
+		InsertOne(ctx, bson.D{{Key: "_id", Value: 2}})
+	we, ok := err.(mongo.WriteException)
+	require.True(t, ok, "expected a write exception, got %v", err)
+	require.NotNil(t, we.WriteConcernError)
+	require.Equal(t, int(codeUnsatisfiableWriteConcern), we.WriteConcernError.Code)
+}
+
+func isDuplicateKey(err error) bool {
+	we, ok := err.(mongo.WriteException)
+	return ok && len(we.WriteErrors) == 1 && we.WriteErrors[0].Code == int(codeDuplicateKey)
+}
@@ -0,0 +1,296 @@
+package driver
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// handshakeCommands are never affected by fault injection, so connections can still be
+// established and monitored while fail points are enabled.
+var handshakeCommands = map[string]bool{
+	"isMaster":     true,
+	"ismaster":     true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"authenticate": true,
+	"getnonce":     true,
+}
+
+// Codes of the errors a server labels TransientTransactionError in a transaction. Not master
+// errors are only labeled when they do not fail commitTransaction or abortTransaction.
+var (
+	transientTxnCodes   = []int32{24, 112, 239, 246, 251, 267}
+	notMasterOrRecovery = []int32{10107, 13435, 13436, 11602, 189}
+)
+
+// FailPoint describes the commands a FaultInjector makes fail and how. It mirrors the
+// failCommand fail point of the server, but is evaluated by the client before the command is
+// sent.
+type FailPoint struct {
+	// Commands lists the names of the commands affected. An empty list affects every command but
+	// the handshake and authentication ones.
+	Commands []string
+	// Times is the number of matching commands affected before the fail point turns itself off.
+	// Zero means no limit.
+	Times int
+	// Probability is the probability a matching command is affected, between 0 and 1. Zero means
+	// every matching command is affected.
+	Probability float64
+	// BlockTime delays the matching commands before they are sent or failed.
+	BlockTime time.Duration
+	// CloseConnection closes the connection instead of sending the command, which fails it with a
+	// network error.
+	CloseConnection bool
+	// ErrorCode makes the command fail with a command error with this code instead of being sent.
+	ErrorCode int32
+	// ErrorCodeName is the name of the code of the command error.
+	ErrorCodeName string
+	// ErrorLabels are the error labels of the command error.
+	ErrorLabels []string
+	// ServerLabels gives the command error the labels a server would add to it when ErrorLabels
+	// is nil, such as TransientTransactionError for some errors of the commands of a transaction.
+	ServerLabels bool
+	// ErrorMessage is the message of the command error. Defaults to a message saying the command
+	// failed because of fault injection.
+	ErrorMessage string
+}
+
+func (fp *FailPoint) matches(name string) bool {
+	if len(fp.Commands) == 0 {
+		return !handshakeCommands[name]
+	}
+	for _, cmd := range fp.Commands {
+		if cmd == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Fault is the fault a FaultInjector applies to a command.
+type Fault struct {
+	// BlockTime is how long the command must be delayed.
+	BlockTime time.Duration
+	// CloseConnection tells the connection must be closed instead of sending the command.
+	CloseConnection bool
+	// Reply is the wire message to return instead of sending the command, or nil if the command
+	// must be sent.
+	Reply []byte
+}
+
+// FaultInjector makes commands fail on the client side according to its fail points, so retry
+// and transaction logic can be exercised without configuring fail points on a server. Connections
+// configured with a FaultInjector consult it before writing each wire message. Fail points are
+// checked in the order they were enabled and the first one that matches a command applies. A fail
+// point whose probability draw misses does not match.
+//
+// Compressed wire messages cannot be inspected, so connections using a FaultInjector do not
+// compress the messages they send.
+type FaultInjector struct {
+	mu        sync.Mutex
+	points    []*failPointState
+	rand      *rand.Rand
+	triggered int
+}
+
+type failPointState struct {
+	FailPoint
+	remaining int
+}
+
+// NewFaultInjector returns a FaultInjector with the given fail points enabled. Probabilities are
+// drawn from a generator seeded with 1, so the faults of a test are the same on every run.
+func NewFaultInjector(fps ...FailPoint) *FaultInjector {
+	fi := &FaultInjector{rand: rand.New(rand.NewSource(1))}
+	for _, fp := range fps {
+		fi.Enable(fp)
+	}
+	return fi
+}
+
+// Enable adds a fail point.
+func (fi *FaultInjector) Enable(fp FailPoint) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.points = append(fi.points, &failPointState{FailPoint: fp, remaining: fp.Times})
+}
+
+// Disable removes all the fail points.
+func (fi *FaultInjector) Disable() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.points = nil
+}
+
+// Seed seeds the generator the probabilities of the fail points are drawn from.
+func (fi *FaultInjector) Seed(seed int64) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.rand = rand.New(rand.NewSource(seed))
+}
+
+// Triggered returns the number of commands a fault was applied to.
+func (fi *FaultInjector) Triggered() int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.triggered
+}
+
+// Inject returns the fault to apply to the command carried by the wire message wm, or nil if it
+// must be sent as is. Unacknowledged writes expect no reply and are never affected.
+func (fi *FaultInjector) Inject(wm []byte) *Fault {
+	if wiremessage.IsMsgMoreToCome(wm) {
+		return nil
+	}
+	_, reqID, _, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok {
+		return nil
+	}
+	cmd := commandDocument(opcode, rem)
+	elem, err := cmd.IndexErr(0)
+	if err != nil {
+		return nil
+	}
+	name := elem.Key()
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for i, fp := range fi.points {
+		if !fp.matches(name) {
+			continue
+		}
+		if fp.Probability > 0 && fi.rand.Float64() >= fp.Probability {
+			continue
+		}
+		if fp.Times > 0 {
+			fp.remaining--
+			if fp.remaining == 0 {
+				fi.points = append(fi.points[:i:i], fi.points[i+1:]...)
+			}
+		}
+		fi.triggered++
+
+		fault := &Fault{BlockTime: fp.BlockTime, CloseConnection: fp.CloseConnection}
+		if !fp.CloseConnection && fp.ErrorCode != 0 {
+			fault.Reply = faultReply(opcode, reqID, &fp.FailPoint, cmd)
+		}
+		return fault
+	}
+	return nil
+}
+
+// commandDocument returns the command carried by an OP_MSG or OP_QUERY message body, or nil.
+func commandDocument(opcode wiremessage.OpCode, rem []byte) bsoncore.Document {
+	var doc bsoncore.Document
+	switch opcode {
+	case wiremessage.OpMsg:
+		var ok bool
+		_, rem, ok = wiremessage.ReadMsgFlags(rem)
+		for ok && len(rem) > 0 {
+			var stype wiremessage.SectionType
+			stype, rem, ok = wiremessage.ReadMsgSectionType(rem)
+			if !ok {
+				break
+			}
+			if stype == wiremessage.SingleDocument {
+				doc, _, ok = wiremessage.ReadMsgSectionSingleDocument(rem)
+				break
+			}
+			_, _, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem)
+		}
+	case wiremessage.OpQuery:
+		var ok bool
+		_, rem, ok = wiremessage.ReadQueryFlags(rem)
+		if ok {
+			_, rem, ok = wiremessage.ReadQueryFullCollectionName(rem)
+		}
+		if ok {
+			_, rem, ok = wiremessage.ReadQueryNumberToSkip(rem)
+		}
+		if ok {
+			_, rem, ok = wiremessage.ReadQueryNumberToReturn(rem)
+		}
+		if ok {
+			doc, _, _ = wiremessage.ReadQueryQuery(rem)
+		}
+		if inner, ok := doc.Lookup("$query").DocumentOK(); ok {
+			doc = inner
+		}
+	}
+	return doc
+}
+
+// faultReply builds the reply to the request with the given id failing the command cmd as
+// described by fp.
+func faultReply(opcode wiremessage.OpCode, reqID int32, fp *FailPoint, cmd bsoncore.Document) []byte {
+	msg := fp.ErrorMessage
+	if msg == "" {
+		msg = "Failing command via client-side fault injection"
+	}
+
+	idx, doc := bsoncore.AppendDocumentStart(nil)
+	doc = bsoncore.AppendDoubleElement(doc, "ok", 0)
+	doc = bsoncore.AppendStringElement(doc, "errmsg", msg)
+	doc = bsoncore.AppendInt32Element(doc, "code", fp.ErrorCode)
+	if fp.ErrorCodeName != "" {
+		doc = bsoncore.AppendStringElement(doc, "codeName", fp.ErrorCodeName)
+	}
+	labels := fp.ErrorLabels
+	if labels == nil && fp.ServerLabels {
+		labels = serverLabels(fp.ErrorCode, cmd)
+	}
+	if len(labels) != 0 {
+		var aidx int32
+		aidx, doc = bsoncore.AppendArrayElementStart(doc, "errorLabels")
+		for i, label := range labels {
+			doc = bsoncore.AppendStringElement(doc, strconv.Itoa(i), label)
+		}
+		doc, _ = bsoncore.AppendArrayEnd(doc, aidx)
+	}
+	doc, _ = bsoncore.AppendDocumentEnd(doc, idx)
+
+	var dst []byte
+	var widx int32
+	if opcode == wiremessage.OpQuery {
+		widx, dst = wiremessage.AppendHeaderStart(dst, wiremessage.NextRequestID(), reqID, wiremessage.OpReply)
+		dst = wiremessage.AppendReplyFlags(dst, 0)
+		dst = wiremessage.AppendReplyCursorID(dst, 0)
+		dst = wiremessage.AppendReplyStartingFrom(dst, 0)
+		dst = wiremessage.AppendReplyNumberReturned(dst, 1)
+	} else {
+		widx, dst = wiremessage.AppendHeaderStart(dst, wiremessage.NextRequestID(), reqID, wiremessage.OpMsg)
+		dst = wiremessage.AppendMsgFlags(dst, 0)
+		dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	}
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, widx, int32(len(dst[widx:])))
+}
+
+// serverLabels returns the labels a server adds to an error with the given code failing cmd.
+func serverLabels(code int32, cmd bsoncore.Document) []string {
+	if _, err := cmd.LookupErr("autocommit"); err != nil {
+		return nil
+	}
+	transient := containsCode(transientTxnCodes, code)
+	if name := cmd.Index(0).Key(); name != "commitTransaction" && name != "abortTransaction" {
+		transient = transient || containsCode(notMasterOrRecovery, code)
+	}
+	if transient {
+		return []string{TransientTransactionError}
+	}
+	return nil
+}
+
+func containsCode(codes []int32, code int32) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
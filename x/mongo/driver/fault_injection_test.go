@@ -0,0 +1,149 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+func opMsg(name string, elems ...[]byte) []byte {
+	idx, wm := wiremessage.AppendHeaderStart(nil, 42, 0, wiremessage.OpMsg)
+	wm = wiremessage.AppendMsgFlags(wm, 0)
+	wm = wiremessage.AppendMsgSectionType(wm, wiremessage.SingleDocument)
+	elems = append([][]byte{bsoncore.AppendInt32Element(nil, name, 1)}, elems...)
+	wm = bsoncore.BuildDocumentFromElements(wm, elems...)
+	return bsoncore.UpdateLength(wm, idx, int32(len(wm[idx:])))
+}
+
+// replyError returns the error carried by the reply of fault.
+func replyError(t *testing.T, fault *Fault) Error {
+	t.Helper()
+	if fault == nil || fault.Reply == nil {
+		t.Fatalf("expected a reply, got %+v", fault)
+	}
+	_, _, respTo, opcode, rem, ok := wiremessage.ReadHeader(fault.Reply)
+	if !ok || respTo != 42 || opcode != wiremessage.OpMsg {
+		t.Fatalf("unexpected reply header: responseTo %d, opcode %v", respTo, opcode)
+	}
+	_, rem, _ = wiremessage.ReadMsgFlags(rem)
+	_, rem, _ = wiremessage.ReadMsgSectionType(rem)
+	doc, _, ok := wiremessage.ReadMsgSectionSingleDocument(rem)
+	if !ok {
+		t.Fatalf("could not read the reply document")
+	}
+	err := extractError(doc)
+	derr, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected a driver.Error, got %v", err)
+	}
+	return derr
+}
+
+func TestFaultInjector(t *testing.T) {
+	t.Run("Commands", func(t *testing.T) {
+		fi := NewFaultInjector(FailPoint{ErrorCode: 91})
+		if fi.Inject(opMsg("isMaster")) != nil {
+			t.Errorf("isMaster should never be affected")
+		}
+		if fi.Inject(opMsg("find")) == nil {
+			t.Errorf("find should be affected by a fail point without commands")
+		}
+
+		fi = NewFaultInjector(FailPoint{Commands: []string{"insert"}, ErrorCode: 91})
+		if fi.Inject(opMsg("find")) != nil {
+			t.Errorf("find should not be affected by a fail point on insert")
+		}
+		if fi.Inject(opMsg("insert")) == nil {
+			t.Errorf("insert should be affected by a fail point on insert")
+		}
+	})
+	t.Run("Times", func(t *testing.T) {
+		fi := NewFaultInjector(FailPoint{Times: 2, CloseConnection: true})
+		for i := 0; i < 2; i++ {
+			if fault := fi.Inject(opMsg("ping")); fault == nil || !fault.CloseConnection {
+				t.Fatalf("command %d should close the connection, got %+v", i, fault)
+			}
+		}
+		if fi.Inject(opMsg("ping")) != nil {
+			t.Errorf("the fail point should be off after 2 commands")
+		}
+		if fi.Triggered() != 2 {
+			t.Errorf("expected 2 faults, got %d", fi.Triggered())
+		}
+	})
+	t.Run("Probability", func(t *testing.T) {
+		count := func(seed int64) int {
+			fi := NewFaultInjector(FailPoint{Probability: 0.5, BlockTime: time.Millisecond})
+			fi.Seed(seed)
+			for i := 0; i < 100; i++ {
+				fi.Inject(opMsg("ping"))
+			}
+			return fi.Triggered()
+		}
+		n := count(7)
+		if n == 0 || n == 100 {
+			t.Errorf("expected some commands to be affected, got %d", n)
+		}
+		if count(7) != n {
+			t.Errorf("faults should be the same for the same seed")
+		}
+	})
+	t.Run("ProbabilityMiss", func(t *testing.T) {
+		fi := NewFaultInjector(
+			FailPoint{Probability: 0.5, BlockTime: time.Millisecond},
+			FailPoint{CloseConnection: true},
+		)
+		var blocked, closed int
+		for i := 0; i < 100; i++ {
+			fault := fi.Inject(opMsg("ping"))
+			switch {
+			case fault == nil:
+				t.Fatalf("command %d was not affected by any fail point", i)
+			case fault.CloseConnection:
+				closed++
+			default:
+				blocked++
+			}
+		}
+		if blocked == 0 || closed == 0 {
+			t.Errorf("expected both fail points to apply, got %d blocked and %d closed", blocked, closed)
+		}
+	})
+	t.Run("Reply", func(t *testing.T) {
+		fi := NewFaultInjector(FailPoint{ErrorCode: 112, ErrorCodeName: "WriteConflict", ErrorLabels: []string{TransientTransactionError}})
+		derr := replyError(t, fi.Inject(opMsg("commitTransaction")))
+		if derr.Code != 112 || derr.Name != "WriteConflict" || !derr.HasErrorLabel(TransientTransactionError) {
+			t.Errorf("unexpected error %+v", derr)
+		}
+
+		// without ServerLabels, an error has no labels unless they are given.
+		autocommit := bsoncore.AppendBooleanElement(nil, "autocommit", false)
+		fi = NewFaultInjector(FailPoint{ErrorCode: 112})
+		if derr := replyError(t, fi.Inject(opMsg("insert", autocommit))); len(derr.Labels) != 0 {
+			t.Errorf("expected no labels, got %v", derr.Labels)
+		}
+	})
+	t.Run("ServerLabels", func(t *testing.T) {
+		autocommit := bsoncore.AppendBooleanElement(nil, "autocommit", false)
+		for _, tc := range []struct {
+			cmd       []byte
+			code      int32
+			transient bool
+		}{
+			{opMsg("insert"), 112, false},
+			{opMsg("insert", autocommit), 112, true},
+			{opMsg("insert", autocommit), 189, true},
+			{opMsg("commitTransaction", autocommit), 189, false},
+			{opMsg("commitTransaction", autocommit), 251, true},
+			{opMsg("commitTransaction", autocommit), 11601, false},
+		} {
+			fi := NewFaultInjector(FailPoint{ErrorCode: tc.code, ServerLabels: true})
+			derr := replyError(t, fi.Inject(tc.cmd))
+			if derr.HasErrorLabel(TransientTransactionError) != tc.transient {
+				t.Errorf("code %d: expected the transient label to be %v, got %v", tc.code, tc.transient, derr.Labels)
+			}
+		}
+	})
+}
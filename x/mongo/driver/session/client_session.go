@@ -133,11 +133,24 @@ func MaxClusterTime(ct1, ct2 bson.Raw) bson.Raw {
 
 // NewClientSession creates a Client.
 func NewClientSession(pool *Pool, clientID uuid.UUID, sessionType Type, opts ...*ClientOptions) (*Client, error) {
+	c := newClient(clientID, sessionType, opts...)
+
+	servSess, err := pool.GetSession()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Server = servSess
+	c.pool = pool
+
+	return c, nil
+}
+
+func newClient(clientID uuid.UUID, sessionType Type, opts ...*ClientOptions) *Client {
 	c := &Client{
 		Consistent:  true, // set default
 		ClientID:    clientID,
 		SessionType: sessionType,
-		pool:        pool,
 	}
 
 	mergedOpts := mergeClientOptions(opts...)
@@ -157,14 +170,7 @@ func NewClientSession(pool *Pool, clientID uuid.UUID, sessionType Type, opts ...
 		c.transactionMaxCommitTime = mergedOpts.DefaultMaxCommitTime
 	}
 
-	servSess, err := pool.GetSession()
-	if err != nil {
-		return nil, err
-	}
-
-	c.Server = servSess
-
-	return c, nil
+	return c
 }
 
 // AdvanceClusterTime updates the session's cluster time.
@@ -234,7 +240,9 @@ func (c *Client) EndSession() {
 	}
 
 	c.Terminated = true
-	c.pool.ReturnSession(c.Server)
+	if c.pool != nil {
+		c.pool.ReturnSession(c.Server)
+	}
 
 	return
 }
@@ -6,6 +6,34 @@
 
 package session // import "go.mongodb.org/mongo-driver/x/mongo/driver/session"
 
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+// NewDetachedClientSession creates a Client bound to a dedicated server session with the given
+// session id. The server session is not checked out of a Pool and is never returned to one, so
+// ending the Client neither ends the logical session on the server nor lets the pool hand the
+// foreign session id out again.
+func NewDetachedClientSession(sessionID bsonx.Doc, clientID uuid.UUID, sessionType Type, opts ...*ClientOptions) *Client {
+	c := newClient(clientID, sessionType, opts...)
+	c.Server = &Server{
+		SessionID: sessionID,
+		LastUsed:  time.Now(),
+	}
+	return c
+}
+
+// Detached returns true if the client session does not belong to a Pool.
+func (c *Client) Detached() bool {
+	return c.pool == nil
+}
+
 // GetState get the state of the client session
 func (c *Client) GetState() uint8 {
 	return uint8(c.state)
@@ -15,3 +43,29 @@ func (c *Client) GetState() uint8 {
 func (c *Client) SetState(s uint8) {
 	c.state = state(s)
 }
+
+// ResumeTransaction restores the txnNumber and the transaction state of a session whose server
+// session id has been replaced with the id of a transaction known elsewhere. If started is true
+// the transaction is already running on the server and the session moves to InProgress, so that
+// startTransaction is not sent again; otherwise it stays in Starting and the next command starts
+// the transaction with the given txnNumber.
+func (c *Client) ResumeTransaction(txnNumber int64, started bool) {
+	c.Server.TxnNumber = txnNumber
+	if started {
+		c.state = InProgress
+	} else {
+		c.state = Starting
+	}
+}
+
+// PinTransaction pins the transaction of a resumed session to the mongos at addr and restores
+// the recovery token returned by the sharded cluster, so that the session routes its commands to
+// the mongos the transaction was started on and commitTransaction and abortTransaction can be
+// retried through another mongos. An empty addr leaves the session unpinned.
+func (c *Client) PinTransaction(addr address.Address, recoveryToken bson.Raw) {
+	c.PinnedServer = nil
+	if addr != "" {
+		c.PinnedServer = &description.Server{Addr: addr, Kind: description.Mongos}
+	}
+	c.RecoveryToken = recoveryToken
+}
@@ -0,0 +1,103 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package session
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/internal/testutil/helpers"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/address"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/uuid"
+)
+
+func TestDetachedClientSession(t *testing.T) {
+	t.Run("EndSessionDoesNotTouchPool", func(t *testing.T) {
+		p := NewPool(make(chan description.Topology))
+		p.timeout = 30
+
+		id, err := uuid.New()
+		testhelpers.RequireNil(t, err, "error generating uuid %s", err)
+		idDoc := bsonx.Doc{{Key: "id", Value: bsonx.Binary(UUIDSubtype, id[:])}}
+
+		c := NewDetachedClientSession(idDoc, id, Explicit)
+		if !c.Detached() {
+			t.Fatal("expected detached client session")
+		}
+		if !c.SessionID.Equal(idDoc) {
+			t.Errorf("session id mismatch. got %s expected %s", c.SessionID, idDoc)
+		}
+
+		c.EndSession()
+		if p.checkedOut != 0 || p.head != nil {
+			t.Errorf("detached session returned to pool, checked out %d", p.checkedOut)
+		}
+
+		pooled, err := p.GetSession()
+		testhelpers.RequireNil(t, err, "error getting session %s", err)
+		if pooled.SessionID.Equal(idDoc) {
+			t.Error("pool handed out the detached session id")
+		}
+	})
+	t.Run("ResumeTransaction", func(t *testing.T) {
+		id, err := uuid.New()
+		testhelpers.RequireNil(t, err, "error generating uuid %s", err)
+		c := NewDetachedClientSession(bsonx.Doc{{Key: "id", Value: bsonx.Binary(UUIDSubtype, id[:])}}, id, Explicit)
+
+		err = c.StartTransaction(nil)
+		testhelpers.RequireNil(t, err, "error starting transaction %s", err)
+		c.ResumeTransaction(4, true)
+		if c.TxnNumber != 4 || !c.TransactionInProgress() {
+			t.Errorf("expected txnNumber 4 in progress, got %d in state %d", c.TxnNumber, c.GetState())
+		}
+
+		c.ResumeTransaction(5, false)
+		if c.TxnNumber != 5 || !c.TransactionStarting() {
+			t.Errorf("expected txnNumber 5 starting, got %d in state %d", c.TxnNumber, c.GetState())
+		}
+	})
+	t.Run("PinTransaction", func(t *testing.T) {
+		id, err := uuid.New()
+		testhelpers.RequireNil(t, err, "error generating uuid %s", err)
+		c := NewDetachedClientSession(bsonx.Doc{{Key: "id", Value: bsonx.Binary(UUIDSubtype, id[:])}}, id, Explicit)
+
+		err = c.StartTransaction(nil)
+		testhelpers.RequireNil(t, err, "error starting transaction %s", err)
+		c.ResumeTransaction(1, true)
+		token := bsoncore.BuildDocument(nil, bsoncore.AppendStringElement(nil, "shard", "sh1"))
+		c.PinTransaction(address.Address("mongos2:27017"), bson.Raw(token))
+
+		topo := description.Topology{
+			Kind: description.Sharded,
+			Servers: []description.Server{
+				{Addr: address.Address("mongos1:27017"), Kind: description.Mongos},
+				{Addr: address.Address("mongos2:27017"), Kind: description.Mongos},
+			},
+		}
+		c.ApplyCommand(topo.Servers[1])
+		if c.PinnedServer == nil {
+			t.Fatal("expected pinned server")
+		}
+		selected, err := c.PinnedServer.SelectServer(topo, topo.Servers)
+		testhelpers.RequireNil(t, err, "error selecting server %s", err)
+		if len(selected) != 1 || selected[0].Addr != "mongos2:27017" {
+			t.Errorf("expected mongos2:27017 to be selected, got %v", selected)
+		}
+		if !bytes.Equal(c.RecoveryToken, token) {
+			t.Errorf("recovery token mismatch. got %s expected %s", c.RecoveryToken, bson.Raw(token))
+		}
+
+		c.PinTransaction("", nil)
+		if c.PinnedServer != nil || c.RecoveryToken != nil {
+			t.Error("expected unpinned session without recovery token")
+		}
+	})
+}
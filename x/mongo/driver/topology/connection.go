@@ -48,6 +48,7 @@ type connection struct {
 	connectDone      chan struct{}
 	connectErr       error
 	config           *connectionConfig
+	injected         []byte // reply to return on the next read, set by the fault injector
 
 	// pool related fields
 	pool       *pool
@@ -178,6 +179,14 @@ func (c *connection) writeWireMessage(ctx context.Context, wm []byte) error {
 	default:
 	}
 
+	if fi := c.faultInjector(); fi != nil {
+		if fault := fi.Inject(wm); fault != nil {
+			if handled, err := c.injectFault(ctx, fault); handled {
+				return err
+			}
+		}
+	}
+
 	var deadline time.Time
 	if c.writeTimeout != 0 {
 		deadline = time.Now().Add(c.writeTimeout)
@@ -201,12 +210,50 @@ func (c *connection) writeWireMessage(ctx context.Context, wm []byte) error {
 	return nil
 }
 
+func (c *connection) faultInjector() *driver.FaultInjector {
+	if c.config == nil {
+		return nil
+	}
+	return c.config.faultInjector
+}
+
+// injectFault applies a fault returned by the fault injector before writing a wire message. It
+// returns false if the wire message must still be written.
+func (c *connection) injectFault(ctx context.Context, fault *driver.Fault) (bool, error) {
+	if fault.BlockTime > 0 {
+		timer := time.NewTimer(fault.BlockTime)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return true, ConnectionError{ConnectionID: c.id, Wrapped: ctx.Err(), message: "failed to write"}
+		case <-timer.C:
+		}
+	}
+	if fault.CloseConnection {
+		c.close()
+		return true, ConnectionError{ConnectionID: c.id, Wrapped: io.EOF, message: "connection closed by fault injection"}
+	}
+	if fault.Reply != nil {
+		c.injected = fault.Reply
+		c.bumpIdleDeadline()
+		return true, nil
+	}
+	return false, nil
+}
+
 // readWireMessage reads a wiremessage from the connection. The dst parameter will be overwritten.
 func (c *connection) readWireMessage(ctx context.Context, dst []byte) ([]byte, error) {
 	if atomic.LoadInt32(&c.connected) != connected {
 		return dst, ConnectionError{ConnectionID: c.id, message: "connection is closed"}
 	}
 
+	if c.injected != nil {
+		dst = append(dst[:0], c.injected...)
+		c.injected = nil
+		c.bumpIdleDeadline()
+		return dst, nil
+	}
+
 	select {
 	case <-ctx.Done():
 		// We closeConnection the connection because we don't know if there is an unread message on the wire.
@@ -365,14 +412,15 @@ func (c *Connection) ReadWireMessage(ctx context.Context, dst []byte) ([]byte, e
 
 // CompressWireMessage handles compressing the provided wire message using the underlying
 // connection's compressor. The dst parameter will be overwritten with the new wire message. If
-// there is no compressor set on the underlying connection, then no compression will be performed.
+// there is no compressor set on the underlying connection, or the connection is configured with a
+// fault injector, then no compression will be performed.
 func (c *Connection) CompressWireMessage(src, dst []byte) ([]byte, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	if c.connection == nil {
 		return dst, ErrConnectionClosed
 	}
-	if c.connection.compressor == wiremessage.CompressorNoOp {
+	if c.connection.compressor == wiremessage.CompressorNoOp || c.connection.faultInjector() != nil {
 		return append(dst, src...), nil
 	}
 	_, reqid, respto, origcode, rem, ok := wiremessage.ReadHeader(src)
@@ -49,6 +49,7 @@ type connectionConfig struct {
 	compressors    []string
 	zlibLevel      *int
 	descCallback   func(description.Server)
+	faultInjector  *driver.FaultInjector
 }
 
 func newConnectionConfig(opts ...ConnectionOption) (*connectionConfig, error) {
@@ -174,6 +175,15 @@ func WithMonitor(fn func(*event.CommandMonitor) *event.CommandMonitor) Connectio
 	}
 }
 
+// WithFaultInjector configures a fault injector that makes the commands sent on the connection
+// fail according to its fail points.
+func WithFaultInjector(fn func(*driver.FaultInjector) *driver.FaultInjector) ConnectionOption {
+	return func(c *connectionConfig) error {
+		c.faultInjector = fn(c.faultInjector)
+		return nil
+	}
+}
+
 // WithZlibLevel sets the zLib compression level.
 func WithZlibLevel(fn func(*int) *int) ConnectionOption {
 	return func(c *connectionConfig) error {